@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/fx"
+
+	"network-tunneler/internal/client"
+	"network-tunneler/pkg/logger"
+	"network-tunneler/pkg/network"
+)
+
+func newExecCmd() *cobra.Command {
+	execCmd := &cobra.Command{
+		Use:   "exec [flags] -- command [args...]",
+		Short: "Run one command with its traffic tunneled, in its own network namespace",
+		Long: "Run a command in a fresh network namespace linked to the host by a veth pair. The interception " +
+			"rules are installed inside the namespace only, so nothing else on the host is affected. The " +
+			"namespace is removed when the command exits, and the command's exit status is returned.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: runExec,
+	}
+	// Flags after the command belong to it.
+	execCmd.Flags().SetInterspersed(false)
+
+	execCmd.Flags().StringVarP(&configFile, "config", "c", "", "Config file (yaml/json/.env)")
+	execCmd.Flags().StringVar(&serverAddr, "server", "", "Server address (overrides config)")
+	execCmd.Flags().StringVar(&targetCIDR, "cidr", "", "Target CIDR to intercept (overrides config)")
+	execCmd.Flags().Duration("wait", 10*time.Second, "How long to wait for routes from the server before starting the command")
+	return execCmd
+}
+
+func runExec(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+	wait, _ := cmd.Flags().GetDuration("wait")
+
+	var (
+		log logger.Logger
+		c   *client.Client
+		ns  *network.Namespace
+	)
+
+	app := fx.New(
+		fx.Supply(configFile),
+		fx.Decorate(func(cfg *client.Config) *client.Config {
+			return client.ExecConfig(applyOverrides(cfg))
+		}),
+
+		logger.Module,
+		client.Module,
+		fx.Provide(provideExecNamespace),
+
+		fx.WithLogger(logger.NewFxLogger),
+
+		fx.Populate(&log, &c, &ns),
+	)
+
+	if err := app.Start(cmd.Context()); err != nil {
+		return fmt.Errorf("failed to start client: %w", err)
+	}
+
+	stop := func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), fx.DefaultTimeout)
+		defer cancel()
+		if err := app.Stop(shutdownCtx); err != nil {
+			log.Error("error during shutdown", logger.Error(err))
+		}
+	}
+
+	select {
+	case <-c.RoutesSynced():
+	case <-time.After(wait):
+		log.Warn("no routes from the server yet, starting the command anyway")
+	}
+
+	child := exec.Command(args[0], args[1:]...)
+	child.Stdin, child.Stdout, child.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := ns.Do(child.Start); err != nil {
+		stop()
+		return fmt.Errorf("failed to start %s: %w", args[0], err)
+	}
+
+	// The terminal sends Ctrl-C to the command itself; other signals are
+	// passed on so the command can exit before the namespace goes away.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGINT {
+				child.Process.Signal(sig)
+			}
+		}
+	}()
+
+	waitErr := child.Wait()
+	signal.Stop(signals)
+	close(signals)
+	stop()
+
+	var exitErr *exec.ExitError
+	if errors.As(waitErr, &exitErr) {
+		code := exitErr.ExitCode()
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			code = 128 + int(status.Signal())
+		}
+		os.Exit(code)
+	}
+	return waitErr
+}
+
+// provideExecNamespace creates the command's namespace, which is removed
+// after the client has stopped.
+func provideExecNamespace(lc fx.Lifecycle, log logger.Logger) (*network.Namespace, error) {
+	ns, err := client.NewExecNamespace(log)
+	if err != nil {
+		return nil, err
+	}
+	lc.Append(fx.Hook{
+		OnStop: func(context.Context) error {
+			return ns.Delete()
+		},
+	})
+	return ns, nil
+}
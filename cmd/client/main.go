@@ -50,6 +50,10 @@ func main() {
 	}
 	versionCmd.Flags().Bool("json", false, "Output version info as JSON")
 	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(newNetfilterCmd())
+	rootCmd.AddCommand(newStatusCmd())
+	rootCmd.AddCommand(newKillCmd())
+	rootCmd.AddCommand(newExecCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
@@ -100,6 +104,7 @@ func applyOverrides(cfg *client.Config) *client.Config {
 	}
 	if targetCIDR != "" {
 		cfg.TargetCIDR = targetCIDR
+		cfg.Targets = nil
 	}
 	if listenPort != 0 {
 		cfg.ListenPort = listenPort
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"network-tunneler/internal/client"
+	"network-tunneler/pkg/logger"
+)
+
+func newNetfilterCmd() *cobra.Command {
+	netfilterCmd := &cobra.Command{
+		Use:   "netfilter",
+		Short: "Manage the client's netfilter state",
+	}
+
+	cleanupCmd := &cobra.Command{
+		Use:   "cleanup",
+		Short: "Remove rules, chains and policy routes left behind by a client",
+		Long: "Remove the rules, chains and UDP policy routes of a client that did not shut down cleanly, " +
+			"with both the iptables and nftables backends. Do not run it while a client is running.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			cfg, err := client.LoadConfig(configFile)
+			if err != nil {
+				return err
+			}
+			log, err := logger.NewSlogLogger(&cfg.Log)
+			if err != nil {
+				return fmt.Errorf("failed to create logger: %w", err)
+			}
+
+			if err := client.CleanupNetfilter(cfg, log); err != nil {
+				return err
+			}
+			fmt.Println("netfilter state removed")
+			return nil
+		},
+	}
+	cleanupCmd.Flags().StringVarP(&configFile, "config", "c", "", "Config file, for the UDP fwmark and route table")
+
+	netfilterCmd.AddCommand(cleanupCmd)
+	return netfilterCmd
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"network-tunneler/internal/client"
+	"network-tunneler/internal/control"
+)
+
+var controlSocket string
+
+func newStatusCmd() *cobra.Command {
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the state of a running client",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			var st client.Status
+			if err := control.NewClient(controlSocket).Get("/status", &st); err != nil {
+				return err
+			}
+
+			if jsonFlag, _ := cmd.Flags().GetBool("json"); jsonFlag {
+				data, _ := json.MarshalIndent(st, "", "  ")
+				fmt.Println(string(data))
+				return nil
+			}
+
+			printStatus(st)
+			return nil
+		},
+	}
+	statusCmd.Flags().StringVar(&controlSocket, "socket", client.DefaultControlSocket, "Client control socket")
+	statusCmd.Flags().Bool("json", false, "Output as JSON")
+	return statusCmd
+}
+
+func newKillCmd() *cobra.Command {
+	killCmd := &cobra.Command{
+		Use:   "kill <connection-id>",
+		Short: "Close one tracked connection of a running client",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			if err := control.NewClient(controlSocket).Delete("/connections/"+url.PathEscape(args[0]), nil); err != nil {
+				return err
+			}
+			fmt.Printf("connection %s closed\n", args[0])
+			return nil
+		},
+	}
+	killCmd.Flags().StringVar(&controlSocket, "socket", client.DefaultControlSocket, "Client control socket")
+	return killCmd
+}
+
+func printStatus(st client.Status) {
+	state := string(st.Connection.State)
+	if st.Connection.LastError != "" {
+		state += ": " + st.Connection.LastError
+	}
+	rtt := "-"
+	if st.RTTMillis > 0 {
+		rtt = fmt.Sprintf("%.1fms", st.RTTMillis)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Client ID:\t%s\n", orDash(st.ClientID))
+	fmt.Fprintf(w, "Server:\t%s (%s, since %s)\n", st.ServerAddr, state, st.Connection.Since.Local().Format(time.DateTime))
+	fmt.Fprintf(w, "RTT:\t%s\n", rtt)
+	fmt.Fprintf(w, "Mode:\t%s\n", st.Mode)
+	fmt.Fprintf(w, "Routes:\t%s\n", orDash(strings.Join(st.Routes, ", ")))
+	w.Flush()
+
+	if len(st.Rules) > 0 {
+		fmt.Println("\nNetfilter rules:")
+		for _, rule := range st.Rules {
+			fmt.Println("  " + rule)
+		}
+	}
+
+	fmt.Printf("\nConnections (%d):\n", len(st.Connections))
+	if len(st.Connections) == 0 {
+		return
+	}
+
+	now := time.Now()
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CONNECTION ID\tDESTINATION\tAGE\tIDLE\tOUT\tIN")
+	for _, c := range st.Connections {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\n",
+			c.ConnectionID, c.Destination,
+			now.Sub(c.CreatedAt).Round(time.Second), now.Sub(c.LastActivity).Round(time.Second),
+			c.BytesOut, c.BytesIn)
+	}
+	w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
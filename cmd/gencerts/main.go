@@ -61,6 +61,7 @@ func run(cmd *cobra.Command, args []string) {
 		DNSNames:   []string{"localhost", "server"},
 		IPAddr:     []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
 		Type:       crypto.ServerCert,
+		Role:       crypto.RoleServer,
 	})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to generate server certificate: %v\n", err)
@@ -81,6 +82,7 @@ func run(cmd *cobra.Command, args []string) {
 		CommonName: "client",
 		DNSNames:   []string{"client"},
 		Type:       crypto.ClientCert,
+		Role:       crypto.RoleClient,
 	})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to generate client certificate: %v\n", err)
@@ -101,6 +103,7 @@ func run(cmd *cobra.Command, args []string) {
 		CommonName: "proxy",
 		DNSNames:   []string{"proxy"},
 		Type:       crypto.ClientCert,
+		Role:       crypto.RoleProxy,
 	})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to generate proxy certificate: %v\n", err)
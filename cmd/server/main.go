@@ -50,6 +50,8 @@ func main() {
 	}
 	versionCmd.Flags().Bool("json", false, "Output version info as JSON")
 	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(newProxiesCmd())
+	rootCmd.AddCommand(newTapCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
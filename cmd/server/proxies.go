@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"network-tunneler/internal/control"
+	"network-tunneler/internal/server"
+)
+
+var adminSocket string
+
+// newAdminCmd returns a command group that talks to a running server over
+// its admin socket.
+func newAdminCmd(use, short string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: short,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			// Errors from the server are self-explanatory; usage would bury them.
+			cmd.SilenceUsage = true
+		},
+	}
+	cmd.PersistentFlags().StringVar(&adminSocket, "socket", server.DefaultAdminSocket, "Server admin socket")
+	return cmd
+}
+
+func newProxiesCmd() *cobra.Command {
+	proxiesCmd := newAdminCmd("proxies", "Inspect and approve proxies on a running server")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List connected and approved proxies",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var statuses []server.ProxyStatus
+			if err := control.NewClient(adminSocket).Get("/proxies", &statuses); err != nil {
+				return err
+			}
+
+			if jsonFlag, _ := cmd.Flags().GetBool("json"); jsonFlag {
+				data, _ := json.MarshalIndent(statuses, "", "  ")
+				fmt.Println(string(data))
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "PROXY ID\tSTATE\tMANAGED CIDR\tCONNECTED\tAPPROVED")
+			for _, st := range statuses {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+					st.ProxyID, st.State, orDash(st.ManagedCIDR),
+					formatTime(st.ConnectedAt), formatTime(st.ApprovedAt))
+			}
+			return w.Flush()
+		},
+	}
+	listCmd.Flags().Bool("json", false, "Output as JSON")
+
+	approveCmd := &cobra.Command{
+		Use:   "approve <proxy-id>",
+		Short: "Approve a proxy so its CIDR becomes routable",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return proxyAction("/proxies/approve", args[0])
+		},
+	}
+
+	revokeCmd := &cobra.Command{
+		Use:   "revoke <proxy-id>",
+		Short: "Revoke a proxy's approval and stop routing to it",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return proxyAction("/proxies/revoke", args[0])
+		},
+	}
+
+	proxiesCmd.AddCommand(listCmd, approveCmd, revokeCmd)
+	return proxiesCmd
+}
+
+func proxyAction(path, id string) error {
+	var st server.ProxyStatus
+	if err := control.NewClient(adminSocket).Post(path, server.ProxyRequest{ProxyID: id}, &st); err != nil {
+		return err
+	}
+	fmt.Printf("proxy %s is now %s\n", st.ProxyID, st.State)
+	return nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"network-tunneler/internal/control"
+	"network-tunneler/internal/server"
+)
+
+func newTapCmd() *cobra.Command {
+	tapCmd := newAdminCmd("tap", "Capture relayed traffic to pcapng files")
+
+	var req server.TapRequest
+
+	startCmd := &cobra.Command{
+		Use:   "start",
+		Short: "Start capturing connections matching the given filters",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// The server resolves paths relative to its own working directory.
+			if req.Path != "" {
+				abs, err := filepath.Abs(req.Path)
+				if err != nil {
+					return err
+				}
+				req.Path = abs
+			}
+
+			var info server.TapInfo
+			if err := control.NewClient(adminSocket).Post("/taps", req, &info); err != nil {
+				return err
+			}
+			fmt.Printf("tap %s writing to %s\n", info.ID, info.Path)
+			return nil
+		},
+	}
+	startCmd.Flags().StringVar(&req.Filter.ClientID, "client", "", "Only connections from this client ID")
+	startCmd.Flags().StringVar(&req.Filter.ProxyID, "proxy", "", "Only connections routed to this proxy ID")
+	startCmd.Flags().StringVar(&req.Filter.Prefix, "prefix", "", "Only destinations inside this CIDR")
+	startCmd.Flags().StringVar(&req.Filter.ConnectionID, "conn", "", "Only this connection ID")
+	startCmd.Flags().StringVarP(&req.Path, "write", "w", "", "Capture file on the server host (default: temp dir)")
+
+	stopCmd := &cobra.Command{
+		Use:   "stop <tap-id>",
+		Short: "Stop a tap and close its capture file",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var info server.TapInfo
+			if err := control.NewClient(adminSocket).Post("/taps/stop", server.TapStopRequest{ID: args[0]}, &info); err != nil {
+				return err
+			}
+			fmt.Printf("tap %s stopped: %d packets, %d payload bytes in %s\n", info.ID, info.Packets, info.Bytes, info.Path)
+			return nil
+		},
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List active taps",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var taps []server.TapInfo
+			if err := control.NewClient(adminSocket).Get("/taps", &taps); err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tCLIENT\tPROXY\tPREFIX\tCONN\tPACKETS\tBYTES\tFILE")
+			for _, t := range taps {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n",
+					t.ID, orDash(t.Filter.ClientID), orDash(t.Filter.ProxyID),
+					orDash(t.Filter.Prefix), orDash(t.Filter.ConnectionID),
+					t.Packets, t.Bytes, t.Path)
+			}
+			return w.Flush()
+		},
+	}
+
+	tapCmd.AddCommand(startCmd, stopCmd, listCmd)
+	return tapCmd
+}
@@ -2,26 +2,64 @@ package client
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
 	"sync"
 	"time"
 
 	"go.uber.org/fx"
 
+	"network-tunneler/internal/control"
+	"network-tunneler/internal/health"
 	"network-tunneler/pkg/logger"
+	pkgnet "network-tunneler/pkg/network"
+	"network-tunneler/proto"
 )
 
+// interceptor steers traffic for the routes pushed by the server into the
+// client: NetfilterManager in redirect mode, TUNManager in tun mode and
+// SOCKSServer in socks mode.
+type interceptor interface {
+	Setup() error
+	SyncRoutes(prefixes []string) error
+	IsActive() bool
+	Cleanup() error
+}
+
+// ingress is a listener applications use explicitly, next to the
+// interceptor: the HTTP proxy, port forwards and the DNS forwarder.
+type ingress interface {
+	Listen() error
+	Serve(serverWriter chan<- *proto.Packet)
+	Close() error
+}
+
 type Client struct {
 	config     *Config
 	logger     logger.Logger
+	intercept  interceptor
 	netfilter  *NetfilterManager
+	tun        *TUNManager
+	socks      *SOCKSServer
+	httpProxy  *HTTPProxy
+	ingresses  []ingress
 	tracker    *ConnectionTracker
 	serverConn *ServerConnection
+	checker    *health.Checker
+	health     *health.Server
+	control    *control.Server
 	listener   net.Listener
-	ctx        context.Context
-	cancel     context.CancelFunc
-	wg         sync.WaitGroup
+	udpConns   []*net.UDPConn
+	// netns, when set, is where the redirect listeners and rules live;
+	// the server connection stays in the host's namespace.
+	netns    *pkgnet.Namespace
+	synced   chan struct{}
+	syncOnce sync.Once
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
 }
 
 type Params struct {
@@ -31,8 +69,15 @@ type Params struct {
 	Config     *Config
 	Logger     logger.Logger
 	Netfilter  *NetfilterManager
+	TUN        *TUNManager
+	SOCKS      *SOCKSServer
+	HTTPProxy  *HTTPProxy
+	Forwarder  *PortForwarder
+	DNS        *DNSForwarder
 	Tracker    *ConnectionTracker
 	ServerConn *ServerConnection
+	Checker    *health.Checker
+	Netns      *pkgnet.Namespace `optional:"true"`
 }
 
 func New(p Params) (*Client, error) {
@@ -40,13 +85,68 @@ func New(p Params) (*Client, error) {
 	client := &Client{
 		config:     p.Config,
 		logger:     p.Logger.With(logger.String("component", "client")),
+		intercept:  p.Netfilter,
 		netfilter:  p.Netfilter,
 		tracker:    p.Tracker,
 		serverConn: p.ServerConn,
+		checker:    p.Checker,
+		netns:      p.Netns,
+		synced:     make(chan struct{}),
 		ctx:        ctx,
 		cancel:     cancel,
 	}
 
+	switch p.Config.Mode {
+	case ModeTUN:
+		client.intercept = p.TUN
+		client.netfilter = nil
+		client.tun = p.TUN
+	case ModeSOCKS:
+		client.intercept = p.SOCKS
+		client.netfilter = nil
+		client.socks = p.SOCKS
+	}
+	if p.Config.HTTPProxy.Enabled {
+		client.httpProxy = p.HTTPProxy
+		client.ingresses = append(client.ingresses, p.HTTPProxy)
+	}
+	if len(p.Config.Forwards) > 0 {
+		client.ingresses = append(client.ingresses, p.Forwarder)
+	}
+	if p.Config.DNS.Enabled {
+		client.ingresses = append(client.ingresses, p.DNS)
+	}
+
+	client.checker.AddReadinessCheck("registration", func() error {
+		if !client.serverConn.IsRegistered() {
+			return fmt.Errorf("not registered with server (%s)", client.serverConn.Status().State)
+		}
+		return nil
+	})
+	switch {
+	case client.tun != nil:
+		client.checker.AddReadinessCheck("tun", func() error {
+			if !client.tun.IsActive() {
+				return fmt.Errorf("tun device not configured")
+			}
+			return nil
+		})
+	case client.socks != nil:
+		client.checker.AddReadinessCheck("socks", func() error {
+			if !client.socks.IsActive() {
+				return fmt.Errorf("socks server not listening")
+			}
+			return nil
+		})
+	default:
+		client.checker.AddReadinessCheck("netfilter", func() error {
+			if !client.netfilter.IsActive() {
+				return fmt.Errorf("netfilter rules not applied")
+			}
+			return nil
+		})
+	}
+
 	p.Lifecycle.Append(fx.Hook{
 		OnStart: client.start,
 		OnStop:  client.stop,
@@ -58,14 +158,100 @@ func New(p Params) (*Client, error) {
 func (a *Client) start(ctx context.Context) error {
 	a.logger.Info("starting client",
 		logger.String("server_addr", a.config.ServerAddr),
+		logger.String("mode", a.mode()),
 		logger.Int("listen_port", a.config.ListenPort),
-		logger.String("target_cidr", a.config.TargetCIDR),
+		logger.Int("targets", len(a.config.interceptTargets())),
+		logger.Int("excludes", len(a.config.Exclude)),
 	)
 
-	if err := a.serverConn.Connect(ctx); err != nil {
-		return fmt.Errorf("failed to connect to server: %w", err)
+	for i, in := range a.ingresses {
+		if err := in.Listen(); err != nil {
+			for _, started := range a.ingresses[:i] {
+				started.Close()
+			}
+			return err
+		}
+	}
+
+	var err error
+	switch {
+	case a.tun != nil:
+		err = a.startTUN()
+	case a.socks != nil:
+		err = a.startSOCKS()
+	default:
+		err = a.startRedirect()
+	}
+	if err != nil {
+		for _, in := range a.ingresses {
+			in.Close()
+		}
+		return err
+	}
+
+	for _, in := range a.ingresses {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			in.Serve(a.serverConn.GetPacketChannel())
+		}()
+	}
+
+	// The tunnel works without it, so a busy or unwritable path only warns.
+	if a.config.ControlSocket != "" {
+		if err := a.startControl(); err != nil {
+			a.logger.Warn("control socket unavailable", logger.Error(err))
+		}
+	}
+	return nil
+}
+
+// startRedirect accepts the connections and datagrams netfilter diverts to
+// the listen port.
+func (a *Client) startRedirect() error {
+	if err := a.inNamespace(a.listenRedirect); err != nil {
+		return err
+	}
+
+	if err := a.startHealth(); err != nil {
+		a.closeListeners()
+		a.inNamespace(a.netfilter.Cleanup)
+		return err
 	}
 
+	// The server may be unreachable at startup; the listener and rules stay
+	// in place while the connection is retried in the background.
+	a.serverConn.Start()
+
+	a.wg.Add(3)
+	go a.acceptLoop()
+	go a.cleanupLoop()
+	go a.routeLoop()
+
+	for _, udpConn := range a.udpConns {
+		relay := NewUDPRelay(a.tracker, a.serverConn.GetPacketChannel(), a.config.UDP.withDefaults().IdleTimeout, a.logger)
+		if a.netns != nil {
+			relay.dialReply = func(from, to *net.UDPAddr) (conn *net.UDPConn, err error) {
+				err = a.netns.Do(func() error {
+					conn, err = pkgnet.DialTransparentUDP(from, to)
+					return err
+				})
+				return conn, err
+			}
+		}
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			relay.Serve(udpConn)
+		}()
+	}
+
+	return nil
+}
+
+// listenRedirect installs the rules and opens the listeners they divert
+// traffic to.
+func (a *Client) listenRedirect() error {
 	if err := a.netfilter.Setup(); err != nil {
 		return fmt.Errorf("failed to setup netfilter: %w", err)
 	}
@@ -82,30 +268,157 @@ func (a *Client) start(ctx context.Context) error {
 		logger.String("listen_addr", listenAddr),
 	)
 
+	// TPROXY needs a socket of the datagram's own family.
+	for _, ipv6 := range []bool{false, true} {
+		if !a.netfilter.InterceptsUDP(ipv6) {
+			continue
+		}
+		udpAddr := listenAddr
+		if ipv6 {
+			udpAddr = fmt.Sprintf("[::]:%d", a.config.ListenPort)
+		}
+		udpConn, err := pkgnet.ListenTransparentUDP(udpAddr)
+		if err != nil {
+			a.closeListeners()
+			a.netfilter.Cleanup()
+			return err
+		}
+		a.udpConns = append(a.udpConns, udpConn)
+		a.logger.Info("listening for diverted UDP datagrams",
+			logger.String("listen_addr", udpAddr),
+		)
+	}
+	return nil
+}
+
+// inNamespace runs fn in the client's network namespace, if it has one.
+func (a *Client) inNamespace(fn func() error) error {
+	if a.netns == nil {
+		return fn()
+	}
+	return a.netns.Do(fn)
+}
+
+// RoutesSynced is closed once the first route table from the server has
+// been applied.
+func (a *Client) RoutesSynced() <-chan struct{} {
+	return a.synced
+}
+
+// startTUN replaces the listeners with a TUN device: there is nothing to
+// accept, packets are read from the device and replies written back to it.
+func (a *Client) startTUN() error {
+	if err := a.tun.Setup(); err != nil {
+		return fmt.Errorf("failed to setup tun device: %w", err)
+	}
+
+	if err := a.startHealth(); err != nil {
+		a.tun.Cleanup()
+		return err
+	}
+
+	a.serverConn.HandleIPPackets(a.tun.Deliver)
+	a.serverConn.Start()
+
 	a.wg.Add(2)
-	go a.acceptLoop()
+	go a.routeLoop()
+	go func() {
+		defer a.wg.Done()
+		a.tun.Serve(a.serverConn.GetPacketChannel())
+	}()
+
+	return nil
+}
+
+// startSOCKS needs no privileges: connections arrive through the SOCKS
+// listener instead of netfilter rules.
+func (a *Client) startSOCKS() error {
+	if err := a.socks.Setup(); err != nil {
+		return fmt.Errorf("failed to setup socks server: %w", err)
+	}
+
+	if err := a.startHealth(); err != nil {
+		a.socks.Cleanup()
+		return err
+	}
+
+	a.serverConn.Start()
+
+	a.wg.Add(3)
 	go a.cleanupLoop()
+	go a.routeLoop()
+	go func() {
+		defer a.wg.Done()
+		a.socks.Serve(a.serverConn.GetPacketChannel())
+	}()
 
 	return nil
 }
 
+func (a *Client) startHealth() error {
+	if a.config.Health.ListenAddr == "" {
+		return nil
+	}
+	a.health = health.NewServer(a.config.Health.ListenAddr, a.checker, a.logger)
+	a.health.Handle("/status", http.HandlerFunc(a.handleStatus))
+	return a.health.Start()
+}
+
+func (a *Client) mode() string {
+	switch {
+	case a.tun != nil:
+		return ModeTUN
+	case a.socks != nil:
+		return ModeSOCKS
+	}
+	return ModeRedirect
+}
+
+func (a *Client) closeListeners() {
+	if a.listener != nil {
+		a.listener.Close()
+	}
+	for _, udpConn := range a.udpConns {
+		udpConn.Close()
+	}
+	if a.tun != nil {
+		a.tun.Close()
+	}
+	if a.socks != nil {
+		a.socks.Close()
+	}
+	for _, in := range a.ingresses {
+		in.Close()
+	}
+}
+
 func (a *Client) stop(ctx context.Context) error {
 	a.logger.Info("stopping client")
 
 	a.cancel()
 
-	if a.listener != nil {
-		a.listener.Close()
+	if a.control != nil {
+		if err := a.control.Stop(ctx); err != nil {
+			a.logger.Error("failed to stop control socket", logger.Error(err))
+		}
+	}
+
+	if a.health != nil {
+		if err := a.health.Stop(ctx); err != nil {
+			a.logger.Error("failed to stop health server", logger.Error(err))
+		}
 	}
 
+	a.closeListeners()
+
 	if err := a.serverConn.Close(); err != nil {
 		a.logger.Error("failed to close server connection", logger.Error(err))
 	}
 
 	a.wg.Wait()
 
-	if err := a.netfilter.Cleanup(); err != nil {
-		a.logger.Error("failed to cleanup netfilter", logger.Error(err))
+	if err := a.inNamespace(a.intercept.Cleanup); err != nil {
+		a.logger.Error("failed to cleanup interception", logger.Error(err))
 	}
 
 	a.logger.Info("client stopped")
@@ -118,6 +431,7 @@ func (a *Client) acceptLoop() {
 	defer a.logger.Info("accept loop stopped")
 
 	handler := NewConnectionHandler(a.tracker, a.serverConn.GetPacketChannel(), a.logger)
+	handler.getOriginalDest = a.netfilter.OriginalDest()
 
 	for {
 		select {
@@ -151,6 +465,42 @@ func (a *Client) acceptLoop() {
 	}
 }
 
+func (a *Client) routeLoop() {
+	defer a.wg.Done()
+	defer a.logger.Info("route loop stopped")
+
+	retry := time.NewTicker(10 * time.Second)
+	defer retry.Stop()
+
+	var pending []string
+	failed := false
+
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case pending = <-a.serverConn.RouteUpdates():
+		case <-retry.C:
+			if !failed {
+				continue
+			}
+		}
+
+		failed = false
+		if err := a.inNamespace(func() error { return a.intercept.SyncRoutes(pending) }); err != nil {
+			a.logger.Error("failed to sync intercepted routes", logger.Error(err))
+			failed = true
+		} else {
+			a.syncOnce.Do(func() { close(a.synced) })
+		}
+		if a.httpProxy != nil {
+			if err := a.httpProxy.SyncRoutes(pending); err != nil {
+				a.logger.Error("failed to sync http proxy routes", logger.Error(err))
+			}
+		}
+	}
+}
+
 func (a *Client) cleanupLoop() {
 	defer a.wg.Done()
 	defer a.logger.Info("cleanup loop stopped")
@@ -174,3 +524,10 @@ func (a *Client) cleanupLoop() {
 		}
 	}
 }
+
+func (a *Client) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(a.serverConn.Status()); err != nil {
+		a.logger.Debug("failed to write status response", logger.Error(err))
+	}
+}
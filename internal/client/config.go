@@ -4,16 +4,46 @@ import (
 	"fmt"
 
 	"network-tunneler/internal/config"
+	"network-tunneler/internal/health"
+	"network-tunneler/internal/reconnect"
 	"network-tunneler/pkg/crypto"
 	"network-tunneler/pkg/logger"
+	"network-tunneler/pkg/netfilter"
 )
 
 type Config struct {
 	ClientID    string             `mapstructure:"client_id" json:"client_id" yaml:"client_id"`
 	ServerAddr string             `mapstructure:"server_addr" json:"server_addr" yaml:"server_addr"`
+	// Mode is "redirect" (netfilter interception, the default), "tun" or
+	// "socks".
+	Mode       string             `mapstructure:"mode" json:"mode" yaml:"mode"`
 	ListenPort int                `mapstructure:"listen_port" json:"listen_port" yaml:"listen_port"`
 	TargetCIDR string             `mapstructure:"target_cidr" json:"target_cidr" yaml:"target_cidr"`
+	// Targets replaces TargetCIDR when set; Exclude always takes precedence.
+	Targets    []Target           `mapstructure:"targets" json:"targets" yaml:"targets"`
+	Exclude    []Target           `mapstructure:"exclude" json:"exclude" yaml:"exclude"`
+	// Processes limits interception of local traffic to matching
+	// processes; by default every process is intercepted.
+	Processes  []ProcessMatch     `mapstructure:"processes" json:"processes" yaml:"processes"`
+	// NetfilterBackend is "auto" (the default), "iptables", "nftables" or
+	// "ebpf".
+	NetfilterBackend string       `mapstructure:"netfilter_backend" json:"netfilter_backend" yaml:"netfilter_backend"`
 	TLS        crypto.TLSOptions  `mapstructure:"tls" json:"tls" yaml:"tls"`
+	Health     health.Config      `mapstructure:"health" json:"health" yaml:"health"`
+	// ControlSocket serves the local control API; empty disables it.
+	ControlSocket string          `mapstructure:"control_socket" json:"control_socket" yaml:"control_socket"`
+	// Delivery queues replies per connection on their way to local sockets.
+	Delivery   DeliveryConfig     `mapstructure:"delivery" json:"delivery" yaml:"delivery"`
+	UDP        UDPConfig          `mapstructure:"udp" json:"udp" yaml:"udp"`
+	Gateway    GatewayConfig      `mapstructure:"gateway" json:"gateway" yaml:"gateway"`
+	TUN        TUNConfig          `mapstructure:"tun" json:"tun" yaml:"tun"`
+	SOCKS      SOCKSConfig        `mapstructure:"socks" json:"socks" yaml:"socks"`
+	// HTTPProxy is an optional HTTP forward proxy that works in every mode.
+	HTTPProxy  HTTPProxyConfig    `mapstructure:"http_proxy" json:"http_proxy" yaml:"http_proxy"`
+	// Forwards tunnel fixed local ports to remote addresses in every mode.
+	Forwards   []ForwardConfig    `mapstructure:"forwards" json:"forwards" yaml:"forwards"`
+	DNS        DNSConfig          `mapstructure:"dns" json:"dns" yaml:"dns"`
+	Reconnect  reconnect.Config `mapstructure:"reconnect" json:"reconnect" yaml:"reconnect"`
 	Log        logger.Config      `mapstructure:"log" json:"log" yaml:"log"`
 }
 
@@ -21,9 +51,20 @@ func DefaultConfig() *Config {
 	return &Config{
 		ClientID:    "",
 		ServerAddr: "localhost:8080",
+		Mode:       ModeRedirect,
 		ListenPort: 9999,
 		TargetCIDR: "100.64.0.0/10",
+		NetfilterBackend: string(netfilter.BackendAuto),
 		TLS:        crypto.TLSOptions{},
+		Health:     health.Config{},
+		ControlSocket: DefaultControlSocket,
+		Delivery:   DefaultDeliveryConfig(),
+		UDP:        DefaultUDPConfig(),
+		TUN:        DefaultTUNConfig(),
+		SOCKS:      DefaultSOCKSConfig(),
+		HTTPProxy:  DefaultHTTPProxyConfig(),
+		DNS:        DefaultDNSConfig(),
+		Reconnect:  reconnect.DefaultConfig(),
 		Log:        config.DefaultLogConfig(),
 	}
 }
@@ -43,8 +84,98 @@ func (c *Config) Validate() error {
 	if c.ListenPort < 1 || c.ListenPort > 65535 {
 		return fmt.Errorf("listen port must be between 1 and 65535")
 	}
-	if c.TargetCIDR == "" {
-		return fmt.Errorf("target CIDR is required")
+	targets := c.interceptTargets()
+	if len(targets) == 0 {
+		return fmt.Errorf("at least one target CIDR is required")
+	}
+	includes, err := parseIncludes(targets)
+	if err != nil {
+		return err
+	}
+	excludes, err := parseExcludes(c.Exclude)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Delivery.Validate(); err != nil {
+		return err
+	}
+
+	switch c.Mode {
+	case "", ModeRedirect:
+		if c.NetfilterBackend == BackendEBPF {
+			// Connect hooks only see local sockets, and by cgroup.
+			if c.Gateway.Enabled {
+				return fmt.Errorf("gateway mode requires the iptables or nftables backend")
+			}
+			for _, p := range c.Processes {
+				if p.User != "" || p.Group != "" {
+					return fmt.Errorf("process match %s: the ebpf backend only matches cgroups", p)
+				}
+			}
+		} else if _, err := netfilter.ParseBackend(c.NetfilterBackend); err != nil {
+			return err
+		}
+		if interceptsUDP(includes) {
+			if err := c.UDP.Validate(); err != nil {
+				return err
+			}
+		}
+		if err := c.Gateway.Validate(); err != nil {
+			return err
+		}
+		for _, p := range c.Processes {
+			if err := p.Validate(); err != nil {
+				return err
+			}
+		}
+	case ModeTUN:
+		if c.Gateway.Enabled {
+			return fmt.Errorf("gateway mode requires redirect mode")
+		}
+		if len(c.Processes) > 0 {
+			return fmt.Errorf("process matches require redirect mode")
+		}
+		// Routes only select by destination.
+		for _, m := range append(includes, excludes...) {
+			if m.Protocol != "" || m.Ports != "" {
+				return fmt.Errorf("target %s: protocol and ports are not supported in tun mode", m)
+			}
+			if m.Prefix.Addr().Is6() {
+				return fmt.Errorf("target %s: IPv6 is not supported in tun mode", m)
+			}
+		}
+		if err := c.TUN.Validate(); err != nil {
+			return err
+		}
+	case ModeSOCKS:
+		if c.Gateway.Enabled {
+			return fmt.Errorf("gateway mode requires redirect mode")
+		}
+		if len(c.Processes) > 0 {
+			return fmt.Errorf("process matches require redirect mode")
+		}
+		if err := c.SOCKS.Validate(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", c.Mode)
+	}
+
+	if c.HTTPProxy.Enabled {
+		if err := c.HTTPProxy.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, f := range c.Forwards {
+		if err := f.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.DNS.Enabled {
+		if err := c.DNS.Validate(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -58,6 +58,315 @@ func TestConfigValidation(t *testing.T) {
 			},
 			expectErr: true,
 		},
+		{
+			name: "targets replace target CIDR",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				Targets: []Target{
+					{CIDR: "10.0.0.0/8", Ports: []string{"80", "443"}},
+					{CIDR: "192.168.0.0/16"},
+				},
+				Exclude: []Target{{CIDR: "10.0.5.0/24"}},
+			},
+			expectErr: false,
+		},
+		{
+			name: "invalid exclude",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				TargetCIDR: "100.64.0.0/10",
+				Exclude:    []Target{{CIDR: "100.64.0.0/10", Ports: []string{"http"}}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "tun mode",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				Mode:       ModeTUN,
+				TargetCIDR: "100.64.0.0/10",
+				Exclude:    []Target{{CIDR: "100.64.1.0/24"}},
+			},
+			expectErr: false,
+		},
+		{
+			name: "tun mode with ports",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				Mode:       ModeTUN,
+				Targets:    []Target{{CIDR: "10.0.0.0/8", Ports: []string{"80"}}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "tun mode with IPv6 target",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				Mode:       ModeTUN,
+				Targets:    []Target{{CIDR: "fd00::/8"}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "unknown netfilter backend",
+			cfg: &Config{
+				ServerAddr:       "localhost:8080",
+				ListenPort:       9999,
+				TargetCIDR:       "100.64.0.0/10",
+				NetfilterBackend: "ipfw",
+			},
+			expectErr: true,
+		},
+		{
+			name: "ebpf backend with cgroup process matches",
+			cfg: &Config{
+				ServerAddr:       "localhost:8080",
+				ListenPort:       9999,
+				TargetCIDR:       "100.64.0.0/10",
+				NetfilterBackend: BackendEBPF,
+				Processes:        []ProcessMatch{{Cgroup: "system.slice/app.service"}},
+			},
+			expectErr: false,
+		},
+		{
+			name: "ebpf backend with user process match",
+			cfg: &Config{
+				ServerAddr:       "localhost:8080",
+				ListenPort:       9999,
+				TargetCIDR:       "100.64.0.0/10",
+				NetfilterBackend: BackendEBPF,
+				Processes:        []ProcessMatch{{User: "1000"}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "ebpf backend in gateway mode",
+			cfg: &Config{
+				ServerAddr:       "localhost:8080",
+				ListenPort:       9999,
+				TargetCIDR:       "100.64.0.0/10",
+				NetfilterBackend: BackendEBPF,
+				Gateway:          GatewayConfig{Enabled: true, Sources: []string{"192.168.1.0/24"}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "gateway mode",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				TargetCIDR: "100.64.0.0/10",
+				Gateway:    GatewayConfig{Enabled: true, Sources: []string{"192.168.1.0/24"}, Interfaces: []string{"eth1"}},
+			},
+			expectErr: false,
+		},
+		{
+			name: "gateway mode without selectors",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				TargetCIDR: "100.64.0.0/10",
+				Gateway:    GatewayConfig{Enabled: true},
+			},
+			expectErr: true,
+		},
+		{
+			name: "gateway mode with invalid source",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				TargetCIDR: "100.64.0.0/10",
+				Gateway:    GatewayConfig{Enabled: true, Sources: []string{"192.168.1"}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "gateway mode in tun mode",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				Mode:       ModeTUN,
+				TargetCIDR: "100.64.0.0/10",
+				Gateway:    GatewayConfig{Enabled: true, Interfaces: []string{"eth1"}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "socks mode",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				Mode:       ModeSOCKS,
+				TargetCIDR: "100.64.0.0/10",
+				SOCKS:      SOCKSConfig{Username: "dev", Password: "secret"},
+			},
+			expectErr: false,
+		},
+		{
+			name: "socks mode with username only",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				Mode:       ModeSOCKS,
+				TargetCIDR: "100.64.0.0/10",
+				SOCKS:      SOCKSConfig{Username: "dev"},
+			},
+			expectErr: true,
+		},
+		{
+			name: "socks mode with invalid listen address",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				Mode:       ModeSOCKS,
+				TargetCIDR: "100.64.0.0/10",
+				SOCKS:      SOCKSConfig{ListenAddr: "1080"},
+			},
+			expectErr: true,
+		},
+		{
+			name: "http proxy",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				TargetCIDR: "100.64.0.0/10",
+				HTTPProxy:  HTTPProxyConfig{Enabled: true},
+			},
+			expectErr: false,
+		},
+		{
+			name: "http proxy with invalid listen address",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				Mode:       ModeSOCKS,
+				TargetCIDR: "100.64.0.0/10",
+				HTTPProxy:  HTTPProxyConfig{Enabled: true, ListenAddr: "3128"},
+			},
+			expectErr: true,
+		},
+		{
+			name: "forwards",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				TargetCIDR: "100.64.0.0/10",
+				Forwards: []ForwardConfig{
+					{ListenAddr: "127.0.0.1:5432", Remote: "10.20.0.7:5432"},
+					{Protocol: "udp", ListenAddr: "127.0.0.1:5353", Remote: "[fd00::53]:53"},
+				},
+			},
+			expectErr: false,
+		},
+		{
+			name: "forward to hostname",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				TargetCIDR: "100.64.0.0/10",
+				Forwards:   []ForwardConfig{{ListenAddr: "127.0.0.1:5432", Remote: "db:5432"}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "forward with unknown protocol",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				TargetCIDR: "100.64.0.0/10",
+				Forwards:   []ForwardConfig{{Protocol: "sctp", ListenAddr: "127.0.0.1:5432", Remote: "10.20.0.7:5432"}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "split dns",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				TargetCIDR: "100.64.0.0/10",
+				DNS:        DNSConfig{Enabled: true, Domains: []string{"*.corp.internal"}, Server: "10.20.0.2"},
+			},
+			expectErr: false,
+		},
+		{
+			name: "split dns without server",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				TargetCIDR: "100.64.0.0/10",
+				DNS:        DNSConfig{Enabled: true, Domains: []string{"corp.internal"}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "split dns with unknown system",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				TargetCIDR: "100.64.0.0/10",
+				DNS:        DNSConfig{Enabled: true, Domains: []string{"corp.internal"}, Server: "10.20.0.2", System: "netplan"},
+			},
+			expectErr: true,
+		},
+		{
+			name: "process matches",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				TargetCIDR: "100.64.0.0/10",
+				Processes: []ProcessMatch{
+					{User: "1000-1999"},
+					{Group: "developers", Cgroup: "/system.slice/app.service"},
+				},
+			},
+			expectErr: false,
+		},
+		{
+			name: "empty process match",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				TargetCIDR: "100.64.0.0/10",
+				Processes:  []ProcessMatch{{}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "process matches in socks mode",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				Mode:       ModeSOCKS,
+				TargetCIDR: "100.64.0.0/10",
+				Processes:  []ProcessMatch{{User: "1000"}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "unknown slow consumer policy",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				TargetCIDR: "100.64.0.0/10",
+				Delivery:   DeliveryConfig{SlowConsumer: "drop"},
+			},
+			expectErr: true,
+		},
+		{
+			name: "unknown mode",
+			cfg: &Config{
+				ServerAddr: "localhost:8080",
+				ListenPort: 9999,
+				Mode:       "bridge",
+				TargetCIDR: "100.64.0.0/10",
+			},
+			expectErr: true,
+		},
 		{
 			name: "missing CIDR",
 			cfg: &Config{
@@ -0,0 +1,254 @@
+package client
+
+import (
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"network-tunneler/pkg/logger"
+	"network-tunneler/pkg/netfilter"
+	"network-tunneler/pkg/network"
+)
+
+// BackendEBPF intercepts TCP connects with eBPF programs on the cgroup
+// connect hooks instead of netfilter rules.
+const BackendEBPF = "ebpf"
+
+// setupHook attaches the connect hook to the root cgroup, or to the cgroups
+// of the process matches. Unlike netfilter rules there is nothing of an
+// earlier run to remove: the kernel detaches the programs of a process
+// that dies.
+func (nf *NetfilterManager) setupHook(includes []trafficMatch) error {
+	excludes, err := nf.interceptExcludes(includes)
+	if err != nil {
+		return err
+	}
+
+	root, err := network.CgroupRoot()
+	if err != nil {
+		return err
+	}
+	cgroups := []string{root}
+	if len(nf.config.Processes) > 0 {
+		cgroups = nil
+		for _, p := range nf.config.Processes {
+			cgroups = append(cgroups, filepath.Join(root, p.cgroupPath()))
+		}
+	}
+
+	hook, err := network.NewConnectHook(cgroups, uint16(nf.config.ListenPort))
+	if err != nil {
+		return fmt.Errorf("failed to set up connect hook: %w", err)
+	}
+
+	if interceptsUDP(includes) {
+		nf.logger.Warn("the ebpf backend intercepts TCP only, UDP targets are left alone")
+	}
+
+	nf.hook = hook
+	nf.hookRules = make(map[netip.Prefix][]network.PortRule)
+	nf.includes = includes
+	nf.excludes = excludes
+
+	nf.logger.Info("netfilter ready, waiting for routes from server",
+		logger.Int("targets", len(includes)),
+		logger.Int("excludes", len(excludes)),
+		logger.String("local_port", nf.localPort),
+		logger.String("backend", BackendEBPF),
+		logger.Any("cgroups", cgroups),
+	)
+
+	nf.active = true
+	return nil
+}
+
+// syncHook brings the hook's port rules in line with the desired matches.
+func (nf *NetfilterManager) syncHook(desired map[string]trafficMatch) error {
+	var intercepts []trafficMatch
+	for _, m := range desired {
+		intercepts = append(intercepts, m)
+	}
+	policies, err := hookPolicies(intercepts, nf.excludes)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for prefix := range nf.hookRules {
+		if _, ok := policies[prefix]; ok {
+			continue
+		}
+		if err := nf.hook.DeleteRules(prefix); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(nf.hookRules, prefix)
+	}
+	for prefix, rules := range policies {
+		if samePortRules(nf.hookRules[prefix], rules) {
+			continue
+		}
+		if err := nf.hook.SetRules(prefix, rules); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		nf.hookRules[prefix] = rules
+	}
+
+	for key, route := range nf.routes {
+		if _, ok := desired[key]; !ok {
+			delete(nf.routes, key)
+			nf.logger.Info("stopped intercepting prefix", logger.String("match", route.match.String()))
+		}
+	}
+	for key, m := range desired {
+		if _, exists := nf.routes[key]; !exists {
+			nf.routes[key] = routeRule{match: m}
+			nf.logger.Info("intercepting prefix", logger.String("match", m.String()))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to sync %d connect hook rule(s): %w", len(errs), errs[0])
+	}
+	return nil
+}
+
+// hookPolicies computes the port rules of every prefix the hook needs. A
+// connect is decided by its longest matching prefix alone, so each prefix
+// carries the excludes and then the intercepting matches of every prefix
+// containing it, which keeps excludes winning as they do with netfilter.
+// Prefixes outside every intercepting match are left out.
+func hookPolicies(intercepts, excludes []trafficMatch) (map[netip.Prefix][]network.PortRule, error) {
+	tcp := func(ms []trafficMatch) []trafficMatch {
+		var out []trafficMatch
+		for _, m := range ms {
+			if m.covers(netfilter.ProtocolTCP) {
+				out = append(out, m)
+			}
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].key() < out[j].key() })
+		return out
+	}
+	intercepts, excludes = tcp(intercepts), tcp(excludes)
+
+	policies := make(map[netip.Prefix][]network.PortRule)
+	for _, m := range append(intercepts, excludes...) {
+		prefix := m.Prefix
+		if _, done := policies[prefix]; done {
+			continue
+		}
+
+		// Nothing after a rule for every port is ever reached.
+		var rules []network.PortRule
+		intercepting, final := false, false
+		add := func(ms []trafficMatch, intercept bool) {
+			for _, c := range ms {
+				if c.Prefix.Bits() > prefix.Bits() || !c.Prefix.Contains(prefix.Addr()) {
+					continue
+				}
+				intercepting = intercepting || intercept
+				if !final {
+					rules = append(rules, portRules(c.Ports, intercept)...)
+					final = c.Ports == ""
+				}
+			}
+		}
+		add(excludes, false)
+		add(intercepts, true)
+		if !intercepting {
+			continue
+		}
+		if len(rules) > network.MaxPortRules {
+			return nil, fmt.Errorf("%s needs %d port rules, the ebpf backend supports %d", prefix, len(rules), network.MaxPortRules)
+		}
+		policies[prefix] = rules
+	}
+	return policies, nil
+}
+
+// portRules turns a port list like "22,8000:8999" into rules with one
+// action; no ports means all of them.
+func portRules(ports string, intercept bool) []network.PortRule {
+	if ports == "" {
+		return []network.PortRule{{First: 0, Last: 65535, Intercept: intercept}}
+	}
+
+	var rules []network.PortRule
+	for _, r := range strings.Split(ports, ",") {
+		lo, hi, isRange := strings.Cut(r, ":")
+		if !isRange {
+			hi = lo
+		}
+		first, _ := strconv.ParseUint(lo, 10, 16)
+		last, _ := strconv.ParseUint(hi, 10, 16)
+		rules = append(rules, network.PortRule{First: uint16(first), Last: uint16(last), Intercept: intercept})
+	}
+	return rules
+}
+
+func samePortRules(a, b []network.PortRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// describeHook lists the hook's port rules per prefix, in prefix order.
+func (nf *NetfilterManager) describeHook() []string {
+	prefixes := make([]netip.Prefix, 0, len(nf.hookRules))
+	for prefix := range nf.hookRules {
+		prefixes = append(prefixes, prefix)
+	}
+	network.SortPrefixes(prefixes)
+
+	var rules []string
+	for _, prefix := range prefixes {
+		var parts []string
+		for _, r := range nf.hookRules[prefix] {
+			action := "return"
+			if r.Intercept {
+				action = "redirect"
+			}
+			ports := fmt.Sprintf("%d-%d", r.First, r.Last)
+			if r.First == r.Last {
+				ports = strconv.Itoa(int(r.First))
+			}
+			parts = append(parts, fmt.Sprintf("port %s %s", ports, action))
+		}
+		rules = append(rules, fmt.Sprintf("ebpf connect %s: %s", prefix, strings.Join(parts, ", ")))
+	}
+	return rules
+}
+
+func (nf *NetfilterManager) closeHook() error {
+	if err := nf.hook.Close(); err != nil {
+		return fmt.Errorf("failed to detach connect hook: %w", err)
+	}
+	nf.hook = nil
+	nf.hookRules = nil
+	nf.routes = make(map[string]routeRule)
+	nf.active = false
+	nf.logger.Info("netfilter rules removed successfully")
+	return nil
+}
+
+// OriginalDest returns how the destination of a connection accepted from
+// the redirect listener is recovered with the active backend.
+func (nf *NetfilterManager) OriginalDest() OriginalDestFunc {
+	nf.mu.Lock()
+	defer nf.mu.Unlock()
+
+	if nf.hook != nil {
+		return nf.hook.OriginalDest
+	}
+	return network.GetOriginalDestAuto
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"network-tunneler/pkg/netfilter"
+	"network-tunneler/pkg/network"
+)
+
+func TestHookPolicies(t *testing.T) {
+	intercepts := []trafficMatch{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8")},
+		{Prefix: netip.MustParsePrefix("172.16.0.0/12"), Protocol: netfilter.ProtocolUDP},
+	}
+	excludes := []trafficMatch{
+		{Prefix: netip.MustParsePrefix("10.1.0.0/16"), Protocol: netfilter.ProtocolTCP, Ports: "22,2200:2299"},
+		{Prefix: netip.MustParsePrefix("10.2.0.0/16")},
+		{Prefix: netip.MustParsePrefix("192.168.0.0/16")},
+	}
+
+	policies, err := hookPolicies(intercepts, excludes)
+	if err != nil {
+		t.Fatalf("hookPolicies failed: %v", err)
+	}
+
+	all := func(intercept bool) network.PortRule {
+		return network.PortRule{First: 0, Last: 65535, Intercept: intercept}
+	}
+	expected := map[netip.Prefix][]network.PortRule{
+		netip.MustParsePrefix("10.0.0.0/8"): {all(true)},
+		netip.MustParsePrefix("10.1.0.0/16"): {
+			{First: 22, Last: 22},
+			{First: 2200, Last: 2299},
+			all(true),
+		},
+		netip.MustParsePrefix("10.2.0.0/16"): {all(false)},
+	}
+	if !reflect.DeepEqual(policies, expected) {
+		t.Errorf("expected %v, got %v", expected, policies)
+	}
+
+	tooMany := []trafficMatch{{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Ports: "1,2,3,4,5,6,7,8,9"}}
+	if _, err := hookPolicies(tooMany, nil); err == nil {
+		t.Error("expected an error for more port rules than the hook holds")
+	}
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"time"
+
+	"network-tunneler/internal/control"
+	"network-tunneler/internal/reconnect"
+)
+
+// DefaultControlSocket is where the client exposes its control API and where
+// the status subcommand looks for it.
+const DefaultControlSocket = "/run/network-tunneler/client.sock"
+
+// Status is what the control API reports about a running client.
+type Status struct {
+	ClientID   string           `json:"client_id"`
+	ServerAddr string           `json:"server_addr"`
+	Mode       string           `json:"mode"`
+	Registered bool             `json:"registered"`
+	Connection reconnect.Status `json:"connection"`
+	// RTTMillis is the last heartbeat round trip, zero until measured.
+	RTTMillis   float64            `json:"rtt_ms"`
+	Routes      []string           `json:"routes"`
+	Rules       []string           `json:"rules"`
+	Connections []ConnectionStatus `json:"connections"`
+}
+
+type ConnectionStatus struct {
+	ConnectionID string    `json:"connection_id"`
+	Destination  string    `json:"destination"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastActivity time.Time `json:"last_activity"`
+	BytesOut     uint64    `json:"bytes_out"`
+	BytesIn      uint64    `json:"bytes_in"`
+}
+
+func (a *Client) Status() Status {
+	st := Status{
+		ClientID:    a.serverConn.ClientID(),
+		ServerAddr:  a.config.ServerAddr,
+		Mode:        a.mode(),
+		Registered:  a.serverConn.IsRegistered(),
+		Connection:  a.serverConn.Status(),
+		RTTMillis:   float64(a.serverConn.RTT()) / float64(time.Millisecond),
+		Routes:      []string{},
+		Rules:       []string{},
+		Connections: []ConnectionStatus{},
+	}
+
+	if r, ok := a.intercept.(interface{ Routes() []netip.Prefix }); ok {
+		for _, p := range r.Routes() {
+			st.Routes = append(st.Routes, p.String())
+		}
+	}
+	if a.netfilter != nil {
+		st.Rules = append(st.Rules, a.netfilter.Rules()...)
+	}
+
+	conns := a.tracker.List()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].CreatedAt.Before(conns[j].CreatedAt) })
+	for _, c := range conns {
+		st.Connections = append(st.Connections, ConnectionStatus{
+			ConnectionID: c.ConnectionID,
+			Destination:  c.OriginalDest,
+			CreatedAt:    c.CreatedAt,
+			LastActivity: c.LastActivity,
+			BytesOut:     c.BytesOut,
+			BytesIn:      c.BytesIn,
+		})
+	}
+
+	return st
+}
+
+func (a *Client) registerControlHandlers(s *control.Server) {
+	s.HandleFunc("GET /status", func(w http.ResponseWriter, req *http.Request) {
+		control.WriteJSON(w, http.StatusOK, a.Status())
+	})
+
+	// Closing a connection resets it, so the server and proxy tear down
+	// their side too.
+	s.HandleFunc("DELETE /connections/{id}", func(w http.ResponseWriter, req *http.Request) {
+		id := req.PathValue("id")
+		if !a.tracker.Reset(id, "closed via control socket") {
+			control.WriteError(w, http.StatusNotFound, fmt.Errorf("connection %s not found", id))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (a *Client) startControl() error {
+	ctl := control.NewServer(a.config.ControlSocket, a.logger)
+	a.registerControlHandlers(ctl)
+	if err := ctl.Start(); err != nil {
+		return err
+	}
+	a.control = ctl
+	return nil
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"network-tunneler/internal/control"
+	testutil "network-tunneler/internal/testing"
+	pb "network-tunneler/proto"
+)
+
+func TestClient_ControlAPI(t *testing.T) {
+	log := testutil.NewTestLogger()
+	cfg := DefaultConfig()
+	cfg.ControlSocket = filepath.Join(t.TempDir(), "client.sock")
+
+	tracker := NewConnectionTracker(TrackerParams{Logger: log})
+	a := &Client{
+		config:     cfg,
+		logger:     log,
+		tracker:    tracker,
+		serverConn: NewServerConnection(ServerConnParams{Config: cfg, Tracker: tracker, Logger: log}),
+	}
+	if err := a.startControl(); err != nil {
+		t.Fatalf("startControl failed: %v", err)
+	}
+	t.Cleanup(func() { a.control.Stop(t.Context()) })
+
+	tracker.Track("tcp-1", "10.0.0.1:80", testutil.NewMockNetConn())
+	tracker.AddBytesOut("tcp-1", 5)
+	if err := tracker.DeliverResponse("tcp-1", []byte("response")); err != nil {
+		t.Fatalf("DeliverResponse failed: %v", err)
+	}
+	waitDelivered(t, tracker, "tcp-1", len("response"))
+
+	ctl := control.NewClient(cfg.ControlSocket)
+
+	var st Status
+	if err := ctl.Get("/status", &st); err != nil {
+		t.Fatalf("status request failed: %v", err)
+	}
+	if st.ServerAddr != cfg.ServerAddr || st.Mode != ModeRedirect || st.Registered {
+		t.Errorf("unexpected status %+v", st)
+	}
+	if len(st.Connections) != 1 {
+		t.Fatalf("expected one connection, got %+v", st.Connections)
+	}
+	if c := st.Connections[0]; c.ConnectionID != "tcp-1" || c.Destination != "10.0.0.1:80" || c.BytesOut != 5 || c.BytesIn != 8 {
+		t.Errorf("unexpected connection %+v", c)
+	}
+
+	if err := ctl.Delete("/connections/tcp-1", nil); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if tracker.Count() != 0 {
+		t.Error("expected the connection to be removed")
+	}
+	if connID, ctrl, ok := a.serverConn.controls.pop(); !ok || connID != "tcp-1" || ctrl != pb.Control_CONTROL_RESET {
+		t.Errorf("expected a RESET for tcp-1 to be queued, got %s %v %v", connID, ctrl, ok)
+	}
+	if err := ctl.Delete("/connections/tcp-1", nil); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
@@ -0,0 +1,499 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/fx"
+
+	"network-tunneler/pkg/logger"
+	"network-tunneler/proto"
+)
+
+const (
+	DNSSystemAuto       = "auto"
+	DNSSystemResolvConf = "resolv.conf"
+	DNSSystemResolved   = "resolved"
+	DNSSystemNone       = "none"
+)
+
+// DNSConfig runs a local forwarder for split DNS: names under Domains are
+// resolved by Server through the tunnel, everything else by the system's
+// own resolvers.
+type DNSConfig struct {
+	Enabled    bool   `mapstructure:"enabled" json:"enabled" yaml:"enabled"`
+	ListenAddr string `mapstructure:"listen_addr" json:"listen_addr" yaml:"listen_addr"`
+	// Domains are suffixes such as "corp.internal" or "*.corp.internal".
+	Domains []string `mapstructure:"domains" json:"domains" yaml:"domains"`
+	// Server is the remote resolver, reached through the tunnel.
+	Server string `mapstructure:"server" json:"server" yaml:"server"`
+	// Upstream resolves every other name; it defaults to the nameservers in
+	// /etc/resolv.conf at startup, or systemd-resolved's upstream servers
+	// when the host is pointed at the forwarder through resolved.
+	Upstream []string `mapstructure:"upstream" json:"upstream" yaml:"upstream"`
+	// System is how the host is pointed at the forwarder: "auto" (the
+	// default), "resolv.conf", "resolved" or "none".
+	System  string        `mapstructure:"system" json:"system" yaml:"system"`
+	Timeout time.Duration `mapstructure:"timeout" json:"timeout" yaml:"timeout"`
+}
+
+func DefaultDNSConfig() DNSConfig {
+	return DNSConfig{
+		ListenAddr: "127.0.0.153:53",
+		System:     DNSSystemAuto,
+		Timeout:    5 * time.Second,
+	}
+}
+
+// withDefaults fills unset fields from DefaultDNSConfig.
+func (c DNSConfig) withDefaults() DNSConfig {
+	def := DefaultDNSConfig()
+	if c.ListenAddr == "" {
+		c.ListenAddr = def.ListenAddr
+	}
+	if c.System == "" {
+		c.System = def.System
+	}
+	if c.Timeout == 0 {
+		c.Timeout = def.Timeout
+	}
+	return c
+}
+
+func (c DNSConfig) Validate() error {
+	c = c.withDefaults()
+	if _, err := netip.ParseAddrPort(c.ListenAddr); err != nil {
+		return fmt.Errorf("dns listen address must be an IP address and port: %w", err)
+	}
+	if len(c.Domains) == 0 {
+		return fmt.Errorf("dns needs at least one domain")
+	}
+	for _, d := range c.Domains {
+		if normalizeDNSDomain(d) == "" {
+			return fmt.Errorf("invalid dns domain %q", d)
+		}
+	}
+	if _, err := parseResolverAddr(c.Server); err != nil {
+		return fmt.Errorf("invalid dns server: %w", err)
+	}
+	for _, u := range c.Upstream {
+		if _, err := parseResolverAddr(u); err != nil {
+			return fmt.Errorf("invalid dns upstream: %w", err)
+		}
+	}
+	switch c.System {
+	case DNSSystemAuto, DNSSystemResolvConf, DNSSystemResolved, DNSSystemNone:
+	default:
+		return fmt.Errorf("unknown dns system %q", c.System)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("dns timeout must be positive")
+	}
+	return nil
+}
+
+// parseResolverAddr accepts an IP address with an optional port, 53 by
+// default.
+func parseResolverAddr(s string) (netip.AddrPort, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.AddrPortFrom(addr, 53), nil
+	}
+	ap, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%q is not an IP address", s)
+	}
+	return ap, nil
+}
+
+func normalizeDNSDomain(d string) string {
+	d = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(d)), "*.")
+	d = strings.Trim(d, ".")
+	if strings.ContainsAny(d, " /:*") {
+		return ""
+	}
+	return d
+}
+
+// DNSForwarder answers queries on the listen address, UDP and TCP. Names
+// under the configured domains go to the remote server as tunneled UDP
+// sessions or TCP connections; the others are relayed to the upstream
+// resolvers directly.
+type DNSForwarder struct {
+	config  DNSConfig
+	tracker *ConnectionTracker
+	logger  logger.Logger
+	system  *dnsSystem
+
+	domains  []string
+	server   netip.AddrPort
+	upstream []string
+
+	conn     *net.UDPConn
+	listener net.Listener
+	mu       sync.Mutex
+}
+
+type DNSParams struct {
+	fx.In
+
+	Config  *Config
+	Tracker *ConnectionTracker
+	Logger  logger.Logger
+}
+
+func NewDNSForwarder(p DNSParams) *DNSForwarder {
+	cfg := p.Config.DNS.withDefaults()
+	log := p.Logger.With(logger.String("component", "dns"))
+
+	domains := make([]string, 0, len(cfg.Domains))
+	for _, d := range cfg.Domains {
+		domains = append(domains, normalizeDNSDomain(d))
+	}
+	server, _ := parseResolverAddr(cfg.Server)
+
+	return &DNSForwarder{
+		config:  cfg,
+		tracker: p.Tracker,
+		logger:  log,
+		system:  newDNSSystem(cfg.System, log),
+		domains: domains,
+		server:  server,
+	}
+}
+
+// Listen binds the forwarder and points the host's resolver at it.
+func (f *DNSForwarder) Listen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	listen := netip.MustParseAddrPort(f.config.ListenAddr)
+
+	upstream, err := f.upstreamResolvers(listen.Addr())
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(listen))
+	if err != nil {
+		return fmt.Errorf("dns failed to listen on %s: %w", listen, err)
+	}
+	listener, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("dns failed to listen on %s: %w", listen, err)
+	}
+
+	if err := f.system.apply(netip.MustParseAddrPort(conn.LocalAddr().String()), f.domains); err != nil {
+		listener.Close()
+		conn.Close()
+		return fmt.Errorf("failed to configure system resolver: %w", err)
+	}
+
+	f.conn = conn
+	f.listener = listener
+	f.upstream = upstream
+
+	f.logger.Info("dns forwarder listening",
+		logger.String("listen_addr", conn.LocalAddr().String()),
+		logger.String("server", f.server.String()),
+		logger.String("domains", strings.Join(f.domains, ",")),
+		logger.String("upstream", strings.Join(upstream, ",")),
+		logger.String("system", f.system.mode),
+	)
+	return nil
+}
+
+// upstreamResolvers returns the configured upstream or, by default, what
+// resolv.conf lists before it is rewritten (systemd-resolved's upstream
+// servers in resolved mode), without the forwarder itself.
+func (f *DNSForwarder) upstreamResolvers(self netip.Addr) ([]string, error) {
+	var upstream []string
+	for _, u := range f.config.Upstream {
+		ap, _ := parseResolverAddr(u)
+		upstream = append(upstream, ap.String())
+	}
+	if len(upstream) > 0 {
+		return upstream, nil
+	}
+
+	nameservers, err := f.system.nameservers()
+	if err != nil {
+		return nil, err
+	}
+	for _, ns := range nameservers {
+		ap, err := parseResolverAddr(ns)
+		if err != nil || ap.Addr() == self {
+			continue
+		}
+		upstream = append(upstream, ap.String())
+	}
+	if len(upstream) == 0 {
+		return nil, fmt.Errorf("no upstream resolvers configured or found in %s", f.system.upstreamSource())
+	}
+	return upstream, nil
+}
+
+// Serve answers queries until Close.
+func (f *DNSForwarder) Serve(serverWriter chan<- *proto.Packet) {
+	f.mu.Lock()
+	conn, listener := f.conn, f.listener
+	f.mu.Unlock()
+
+	if conn == nil {
+		return
+	}
+
+	// Tunneled UDP queries are sessions from the querying socket to the
+	// server; they only live for one exchange or so.
+	tunnel := &udpForward{
+		conn:         conn,
+		remote:       f.server,
+		serverWriter: serverWriter,
+		idleTimeout:  f.config.Timeout,
+		tracker:      f.tracker,
+		logger:       f.logger,
+		sessions:     make(map[string]bool),
+	}
+	done := make(chan struct{})
+	go tunnel.expire(done)
+	defer tunnel.closeSessions()
+	defer close(done)
+
+	handler := NewConnectionHandler(f.tracker, serverWriter, f.logger)
+	handler.getOriginalDest = FixedDest(f.server.String())
+	go f.acceptTCP(listener, handler)
+
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			f.logger.Warn("failed to read dns query", logger.Error(err))
+			continue
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+
+		query := buf[:n]
+		if f.tunneled(query) {
+			tunnel.forward(from, query)
+			continue
+		}
+		go f.resolveUpstream(conn, from, append([]byte(nil), query...))
+	}
+}
+
+// tunneled reports whether the query's name falls under a split domain.
+// Malformed queries go upstream, which answers them as it sees fit.
+func (f *DNSForwarder) tunneled(msg []byte) bool {
+	name, err := dnsQuestionName(msg)
+	if err != nil {
+		f.logger.Debug("failed to parse dns query", logger.Error(err))
+		return false
+	}
+
+	for _, d := range f.domains {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			f.logger.Debug("dns query through tunnel", logger.String("name", name))
+			return true
+		}
+	}
+	f.logger.Debug("dns query to upstream", logger.String("name", name))
+	return false
+}
+
+// resolveUpstream tries each upstream resolver in turn and answers
+// SERVFAIL if none replies.
+func (f *DNSForwarder) resolveUpstream(conn *net.UDPConn, from netip.AddrPort, query []byte) {
+	reply := make([]byte, 65535)
+	for _, up := range f.upstream {
+		n, err := exchangeUDP(up, query, reply, f.config.Timeout)
+		if err != nil {
+			f.logger.Debug("upstream dns query failed",
+				logger.String("upstream", up),
+				logger.Error(err),
+			)
+			continue
+		}
+		conn.WriteToUDPAddrPort(reply[:n], from)
+		return
+	}
+
+	if msg, err := dnsServfail(query); err == nil {
+		conn.WriteToUDPAddrPort(msg, from)
+	}
+}
+
+func exchangeUDP(addr string, query, reply []byte, timeout time.Duration) (int, error) {
+	conn, err := net.DialTimeout("udp", addr, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(query); err != nil {
+		return 0, err
+	}
+	return conn.Read(reply)
+}
+
+func (f *DNSForwarder) acceptTCP(listener net.Listener, handler *ConnectionHandler) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				f.logger.Error("accept error", logger.Error(err))
+				continue
+			}
+			return
+		}
+
+		go f.handleTCP(conn, handler)
+	}
+}
+
+// handleTCP routes a TCP connection by its first query; resolvers fall
+// back to TCP one query at a time.
+func (f *DNSForwarder) handleTCP(conn net.Conn, handler *ConnectionHandler) {
+	_ = conn.SetReadDeadline(time.Now().Add(f.config.Timeout))
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		conn.Close()
+		return
+	}
+	query := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, query); err != nil {
+		conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	first := io.MultiReader(bytes.NewReader(length[:]), bytes.NewReader(query), conn)
+	if f.tunneled(query) {
+		handler.Handle(&replayConn{Conn: conn, r: first})
+		return
+	}
+
+	defer conn.Close()
+	for _, up := range f.upstream {
+		upConn, err := net.DialTimeout("tcp", up, f.config.Timeout)
+		if err != nil {
+			f.logger.Debug("upstream dns connection failed",
+				logger.String("upstream", up),
+				logger.Error(err),
+			)
+			continue
+		}
+		go func() {
+			io.Copy(upConn, first)
+			upConn.Close()
+		}()
+		io.Copy(conn, upConn)
+		upConn.Close()
+		return
+	}
+}
+
+// Close stops the forwarder and restores the host's resolver
+// configuration.
+func (f *DNSForwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.conn == nil {
+		return nil
+	}
+	f.conn.Close()
+	f.listener.Close()
+	f.conn = nil
+	f.listener = nil
+
+	if err := f.system.restore(); err != nil {
+		f.logger.Error("failed to restore system resolver", logger.Error(err))
+		return err
+	}
+	return nil
+}
+
+// replayConn reads data already consumed from the connection first.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+const dnsHeaderLen = 12
+
+// dnsQuestionName returns the lower-cased name of a query's first
+// question.
+func dnsQuestionName(msg []byte) (string, error) {
+	if len(msg) < dnsHeaderLen {
+		return "", fmt.Errorf("dns message too short")
+	}
+	if binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return "", fmt.Errorf("dns message has no question")
+	}
+
+	name, _, err := readDNSName(msg, dnsHeaderLen)
+	return name, err
+}
+
+// readDNSName reads an uncompressed name at off, returning it and the
+// offset past it. Questions are never compressed.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	for {
+		if off >= len(msg) {
+			return "", 0, fmt.Errorf("dns name truncated")
+		}
+		n := int(msg[off])
+		off++
+		if n == 0 {
+			break
+		}
+		if n&0xc0 != 0 {
+			return "", 0, fmt.Errorf("compressed dns question name")
+		}
+		if off+n > len(msg) {
+			return "", 0, fmt.Errorf("dns name truncated")
+		}
+		labels = append(labels, strings.ToLower(string(msg[off:off+n])))
+		off += n
+	}
+	return strings.Join(labels, "."), off, nil
+}
+
+// dnsServfail builds a SERVFAIL answer to query, echoing its question.
+func dnsServfail(query []byte) ([]byte, error) {
+	if _, err := dnsQuestionName(query); err != nil {
+		return nil, err
+	}
+	_, off, _ := readDNSName(query, dnsHeaderLen)
+	if off+4 > len(query) {
+		return nil, fmt.Errorf("dns question truncated")
+	}
+
+	msg := append([]byte(nil), query[:off+4]...)
+	// QR with the query's opcode and RD; RA and SERVFAIL.
+	msg[2] = 0x80 | msg[2]&0x79
+	msg[3] = 0x80 | 0x02
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+	binary.BigEndian.PutUint16(msg[6:8], 0)
+	binary.BigEndian.PutUint16(msg[8:10], 0)
+	binary.BigEndian.PutUint16(msg[10:12], 0)
+	return msg, nil
+}
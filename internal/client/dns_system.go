@@ -0,0 +1,245 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"network-tunneler/pkg/logger"
+)
+
+const (
+	defaultResolvConf     = "/etc/resolv.conf"
+	defaultResolvedDropIn = "/etc/systemd/resolved.conf.d/network-tunneler.conf"
+	// defaultResolvedUpstream lists the servers systemd-resolved itself
+	// uses, unlike the stub resolv.conf that only names 127.0.0.53.
+	defaultResolvedUpstream = "/run/systemd/resolve/resolv.conf"
+
+	// resolvConfBackupSuffix names the saved original next to resolv.conf.
+	// One left behind by a crash is restored on the next start.
+	resolvConfBackupSuffix = ".network-tunneler"
+)
+
+// dnsSystem points the host's resolver at the forwarder and puts it back.
+// With resolv.conf the file is replaced by one naming only the forwarder,
+// which then sees every query; with systemd-resolved a drop-in routes just
+// the split domains to it.
+type dnsSystem struct {
+	mode             string
+	resolvConf       string
+	resolvedDropIn   string
+	resolvedUpstream string
+	restartResolved  func() error
+	logger           logger.Logger
+
+	applied bool
+}
+
+func newDNSSystem(mode string, log logger.Logger) *dnsSystem {
+	return &dnsSystem{
+		mode:             mode,
+		resolvConf:       defaultResolvConf,
+		resolvedDropIn:   defaultResolvedDropIn,
+		resolvedUpstream: defaultResolvedUpstream,
+		restartResolved: func() error {
+			if out, err := exec.Command("systemctl", "restart", "systemd-resolved").CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to restart systemd-resolved: %w (%s)", err, strings.TrimSpace(string(out)))
+			}
+			return nil
+		},
+		logger: log,
+	}
+}
+
+// detect resolves "auto": systemd-resolved when resolv.conf links to its
+// stub, the file otherwise.
+func (s *dnsSystem) detect() string {
+	if s.mode != DNSSystemAuto {
+		return s.mode
+	}
+	if target, err := os.Readlink(s.resolvConf); err == nil && strings.Contains(target, "/run/systemd/resolve/") {
+		return DNSSystemResolved
+	}
+	return DNSSystemResolvConf
+}
+
+// nameservers lists the nameservers the forwarder falls back to.
+func (s *dnsSystem) nameservers() ([]string, error) {
+	data, err := os.ReadFile(s.upstreamSource())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read resolver configuration: %w", err)
+	}
+
+	var servers []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers, nil
+}
+
+// upstreamSource is the file nameservers reads. With systemd-resolved the
+// drop-in's global DNS= also catches names outside the split domains, so
+// going back through the stub would loop them to the forwarder; resolved's
+// own upstream list is used instead.
+func (s *dnsSystem) upstreamSource() string {
+	if s.detect() == DNSSystemResolved {
+		return s.resolvedUpstream
+	}
+	return s.original()
+}
+
+// original is where the unmodified resolv.conf is: the backup while one
+// exists.
+func (s *dnsSystem) original() string {
+	if _, err := os.Lstat(s.resolvConf + resolvConfBackupSuffix); err == nil {
+		return s.resolvConf + resolvConfBackupSuffix
+	}
+	return s.resolvConf
+}
+
+func (s *dnsSystem) apply(listen netip.AddrPort, domains []string) error {
+	s.mode = s.detect()
+
+	switch s.mode {
+	case DNSSystemResolvConf:
+		if err := s.applyResolvConf(listen); err != nil {
+			return err
+		}
+	case DNSSystemResolved:
+		if err := s.applyResolved(listen, domains); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	s.applied = true
+	return nil
+}
+
+func (s *dnsSystem) applyResolvConf(listen netip.AddrPort) error {
+	if listen.Port() != 53 {
+		return fmt.Errorf("resolv.conf cannot name a port; the dns listen address must use port 53")
+	}
+
+	backup := s.resolvConf + resolvConfBackupSuffix
+	if _, err := os.Lstat(backup); err == nil {
+		s.logger.Warn("restoring resolv.conf left behind by a previous run", logger.String("backup", backup))
+		if err := s.restoreResolvConf(); err != nil {
+			return err
+		}
+	}
+
+	data, err := os.ReadFile(s.resolvConf)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", s.resolvConf, err)
+	}
+
+	// Renaming keeps a symlink a symlink. A bind-mounted resolv.conf, as in
+	// containers, cannot be renamed and is copied instead.
+	if err := os.Rename(s.resolvConf, backup); err != nil {
+		if err := os.WriteFile(backup, data, 0644); err != nil {
+			return fmt.Errorf("failed to back up %s: %w", s.resolvConf, err)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("# Generated by network-tunneler client, restored on shutdown.\n")
+	fmt.Fprintf(&b, "nameserver %s\n", listen.Addr())
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if fields := strings.Fields(line); len(fields) > 0 {
+			switch fields[0] {
+			case "search", "domain", "options":
+				b.WriteString(line + "\n")
+			}
+		}
+	}
+
+	if err := os.WriteFile(s.resolvConf, []byte(b.String()), 0644); err != nil {
+		s.restoreResolvConf()
+		return fmt.Errorf("failed to write %s: %w", s.resolvConf, err)
+	}
+
+	s.logger.Info("resolv.conf points at dns forwarder", logger.String("path", s.resolvConf))
+	return nil
+}
+
+func (s *dnsSystem) applyResolved(listen netip.AddrPort, domains []string) error {
+	server := listen.Addr().String()
+	if listen.Port() != 53 {
+		server = listen.String()
+	}
+	routing := make([]string, 0, len(domains))
+	for _, d := range domains {
+		routing = append(routing, "~"+d)
+	}
+
+	content := fmt.Sprintf("# Generated by network-tunneler client, removed on shutdown.\n[Resolve]\nDNS=%s\nDomains=%s\n",
+		server, strings.Join(routing, " "))
+
+	if err := os.MkdirAll(filepath.Dir(s.resolvedDropIn), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(s.resolvedDropIn), err)
+	}
+	if err := os.WriteFile(s.resolvedDropIn, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.resolvedDropIn, err)
+	}
+	if err := s.restartResolved(); err != nil {
+		os.Remove(s.resolvedDropIn)
+		return err
+	}
+
+	s.logger.Info("systemd-resolved routes split domains to dns forwarder",
+		logger.String("drop_in", s.resolvedDropIn),
+	)
+	return nil
+}
+
+func (s *dnsSystem) restore() error {
+	if !s.applied {
+		return nil
+	}
+	s.applied = false
+
+	switch s.mode {
+	case DNSSystemResolvConf:
+		return s.restoreResolvConf()
+	case DNSSystemResolved:
+		if err := os.Remove(s.resolvedDropIn); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", s.resolvedDropIn, err)
+		}
+		return s.restartResolved()
+	}
+	return nil
+}
+
+func (s *dnsSystem) restoreResolvConf() error {
+	backup := s.resolvConf + resolvConfBackupSuffix
+	if err := os.Rename(backup, s.resolvConf); err == nil {
+		s.logger.Info("resolv.conf restored", logger.String("path", s.resolvConf))
+		return nil
+	}
+
+	data, err := os.ReadFile(backup)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", backup, err)
+	}
+	if err := os.WriteFile(s.resolvConf, data, 0644); err != nil {
+		return fmt.Errorf("failed to restore %s: %w", s.resolvConf, err)
+	}
+	os.Remove(backup)
+	s.logger.Info("resolv.conf restored", logger.String("path", s.resolvConf))
+	return nil
+}
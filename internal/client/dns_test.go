@@ -0,0 +1,226 @@
+package client
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	testutil "network-tunneler/internal/testing"
+	pb "network-tunneler/proto"
+)
+
+func dnsQuery(id uint16, name string) []byte {
+	msg := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	msg[2] = 0x01 // RD
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+	for _, label := range strings.Split(name, ".") {
+		msg = append(append(msg, byte(len(label))), label...)
+	}
+	return append(msg, 0, 0, 1, 0, 1) // root, type A, class IN
+}
+
+func TestDNSMessages(t *testing.T) {
+	query := dnsQuery(0x1234, "DB.Corp.Internal")
+
+	name, err := dnsQuestionName(query)
+	if err != nil || name != "db.corp.internal" {
+		t.Errorf("expected db.corp.internal, got %q (%v)", name, err)
+	}
+	if _, err := dnsQuestionName(query[:dnsHeaderLen+3]); err == nil {
+		t.Error("expected truncated name to be rejected")
+	}
+
+	reply, err := dnsServfail(query)
+	if err != nil {
+		t.Fatalf("dnsServfail failed: %v", err)
+	}
+	if len(reply) != len(query) || reply[0] != 0x12 || reply[1] != 0x34 {
+		t.Errorf("expected reply to echo the query, got %x", reply)
+	}
+	if reply[2]&0x80 == 0 || reply[3]&0x0f != 2 {
+		t.Errorf("expected a SERVFAIL response, got flags %x%x", reply[2], reply[3])
+	}
+}
+
+func TestDNSForwarder(t *testing.T) {
+	log := testutil.NewTestLogger()
+	tracker := NewConnectionTracker(TrackerParams{Logger: log})
+
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to open upstream: %v", err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := upstream.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			upstream.WriteToUDP(append([]byte("upstream:"), buf[:n]...), from)
+		}
+	}()
+
+	f := NewDNSForwarder(DNSParams{
+		Config: &Config{DNS: DNSConfig{
+			Enabled:    true,
+			ListenAddr: "127.0.0.1:0",
+			Domains:    []string{"*.corp.internal"},
+			Server:     "10.20.0.2",
+			Upstream:   []string{upstream.LocalAddr().String()},
+			System:     DNSSystemNone,
+		}},
+		Tracker: tracker,
+		Logger:  log,
+	})
+	if err := f.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	serverChan := make(chan *pb.Packet, 10)
+	go f.Serve(serverChan)
+
+	conn, err := net.Dial("udp", f.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to dial forwarder: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+
+	query := dnsQuery(1, "db.corp.internal")
+	conn.Write(query)
+	select {
+	case pkt := <-serverChan:
+		if string(pkt.Data) != string(query) || pkt.Protocol != pb.Protocol_PROTOCOL_UDP {
+			t.Fatalf("unexpected packet %x (%v)", pkt.Data, pkt.Protocol)
+		}
+		if pkt.ConnTuple.DstIp != "10.20.0.2" || pkt.ConnTuple.DstPort != 53 {
+			t.Errorf("expected destination 10.20.0.2:53, got %+v", pkt.ConnTuple)
+		}
+		if err := tracker.DeliverResponse(pkt.ConnectionId, []byte("tunneled")); err != nil {
+			t.Fatalf("DeliverResponse failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for tunneled query")
+	}
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "tunneled" {
+		t.Errorf("expected tunneled answer, got %q (%v)", buf[:n], err)
+	}
+
+	query = dnsQuery(2, "example.com")
+	conn.Write(query)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "upstream:"+string(query) {
+		t.Errorf("expected upstream answer, got %q (%v)", buf[:n], err)
+	}
+	select {
+	case pkt := <-serverChan:
+		t.Errorf("unexpected tunneled packet for %q", pkt.Data)
+	default:
+	}
+}
+
+func newTestDNSSystem(t *testing.T, mode string) (*dnsSystem, *int) {
+	t.Helper()
+
+	dir := t.TempDir()
+	restarts := 0
+	s := newDNSSystem(mode, testutil.NewTestLogger())
+	s.resolvConf = filepath.Join(dir, "resolv.conf")
+	s.resolvedDropIn = filepath.Join(dir, "resolved.conf.d", "network-tunneler.conf")
+	s.resolvedUpstream = filepath.Join(dir, "resolved-upstream.conf")
+	s.restartResolved = func() error {
+		restarts++
+		return nil
+	}
+	return s, &restarts
+}
+
+func TestDNSSystem_ResolvConf(t *testing.T) {
+	s, _ := newTestDNSSystem(t, DNSSystemAuto)
+
+	original := "nameserver 192.0.2.1\nsearch corp.example\noptions edns0\n"
+	target := s.resolvConf + ".real"
+	os.WriteFile(target, []byte(original), 0644)
+	if err := os.Symlink(target, s.resolvConf); err != nil {
+		t.Fatalf("failed to link resolv.conf: %v", err)
+	}
+
+	if err := s.apply(netip.MustParseAddrPort("127.0.0.153:53"), []string{"corp.internal"}); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if s.mode != DNSSystemResolvConf {
+		t.Errorf("expected resolv.conf mode, got %s", s.mode)
+	}
+
+	data, _ := os.ReadFile(s.resolvConf)
+	if !strings.Contains(string(data), "nameserver 127.0.0.153\nsearch corp.example\noptions edns0\n") ||
+		strings.Contains(string(data), "192.0.2.1") {
+		t.Errorf("unexpected resolv.conf:\n%s", data)
+	}
+	if servers, err := s.nameservers(); err != nil || len(servers) != 1 || servers[0] != "192.0.2.1" {
+		t.Errorf("expected original nameservers, got %v (%v)", servers, err)
+	}
+
+	if err := s.restore(); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	if link, err := os.Readlink(s.resolvConf); err != nil || link != target {
+		t.Errorf("expected symlink to %s to be restored, got %q (%v)", target, link, err)
+	}
+	if data, _ := os.ReadFile(target); string(data) != original {
+		t.Errorf("expected target to be untouched, got:\n%s", data)
+	}
+}
+
+func TestDNSSystem_Resolved(t *testing.T) {
+	s, restarts := newTestDNSSystem(t, DNSSystemAuto)
+	os.Symlink("/run/systemd/resolve/stub-resolv.conf", s.resolvConf)
+
+	if err := s.apply(netip.MustParseAddrPort("127.0.0.153:5353"), []string{"corp.internal", "lab"}); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if s.mode != DNSSystemResolved {
+		t.Errorf("expected resolved mode, got %s", s.mode)
+	}
+
+	data, _ := os.ReadFile(s.resolvedDropIn)
+	if !strings.Contains(string(data), "DNS=127.0.0.153:5353\nDomains=~corp.internal ~lab\n") {
+		t.Errorf("unexpected drop-in:\n%s", data)
+	}
+
+	if err := s.restore(); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	if _, err := os.Stat(s.resolvedDropIn); !os.IsNotExist(err) {
+		t.Errorf("expected drop-in to be removed, got %v", err)
+	}
+	if *restarts != 2 {
+		t.Errorf("expected systemd-resolved to restart twice, got %d", *restarts)
+	}
+}
+
+func TestDNSSystem_ResolvedUpstream(t *testing.T) {
+	s, _ := newTestDNSSystem(t, DNSSystemAuto)
+	os.Symlink("/run/systemd/resolve/stub-resolv.conf", s.resolvConf)
+	os.WriteFile(s.resolvedUpstream, []byte("nameserver 192.0.2.53\nnameserver 192.0.2.54\n"), 0644)
+
+	// The stub would hand names outside the split domains back to resolved,
+	// whose global DNS= is the forwarder.
+	f := &DNSForwarder{system: s}
+	upstream, err := f.upstreamResolvers(netip.MustParseAddr("127.0.0.153"))
+	if err != nil {
+		t.Fatalf("upstreamResolvers failed: %v", err)
+	}
+	if len(upstream) != 2 || upstream[0] != "192.0.2.53:53" || upstream[1] != "192.0.2.54:53" {
+		t.Errorf("expected resolved's upstream servers, got %v", upstream)
+	}
+}
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"network-tunneler/pkg/logger"
+	"network-tunneler/pkg/netfilter"
+	pkgnet "network-tunneler/pkg/network"
+)
+
+// execNamespacePrefix names the namespaces of exec runs, followed by the
+// client's PID.
+const execNamespacePrefix = "network-tunneler-"
+
+// execSubnets holds the /30s linking exec namespaces to the host. The
+// cloud metadata /24 is skipped.
+var execSubnets = netip.MustParsePrefix("169.254.0.0/16")
+
+// ExecConfig adapts cfg for a client serving a single command in its own
+// network namespace: interception works as in redirect mode, but only
+// there, and nothing listens on the host. Logs go to stderr so the
+// command's output stays its own.
+func ExecConfig(cfg *Config) *Config {
+	c := *cfg
+	c.Log.Output = os.Stderr
+	c.Mode = ModeRedirect
+	// Connect hooks apply to cgroups, not namespaces.
+	if c.NetfilterBackend == BackendEBPF {
+		c.NetfilterBackend = string(netfilter.BackendAuto)
+	}
+	c.Gateway = GatewayConfig{}
+	c.HTTPProxy.Enabled = false
+	c.Forwards = nil
+	c.DNS.Enabled = false
+	c.ControlSocket = ""
+	c.Health.ListenAddr = ""
+	return &c
+}
+
+// NewExecNamespace creates the network namespace an exec run's command
+// lives in, linked to the host by a veth pair. Namespaces of earlier runs
+// that were killed are removed first.
+func NewExecNamespace(log logger.Logger) (*pkgnet.Namespace, error) {
+	removeStaleExecNamespaces(log)
+
+	name := execNamespacePrefix + strconv.Itoa(os.Getpid())
+	ns, err := pkgnet.CreateNamespace(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create network namespace: %w", err)
+	}
+
+	hostAddr, peerAddr, err := pickExecSubnet(os.Getpid())
+	if err != nil {
+		ns.Delete()
+		return nil, err
+	}
+	hostName := "nt" + strconv.Itoa(os.Getpid())
+	if err := ns.AddVeth(hostName, hostAddr, peerAddr); err != nil {
+		ns.Delete()
+		return nil, fmt.Errorf("failed to link network namespace: %w", err)
+	}
+
+	log.Info("network namespace created",
+		logger.String("netns", name),
+		logger.String("host_addr", hostAddr.String()),
+		logger.String("netns_addr", peerAddr.String()),
+	)
+	return ns, nil
+}
+
+func removeStaleExecNamespaces(log logger.Logger) {
+	names, err := pkgnet.ListNamespaces()
+	if err != nil {
+		log.Warn("failed to list network namespaces", logger.Error(err))
+		return
+	}
+
+	for _, name := range names {
+		pid, err := strconv.Atoi(strings.TrimPrefix(name, execNamespacePrefix))
+		if !strings.HasPrefix(name, execNamespacePrefix) || err != nil || processAlive(pid) {
+			continue
+		}
+		if err := pkgnet.DeleteNamespace(name); err != nil {
+			log.Warn("failed to remove stale network namespace", logger.String("netns", name), logger.Error(err))
+			continue
+		}
+		log.Warn("removed network namespace left behind by an earlier run", logger.String("netns", name))
+	}
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// pickExecSubnet returns the host and namespace addresses of the first /30
+// from a PID-derived starting point that no host interface uses.
+func pickExecSubnet(pid int) (netip.Prefix, netip.Prefix, error) {
+	var used []netip.Prefix
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if p, err := netip.ParsePrefix(a.String()); err == nil {
+				used = append(used, p.Masked())
+			}
+		}
+	}
+
+	const blocks = 1 << (32 - 16 - 2)
+	base := execSubnets.Addr().As4()
+	for i := 0; i < blocks; i++ {
+		n := (pid + i) % blocks
+		third, fourth := byte(n>>6), byte(n&63)<<2
+		if third == 169 {
+			continue
+		}
+
+		subnet := netip.PrefixFrom(netip.AddrFrom4([4]byte{base[0], base[1], third, fourth}), 30)
+		if overlapsAny(subnet, used) {
+			continue
+		}
+		host := subnet.Addr().Next()
+		return netip.PrefixFrom(host, 30), netip.PrefixFrom(host.Next(), 30), nil
+	}
+	return netip.Prefix{}, netip.Prefix{}, fmt.Errorf("no free subnet in %s for the network namespace", execSubnets)
+}
+
+func overlapsAny(p netip.Prefix, prefixes []netip.Prefix) bool {
+	for _, q := range prefixes {
+		if p.Overlaps(q) {
+			return true
+		}
+	}
+	return false
+}
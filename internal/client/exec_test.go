@@ -0,0 +1,44 @@
+package client
+
+import (
+	"os"
+	"testing"
+)
+
+func TestExecConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Mode = ModeSOCKS
+	cfg.HTTPProxy.Enabled = true
+	cfg.DNS.Enabled = true
+	cfg.Forwards = []ForwardConfig{{ListenAddr: "127.0.0.1:5432", Remote: "10.0.0.7:5432"}}
+	cfg.ControlSocket = "/tmp/client.sock"
+
+	c := ExecConfig(cfg)
+	if c.Mode != ModeRedirect || c.HTTPProxy.Enabled || c.DNS.Enabled || c.Forwards != nil || c.ControlSocket != "" || c.Health.ListenAddr != "" {
+		t.Errorf("unexpected exec config %+v", c)
+	}
+	if c.Log.Output != os.Stderr {
+		t.Error("expected logs on stderr")
+	}
+	if cfg.Mode != ModeSOCKS || !cfg.DNS.Enabled || cfg.ControlSocket == "" {
+		t.Error("expected the original config to be left alone")
+	}
+}
+
+func TestPickExecSubnet(t *testing.T) {
+	for _, pid := range []int{1, 4242, 169 << 6, 1<<14 - 1} {
+		host, peer, err := pickExecSubnet(pid)
+		if err != nil {
+			t.Fatalf("pid %d: %v", pid, err)
+		}
+		if host.Bits() != 30 || peer.Bits() != 30 || host.Masked() != peer.Masked() || host.Addr() == peer.Addr() {
+			t.Errorf("pid %d: expected two addresses in one /30, got %s and %s", pid, host, peer)
+		}
+		if !execSubnets.Contains(host.Addr()) {
+			t.Errorf("pid %d: %s is outside %s", pid, host, execSubnets)
+		}
+		if host.Addr().As4()[2] == 169 {
+			t.Errorf("pid %d: %s is in the metadata range", pid, host)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"fmt"
+	"net/netip"
+
+	"network-tunneler/pkg/logger"
+	"network-tunneler/pkg/network"
+)
+
+// GatewayConfig lets the client route for other hosts: forwarded traffic
+// to the targets is intercepted in PREROUTING as well as the client's own
+// traffic in OUTPUT.
+type GatewayConfig struct {
+	Enabled bool `mapstructure:"enabled" json:"enabled" yaml:"enabled"`
+	// Sources and Interfaces select the forwarded traffic to intercept:
+	// packets from any of the source prefixes or arriving on any of the
+	// interfaces.
+	Sources    []string `mapstructure:"sources" json:"sources" yaml:"sources"`
+	Interfaces []string `mapstructure:"interfaces" json:"interfaces" yaml:"interfaces"`
+}
+
+func (c GatewayConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.Sources) == 0 && len(c.Interfaces) == 0 {
+		return fmt.Errorf("gateway mode needs at least one source or interface")
+	}
+	if _, err := c.sourcePrefixes(); err != nil {
+		return err
+	}
+	for _, name := range c.Interfaces {
+		if name == "" || len(name) >= 16 {
+			return fmt.Errorf("gateway interface %q is invalid", name)
+		}
+	}
+	return nil
+}
+
+func (c GatewayConfig) sourcePrefixes() ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(c.Sources))
+	for _, s := range c.Sources {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gateway source %q: %w", s, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// gatewaySelector is one way forwarded traffic is picked up: by source
+// prefix or by input interface.
+type gatewaySelector struct {
+	source netip.Prefix
+	iface  string
+}
+
+func (s gatewaySelector) String() string {
+	if s.iface != "" {
+		return "interface " + s.iface
+	}
+	return "source " + s.source.String()
+}
+
+// matches reports whether the selector can be combined with a destination
+// of this family; an interface carries both.
+func (s gatewaySelector) matches(dst netip.Prefix) bool {
+	return s.iface != "" || s.source.Addr().Is6() == dst.Addr().Is6()
+}
+
+func (c GatewayConfig) selectors() ([]gatewaySelector, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	prefixes, err := c.sourcePrefixes()
+	if err != nil {
+		return nil, err
+	}
+
+	var selectors []gatewaySelector
+	for _, p := range prefixes {
+		selectors = append(selectors, gatewaySelector{source: p})
+	}
+	for _, name := range c.Interfaces {
+		selectors = append(selectors, gatewaySelector{iface: name})
+	}
+	return selectors, nil
+}
+
+type sysctlChange struct {
+	name string
+	prev string
+}
+
+// gatewaySysctls enables forwarding for the families with targets and
+// relaxes strict reverse path filtering to loose on "all" and the gateway
+// interfaces, since the effective mode is the highest of the two; policy
+// routed traffic fails strict checks. Every value changed is returned so it
+// can be restored, including on failure.
+func gatewaySysctls(gw GatewayConfig, ipv4, ipv6 bool, log logger.Logger) ([]sysctlChange, error) {
+	var changes []sysctlChange
+	always := func(string) bool { return true }
+	isStrict := func(prev string) bool { return prev == "1" }
+
+	// set writes value when replace accepts the current one.
+	set := func(name, value string, replace func(prev string) bool) error {
+		prev, err := network.ReadSysctl(name)
+		if err != nil {
+			return err
+		}
+		if prev == value || !replace(prev) {
+			return nil
+		}
+		if err := network.WriteSysctl(name, value); err != nil {
+			return err
+		}
+		changes = append(changes, sysctlChange{name: name, prev: prev})
+		log.Info("changed sysctl for gateway mode",
+			logger.String("name", name),
+			logger.String("from", prev),
+			logger.String("to", value),
+		)
+		return nil
+	}
+
+	if ipv4 {
+		if err := set("net/ipv4/ip_forward", "1", always); err != nil {
+			return changes, err
+		}
+		for _, name := range append([]string{"all"}, gw.Interfaces...) {
+			if err := set("net/ipv4/conf/"+name+"/rp_filter", "2", isStrict); err != nil {
+				return changes, err
+			}
+		}
+	}
+	if ipv6 {
+		if err := set("net/ipv6/conf/all/forwarding", "1", always); err != nil {
+			return changes, err
+		}
+	}
+
+	return changes, nil
+}
+
+// restoreSysctls puts changed values back in reverse order.
+func restoreSysctls(changes []sysctlChange) error {
+	var firstErr error
+	for i := len(changes) - 1; i >= 0; i-- {
+		if err := network.WriteSysctl(changes[i].name, changes[i].prev); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"errors"
 	"io"
 	"net"
 	"time"
@@ -12,6 +13,18 @@ import (
 
 type OriginalDestFunc func(net.Conn) (string, error)
 
+// FixedDest sends every connection to dest, for listeners that are not fed
+// by netfilter.
+func FixedDest(dest string) OriginalDestFunc {
+	return func(net.Conn) (string, error) {
+		return dest, nil
+	}
+}
+
+// queueTimeout bounds how long a read waits for room in the server queue,
+// which covers a short reconnect without dropping data.
+const queueTimeout = 5 * time.Second
+
 type ConnectionHandler struct {
 	tracker         *ConnectionTracker
 	serverWriter    chan<- *proto.Packet
@@ -61,13 +74,24 @@ func (h *ConnectionHandler) Handle(conn net.Conn) {
 
 	connID := pkgnet.GenerateConnectionID(srcIP, srcPort, dstIP, dstPort)
 
-	h.tracker.Track(connID, originalDest, conn)
+	h.forward(conn, connID, originalDest, &proto.ConnectionTuple{
+		SrcIp:   srcIP.String(),
+		SrcPort: uint32(srcPort),
+		DstIp:   dstIP.String(),
+		DstPort: uint32(dstPort),
+	})
+}
+
+// forward tracks conn under connID and sends everything read from it to the
+// server until it is closed.
+func (h *ConnectionHandler) forward(conn net.Conn, connID, dest string, tuple *proto.ConnectionTuple) {
+	h.tracker.Track(connID, dest, conn)
 	defer h.tracker.Remove(connID)
 
 	h.logger.Info("new connection",
 		logger.String("connection_id", connID),
 		logger.String("source", conn.RemoteAddr().String()),
-		logger.String("original_dest", originalDest),
+		logger.String("original_dest", dest),
 	)
 
 	buf := make([]byte, 65535)
@@ -80,6 +104,10 @@ func (h *ConnectionHandler) Handle(conn net.Conn) {
 				h.logger.Debug("connection closed by client",
 					logger.String("connection_id", connID),
 				)
+			} else if errors.Is(err, net.ErrClosed) {
+				h.logger.Debug("connection closed locally",
+					logger.String("connection_id", connID),
+				)
 			} else {
 				h.logger.Error("read error",
 					logger.Error(err),
@@ -95,31 +123,31 @@ func (h *ConnectionHandler) Handle(conn net.Conn) {
 
 		h.tracker.UpdateActivity(connID)
 
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
 		packet := &proto.Packet{
 			ConnectionId: connID,
-			Data:         buf[:n],
-			ConnTuple: &proto.ConnectionTuple{
-				SrcIp:   srcIP.String(),
-				SrcPort: uint32(srcPort),
-				DstIp:   dstIP.String(),
-				DstPort: uint32(dstPort),
-			},
-			Protocol:  proto.Protocol_PROTOCOL_TCP,
-			Direction: proto.Direction_DIRECTION_FORWARD,
-			Timestamp: time.Now().Unix(),
+			Data:         data,
+			ConnTuple:    tuple,
+			Protocol:     proto.Protocol_PROTOCOL_TCP,
+			Direction:    proto.Direction_DIRECTION_FORWARD,
+			Timestamp:    time.Now().Unix(),
 		}
 
+		timer := time.NewTimer(queueTimeout)
 		select {
 		case h.serverWriter <- packet:
 			h.logger.Debug("packet sent to server",
 				logger.String("connection_id", connID),
 				logger.Int("bytes", n),
 			)
-		default:
+		case <-timer.C:
 			h.logger.Warn("server writer channel full, dropping packet",
 				logger.String("connection_id", connID),
 			)
 		}
+		timer.Stop()
 	}
 }
 
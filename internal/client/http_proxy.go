@@ -0,0 +1,409 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/fx"
+
+	"network-tunneler/pkg/logger"
+	"network-tunneler/pkg/netfilter"
+	"network-tunneler/proto"
+)
+
+type HTTPProxyConfig struct {
+	Enabled    bool   `mapstructure:"enabled" json:"enabled" yaml:"enabled"`
+	ListenAddr string `mapstructure:"listen_addr" json:"listen_addr" yaml:"listen_addr"`
+	// AccessLog logs one line per request or CONNECT tunnel.
+	AccessLog bool `mapstructure:"access_log" json:"access_log" yaml:"access_log"`
+}
+
+func DefaultHTTPProxyConfig() HTTPProxyConfig {
+	return HTTPProxyConfig{
+		ListenAddr: "127.0.0.1:3128",
+	}
+}
+
+// withDefaults fills unset fields from DefaultHTTPProxyConfig.
+func (c HTTPProxyConfig) withDefaults() HTTPProxyConfig {
+	if c.ListenAddr == "" {
+		c.ListenAddr = DefaultHTTPProxyConfig().ListenAddr
+	}
+	return c
+}
+
+func (c HTTPProxyConfig) Validate() error {
+	c = c.withDefaults()
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		return fmt.Errorf("invalid http proxy listen address: %w", err)
+	}
+	return nil
+}
+
+const (
+	// httpProxyHeaderTimeout bounds reading a request's headers.
+	httpProxyHeaderTimeout = 10 * time.Second
+	httpProxyIdleTimeout   = 90 * time.Second
+)
+
+// httpSourceKey carries the requesting client's address to dial.
+type httpSourceKey struct{}
+
+// HTTPProxy is an HTTP forward proxy for applications that honor
+// HTTP(S)_PROXY but not SOCKS. CONNECT tunnels go through the
+// ConnectionHandler like redirected connections; plain absolute-URI
+// requests are proxied over tunneled connections dialed per upstream host.
+// It runs next to any mode, destinations are checked like SOCKS ones.
+type HTTPProxy struct {
+	config  HTTPProxyConfig
+	targets *Config
+	tracker *ConnectionTracker
+	logger  logger.Logger
+
+	listener  net.Listener
+	server    *http.Server
+	filter    *destinationFilter
+	handler   *ConnectionHandler
+	forwarder *httputil.ReverseProxy
+	seq       atomic.Uint64
+	mu        sync.Mutex
+}
+
+type HTTPProxyParams struct {
+	fx.In
+
+	Config  *Config
+	Tracker *ConnectionTracker
+	Logger  logger.Logger
+}
+
+func NewHTTPProxy(p HTTPProxyParams) *HTTPProxy {
+	return &HTTPProxy{
+		config:  p.Config.HTTPProxy.withDefaults(),
+		targets: p.Config,
+		tracker: p.Tracker,
+		logger:  p.Logger.With(logger.String("component", "http_proxy")),
+	}
+}
+
+// Listen binds the proxy; requests are handled once Serve runs.
+func (p *HTTPProxy) Listen() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	filter, err := newDestinationFilter(p.targets)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", p.config.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("http proxy failed to listen on %s: %w", p.config.ListenAddr, err)
+	}
+
+	p.listener = listener
+	p.filter = filter
+
+	p.logger.Info("http proxy listening",
+		logger.String("listen_addr", listener.Addr().String()),
+		logger.Bool("access_log", p.config.AccessLog),
+	)
+	return nil
+}
+
+// SyncRoutes records the pushed prefixes that address destinations must
+// fall in.
+func (p *HTTPProxy) SyncRoutes(prefixes []string) error {
+	p.mu.Lock()
+	filter := p.filter
+	p.mu.Unlock()
+
+	if filter == nil {
+		return fmt.Errorf("http proxy not listening")
+	}
+
+	n := filter.setRoutes(prefixes, p.logger)
+	p.logger.Debug("http proxy routes updated", logger.Int("prefixes", n))
+	return nil
+}
+
+// Serve handles requests until Close.
+func (p *HTTPProxy) Serve(serverWriter chan<- *proto.Packet) {
+	p.mu.Lock()
+	listener := p.listener
+	if listener == nil {
+		p.mu.Unlock()
+		return
+	}
+
+	p.handler = NewConnectionHandler(p.tracker, serverWriter, p.logger)
+	p.forwarder = &httputil.ReverseProxy{
+		// The request already carries the absolute target URL.
+		Rewrite: func(*httputil.ProxyRequest) {},
+		Transport: &http.Transport{
+			DialContext:        p.dial,
+			IdleConnTimeout:    httpProxyIdleTimeout,
+			DisableCompression: true,
+		},
+		ErrorHandler: p.forwardError,
+	}
+	p.server = &http.Server{
+		Handler:           p,
+		ReadHeaderTimeout: httpProxyHeaderTimeout,
+		IdleTimeout:       httpProxyIdleTimeout,
+	}
+	server := p.server
+	p.mu.Unlock()
+
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+		p.logger.Error("http proxy stopped", logger.Error(err))
+	}
+}
+
+func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.connect(w, r)
+		return
+	}
+
+	start := time.Now()
+	rec := &httpProxyRecorder{ResponseWriter: w, status: http.StatusOK}
+	body := &countingReader{Reader: r.Body}
+
+	if r.URL.Scheme != "http" || r.URL.Host == "" {
+		http.Error(rec, "only absolute http:// URLs and CONNECT are supported", http.StatusBadRequest)
+	} else {
+		r.Body = body
+		src, _ := parseIngressAddr(r.RemoteAddr)
+		p.forwarder.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), httpSourceKey{}, src)))
+	}
+
+	p.accessLog(r, rec.status, body.n.Load(), rec.n, start)
+}
+
+// connect takes over the client connection once the target is accepted.
+// As with SOCKS the proxy dials on the first data, so an unreachable target
+// shows up as a closed tunnel rather than an error status.
+func (p *HTTPProxy) connect(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	dst, err := parseIngressAddr(r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		p.accessLog(r, http.StatusBadRequest, 0, 0, start)
+		return
+	}
+	if err := p.filter.check(dst, netfilter.ProtocolTCP); err != nil {
+		status := httpProxyStatus(err)
+		http.Error(w, err.Error(), status)
+		p.accessLog(r, status, 0, 0, start)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be hijacked", http.StatusInternalServerError)
+		p.accessLog(r, http.StatusInternalServerError, 0, 0, start)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		p.logger.Error("failed to hijack connection", logger.Error(err))
+		return
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		conn.Close()
+		return
+	}
+
+	// Clients may send the first bytes of the tunnel along with the
+	// request, so reads start with what the server already buffered.
+	tunnel := &httpTunnelConn{Conn: conn, r: brw.Reader}
+	src := ingressAddrFrom(conn.RemoteAddr())
+	tuple := &proto.ConnectionTuple{
+		SrcIp:   src.Addr.String(),
+		SrcPort: uint32(src.Port),
+		DstHost: dst.Host,
+		DstPort: uint32(dst.Port),
+	}
+	if dst.Addr.IsValid() {
+		tuple.DstIp = dst.Addr.String()
+	}
+
+	p.handler.forward(tunnel, ingressConnID("http", "tcp", src, dst), dst.String(), tuple)
+	conn.Close()
+
+	p.accessLog(r, http.StatusOK, tunnel.in.Load(), tunnel.out.Load(), start)
+}
+
+// dial opens a tunneled connection for the forwarder: one end of a pipe is
+// forwarded like an accepted connection, the other is handed to the
+// transport. Idle ones are reused for later requests to the same host.
+func (p *HTTPProxy) dial(ctx context.Context, _, addr string) (net.Conn, error) {
+	dst, err := parseIngressAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.filter.check(dst, netfilter.ProtocolTCP); err != nil {
+		return nil, err
+	}
+
+	src, _ := ctx.Value(httpSourceKey{}).(ingressAddr)
+	tuple := &proto.ConnectionTuple{
+		SrcIp:   src.Addr.String(),
+		SrcPort: uint32(src.Port),
+		DstHost: dst.Host,
+		DstPort: uint32(dst.Port),
+	}
+	if dst.Addr.IsValid() {
+		tuple.DstIp = dst.Addr.String()
+	}
+
+	// One client connection may need several upstream connections.
+	connID := fmt.Sprintf("%s-%d", ingressConnID("http", "tcp", src, dst), p.seq.Add(1))
+
+	local, remote := net.Pipe()
+	go func() {
+		conn := &httpPipeConn{Conn: local, src: net.TCPAddrFromAddrPort(netip.AddrPortFrom(src.Addr, src.Port))}
+		p.handler.forward(conn, connID, dst.String(), tuple)
+		local.Close()
+	}()
+	return remote, nil
+}
+
+func (p *HTTPProxy) forwardError(w http.ResponseWriter, r *http.Request, err error) {
+	p.logger.Debug("http proxy request failed",
+		logger.String("target", r.URL.String()),
+		logger.Error(err),
+	)
+	http.Error(w, err.Error(), httpProxyStatus(err))
+}
+
+func httpProxyStatus(err error) int {
+	if errors.Is(err, errDestNotAllowed) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+func (p *HTTPProxy) accessLog(r *http.Request, status int, in, out int64, start time.Time) {
+	if !p.config.AccessLog {
+		return
+	}
+	target := r.URL.String()
+	if r.Method == http.MethodConnect {
+		target = r.Host
+	}
+	p.logger.Info("http proxy request",
+		logger.String("client", r.RemoteAddr),
+		logger.String("method", r.Method),
+		logger.String("target", target),
+		logger.Int("status", status),
+		logger.Int64("bytes_in", in),
+		logger.Int64("bytes_out", out),
+		logger.Duration("duration", time.Since(start)),
+	)
+}
+
+// Close stops the proxy, which stops Serve. Established tunnels are left
+// to the tracker.
+func (p *HTTPProxy) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var err error
+	switch {
+	case p.server != nil:
+		err = p.server.Close()
+		p.server = nil
+	case p.listener != nil:
+		err = p.listener.Close()
+	}
+	p.listener = nil
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	return err
+}
+
+// httpTunnelConn counts the bytes of a CONNECT tunnel: in from the client,
+// out to it.
+type httpTunnelConn struct {
+	net.Conn
+	r   io.Reader
+	in  atomic.Int64
+	out atomic.Int64
+}
+
+func (c *httpTunnelConn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.in.Add(int64(n))
+	return n, err
+}
+
+func (c *httpTunnelConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.Add(int64(n))
+	return n, err
+}
+
+// httpPipeConn reports the requesting client as the pipe's remote end.
+type httpPipeConn struct {
+	net.Conn
+	src net.Addr
+}
+
+func (c *httpPipeConn) RemoteAddr() net.Addr { return c.src }
+
+type httpProxyRecorder struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (r *httpProxyRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *httpProxyRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// Flush lets streamed responses through as they arrive.
+func (r *httpProxyRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// countingReader counts a request body, which the transport may still be
+// reading when the response is done.
+type countingReader struct {
+	io.Reader
+	n atomic.Int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+func (r *countingReader) Close() error {
+	if c, ok := r.Reader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	testutil "network-tunneler/internal/testing"
+	pb "network-tunneler/proto"
+)
+
+func newTestHTTPProxy(t *testing.T) (*HTTPProxy, *ConnectionTracker, chan *pb.Packet) {
+	t.Helper()
+
+	log := testutil.NewTestLogger()
+	tracker := NewConnectionTracker(TrackerParams{Logger: log})
+
+	p := NewHTTPProxy(HTTPProxyParams{
+		Config: &Config{
+			TargetCIDR: "10.0.0.0/8",
+			Exclude:    []Target{{CIDR: "10.0.5.0/24"}},
+			HTTPProxy:  HTTPProxyConfig{Enabled: true, ListenAddr: "127.0.0.1:0", AccessLog: true},
+		},
+		Tracker: tracker,
+		Logger:  log,
+	})
+	if err := p.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	if err := p.SyncRoutes([]string{"10.0.0.0/16"}); err != nil {
+		t.Fatalf("SyncRoutes failed: %v", err)
+	}
+
+	serverChan := make(chan *pb.Packet, 10)
+	go p.Serve(serverChan)
+
+	return p, tracker, serverChan
+}
+
+func TestHTTPProxy_Connect(t *testing.T) {
+	p, _, serverChan := newTestHTTPProxy(t)
+
+	connect := func(t *testing.T, target, early string) (net.Conn, int) {
+		conn, err := net.Dial("tcp", p.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial proxy: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+		io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"+early)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		return conn, resp.StatusCode
+	}
+
+	// Bytes sent along with the request belong to the tunnel.
+	if _, status := connect(t, "db.corp.internal:5432", "hello"); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	select {
+	case pkt := <-serverChan:
+		if string(pkt.Data) != "hello" || pkt.Protocol != pb.Protocol_PROTOCOL_TCP {
+			t.Errorf("unexpected packet %q (%v)", pkt.Data, pkt.Protocol)
+		}
+		if pkt.ConnTuple.DstHost != "db.corp.internal" || pkt.ConnTuple.DstIp != "" || pkt.ConnTuple.DstPort != 5432 {
+			t.Errorf("expected hostname destination, got %+v", pkt.ConnTuple)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for packet")
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"no port", "10.0.1.1", http.StatusBadRequest},
+		{"outside targets", "192.168.1.1:443", http.StatusForbidden},
+		{"excluded", "10.0.5.1:443", http.StatusForbidden},
+		{"not routed", "10.1.0.1:443", http.StatusBadGateway},
+		{"routed", "10.0.1.1:443", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, status := connect(t, tt.target, ""); status != tt.want {
+				t.Errorf("expected status %d, got %d", tt.want, status)
+			}
+		})
+	}
+}
+
+func TestHTTPProxy_Forward(t *testing.T) {
+	p, tracker, serverChan := newTestHTTPProxy(t)
+
+	proxyURL, _ := url.Parse("http://" + p.listener.Addr().String())
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   2 * time.Second,
+	}
+
+	// Stand in for the proxy side: answer the request sent through the
+	// tunnel.
+	go func() {
+		select {
+		case pkt := <-serverChan:
+			if !strings.HasPrefix(string(pkt.Data), "GET /status HTTP/1.1\r\n") {
+				t.Errorf("unexpected request %q", pkt.Data)
+			}
+			if pkt.ConnTuple.DstIp != "10.0.1.1" || pkt.ConnTuple.DstPort != 8080 {
+				t.Errorf("expected destination 10.0.1.1:8080, got %+v", pkt.ConnTuple)
+			}
+			tracker.DeliverResponse(pkt.ConnectionId, []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+		case <-time.After(2 * time.Second):
+			t.Error("timeout waiting for request")
+		}
+	}()
+
+	resp, err := client.Get("http://10.0.1.1:8080/status")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("expected 200 ok, got %d %q", resp.StatusCode, body)
+	}
+
+	resp, err = client.Get("http://192.168.1.1/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 outside targets, got %d", resp.StatusCode)
+	}
+}
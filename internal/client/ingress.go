@@ -0,0 +1,163 @@
+package client
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+
+	"network-tunneler/pkg/logger"
+	"network-tunneler/pkg/netfilter"
+	"network-tunneler/pkg/network"
+)
+
+// Listener ingresses (SOCKS, HTTP proxy) receive destinations from
+// applications instead of from netfilter, so they share the address type
+// and the target checks here.
+
+var (
+	errDestNotAllowed = errors.New("destination not allowed")
+	errDestNotRouted  = errors.New("destination not routed")
+)
+
+// ingressAddr is a requested destination: an address, or a hostname left
+// for the proxy to resolve.
+type ingressAddr struct {
+	Addr netip.Addr
+	Host string
+	Port uint16
+}
+
+func (a ingressAddr) String() string {
+	host := a.Host
+	if a.Addr.IsValid() {
+		host = a.Addr.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(a.Port)))
+}
+
+func ingressAddrFrom(addr net.Addr) ingressAddr {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return ingressAddr{}
+	}
+	return ingressAddr{Addr: ap.Addr().Unmap(), Port: ap.Port()}
+}
+
+// ingressConnID names a flow from a listener ingress. Destinations may be
+// hostnames, which GenerateConnectionID cannot hash.
+func ingressConnID(ingress, kind string, src, dst ingressAddr) string {
+	sum := sha256.Sum256([]byte(kind + " " + src.String() + " " + dst.String()))
+	return fmt.Sprintf("%s-%s-%x", ingress, kind, sum[:16])
+}
+
+// destinationFilter applies the configured targets and excludes and the
+// routes pushed by the server to requested destinations.
+type destinationFilter struct {
+	includes []trafficMatch
+	excludes []trafficMatch
+	routes   []netip.Prefix
+	mu       sync.Mutex
+}
+
+func newDestinationFilter(cfg *Config) (*destinationFilter, error) {
+	includes, err := parseIncludes(cfg.interceptTargets())
+	if err != nil {
+		return nil, err
+	}
+	excludes, err := parseExcludes(cfg.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	return &destinationFilter{includes: includes, excludes: excludes}, nil
+}
+
+// setRoutes replaces the routed prefixes, skipping invalid ones, and
+// returns how many were kept.
+func (f *destinationFilter) setRoutes(prefixes []string, log logger.Logger) int {
+	routes := make([]netip.Prefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			log.Warn("ignoring invalid route from server", logger.String("prefix", p))
+			continue
+		}
+		routes = append(routes, prefix)
+	}
+
+	f.mu.Lock()
+	f.routes = routes
+	f.mu.Unlock()
+
+	return len(routes)
+}
+
+func (f *destinationFilter) prefixes() []netip.Prefix {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	routes := append([]netip.Prefix(nil), f.routes...)
+	network.SortPrefixes(routes)
+	return routes
+}
+
+// check reports whether an address is excluded, outside every target or
+// not routed by the server. Hostnames always pass; the server routes them.
+func (f *destinationFilter) check(dst ingressAddr, proto netfilter.Protocol) error {
+	if !dst.Addr.IsValid() {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, m := range f.excludes {
+		if m.matches(dst.Addr, proto, dst.Port) {
+			return errDestNotAllowed
+		}
+	}
+
+	included := false
+	for _, m := range f.includes {
+		if m.matches(dst.Addr, proto, dst.Port) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return errDestNotAllowed
+	}
+
+	for _, p := range f.routes {
+		if p.Contains(dst.Addr) {
+			return nil
+		}
+	}
+	return errDestNotRouted
+}
+
+// parseIngressAddr parses a host:port destination as given by an
+// application.
+func parseIngressAddr(hostport string) (ingressAddr, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return ingressAddr{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return ingressAddr{}, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	a := ingressAddr{Port: uint16(port)}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		a.Addr = addr.Unmap()
+	} else if host == "" {
+		return ingressAddr{}, fmt.Errorf("empty host in %q", hostport)
+	} else {
+		a.Host = host
+	}
+	return a, nil
+}
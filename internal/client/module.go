@@ -7,6 +7,7 @@ import (
 	"go.uber.org/fx"
 
 	"network-tunneler/internal/certs"
+	"network-tunneler/internal/health"
 	"network-tunneler/pkg/crypto"
 	"network-tunneler/pkg/logger"
 )
@@ -15,8 +16,14 @@ var Module = fx.Module("client",
 	fx.Provide(
 		ProvideConfig,
 
+		health.NewChecker,
 		NewConnectionTracker,
 		NewNetfilterManager,
+		NewTUNManager,
+		NewSOCKSServer,
+		NewHTTPProxy,
+		NewPortForwarder,
+		NewDNSForwarder,
 		NewServerConnection,
 
 		New,
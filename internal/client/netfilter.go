@@ -1,20 +1,65 @@
 package client
 
 import (
+	"errors"
 	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
 
 	"go.uber.org/fx"
 
 	"network-tunneler/pkg/logger"
 	"network-tunneler/pkg/netfilter"
+	"network-tunneler/pkg/network"
 )
 
+// NetfilterManager intercepts the prefixes the server currently routes,
+// clipped to the configured targets: TCP with a nat REDIRECT rule, UDP by
+// marking it in mangle OUTPUT so policy routing loops it back to a TPROXY
+// rule in PREROUTING. Excludes are RETURN rules inserted at the top of each
+// chain, while intercepting rules are appended, so an exclude always wins.
+// In gateway mode forwarded traffic from the selected sources is
+// intercepted the same way in PREROUTING. Process matches only narrow the
+// OUTPUT rules, since forwarded packets have no local owner.
 type NetfilterManager struct {
-	manager    *netfilter.Manager
-	targetCIDR string
-	localPort  string
-	logger     logger.Logger
-	active     bool
+	manager   netfilter.Manager
+	config    *Config
+	udp       UDPConfig
+	localPort string
+	logger    logger.Logger
+	active    bool
+
+	includes []trafficMatch
+	excludes []trafficMatch
+	policy   *netfilter.PolicyRoute
+	policy6  *netfilter.PolicyRoute
+	gateway  []gatewaySelector
+	sysctls  []sysctlChange
+	routes   map[string]routeRule
+	mu       sync.Mutex
+
+	// exclusions are the rules installed for excludes at setup.
+	exclusions []*netfilter.Rule
+
+	// hook replaces the rules with the ebpf backend; hookRules are the port
+	// rules it holds per prefix.
+	hook      *network.ConnectHook
+	hookRules map[netip.Prefix][]network.PortRule
+}
+
+// netfilterOwner is what the client owns on the host: an nftables table or
+// the NETWORK-TUNNELER chains, and the comment tag of its rules, which
+// earlier versions placed in the built-in chains.
+var netfilterOwner = netfilter.Owner{
+	Table: "network_tunneler_client",
+	Chain: "NETWORK-TUNNELER",
+	Tag:   "network-tunneler",
+}
+
+type routeRule struct {
+	match trafficMatch
+	rules []*netfilter.Rule
 }
 
 type NetfilterParams struct {
@@ -26,50 +71,519 @@ type NetfilterParams struct {
 
 func NewNetfilterManager(p NetfilterParams) *NetfilterManager {
 	return &NetfilterManager{
-		manager:    netfilter.NewManager(),
-		targetCIDR: p.Config.TargetCIDR,
-		localPort:  fmt.Sprintf("%d", p.Config.ListenPort),
-		logger:     p.Logger.With(logger.String("component", "netfilter")),
-		active:     false,
+		config:    p.Config,
+		udp:       p.Config.UDP.withDefaults(),
+		localPort: fmt.Sprintf("%d", p.Config.ListenPort),
+		logger:    p.Logger.With(logger.String("component", "netfilter")),
+		active:    false,
+		routes:    make(map[string]routeRule),
 	}
 }
 
 func (nf *NetfilterManager) Setup() error {
+	nf.mu.Lock()
+	defer nf.mu.Unlock()
+
 	if nf.active {
 		nf.logger.Warn("netfilter rules already active")
 		return nil
 	}
 
-	nf.logger.Info("setting up netfilter rules",
-		logger.String("target_cidr", nf.targetCIDR),
+	includes, err := parseIncludes(nf.config.interceptTargets())
+	if err != nil {
+		return err
+	}
+
+	if nf.config.NetfilterBackend == BackendEBPF {
+		return nf.setupHook(includes)
+	}
+
+	backend, err := netfilter.ParseBackend(nf.config.NetfilterBackend)
+	if err != nil {
+		return err
+	}
+	manager, err := netfilter.NewManager(backend, netfilterOwner)
+	if err != nil {
+		return fmt.Errorf("failed to select netfilter backend: %w", err)
+	}
+	nf.manager = manager
+
+	// A client that was killed leaves its rules behind, redirecting to a
+	// port nobody listens on.
+	stale, err := manager.Reset()
+	if err != nil {
+		return fmt.Errorf("failed to remove stale netfilter rules: %w", err)
+	}
+	if stale {
+		nf.logger.Warn("removed netfilter rules left behind by an earlier run")
+	}
+
+	excludes, err := nf.interceptExcludes(includes)
+	if err != nil {
+		return err
+	}
+
+	udp4 := interceptsUDP(byFamily(includes, false))
+	udp6 := interceptsUDP(byFamily(includes, true))
+
+	gateway, err := nf.config.Gateway.selectors()
+	if err != nil {
+		return err
+	}
+	nf.gateway = gateway
+	if len(gateway) > 0 {
+		ipv4, ipv6 := len(byFamily(includes, false)) > 0, len(byFamily(includes, true)) > 0
+		changes, err := gatewaySysctls(nf.config.Gateway, ipv4, ipv6, nf.logger)
+		nf.sysctls = changes
+		if err != nil {
+			nf.restoreSysctls()
+			return fmt.Errorf("failed to prepare gateway mode: %w", err)
+		}
+	}
+
+	for _, m := range excludes {
+		udp := udp4
+		if m.Prefix.Addr().Is6() {
+			udp = udp6
+		}
+		rules, err := nf.excludeRules(m, udp)
+		for _, rule := range rules {
+			if err != nil {
+				break
+			}
+			err = nf.manager.Insert(rule)
+		}
+		if err != nil {
+			nf.manager.Remove()
+			nf.restoreSysctls()
+			nf.exclusions = nil
+			return fmt.Errorf("failed to exclude %s: %w", m, err)
+		}
+		nf.exclusions = append(nf.exclusions, rules...)
+	}
+
+	for _, ipv6 := range []bool{false, true} {
+		if (ipv6 && !udp6) || (!ipv6 && !udp4) {
+			continue
+		}
+		policy := &netfilter.PolicyRoute{Mark: nf.udp.FwMark, Table: nf.udp.RouteTable, IPv6: ipv6}
+		if err := policy.Add(); err != nil {
+			nf.manager.Remove()
+			nf.exclusions = nil
+			nf.deletePolicies()
+			nf.restoreSysctls()
+			return fmt.Errorf("failed to set up UDP policy routing: %w", err)
+		}
+		if ipv6 {
+			nf.policy6 = policy
+		} else {
+			nf.policy = policy
+		}
+	}
+
+	nf.includes = includes
+	nf.excludes = excludes
+
+	nf.logger.Info("netfilter ready, waiting for routes from server",
+		logger.Int("targets", len(includes)),
+		logger.Int("excludes", len(excludes)),
 		logger.String("local_port", nf.localPort),
+		logger.String("backend", string(manager.Backend())),
+		logger.Int("gateway_selectors", len(gateway)),
+		logger.Int("process_matches", len(nf.config.Processes)),
+		logger.Bool("udp", udp4),
+		logger.Bool("udp6", udp6),
 	)
 
-	rule := netfilter.NewRule().
-		Table(netfilter.TableNat).
-		Chain(netfilter.ChainOutput).
-		Protocol(netfilter.ProtocolTCP).
-		Destination(nf.targetCIDR).
-		Target(netfilter.TargetRedirect).
-		ToPort(nf.localPort).
-		Comment("network-tunneler TCP redirect").
-		MustBuild()
+	nf.active = true
+	return nil
+}
 
-	if err := nf.manager.AddRule(rule); err != nil {
-		return fmt.Errorf("failed to add redirect rule: %w", err)
+// interceptExcludes returns the configured excludes plus the server's
+// address, for the families that have targets.
+func (nf *NetfilterManager) interceptExcludes(includes []trafficMatch) ([]trafficMatch, error) {
+	excludes, err := parseExcludes(nf.config.Exclude)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := nf.manager.Apply(); err != nil {
-		return fmt.Errorf("failed to apply netfilter rules: %w", err)
+	server, err := serverExcludes(nf.config.ServerAddr, includes)
+	if err != nil {
+		nf.logger.Warn("server address not excluded from interception", logger.Error(err))
 	}
+	for _, m := range server {
+		nf.logger.Info("excluding server address", logger.String("prefix", m.Prefix.String()))
+	}
+	excludes = append(excludes, server...)
 
-	nf.active = true
-	nf.logger.Info("netfilter rules applied successfully")
+	// Excludes only matter, and ip6tables is only needed, for a family
+	// that has targets.
+	var applied []trafficMatch
+	for _, ipv6 := range []bool{false, true} {
+		if len(byFamily(includes, ipv6)) > 0 {
+			applied = append(applied, byFamily(excludes, ipv6)...)
+		}
+	}
+	return applied, nil
+}
+
+// SyncRoutes reconciles the intercepting rules with the prefixes pushed by the
+// server, restricted to the configured targets. Rules that fail to apply
+// are retried on the next sync.
+func (nf *NetfilterManager) SyncRoutes(prefixes []string) error {
+	nf.mu.Lock()
+	defer nf.mu.Unlock()
+
+	if !nf.active {
+		return fmt.Errorf("netfilter not set up")
+	}
+
+	desired := make(map[string]trafficMatch)
+	for _, s := range prefixes {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			nf.logger.Warn("ignoring invalid route from server", logger.String("prefix", s))
+			continue
+		}
+		for _, inc := range nf.includes {
+			inter, ok := network.IntersectPrefix(p, inc.Prefix)
+			if !ok {
+				continue
+			}
+			m := trafficMatch{Prefix: inter, Protocol: inc.Protocol, Ports: inc.Ports}
+			desired[m.key()] = m
+		}
+	}
+
+	if nf.hook != nil {
+		return nf.syncHook(desired)
+	}
+
+	var errs []error
+
+	for key, route := range nf.routes {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+		if err := nf.deleteRules(route.rules); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(nf.routes, key)
+		nf.logger.Info("stopped intercepting prefix", logger.String("match", route.match.String()))
+	}
+
+	for key, m := range desired {
+		if _, exists := nf.routes[key]; exists {
+			continue
+		}
+		rules, err := nf.interceptRules(m)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := nf.appendRules(rules); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		nf.routes[key] = routeRule{match: m, rules: rules}
+		nf.logger.Info("intercepting prefix", logger.String("match", m.String()))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to sync %d route rule(s): %w", len(errs), errs[0])
+	}
+	return nil
+}
+
+// interceptRules builds the rules for one match: a REDIRECT for TCP and,
+// for UDP, a MARK plus the TPROXY rule that picks the marked datagram up
+// once it has been looped back.
+func (nf *NetfilterManager) interceptRules(m trafficMatch) ([]*netfilter.Rule, error) {
+	var rules []*netfilter.Rule
+
+	// Local traffic is picked in OUTPUT, once per process match if any.
+	processes := nf.config.Processes
+	if len(processes) == 0 {
+		processes = []ProcessMatch{{}}
+	}
+
+	if m.covers(netfilter.ProtocolTCP) {
+		for _, p := range processes {
+			rule, err := p.apply(netfilter.NewRule().
+				Table(netfilter.TableNat).
+				Chain(netfilter.ChainOutput).
+				Protocol(netfilter.ProtocolTCP).
+				Destination(m.Prefix.String()).
+				DstPort(m.Ports)).
+				Target(netfilter.TargetRedirect).
+				ToPort(nf.localPort).
+				Comment("network-tunneler TCP redirect").
+				Build()
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	if m.covers(netfilter.ProtocolUDP) {
+		mark := fmt.Sprintf("%#x", nf.udp.FwMark)
+		onIP := "127.0.0.1"
+		if m.Prefix.Addr().Is6() {
+			onIP = "::1"
+		}
+
+		for _, p := range processes {
+			markRule, err := p.apply(netfilter.NewRule().
+				Table(netfilter.TableMangle).
+				Chain(netfilter.ChainOutput).
+				Protocol(netfilter.ProtocolUDP).
+				Destination(m.Prefix.String()).
+				DstPort(m.Ports)).
+				Target(netfilter.TargetMark).
+				Mark(mark).
+				Comment("network-tunneler UDP mark").
+				Build()
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, markRule)
+		}
+
+		tproxyRule, err := netfilter.NewRule().
+			Table(netfilter.TableMangle).
+			Chain(netfilter.ChainPrerouting).
+			Protocol(netfilter.ProtocolUDP).
+			Destination(m.Prefix.String()).
+			DstPort(m.Ports).
+			MatchMark(mark).
+			Target(netfilter.TargetTProxy).
+			ToPort(nf.localPort).
+			OnIP(onIP).
+			Mark(mark).
+			Comment("network-tunneler UDP tproxy").
+			Build()
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, tproxyRule)
+	}
+
+	for _, sel := range nf.gateway {
+		if !sel.matches(m.Prefix) {
+			continue
+		}
+		gwRules, err := nf.gatewayRules(m, sel)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, gwRules...)
+	}
+
+	return rules, nil
+}
+
+// gatewayRules intercept forwarded traffic picked up by a selector in
+// PREROUTING: a REDIRECT for TCP and a TPROXY for UDP, which needs no
+// loopback since the datagram is already on its way in.
+func (nf *NetfilterManager) gatewayRules(m trafficMatch, sel gatewaySelector) ([]*netfilter.Rule, error) {
+	var rules []*netfilter.Rule
 
+	selected := func(b *netfilter.RuleBuilder) *netfilter.RuleBuilder {
+		if sel.iface != "" {
+			return b.InInterface(sel.iface)
+		}
+		return b.Source(sel.source.String())
+	}
+
+	if m.covers(netfilter.ProtocolTCP) {
+		rule, err := selected(netfilter.NewRule().
+			Table(netfilter.TableNat).
+			Chain(netfilter.ChainPrerouting).
+			Protocol(netfilter.ProtocolTCP)).
+			Destination(m.Prefix.String()).
+			DstPort(m.Ports).
+			Target(netfilter.TargetRedirect).
+			ToPort(nf.localPort).
+			Comment("network-tunneler gateway TCP redirect").
+			Build()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	if m.covers(netfilter.ProtocolUDP) {
+		mark := fmt.Sprintf("%#x", nf.udp.FwMark)
+		onIP := "127.0.0.1"
+		if m.Prefix.Addr().Is6() {
+			onIP = "::1"
+		}
+
+		rule, err := selected(netfilter.NewRule().
+			Table(netfilter.TableMangle).
+			Chain(netfilter.ChainPrerouting).
+			Protocol(netfilter.ProtocolUDP)).
+			Destination(m.Prefix.String()).
+			DstPort(m.Ports).
+			Target(netfilter.TargetTProxy).
+			ToPort(nf.localPort).
+			OnIP(onIP).
+			Mark(mark).
+			Comment("network-tunneler gateway UDP tproxy").
+			Build()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// excludeRules builds RETURN rules for every chain an intercepted protocol
+// passes through. Ports need an explicit protocol, so a port exclude
+// without one is split per protocol.
+func (nf *NetfilterManager) excludeRules(m trafficMatch, udp bool) ([]*netfilter.Rule, error) {
+	var rules []*netfilter.Rule
+
+	chains := []netfilter.Chain{netfilter.ChainOutput}
+	if len(nf.gateway) > 0 {
+		chains = append(chains, netfilter.ChainPrerouting)
+	}
+
+	addChain := func(table netfilter.Table, chain netfilter.Chain, proto netfilter.Protocol) error {
+		rule, err := netfilter.NewRule().
+			Table(table).
+			Chain(chain).
+			Protocol(proto).
+			Destination(m.Prefix.String()).
+			DstPort(m.Ports).
+			Target(netfilter.TargetReturn).
+			Comment("network-tunneler exclude").
+			Build()
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+		return nil
+	}
+
+	add := func(table netfilter.Table, proto netfilter.Protocol) error {
+		for _, chain := range chains {
+			if err := addChain(table, chain, proto); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if m.covers(netfilter.ProtocolTCP) {
+		proto := m.Protocol
+		if m.Ports != "" {
+			proto = netfilter.ProtocolTCP
+		}
+		if err := add(netfilter.TableNat, proto); err != nil {
+			return nil, err
+		}
+	}
+	if udp && m.covers(netfilter.ProtocolUDP) {
+		proto := m.Protocol
+		if m.Ports != "" {
+			proto = netfilter.ProtocolUDP
+		}
+		if err := add(netfilter.TableMangle, proto); err != nil {
+			return nil, err
+		}
+	}
+
+	return rules, nil
+}
+
+// appendRules applies rules in order and rolls them back if one fails.
+func (nf *NetfilterManager) appendRules(rules []*netfilter.Rule) error {
+	for i, rule := range rules {
+		if err := nf.manager.Append(rule); err != nil {
+			nf.deleteRules(rules[:i])
+			return err
+		}
+	}
 	return nil
 }
 
+func (nf *NetfilterManager) deleteRules(rules []*netfilter.Rule) error {
+	var firstErr error
+	for _, rule := range rules {
+		if err := nf.manager.Delete(rule); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// InterceptsUDP reports whether the active targets of a family divert UDP,
+// which needs a transparent UDP listener of that family.
+func (nf *NetfilterManager) InterceptsUDP(ipv6 bool) bool {
+	nf.mu.Lock()
+	defer nf.mu.Unlock()
+
+	if ipv6 {
+		return nf.policy6 != nil
+	}
+	return nf.policy != nil
+}
+
+// Routes returns the prefixes currently intercepted.
+func (nf *NetfilterManager) Routes() []netip.Prefix {
+	nf.mu.Lock()
+	defer nf.mu.Unlock()
+
+	seen := make(map[netip.Prefix]bool, len(nf.routes))
+	routes := make([]netip.Prefix, 0, len(nf.routes))
+	for _, r := range nf.routes {
+		if !seen[r.match.Prefix] {
+			seen[r.match.Prefix] = true
+			routes = append(routes, r.match.Prefix)
+		}
+	}
+	network.SortPrefixes(routes)
+	return routes
+}
+
+// Rules describes every installed rule: excludes first, then the rules of
+// each intercepted match.
+func (nf *NetfilterManager) Rules() []string {
+	nf.mu.Lock()
+	defer nf.mu.Unlock()
+
+	if nf.hook != nil {
+		return nf.describeHook()
+	}
+
+	var rules []string
+	for _, rule := range nf.exclusions {
+		rules = append(rules, rule.String())
+	}
+
+	keys := make([]string, 0, len(nf.routes))
+	for key := range nf.routes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, rule := range nf.routes[key].rules {
+			rules = append(rules, rule.String())
+		}
+	}
+	return rules
+}
+
 func (nf *NetfilterManager) Cleanup() error {
+	nf.mu.Lock()
+	defer nf.mu.Unlock()
+
 	if !nf.active {
 		nf.logger.Debug("netfilter rules not active, nothing to clean up")
 		return nil
@@ -77,16 +591,91 @@ func (nf *NetfilterManager) Cleanup() error {
 
 	nf.logger.Info("cleaning up netfilter rules")
 
+	if nf.hook != nil {
+		return nf.closeHook()
+	}
+
 	if err := nf.manager.Remove(); err != nil {
 		return fmt.Errorf("failed to remove netfilter rules: %w", err)
 	}
 
+	if err := nf.deletePolicies(); err != nil {
+		return err
+	}
+
+	if err := nf.restoreSysctls(); err != nil {
+		return fmt.Errorf("failed to restore sysctls: %w", err)
+	}
+
+	nf.routes = make(map[string]routeRule)
+	nf.exclusions = nil
 	nf.active = false
 	nf.logger.Info("netfilter rules removed successfully")
 
 	return nil
 }
 
+// CleanupNetfilter removes whatever a client left on the host with either
+// backend: its rules, its chains and its UDP policy routes. It must not run
+// while a client is running, since that client's rules go as well.
+// Sysctls changed for gateway mode cannot be told apart and are kept.
+func CleanupNetfilter(cfg *Config, log logger.Logger) error {
+	var errs []error
+
+	for _, backend := range []netfilter.Backend{netfilter.BackendIPTables, netfilter.BackendNFTables} {
+		manager, err := netfilter.NewManager(backend, netfilterOwner)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		stale, err := manager.Reset()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", backend, err))
+			continue
+		}
+		if stale {
+			log.Info("removed netfilter rules", logger.String("backend", string(backend)))
+		}
+	}
+
+	udp := cfg.UDP.withDefaults()
+	for _, ipv6 := range []bool{false, true} {
+		policy := netfilter.PolicyRoute{Mark: udp.FwMark, Table: udp.RouteTable, IPv6: ipv6}
+		if err := policy.Delete(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (nf *NetfilterManager) deletePolicies() error {
+	if nf.policy != nil {
+		if err := nf.policy.Delete(); err != nil {
+			return err
+		}
+		nf.policy = nil
+	}
+	if nf.policy6 != nil {
+		if err := nf.policy6.Delete(); err != nil {
+			return err
+		}
+		nf.policy6 = nil
+	}
+	return nil
+}
+
+func (nf *NetfilterManager) restoreSysctls() error {
+	if err := restoreSysctls(nf.sysctls); err != nil {
+		return err
+	}
+	nf.sysctls = nil
+	return nil
+}
+
 func (nf *NetfilterManager) IsActive() bool {
+	nf.mu.Lock()
+	defer nf.mu.Unlock()
+
 	return nf.active
 }
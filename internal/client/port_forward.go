@@ -0,0 +1,349 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/fx"
+
+	"network-tunneler/pkg/logger"
+	pkgnet "network-tunneler/pkg/network"
+	"network-tunneler/proto"
+)
+
+// ForwardConfig maps a local listen address to a fixed remote destination,
+// like ssh -L.
+type ForwardConfig struct {
+	// Protocol is "tcp" (the default) or "udp".
+	Protocol   string `mapstructure:"protocol" json:"protocol" yaml:"protocol"`
+	ListenAddr string `mapstructure:"listen_addr" json:"listen_addr" yaml:"listen_addr"`
+	Remote     string `mapstructure:"remote" json:"remote" yaml:"remote"`
+}
+
+func (f ForwardConfig) network() string {
+	if f.Protocol == "" {
+		return "tcp"
+	}
+	return strings.ToLower(f.Protocol)
+}
+
+func (f ForwardConfig) String() string {
+	return fmt.Sprintf("%s/%s->%s", f.network(), f.ListenAddr, f.Remote)
+}
+
+func (f ForwardConfig) Validate() error {
+	if n := f.network(); n != "tcp" && n != "udp" {
+		return fmt.Errorf("forward %s: protocol must be tcp or udp", f)
+	}
+	if _, _, err := net.SplitHostPort(f.ListenAddr); err != nil {
+		return fmt.Errorf("forward %s: invalid listen address: %w", f, err)
+	}
+	remote, err := netip.ParseAddrPort(f.Remote)
+	if err != nil {
+		return fmt.Errorf("forward %s: remote must be an IP address and port: %w", f, err)
+	}
+	if remote.Port() == 0 {
+		return fmt.Errorf("forward %s: remote port is required", f)
+	}
+	return nil
+}
+
+// PortForwarder tunnels connections and datagrams accepted on the
+// configured local addresses to their fixed remotes. Like the HTTP proxy it
+// needs no privileges and runs next to any mode.
+type PortForwarder struct {
+	forwards    []ForwardConfig
+	idleTimeout time.Duration
+	tracker     *ConnectionTracker
+	logger      logger.Logger
+
+	tcp []tcpForward
+	udp []*udpForward
+	mu  sync.Mutex
+}
+
+type tcpForward struct {
+	listener net.Listener
+	remote   string
+}
+
+type PortForwarderParams struct {
+	fx.In
+
+	Config  *Config
+	Tracker *ConnectionTracker
+	Logger  logger.Logger
+}
+
+func NewPortForwarder(p PortForwarderParams) *PortForwarder {
+	return &PortForwarder{
+		forwards:    p.Config.Forwards,
+		idleTimeout: p.Config.UDP.withDefaults().IdleTimeout,
+		tracker:     p.Tracker,
+		logger:      p.Logger.With(logger.String("component", "forward")),
+	}
+}
+
+// Listen binds every forward, or none if one fails.
+func (f *PortForwarder) Listen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, fwd := range f.forwards {
+		var local net.Addr
+		if fwd.network() == "udp" {
+			addr, err := net.ResolveUDPAddr("udp", fwd.ListenAddr)
+			if err != nil {
+				f.closeLocked()
+				return fmt.Errorf("forward %s: %w", fwd, err)
+			}
+			conn, err := net.ListenUDP("udp", addr)
+			if err != nil {
+				f.closeLocked()
+				return fmt.Errorf("forward %s: %w", fwd, err)
+			}
+			f.udp = append(f.udp, &udpForward{
+				conn:        conn,
+				remote:      netip.MustParseAddrPort(fwd.Remote),
+				idleTimeout: f.idleTimeout,
+				tracker:     f.tracker,
+				logger:      f.logger,
+				sessions:    make(map[string]bool),
+			})
+			local = conn.LocalAddr()
+		} else {
+			listener, err := net.Listen("tcp", fwd.ListenAddr)
+			if err != nil {
+				f.closeLocked()
+				return fmt.Errorf("forward %s: %w", fwd, err)
+			}
+			f.tcp = append(f.tcp, tcpForward{listener: listener, remote: fwd.Remote})
+			local = listener.Addr()
+		}
+
+		f.logger.Info("forwarding local port",
+			logger.String("protocol", fwd.network()),
+			logger.String("listen_addr", local.String()),
+			logger.String("remote", fwd.Remote),
+		)
+	}
+	return nil
+}
+
+// Serve tunnels traffic from every forward until Close.
+func (f *PortForwarder) Serve(serverWriter chan<- *proto.Packet) {
+	f.mu.Lock()
+	tcp := f.tcp
+	udp := f.udp
+	f.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, fwd := range tcp {
+		handler := NewConnectionHandler(f.tracker, serverWriter, f.logger)
+		handler.getOriginalDest = FixedDest(fwd.remote)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.accept(fwd.listener, handler)
+		}()
+	}
+	for _, u := range udp {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u.serve(serverWriter)
+		}()
+	}
+	wg.Wait()
+}
+
+func (f *PortForwarder) accept(listener net.Listener, handler *ConnectionHandler) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				f.logger.Error("accept error", logger.Error(err))
+				continue
+			}
+			return
+		}
+
+		go handler.Handle(conn)
+	}
+}
+
+// Close stops every forward, which stops Serve. Established connections
+// are left to the tracker.
+func (f *PortForwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closeLocked()
+	return nil
+}
+
+func (f *PortForwarder) closeLocked() {
+	for _, fwd := range f.tcp {
+		fwd.listener.Close()
+	}
+	for _, u := range f.udp {
+		u.conn.Close()
+	}
+	f.tcp = nil
+	f.udp = nil
+}
+
+// udpForward relays one UDP forward. Each local source is a session to the
+// remote; replies are sent back from the forward's own socket.
+type udpForward struct {
+	conn         *net.UDPConn
+	remote       netip.AddrPort
+	serverWriter chan<- *proto.Packet
+	idleTimeout  time.Duration
+	tracker      *ConnectionTracker
+	logger       logger.Logger
+
+	sessions map[string]bool
+	mu       sync.Mutex
+}
+
+func (u *udpForward) serve(serverWriter chan<- *proto.Packet) {
+	u.serverWriter = serverWriter
+
+	done := make(chan struct{})
+	defer close(done)
+	go u.expire(done)
+	defer u.closeSessions()
+
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := u.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			u.logger.Warn("failed to read datagram", logger.Error(err))
+			continue
+		}
+
+		u.forward(netip.AddrPortFrom(from.Addr().Unmap(), from.Port()), buf[:n])
+	}
+}
+
+func (u *udpForward) forward(from netip.AddrPort, data []byte) {
+	src := net.UDPAddrFromAddrPort(from)
+	dst := net.UDPAddrFromAddrPort(u.remote)
+	connID := "udp-" + pkgnet.GenerateConnectionID(src.IP, uint16(src.Port), dst.IP, uint16(dst.Port))
+
+	u.mu.Lock()
+	isNew := !u.sessions[connID]
+	u.sessions[connID] = true
+	u.mu.Unlock()
+
+	// Tracked outside the lock: the tracker calls Close, which takes it.
+	if isNew {
+		u.tracker.Track(connID, u.remote.String(), &forwardDatagramConn{
+			UDPConn: u.conn,
+			fwd:     u,
+			connID:  connID,
+			client:  from,
+		})
+		u.logger.Info("new UDP session",
+			logger.String("connection_id", connID),
+			logger.String("source", from.String()),
+			logger.String("original_dest", u.remote.String()),
+		)
+	}
+	u.tracker.UpdateActivity(connID)
+
+	packet := &proto.Packet{
+		ConnectionId: connID,
+		Data:         append([]byte(nil), data...),
+		ConnTuple: &proto.ConnectionTuple{
+			SrcIp:   src.IP.String(),
+			SrcPort: uint32(src.Port),
+			DstIp:   dst.IP.String(),
+			DstPort: uint32(dst.Port),
+		},
+		Protocol:  proto.Protocol_PROTOCOL_UDP,
+		Direction: proto.Direction_DIRECTION_FORWARD,
+		Timestamp: time.Now().Unix(),
+	}
+
+	select {
+	case u.serverWriter <- packet:
+	default:
+		u.logger.Warn("server writer channel full, dropping datagram",
+			logger.String("connection_id", connID),
+		)
+	}
+}
+
+// expire ends sessions idle for longer than the idle timeout.
+func (u *udpForward) expire(done <-chan struct{}) {
+	ticker := time.NewTicker(u.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		for _, id := range u.sessionIDs() {
+			if idle, ok := u.tracker.IdleFor(id); !ok || idle >= u.idleTimeout {
+				u.logger.Debug("UDP session expired", logger.String("connection_id", id))
+				u.tracker.Remove(id)
+				u.endSession(id)
+			}
+		}
+	}
+}
+
+func (u *udpForward) sessionIDs() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	ids := make([]string, 0, len(u.sessions))
+	for id := range u.sessions {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (u *udpForward) endSession(connID string) {
+	u.mu.Lock()
+	delete(u.sessions, connID)
+	u.mu.Unlock()
+}
+
+func (u *udpForward) closeSessions() {
+	for _, id := range u.sessionIDs() {
+		u.tracker.Remove(id)
+	}
+}
+
+// forwardDatagramConn delivers replies for one session as datagrams to the
+// local source. Close only ends the session, the socket belongs to the
+// forward.
+type forwardDatagramConn struct {
+	*net.UDPConn
+	fwd    *udpForward
+	connID string
+	client netip.AddrPort
+}
+
+func (c *forwardDatagramConn) Write(b []byte) (int, error) {
+	return c.UDPConn.WriteToUDPAddrPort(b, c.client)
+}
+
+func (c *forwardDatagramConn) Close() error {
+	c.fwd.endSession(c.connID)
+	return nil
+}
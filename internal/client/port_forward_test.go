@@ -0,0 +1,91 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	testutil "network-tunneler/internal/testing"
+	pb "network-tunneler/proto"
+)
+
+func TestPortForwarder(t *testing.T) {
+	log := testutil.NewTestLogger()
+	tracker := NewConnectionTracker(TrackerParams{Logger: log})
+
+	f := NewPortForwarder(PortForwarderParams{
+		Config: &Config{
+			Forwards: []ForwardConfig{
+				{ListenAddr: "127.0.0.1:0", Remote: "10.20.0.7:5432"},
+				{Protocol: "udp", ListenAddr: "127.0.0.1:0", Remote: "10.20.0.53:53"},
+			},
+		},
+		Tracker: tracker,
+		Logger:  log,
+	})
+	if err := f.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	serverChan := make(chan *pb.Packet, 10)
+	go f.Serve(serverChan)
+
+	receive := func(t *testing.T) *pb.Packet {
+		t.Helper()
+		select {
+		case pkt := <-serverChan:
+			return pkt
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for packet")
+			return nil
+		}
+	}
+
+	t.Run("tcp", func(t *testing.T) {
+		conn, err := net.Dial("tcp", f.tcp[0].listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial forward: %v", err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+
+		pkt := receive(t)
+		if string(pkt.Data) != "hello" || pkt.Protocol != pb.Protocol_PROTOCOL_TCP {
+			t.Errorf("unexpected packet %q (%v)", pkt.Data, pkt.Protocol)
+		}
+		if pkt.ConnTuple.DstIp != "10.20.0.7" || pkt.ConnTuple.DstPort != 5432 {
+			t.Errorf("expected destination 10.20.0.7:5432, got %+v", pkt.ConnTuple)
+		}
+	})
+
+	t.Run("udp", func(t *testing.T) {
+		conn, err := net.Dial("udp", f.udp[0].conn.LocalAddr().String())
+		if err != nil {
+			t.Fatalf("failed to dial forward: %v", err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte("query"))
+
+		pkt := receive(t)
+		if string(pkt.Data) != "query" || pkt.Protocol != pb.Protocol_PROTOCOL_UDP {
+			t.Fatalf("unexpected packet %q (%v)", pkt.Data, pkt.Protocol)
+		}
+		if pkt.ConnTuple.DstIp != "10.20.0.53" || pkt.ConnTuple.DstPort != 53 {
+			t.Errorf("expected destination 10.20.0.53:53, got %+v", pkt.ConnTuple)
+		}
+
+		if err := tracker.DeliverResponse(pkt.ConnectionId, []byte("answer")); err != nil {
+			t.Fatalf("DeliverResponse failed: %v", err)
+		}
+		buf := make([]byte, 1500)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("failed to read reply: %v", err)
+		}
+		if string(buf[:n]) != "answer" {
+			t.Errorf("expected answer, got %q", buf[:n])
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"network-tunneler/pkg/netfilter"
+)
+
+// ProcessMatch selects local processes by the owner or cgroup of their
+// sockets. Every field set in one entry must match; entries are
+// alternatives.
+type ProcessMatch struct {
+	// User and Group are names, numeric IDs or ID ranges like "1000-1999".
+	User  string `mapstructure:"user" json:"user,omitempty" yaml:"user,omitempty"`
+	Group string `mapstructure:"group" json:"group,omitempty" yaml:"group,omitempty"`
+	// Cgroup is a cgroup v2 path such as "system.slice/app.service".
+	Cgroup string `mapstructure:"cgroup" json:"cgroup,omitempty" yaml:"cgroup,omitempty"`
+}
+
+func (p ProcessMatch) String() string {
+	var parts []string
+	if p.User != "" {
+		parts = append(parts, "user "+p.User)
+	}
+	if p.Group != "" {
+		parts = append(parts, "group "+p.Group)
+	}
+	if p.Cgroup != "" {
+		parts = append(parts, "cgroup "+p.cgroupPath())
+	}
+	return strings.Join(parts, " ")
+}
+
+// cgroupPath accepts paths as /proc/<pid>/cgroup shows them, with a
+// leading slash, and returns them relative to the hierarchy root.
+func (p ProcessMatch) cgroupPath() string {
+	return strings.Trim(p.Cgroup, "/")
+}
+
+func (p ProcessMatch) Validate() error {
+	if p.User == "" && p.Group == "" && p.Cgroup == "" {
+		return fmt.Errorf("process match needs a user, group or cgroup")
+	}
+	if p.User != "" {
+		if err := netfilter.ValidateOwner(p.User); err != nil {
+			return fmt.Errorf("process match user: %w", err)
+		}
+	}
+	if p.Group != "" {
+		if err := netfilter.ValidateOwner(p.Group); err != nil {
+			return fmt.Errorf("process match group: %w", err)
+		}
+	}
+	if p.Cgroup != "" {
+		if err := netfilter.ValidateCgroupPath(p.cgroupPath()); err != nil {
+			return fmt.Errorf("process match: %w", err)
+		}
+	}
+	return nil
+}
+
+// apply restricts a rule in OUTPUT to the matching processes.
+func (p ProcessMatch) apply(b *netfilter.RuleBuilder) *netfilter.RuleBuilder {
+	return b.UIDOwner(p.User).GIDOwner(p.Group).CgroupPath(p.cgroupPath())
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"math/big"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/fx"
@@ -15,6 +16,7 @@ import (
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 
+	"network-tunneler/internal/reconnect"
 	"network-tunneler/pkg/logger"
 	pb "network-tunneler/proto"
 )
@@ -27,15 +29,48 @@ type ServerConnection struct {
 	grpcInsecure bool
 	config       *Config
 	clientID     string
+	supervisor   *reconnect.Supervisor
 
-	grpcConn   *grpc.ClientConn
-	grpcClient pb.TunnelClientClient
-	stream     pb.TunnelClient_ConnectClient
+	session *session
+	mu      sync.Mutex
 
+	registered atomic.Bool
+	// rtt is the round trip of the last echoed heartbeat, in nanoseconds.
+	rtt atomic.Int64
+	// ipHandler receives whole IP packets in TUN mode.
+	ipHandler func([]byte) error
+	// packetChan outlives sessions so packets queue while reconnecting.
 	packetChan chan *pb.Packet
-	stopChan   chan struct{}
-	stopOnce   sync.Once
-	wg         sync.WaitGroup
+	// controls carries flow control signals apart from data, so raising one
+	// never waits behind a full packetChan.
+	controls *controlQueue
+
+	// routeUpdates holds at most the latest table; older ones are replaced.
+	routeUpdates chan []string
+	routeVersion uint64
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+	cancel   context.CancelFunc
+	runDone  chan struct{}
+	wg       sync.WaitGroup
+}
+
+// session is one gRPC stream to the server. done is closed by the read loop
+// once the stream fails, after err has been set. The write loop is the
+// stream's only sender, so it also half-closes it once closing is closed.
+type session struct {
+	conn       *grpc.ClientConn
+	stream     pb.TunnelClient_ConnectClient
+	done       chan struct{}
+	err        error
+	closing    chan struct{}
+	writerDone chan struct{}
+
+	// The heartbeat awaiting its echo from the server.
+	pingMu   sync.Mutex
+	pingTS   int64
+	pingSent time.Time
 }
 
 type ServerConnParams struct {
@@ -48,17 +83,57 @@ type ServerConnParams struct {
 }
 
 func NewServerConnection(p ServerConnParams) *ServerConnection {
-	return &ServerConnection{
-		serverAddr: p.Config.ServerAddr,
-		tlsConfig:  p.TLSConfig,
-		tracker:    p.Tracker,
-		config:     p.Config,
-		packetChan: make(chan *pb.Packet, 100),
-		logger:     p.Logger.With(logger.String("component", "server_conn")),
-		stopChan:   make(chan struct{}),
+	log := p.Logger.With(logger.String("component", "server_conn"))
+	sc := &ServerConnection{
+		serverAddr:   p.Config.ServerAddr,
+		tlsConfig:    p.TLSConfig,
+		tracker:      p.Tracker,
+		config:       p.Config,
+		supervisor:   reconnect.NewSupervisor(p.Config.Reconnect, log),
+		packetChan:   make(chan *pb.Packet, 100),
+		controls:     newControlQueue(),
+		routeUpdates: make(chan []string, 1),
+		logger:       log,
+		stopChan:     make(chan struct{}),
+	}
+	p.Tracker.OnControl(sc.sendControl)
+	return sc
+}
+
+// Start keeps a session to the server alive in the background, reconnecting
+// with backoff whenever it is lost.
+func (sc *ServerConnection) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	sc.cancel = cancel
+	sc.runDone = make(chan struct{})
+
+	go func() {
+		defer close(sc.runDone)
+		sc.supervisor.Run(ctx, sc.runSession)
+	}()
+}
+
+func (sc *ServerConnection) runSession(ctx context.Context, registered func()) error {
+	if err := sc.Connect(ctx); err != nil {
+		return err
+	}
+	registered()
+
+	sc.mu.Lock()
+	s := sc.session
+	sc.mu.Unlock()
+
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+	case <-sc.stopChan:
 	}
+
+	sc.closeSession()
+	return s.err
 }
 
+// Connect establishes a single session and starts its read and write loops.
 func (sc *ServerConnection) Connect(ctx context.Context) error {
 	sc.logger.Info("connecting to server via gRPC",
 		logger.String("server_addr", sc.serverAddr),
@@ -72,43 +147,60 @@ func (sc *ServerConnection) Connect(ctx context.Context) error {
 		creds = credentials.NewTLS(sc.tlsConfig)
 	}
 	opts = append(opts, grpc.WithTransportCredentials(creds))
+	opts = append(opts, reconnect.KeepaliveOption())
 
 	conn, err := grpc.NewClient(sc.serverAddr, opts...)
 	if err != nil {
 		return fmt.Errorf("failed to create gRPC client: %w", err)
 	}
 
-	sc.grpcConn = conn
-	sc.grpcClient = pb.NewTunnelClientClient(conn)
-
-	stream, err := sc.grpcClient.Connect(ctx)
+	stream, err := pb.NewTunnelClientClient(conn).Connect(ctx)
 	if err != nil {
-		sc.grpcConn.Close()
+		conn.Close()
 		return fmt.Errorf("failed to create stream: %w", err)
 	}
 
-	sc.stream = stream
 	sc.logger.Info("gRPC stream established")
 
-	if err := sc.register(); err != nil {
-		sc.Close()
+	if err := sc.register(stream); err != nil {
+		stream.CloseSend()
+		conn.Close()
 		return fmt.Errorf("failed to register with server: %w", err)
 	}
 
+	s := &session{
+		conn:       conn,
+		stream:     stream,
+		done:       make(chan struct{}),
+		closing:    make(chan struct{}),
+		writerDone: make(chan struct{}),
+	}
+
+	sc.mu.Lock()
+	sc.session = s
+	// A restarted server numbers its tables from scratch.
+	sc.routeVersion = 0
+	sc.mu.Unlock()
+	sc.rtt.Store(0)
+
 	sc.wg.Add(2)
-	go sc.readLoop()
-	go sc.writeLoop()
+	go sc.readLoop(s)
+	go sc.writeLoop(s)
 
 	return nil
 }
 
-func (sc *ServerConnection) register() error {
-	clientID := sc.config.ClientID
-	if clientID == "" {
-		clientID = fmt.Sprintf("client-%s", generateAlphanumericID(16))
-		sc.clientID = clientID
-	} else {
-		sc.clientID = clientID
+func (sc *ServerConnection) register(stream pb.TunnelClient_ConnectClient) error {
+	// Keep a generated ID across reconnects so the server can keep routing
+	// responses for connections that survive the outage.
+	if sc.clientID == "" {
+		id := sc.config.ClientID
+		if id == "" {
+			id = fmt.Sprintf("client-%s", generateAlphanumericID(16))
+		}
+		sc.mu.Lock()
+		sc.clientID = id
+		sc.mu.Unlock()
 	}
 
 	reg := &pb.ClientMessage{
@@ -119,13 +211,13 @@ func (sc *ServerConnection) register() error {
 		},
 	}
 
-	if err := sc.stream.Send(reg); err != nil {
+	if err := stream.Send(reg); err != nil {
 		return fmt.Errorf("failed to send registration: %w", err)
 	}
 
 	sc.logger.Info("registration sent", logger.String("client_id", sc.clientID))
 
-	msg, err := sc.stream.Recv()
+	msg, err := stream.Recv()
 	if err != nil {
 		return fmt.Errorf("failed to read registration response: %w", err)
 	}
@@ -139,28 +231,34 @@ func (sc *ServerConnection) register() error {
 		return fmt.Errorf("registration failed: %s", ack.Ack.Message)
 	}
 
+	sc.registered.Store(true)
 	sc.logger.Info("registered with server successfully")
 
 	return nil
 }
 
-func (sc *ServerConnection) readLoop() {
+func (sc *ServerConnection) readLoop(s *session) {
 	defer sc.wg.Done()
 	defer sc.logger.Info("read loop stopped")
+	defer close(s.done)
+	defer sc.registered.Store(false)
 
 	for {
-		select {
-		case <-sc.stopChan:
-			return
-		default:
-		}
-
-		msg, err := sc.stream.Recv()
+		msg, err := s.stream.Recv()
 		if err != nil {
+			select {
+			case <-sc.stopChan:
+				s.err = err
+				return
+			default:
+			}
+
 			if err == io.EOF {
 				sc.logger.Info("server closed stream")
+				s.err = fmt.Errorf("server closed stream")
 			} else {
 				sc.logger.Error("stream recv error", logger.Error(err))
+				s.err = err
 			}
 			return
 		}
@@ -168,8 +266,11 @@ func (sc *ServerConnection) readLoop() {
 		switch m := msg.Message.(type) {
 		case *pb.ClientMessage_Packet:
 			sc.handlePacket(m.Packet)
+		case *pb.ClientMessage_Routes:
+			sc.handleRoutes(m.Routes)
 		case *pb.ClientMessage_Heartbeat:
 			sc.logger.Debug("heartbeat received")
+			sc.heartbeatEchoed(s, m.Heartbeat)
 		default:
 			sc.logger.Warn("unexpected message type",
 				logger.String("type", fmt.Sprintf("%T", msg.Message)),
@@ -178,49 +279,131 @@ func (sc *ServerConnection) readLoop() {
 	}
 }
 
-func (sc *ServerConnection) writeLoop() {
+func (sc *ServerConnection) writeLoop(s *session) {
 	defer sc.wg.Done()
+	defer close(s.writerDone)
 	defer sc.logger.Info("write loop stopped")
 
 	heartbeatTicker := time.NewTicker(30 * time.Second)
 	defer heartbeatTicker.Stop()
 
+	// The first heartbeat measures the round trip right away.
+	sc.sendHeartbeat(s)
+	// Signals left over from a lost session go out first.
+	sc.flushControls(s)
+
 	for {
 		select {
 		case <-sc.stopChan:
+			s.stream.CloseSend()
+			return
+
+		case <-s.closing:
+			s.stream.CloseSend()
 			return
 
+		case <-s.done:
+			return
+
+		case <-sc.controls.ready:
+			sc.flushControls(s)
+
 		case packet := <-sc.packetChan:
 			msg := &pb.ClientMessage{
 				Message: &pb.ClientMessage_Packet{
 					Packet: packet,
 				},
 			}
-			if err := sc.stream.Send(msg); err != nil {
+			if err := s.stream.Send(msg); err != nil {
 				sc.logger.Error("failed to send packet",
 					logger.Error(err),
 					logger.String("connection_id", packet.ConnectionId),
 				)
+				continue
 			}
+			sc.tracker.AddBytesOut(packet.ConnectionId, len(packet.Data))
 
 		case <-heartbeatTicker.C:
-			msg := &pb.ClientMessage{
-				Message: &pb.ClientMessage_Heartbeat{
-					Heartbeat: &pb.Heartbeat{
-						SenderId:  sc.clientID,
-						Timestamp: time.Now().Unix(),
-					},
-				},
-			}
-			if err := sc.stream.Send(msg); err != nil {
-				sc.logger.Error("failed to send heartbeat", logger.Error(err))
-			}
+			sc.sendHeartbeat(s)
 		}
 	}
 }
 
+func (sc *ServerConnection) sendHeartbeat(s *session) {
+	now := time.Now()
+	msg := &pb.ClientMessage{
+		Message: &pb.ClientMessage_Heartbeat{
+			Heartbeat: &pb.Heartbeat{
+				SenderId:  sc.clientID,
+				Timestamp: now.Unix(),
+			},
+		},
+	}
+
+	s.pingMu.Lock()
+	s.pingTS, s.pingSent = now.Unix(), now
+	s.pingMu.Unlock()
+
+	if err := s.stream.Send(msg); err != nil {
+		sc.logger.Error("failed to send heartbeat", logger.Error(err))
+	}
+}
+
+// heartbeatEchoed measures the round trip when the server echoes the
+// heartbeat sent last. Servers that do not echo leave the RTT unknown.
+func (sc *ServerConnection) heartbeatEchoed(s *session, hb *pb.Heartbeat) {
+	s.pingMu.Lock()
+	defer s.pingMu.Unlock()
+
+	if s.pingSent.IsZero() || hb.Timestamp != s.pingTS {
+		return
+	}
+	sc.rtt.Store(int64(time.Since(s.pingSent)))
+	s.pingSent = time.Time{}
+}
+
+// closeSession tears down the current session, if any, and waits for its
+// loops to exit.
+func (sc *ServerConnection) closeSession() error {
+	sc.mu.Lock()
+	s := sc.session
+	sc.session = nil
+	sc.mu.Unlock()
+
+	if s == nil {
+		return nil
+	}
+
+	// Give the write loop a moment to half-close the stream; closing the
+	// connection unblocks it if it is stuck sending.
+	close(s.closing)
+	select {
+	case <-s.writerDone:
+	case <-time.After(time.Second):
+	}
+	err := s.conn.Close()
+	sc.wg.Wait()
+
+	return err
+}
+
 func (sc *ServerConnection) handlePacket(pkt *pb.Packet) {
-	if err := sc.tracker.DeliverResponse(pkt.ConnectionId, pkt.Data); err != nil {
+	if pkt.Control == pb.Control_CONTROL_RESET {
+		sc.logger.Info("connection refused or reset by proxy",
+			logger.String("connection_id", pkt.ConnectionId),
+		)
+		sc.tracker.ResetByPeer(pkt.ConnectionId)
+		return
+	}
+
+	var err error
+	if pkt.IpPacket && sc.ipHandler != nil {
+		err = sc.ipHandler(pkt.Data)
+	} else {
+		err = sc.tracker.DeliverResponse(pkt.ConnectionId, pkt.Data)
+	}
+
+	if err != nil {
 		sc.logger.Error("failed to deliver response",
 			logger.Error(err),
 			logger.String("connection_id", pkt.ConnectionId),
@@ -228,6 +411,36 @@ func (sc *ServerConnection) handlePacket(pkt *pb.Packet) {
 	}
 }
 
+func (sc *ServerConnection) handleRoutes(table *pb.RouteTable) {
+	if table.Version <= sc.routeVersion {
+		sc.logger.Debug("ignoring stale route table", logger.Int("version", int(table.Version)))
+		return
+	}
+	sc.routeVersion = table.Version
+
+	sc.logger.Info("route table received",
+		logger.Int("version", int(table.Version)),
+		logger.Int("prefixes", len(table.Prefixes)),
+	)
+
+	select {
+	case <-sc.routeUpdates:
+	default:
+	}
+	sc.routeUpdates <- table.Prefixes
+}
+
+// HandleIPPackets sets where whole IP packets from the server go. It must be
+// called before Start.
+func (sc *ServerConnection) HandleIPPackets(handler func([]byte) error) {
+	sc.ipHandler = handler
+}
+
+// RouteUpdates delivers the prefixes pushed by the server, latest first.
+func (sc *ServerConnection) RouteUpdates() <-chan []string {
+	return sc.routeUpdates
+}
+
 func (sc *ServerConnection) SendPacket(pkt *pb.Packet) {
 	select {
 	case sc.packetChan <- pkt:
@@ -238,6 +451,108 @@ func (sc *ServerConnection) SendPacket(pkt *pb.Packet) {
 	}
 }
 
+// sendControl queues a flow control signal for the proxy. It is called on
+// the read loop and from connection writers, so it never blocks; a signal
+// still pending for the connection is replaced by the newer one.
+func (sc *ServerConnection) sendControl(connID string, ctrl pb.Control) {
+	sc.controls.push(connID, ctrl)
+}
+
+// flushControls sends every pending control signal. One that fails to send
+// is kept for the next session.
+func (sc *ServerConnection) flushControls(s *session) {
+	for {
+		connID, ctrl, ok := sc.controls.pop()
+		if !ok {
+			return
+		}
+
+		msg := &pb.ClientMessage{
+			Message: &pb.ClientMessage_Packet{
+				Packet: &pb.Packet{
+					ConnectionId: connID,
+					Direction:    pb.Direction_DIRECTION_FORWARD,
+					Control:      ctrl,
+					Timestamp:    time.Now().Unix(),
+				},
+			},
+		}
+		if err := s.stream.Send(msg); err != nil {
+			sc.logger.Warn("failed to send control signal",
+				logger.String("connection_id", connID),
+				logger.String("control", ctrl.String()),
+				logger.Error(err),
+			)
+			sc.controls.requeue(connID, ctrl)
+			return
+		}
+	}
+}
+
+// controlQueue holds at most one pending control signal per connection, in
+// the order connections first raised one. Only the latest state matters to
+// the proxy, so a newer signal replaces an older one, except that a reset
+// is final.
+type controlQueue struct {
+	mu      sync.Mutex
+	pending map[string]pb.Control
+	order   []string
+	// ready wakes the write loop; one token covers any number of pushes.
+	ready chan struct{}
+}
+
+func newControlQueue() *controlQueue {
+	return &controlQueue{
+		pending: make(map[string]pb.Control),
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+func (q *controlQueue) push(connID string, ctrl pb.Control) {
+	q.mu.Lock()
+	prev, exists := q.pending[connID]
+	switch {
+	case !exists:
+		q.order = append(q.order, connID)
+		q.pending[connID] = ctrl
+	case prev != pb.Control_CONTROL_RESET:
+		q.pending[connID] = ctrl
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// requeue puts back a signal that could not be sent, unless a newer one for
+// the connection is already waiting.
+func (q *controlQueue) requeue(connID string, ctrl pb.Control) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, exists := q.pending[connID]; exists {
+		return
+	}
+	q.order = append([]string{connID}, q.order...)
+	q.pending[connID] = ctrl
+}
+
+func (q *controlQueue) pop() (string, pb.Control, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.order) == 0 {
+		return "", pb.Control_CONTROL_NONE, false
+	}
+	connID := q.order[0]
+	q.order = q.order[1:]
+	ctrl := q.pending[connID]
+	delete(q.pending, connID)
+	return connID, ctrl, true
+}
+
 func generateAlphanumericID(length int) string {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	charsetLen := big.NewInt(int64(len(charset)))
@@ -256,16 +571,33 @@ func generateAlphanumericID(length int) string {
 func (sc *ServerConnection) Close() error {
 	sc.stopOnce.Do(func() { close(sc.stopChan) })
 
-	if sc.stream != nil {
-		sc.stream.CloseSend()
+	if sc.cancel != nil {
+		sc.cancel()
+		<-sc.runDone
 	}
 
-	sc.wg.Wait()
+	return sc.closeSession()
+}
 
-	if sc.grpcConn != nil {
-		return sc.grpcConn.Close()
-	}
-	return nil
+func (sc *ServerConnection) IsRegistered() bool {
+	return sc.registered.Load()
+}
+
+// ClientID is the ID the client registers with, once it has been chosen.
+func (sc *ServerConnection) ClientID() string {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	return sc.clientID
+}
+
+// RTT is the last measured round trip to the server, zero until measured.
+func (sc *ServerConnection) RTT() time.Duration {
+	return time.Duration(sc.rtt.Load())
+}
+
+func (sc *ServerConnection) Status() reconnect.Status {
+	return sc.supervisor.Status()
 }
 
 func (sc *ServerConnection) GetPacketChannel() chan<- *pb.Packet {
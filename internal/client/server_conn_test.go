@@ -9,6 +9,7 @@ import (
 
 	"google.golang.org/grpc"
 
+	"network-tunneler/internal/reconnect"
 	testutil "network-tunneler/internal/testing"
 	"network-tunneler/pkg/logger"
 	pb "network-tunneler/proto"
@@ -52,7 +53,11 @@ func (m *mockClientServer) Connect(stream pb.TunnelClient_ConnectServer) error {
 }
 
 func setupMockServer(t *testing.T) (*grpc.Server, string, *mockClientServer) {
-	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	return setupMockServerAt(t, "127.0.0.1:0")
+}
+
+func setupMockServerAt(t *testing.T, addr string) (*grpc.Server, string, *mockClientServer) {
+	lis, err := net.Listen("tcp", addr)
 	if err != nil {
 		t.Fatalf("failed to listen: %v", err)
 	}
@@ -81,7 +86,13 @@ func newTestServerConnection(addr string, tracker *ConnectionTracker, log logger
 		tracker:      tracker,
 		config:       cfg,
 		packetChan:   make(chan *pb.Packet, 100),
+		controls:     newControlQueue(),
+		routeUpdates: make(chan []string, 1),
 		logger:       log.With(logger.String("component", "server_conn")),
+		supervisor: reconnect.NewSupervisor(reconnect.Config{
+			InitialBackoff: 50 * time.Millisecond,
+			MaxBackoff:     200 * time.Millisecond,
+		}, log),
 		stopChan:     make(chan struct{}),
 		grpcInsecure: true,
 	}
@@ -202,9 +213,9 @@ func TestServerConnection_ReceivePacket(t *testing.T) {
 		t.Fatalf("failed to send response: %v", err)
 	}
 
-	time.Sleep(100 * time.Millisecond)
+	waitDelivered(t, tracker, connID, len(responseData))
 
-	receivedData := mockConn.WriteBuf.Bytes()
+	receivedData := mockConn.Written()
 
 	if string(receivedData) != string(responseData) {
 		t.Errorf("expected data %s, got %s", responseData, receivedData)
@@ -239,3 +250,183 @@ func TestServerConnection_Close(t *testing.T) {
 	}
 	sc.SendPacket(testPacket)
 }
+
+func TestServerConnection_RouteUpdates(t *testing.T) {
+	server, addr, mock := setupMockServer(t)
+	defer server.Stop()
+
+	log := testutil.NewTestLogger()
+	tracker := NewConnectionTracker(TrackerParams{Logger: log})
+
+	sc := newTestServerConnection(addr, tracker, log)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := sc.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer sc.Close()
+
+	<-mock.registerChan
+
+	push := func(version uint64, prefixes ...string) {
+		err := mock.stream.Send(&pb.ClientMessage{
+			Message: &pb.ClientMessage_Routes{
+				Routes: &pb.RouteTable{Version: version, Prefixes: prefixes},
+			},
+		})
+		if err != nil {
+			t.Fatalf("failed to push routes: %v", err)
+		}
+	}
+
+	expect := func(want ...string) {
+		t.Helper()
+		select {
+		case got := <-sc.RouteUpdates():
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("expected routes %v, got %v", want, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for route update")
+		}
+	}
+
+	push(2, "10.0.0.0/8")
+	expect("10.0.0.0/8")
+
+	push(1, "172.16.0.0/12")
+	push(3, "10.0.0.0/8", "192.168.1.0/24")
+	expect("10.0.0.0/8", "192.168.1.0/24")
+}
+
+func TestServerConnection_ReconnectsAfterServerRestart(t *testing.T) {
+	server, addr, mock := setupMockServer(t)
+
+	log := testutil.NewTestLogger()
+	tracker := NewConnectionTracker(TrackerParams{Logger: log})
+
+	sc := newTestServerConnection(addr, tracker, log)
+	sc.Start()
+	defer sc.Close()
+
+	var firstID string
+	select {
+	case reg := <-mock.registerChan:
+		firstID = reg.ClientId
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for registration")
+	}
+
+	server.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for sc.IsRegistered() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sc.IsRegistered() {
+		t.Fatal("expected connection to notice the server going away")
+	}
+
+	server, _, mock = setupMockServerAt(t, addr)
+	defer server.Stop()
+
+	select {
+	case reg := <-mock.registerChan:
+		if reg.ClientId != firstID {
+			t.Errorf("expected client ID %s to survive reconnect, got %s", firstID, reg.ClientId)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for re-registration")
+	}
+
+	deadline = time.Now().Add(2 * time.Second)
+	for sc.Status().State != reconnect.StateRegistered && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state := sc.Status().State; state != reconnect.StateRegistered {
+		t.Errorf("expected state registered, got %s", state)
+	}
+
+	sc.SendPacket(&pb.Packet{ConnectionId: "after-reconnect", Data: []byte("queued")})
+
+	select {
+	case pkt := <-mock.packetChan:
+		if pkt.ConnectionId != "after-reconnect" {
+			t.Errorf("expected packet after reconnect, got %s", pkt.ConnectionId)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for packet after reconnect")
+	}
+}
+
+func TestServerConnection_SendControlDoesNotBlock(t *testing.T) {
+	log := testutil.NewTestLogger()
+	tracker := NewConnectionTracker(TrackerParams{Logger: log})
+	sc := newTestServerConnection("127.0.0.1:0", tracker, log)
+
+	for i := 0; i < cap(sc.packetChan); i++ {
+		sc.packetChan <- &pb.Packet{ConnectionId: "data"}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		sc.sendControl("conn-a", pb.Control_CONTROL_PAUSE)
+		sc.sendControl("conn-b", pb.Control_CONTROL_RESET)
+		sc.sendControl("conn-a", pb.Control_CONTROL_RESUME)
+		sc.sendControl("conn-b", pb.Control_CONTROL_RESUME)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sendControl blocked on a full packet channel")
+	}
+
+	// The latest state per connection survives, but a reset stays a reset.
+	want := []struct {
+		connID string
+		ctrl   pb.Control
+	}{
+		{"conn-a", pb.Control_CONTROL_RESUME},
+		{"conn-b", pb.Control_CONTROL_RESET},
+	}
+	for _, w := range want {
+		connID, ctrl, ok := sc.controls.pop()
+		if !ok || connID != w.connID || ctrl != w.ctrl {
+			t.Errorf("expected %s %s, got %s %s (%v)", w.connID, w.ctrl, connID, ctrl, ok)
+		}
+	}
+	if _, _, ok := sc.controls.pop(); ok {
+		t.Error("expected control queue to be empty")
+	}
+}
+
+func TestServerConnection_ResetFromProxy(t *testing.T) {
+	log := testutil.NewTestLogger()
+	tracker, signals := newSignalingTracker(DefaultDeliveryConfig())
+	sc := newTestServerConnection("127.0.0.1:0", tracker, log)
+
+	mockConn := testutil.NewMockNetConn()
+	tracker.Track("conn-1", "10.0.0.1:25", mockConn)
+
+	sc.handlePacket(&pb.Packet{
+		ConnectionId: "conn-1",
+		Direction:    pb.Direction_DIRECTION_REVERSE,
+		Control:      pb.Control_CONTROL_RESET,
+	})
+
+	if _, exists := tracker.Get("conn-1"); exists {
+		t.Error("expected refused connection to be removed")
+	}
+	if !mockConn.Closed {
+		t.Error("expected local connection to be closed")
+	}
+	select {
+	case ctrl := <-signals:
+		t.Errorf("unexpected signal %s back to the proxy", ctrl)
+	default:
+	}
+}
@@ -0,0 +1,480 @@
+package client
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"go.uber.org/fx"
+
+	"network-tunneler/pkg/logger"
+	"network-tunneler/pkg/netfilter"
+	"network-tunneler/proto"
+)
+
+type SOCKSConfig struct {
+	ListenAddr string `mapstructure:"listen_addr" json:"listen_addr" yaml:"listen_addr"`
+	// Username and Password require RFC 1929 authentication when set.
+	Username string `mapstructure:"username" json:"username" yaml:"username"`
+	Password string `mapstructure:"password" json:"password" yaml:"password"`
+}
+
+func DefaultSOCKSConfig() SOCKSConfig {
+	return SOCKSConfig{
+		ListenAddr: "127.0.0.1:1080",
+	}
+}
+
+// withDefaults fills unset fields from DefaultSOCKSConfig.
+func (c SOCKSConfig) withDefaults() SOCKSConfig {
+	if c.ListenAddr == "" {
+		c.ListenAddr = DefaultSOCKSConfig().ListenAddr
+	}
+	return c
+}
+
+func (c SOCKSConfig) Validate() error {
+	c = c.withDefaults()
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		return fmt.Errorf("invalid socks listen address: %w", err)
+	}
+	if (c.Username == "") != (c.Password == "") {
+		return fmt.Errorf("socks username and password must be set together")
+	}
+	if len(c.Username) > 255 || len(c.Password) > 255 {
+		return fmt.Errorf("socks username and password are limited to 255 bytes")
+	}
+	return nil
+}
+
+const (
+	socksVersion = 5
+
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksRepSuccess          = 0
+	socksRepFailure          = 1
+	socksRepNotAllowed       = 2
+	socksRepNetUnreachable   = 3
+	socksRepCmdNotSupported  = 7
+	socksRepAtypNotSupported = 8
+
+	// socksHandshakeTimeout bounds negotiation and the request, so idle
+	// connections cannot hold a goroutine forever.
+	socksHandshakeTimeout = 10 * time.Second
+)
+
+var errSOCKSAddrType = errors.New("unsupported SOCKS address type")
+
+// readSOCKSAddr reads ATYP, the address and the port. Domains that are IP
+// literals are treated as addresses.
+func readSOCKSAddr(r io.Reader) (ingressAddr, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return ingressAddr{}, err
+	}
+
+	var a ingressAddr
+	switch atyp[0] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make([]byte, 4)
+		if atyp[0] == socksAtypIPv6 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return ingressAddr{}, err
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		a.Addr = addr.Unmap()
+	case socksAtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return ingressAddr{}, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return ingressAddr{}, err
+		}
+		if addr, err := netip.ParseAddr(string(name)); err == nil {
+			a.Addr = addr.Unmap()
+		} else if len(name) == 0 {
+			return ingressAddr{}, fmt.Errorf("empty SOCKS hostname")
+		} else {
+			a.Host = string(name)
+		}
+	default:
+		return ingressAddr{}, fmt.Errorf("%w %d", errSOCKSAddrType, atyp[0])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return ingressAddr{}, err
+	}
+	a.Port = uint16(port[0])<<8 | uint16(port[1])
+	return a, nil
+}
+
+// appendSOCKSAddr encodes a as ATYP, address and port. An empty address is
+// sent as 0.0.0.0.
+func appendSOCKSAddr(b []byte, a ingressAddr) []byte {
+	switch {
+	case a.Addr.Is4():
+		ip := a.Addr.As4()
+		b = append(append(b, socksAtypIPv4), ip[:]...)
+	case a.Addr.Is6():
+		ip := a.Addr.As16()
+		b = append(append(b, socksAtypIPv6), ip[:]...)
+	case a.Host != "":
+		b = append(append(b, socksAtypDomain, byte(len(a.Host))), a.Host...)
+	default:
+		b = append(b, socksAtypIPv4, 0, 0, 0, 0)
+	}
+	return append(b, byte(a.Port>>8), byte(a.Port))
+}
+
+func writeSOCKSReply(w io.Writer, rep byte, bind ingressAddr) error {
+	_, err := w.Write(appendSOCKSAddr([]byte{socksVersion, rep, 0}, bind))
+	return err
+}
+
+// SOCKSServer is the unprivileged alternative to NetfilterManager:
+// applications connect to it explicitly with SOCKS5, so neither netfilter
+// rules nor root are needed. CONNECT streams go through the same
+// ConnectionHandler as redirected connections and UDP ASSOCIATE datagrams
+// become UDP sessions. Address destinations are checked against the
+// targets, excludes and pushed routes; hostnames are left to the server,
+// which routes them to a proxy that resolves them.
+type SOCKSServer struct {
+	config  SOCKSConfig
+	targets *Config
+	tracker *ConnectionTracker
+	logger  logger.Logger
+	active  bool
+
+	listener net.Listener
+	filter   *destinationFilter
+	mu       sync.Mutex
+}
+
+type SOCKSParams struct {
+	fx.In
+
+	Config  *Config
+	Tracker *ConnectionTracker
+	Logger  logger.Logger
+}
+
+func NewSOCKSServer(p SOCKSParams) *SOCKSServer {
+	return &SOCKSServer{
+		config:  p.Config.SOCKS.withDefaults(),
+		targets: p.Config,
+		tracker: p.Tracker,
+		logger:  p.Logger.With(logger.String("component", "socks")),
+	}
+}
+
+func (s *SOCKSServer) Setup() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active {
+		s.logger.Warn("socks server already active")
+		return nil
+	}
+
+	filter, err := newDestinationFilter(s.targets)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", s.config.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.config.ListenAddr, err)
+	}
+
+	s.listener = listener
+	s.filter = filter
+
+	s.logger.Info("socks server ready, waiting for routes from server",
+		logger.String("listen_addr", listener.Addr().String()),
+		logger.Bool("auth", s.config.Username != ""),
+		logger.Int("targets", len(filter.includes)),
+		logger.Int("excludes", len(filter.excludes)),
+	)
+
+	s.active = true
+	return nil
+}
+
+// SyncRoutes records the pushed prefixes; there is nothing to install.
+func (s *SOCKSServer) SyncRoutes(prefixes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.active {
+		return fmt.Errorf("socks server not set up")
+	}
+
+	n := s.filter.setRoutes(prefixes, s.logger)
+	s.logger.Info("socks routes updated", logger.Int("prefixes", n))
+	return nil
+}
+
+// reply maps a destinationFilter verdict to a SOCKS reply code.
+func (s *SOCKSServer) reply(dst ingressAddr, proto netfilter.Protocol) byte {
+	switch err := s.filter.check(dst, proto); {
+	case err == nil:
+		return socksRepSuccess
+	case errors.Is(err, errDestNotRouted):
+		return socksRepNetUnreachable
+	default:
+		return socksRepNotAllowed
+	}
+}
+
+// Serve accepts SOCKS clients until the listener is closed.
+func (s *SOCKSServer) Serve(serverWriter chan<- *proto.Packet) {
+	s.mu.Lock()
+	listener := s.listener
+	s.mu.Unlock()
+
+	if listener == nil {
+		return
+	}
+
+	handler := NewConnectionHandler(s.tracker, serverWriter, s.logger)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Error("accept error", logger.Error(err))
+				continue
+			}
+			return
+		}
+
+		go s.handle(conn, handler, serverWriter)
+	}
+}
+
+func (s *SOCKSServer) handle(conn net.Conn, handler *ConnectionHandler, serverWriter chan<- *proto.Packet) {
+	_ = conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	if err := s.negotiate(conn); err != nil {
+		s.logger.Warn("socks negotiation failed",
+			logger.Error(err),
+			logger.String("remote_addr", conn.RemoteAddr().String()),
+		)
+		conn.Close()
+		return
+	}
+
+	cmd, dst, err := readSOCKSRequest(conn)
+	if err != nil {
+		rep := byte(socksRepFailure)
+		if errors.Is(err, errSOCKSAddrType) {
+			rep = socksRepAtypNotSupported
+		}
+		writeSOCKSReply(conn, rep, ingressAddr{})
+		s.logger.Debug("invalid socks request", logger.Error(err))
+		conn.Close()
+		return
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	switch cmd {
+	case socksCmdConnect:
+		s.connect(conn, dst, handler)
+	case socksCmdUDPAssociate:
+		s.associate(conn, dst, serverWriter)
+	default:
+		writeSOCKSReply(conn, socksRepCmdNotSupported, ingressAddr{})
+		conn.Close()
+	}
+}
+
+// negotiate selects the authentication method and, for username/password,
+// runs the RFC 1929 exchange.
+func (s *SOCKSServer) negotiate(conn net.Conn) error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socksVersion {
+		return fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	method := byte(socksAuthNone)
+	if s.config.Username != "" {
+		method = socksAuthPassword
+	}
+	if !bytes.Contains(methods, []byte{method}) {
+		conn.Write([]byte{socksVersion, socksAuthNoAcceptable})
+		return fmt.Errorf("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return err
+	}
+
+	if method == socksAuthPassword {
+		return s.authenticate(conn)
+	}
+	return nil
+}
+
+func (s *SOCKSServer) authenticate(conn net.Conn) error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	user := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return err
+	}
+	var plen [1]byte
+	if _, err := io.ReadFull(conn, plen[:]); err != nil {
+		return err
+	}
+	pass := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return err
+	}
+
+	userOK := subtle.ConstantTimeCompare(user, []byte(s.config.Username)) == 1
+	passOK := subtle.ConstantTimeCompare(pass, []byte(s.config.Password)) == 1
+	if hdr[0] != 1 || !userOK || !passOK {
+		conn.Write([]byte{1, 1})
+		return fmt.Errorf("authentication failed for user %q", user)
+	}
+
+	_, err := conn.Write([]byte{1, 0})
+	return err
+}
+
+func readSOCKSRequest(r io.Reader) (byte, ingressAddr, error) {
+	var hdr [3]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, ingressAddr{}, err
+	}
+	if hdr[0] != socksVersion {
+		return 0, ingressAddr{}, fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	dst, err := readSOCKSAddr(r)
+	if err != nil {
+		return 0, ingressAddr{}, err
+	}
+	return hdr[1], dst, nil
+}
+
+// connect replies before anything reaches the target: the proxy dials on
+// the first data, so an unreachable target shows up as a closed connection.
+func (s *SOCKSServer) connect(conn net.Conn, dst ingressAddr, handler *ConnectionHandler) {
+	defer conn.Close()
+
+	if rep := s.reply(dst, netfilter.ProtocolTCP); rep != socksRepSuccess {
+		writeSOCKSReply(conn, rep, ingressAddr{})
+		s.logger.Info("refused socks connection",
+			logger.String("source", conn.RemoteAddr().String()),
+			logger.String("dest", dst.String()),
+			logger.Int("reply", int(rep)),
+		)
+		return
+	}
+
+	if err := writeSOCKSReply(conn, socksRepSuccess, ingressAddrFrom(conn.LocalAddr())); err != nil {
+		return
+	}
+
+	src := ingressAddrFrom(conn.RemoteAddr())
+	tuple := &proto.ConnectionTuple{
+		SrcIp:   src.Addr.String(),
+		SrcPort: uint32(src.Port),
+		DstHost: dst.Host,
+		DstPort: uint32(dst.Port),
+	}
+	if dst.Addr.IsValid() {
+		tuple.DstIp = dst.Addr.String()
+	}
+
+	handler.forward(conn, ingressConnID("socks", "tcp", src, dst), dst.String(), tuple)
+}
+
+// Close stops accepting clients, which stops Serve.
+func (s *SOCKSServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closeLocked()
+}
+
+func (s *SOCKSServer) closeLocked() error {
+	if s.listener == nil {
+		return nil
+	}
+	err := s.listener.Close()
+	s.listener = nil
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	return err
+}
+
+func (s *SOCKSServer) Cleanup() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.active {
+		s.logger.Debug("socks server not active, nothing to clean up")
+		return nil
+	}
+
+	if err := s.closeLocked(); err != nil {
+		return fmt.Errorf("failed to close socks listener: %w", err)
+	}
+
+	s.filter.setRoutes(nil, s.logger)
+	s.active = false
+	s.logger.Info("socks server stopped")
+
+	return nil
+}
+
+// Routes returns the prefixes pushed by the server that address
+// destinations must fall in.
+func (s *SOCKSServer) Routes() []netip.Prefix {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.filter == nil {
+		return nil
+	}
+	return s.filter.prefixes()
+}
+
+func (s *SOCKSServer) IsActive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.active
+}
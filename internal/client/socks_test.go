@@ -0,0 +1,190 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	testutil "network-tunneler/internal/testing"
+	pb "network-tunneler/proto"
+)
+
+func newTestSOCKSServer(t *testing.T, cfg SOCKSConfig) (*SOCKSServer, *ConnectionTracker, chan *pb.Packet) {
+	t.Helper()
+
+	log := testutil.NewTestLogger()
+	tracker := NewConnectionTracker(TrackerParams{Logger: log})
+	cfg.ListenAddr = "127.0.0.1:0"
+
+	s := NewSOCKSServer(SOCKSParams{
+		Config: &Config{
+			TargetCIDR: "10.0.0.0/8",
+			Exclude:    []Target{{CIDR: "10.0.5.0/24"}},
+			SOCKS:      cfg,
+		},
+		Tracker: tracker,
+		Logger:  log,
+	})
+	if err := s.Setup(); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	t.Cleanup(func() { s.Cleanup() })
+
+	if err := s.SyncRoutes([]string{"10.0.0.0/16"}); err != nil {
+		t.Fatalf("SyncRoutes failed: %v", err)
+	}
+
+	serverChan := make(chan *pb.Packet, 10)
+	go s.Serve(serverChan)
+
+	return s, tracker, serverChan
+}
+
+// socksDial negotiates and sends a request, returning the reply code and
+// bound address.
+func socksDial(t *testing.T, s *SOCKSServer, auth []byte, cmd byte, dst ingressAddr) (net.Conn, byte, ingressAddr) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial socks server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	method := byte(socksAuthNone)
+	if auth != nil {
+		method = socksAuthPassword
+	}
+	conn.Write([]byte{socksVersion, 1, method})
+
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil || choice[1] != method {
+		t.Fatalf("expected method %d to be selected, got %v (%v)", method, choice, err)
+	}
+	if auth != nil {
+		conn.Write(auth)
+		var status [2]byte
+		if _, err := io.ReadFull(conn, status[:]); err != nil {
+			t.Fatalf("failed to read auth status: %v", err)
+		}
+		if status[1] != 0 {
+			return conn, socksRepNotAllowed, ingressAddr{}
+		}
+	}
+
+	conn.Write(appendSOCKSAddr([]byte{socksVersion, cmd, 0}, dst))
+
+	var hdr [3]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	bind, err := readSOCKSAddr(conn)
+	if err != nil {
+		t.Fatalf("failed to read bound address: %v", err)
+	}
+	return conn, hdr[1], bind
+}
+
+func passwordAuth(user, pass string) []byte {
+	b := append([]byte{1, byte(len(user))}, user...)
+	return append(append(b, byte(len(pass))), pass...)
+}
+
+func TestSOCKSServer_Connect(t *testing.T) {
+	s, _, serverChan := newTestSOCKSServer(t, SOCKSConfig{Username: "dev", Password: "secret"})
+
+	conn, rep, _ := socksDial(t, s, passwordAuth("dev", "secret"), socksCmdConnect, ingressAddr{Host: "db.corp.internal", Port: 5432})
+	if rep != socksRepSuccess {
+		t.Fatalf("expected success, got reply %d", rep)
+	}
+	conn.Write([]byte("hello"))
+
+	select {
+	case pkt := <-serverChan:
+		if string(pkt.Data) != "hello" || pkt.Protocol != pb.Protocol_PROTOCOL_TCP {
+			t.Errorf("unexpected packet %q (%v)", pkt.Data, pkt.Protocol)
+		}
+		if pkt.ConnTuple.DstHost != "db.corp.internal" || pkt.ConnTuple.DstIp != "" || pkt.ConnTuple.DstPort != 5432 {
+			t.Errorf("expected hostname destination, got %+v", pkt.ConnTuple)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for packet")
+	}
+
+	tests := []struct {
+		name string
+		auth []byte
+		dst  ingressAddr
+		want byte
+	}{
+		{"wrong password", passwordAuth("dev", "nope"), ingressAddr{Addr: netip.MustParseAddr("10.0.1.1"), Port: 80}, socksRepNotAllowed},
+		{"outside targets", passwordAuth("dev", "secret"), ingressAddr{Addr: netip.MustParseAddr("192.168.1.1"), Port: 80}, socksRepNotAllowed},
+		{"excluded", passwordAuth("dev", "secret"), ingressAddr{Addr: netip.MustParseAddr("10.0.5.1"), Port: 80}, socksRepNotAllowed},
+		{"not routed", passwordAuth("dev", "secret"), ingressAddr{Addr: netip.MustParseAddr("10.1.0.1"), Port: 80}, socksRepNetUnreachable},
+		{"routed", passwordAuth("dev", "secret"), ingressAddr{Addr: netip.MustParseAddr("10.0.1.1"), Port: 80}, socksRepSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, rep, _ := socksDial(t, s, tt.auth, socksCmdConnect, tt.dst); rep != tt.want {
+				t.Errorf("expected reply %d, got %d", tt.want, rep)
+			}
+		})
+	}
+}
+
+func TestSOCKSServer_UDPAssociate(t *testing.T) {
+	s, tracker, serverChan := newTestSOCKSServer(t, SOCKSConfig{})
+
+	_, rep, bind := socksDial(t, s, nil, socksCmdUDPAssociate, ingressAddr{})
+	if rep != socksRepSuccess {
+		t.Fatalf("expected success, got reply %d", rep)
+	}
+
+	app, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to open app socket: %v", err)
+	}
+	defer app.Close()
+	_ = app.SetDeadline(time.Now().Add(2 * time.Second))
+
+	relay := net.UDPAddrFromAddrPort(netip.AddrPortFrom(bind.Addr, bind.Port))
+	dst := ingressAddr{Addr: netip.MustParseAddr("10.0.0.53"), Port: 53}
+
+	// Fragments are dropped; only the second datagram gets through.
+	app.WriteToUDP(append(appendSOCKSAddr([]byte{0, 0, 1}, dst), "frag"...), relay)
+	app.WriteToUDP(append(appendSOCKSAddr([]byte{0, 0, 0}, dst), "query"...), relay)
+
+	var pkt *pb.Packet
+	select {
+	case pkt = <-serverChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for datagram")
+	}
+	if string(pkt.Data) != "query" || pkt.Protocol != pb.Protocol_PROTOCOL_UDP {
+		t.Fatalf("unexpected packet %q (%v)", pkt.Data, pkt.Protocol)
+	}
+	if pkt.ConnTuple.DstIp != "10.0.0.53" || pkt.ConnTuple.DstPort != 53 {
+		t.Errorf("expected destination 10.0.0.53:53, got %+v", pkt.ConnTuple)
+	}
+
+	if err := tracker.DeliverResponse(pkt.ConnectionId, []byte("answer")); err != nil {
+		t.Fatalf("DeliverResponse failed: %v", err)
+	}
+
+	buf := make([]byte, 1500)
+	n, _, err := app.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	from, payload, err := parseSOCKSDatagram(buf[:n])
+	if err != nil {
+		t.Fatalf("invalid reply datagram: %v", err)
+	}
+	if from != dst || !bytes.Equal(payload, []byte("answer")) {
+		t.Errorf("expected answer from %s, got %q from %s", dst, payload, from)
+	}
+}
@@ -0,0 +1,242 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"network-tunneler/pkg/logger"
+	"network-tunneler/pkg/netfilter"
+	"network-tunneler/proto"
+)
+
+// socksAssociation relays the datagrams of one UDP ASSOCIATE. Every
+// destination the client sends to becomes a UDP session, and the
+// association, with its sessions, lasts as long as the control connection.
+type socksAssociation struct {
+	server       *SOCKSServer
+	conn         *net.UDPConn
+	serverWriter chan<- *proto.Packet
+	logger       logger.Logger
+
+	// Only the control connection's host may use the association; the
+	// port is pinned by the request or the first datagram.
+	clientIP   netip.Addr
+	clientPort uint16
+
+	sessions map[string]bool
+	mu       sync.Mutex
+}
+
+func (s *SOCKSServer) associate(ctrl net.Conn, requested ingressAddr, serverWriter chan<- *proto.Packet) {
+	defer ctrl.Close()
+
+	local := ingressAddrFrom(ctrl.LocalAddr())
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP(local.Addr.AsSlice())})
+	if err != nil {
+		writeSOCKSReply(ctrl, socksRepFailure, ingressAddr{})
+		s.logger.Error("failed to open socks UDP relay", logger.Error(err))
+		return
+	}
+
+	a := &socksAssociation{
+		server:       s,
+		conn:         conn,
+		serverWriter: serverWriter,
+		logger:       s.logger,
+		clientIP:     ingressAddrFrom(ctrl.RemoteAddr()).Addr,
+		clientPort:   requested.Port,
+		sessions:     make(map[string]bool),
+	}
+
+	if err := writeSOCKSReply(ctrl, socksRepSuccess, ingressAddrFrom(conn.LocalAddr())); err != nil {
+		conn.Close()
+		return
+	}
+
+	s.logger.Info("new socks UDP association",
+		logger.String("source", ctrl.RemoteAddr().String()),
+		logger.String("relay", conn.LocalAddr().String()),
+	)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.serve()
+	}()
+
+	// Nothing more is expected on the control connection; it closing ends
+	// the association.
+	io.Copy(io.Discard, ctrl)
+
+	conn.Close()
+	<-done
+	a.closeSessions()
+
+	s.logger.Debug("socks UDP association ended", logger.String("source", ctrl.RemoteAddr().String()))
+}
+
+func (a *socksAssociation) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := a.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			a.logger.Warn("failed to read socks datagram", logger.Error(err))
+			continue
+		}
+
+		if !a.accept(from) {
+			a.logger.Debug("dropping datagram from unexpected source", logger.String("source", from.String()))
+			continue
+		}
+
+		dst, payload, err := parseSOCKSDatagram(buf[:n])
+		if err != nil {
+			a.logger.Debug("dropping invalid socks datagram", logger.Error(err))
+			continue
+		}
+
+		if rep := a.server.reply(dst, netfilter.ProtocolUDP); rep != socksRepSuccess {
+			a.logger.Debug("dropping socks datagram to refused destination",
+				logger.String("dest", dst.String()),
+				logger.Int("reply", int(rep)),
+			)
+			continue
+		}
+
+		a.forward(from, dst, payload)
+	}
+}
+
+func (a *socksAssociation) accept(from netip.AddrPort) bool {
+	if from.Addr().Unmap() != a.clientIP {
+		return false
+	}
+	if a.clientPort == 0 {
+		a.clientPort = from.Port()
+	}
+	return from.Port() == a.clientPort
+}
+
+// parseSOCKSDatagram splits an RFC 1928 UDP request header from its data.
+func parseSOCKSDatagram(b []byte) (ingressAddr, []byte, error) {
+	if len(b) < 4 {
+		return ingressAddr{}, nil, fmt.Errorf("datagram too short")
+	}
+	if b[2] != 0 {
+		return ingressAddr{}, nil, fmt.Errorf("fragmented datagrams are not supported")
+	}
+
+	r := bytes.NewReader(b[3:])
+	dst, err := readSOCKSAddr(r)
+	if err != nil {
+		return ingressAddr{}, nil, err
+	}
+	return dst, b[len(b)-r.Len():], nil
+}
+
+func (a *socksAssociation) forward(from netip.AddrPort, dst ingressAddr, data []byte) {
+	src := ingressAddr{Addr: from.Addr().Unmap(), Port: from.Port()}
+	connID := ingressConnID("socks", "udp", src, dst)
+
+	a.mu.Lock()
+	isNew := !a.sessions[connID]
+	a.sessions[connID] = true
+	a.mu.Unlock()
+
+	// Tracked outside the lock: the tracker calls Close, which takes it.
+	if isNew {
+		a.server.tracker.Track(connID, dst.String(), &socksDatagramConn{
+			UDPConn: a.conn,
+			assoc:   a,
+			connID:  connID,
+			client:  from,
+			header:  appendSOCKSAddr([]byte{0, 0, 0}, dst),
+		})
+		a.logger.Info("new socks UDP session",
+			logger.String("connection_id", connID),
+			logger.String("source", from.String()),
+			logger.String("dest", dst.String()),
+		)
+	}
+	a.server.tracker.UpdateActivity(connID)
+
+	tuple := &proto.ConnectionTuple{
+		SrcIp:   src.Addr.String(),
+		SrcPort: uint32(src.Port),
+		DstHost: dst.Host,
+		DstPort: uint32(dst.Port),
+	}
+	if dst.Addr.IsValid() {
+		tuple.DstIp = dst.Addr.String()
+	}
+
+	packet := &proto.Packet{
+		ConnectionId: connID,
+		Data:         append([]byte(nil), data...),
+		ConnTuple:    tuple,
+		Protocol:     proto.Protocol_PROTOCOL_UDP,
+		Direction:    proto.Direction_DIRECTION_FORWARD,
+		Timestamp:    time.Now().Unix(),
+	}
+
+	select {
+	case a.serverWriter <- packet:
+	default:
+		a.logger.Warn("server writer channel full, dropping datagram",
+			logger.String("connection_id", connID),
+		)
+	}
+}
+
+func (a *socksAssociation) endSession(connID string) {
+	a.mu.Lock()
+	delete(a.sessions, connID)
+	a.mu.Unlock()
+}
+
+func (a *socksAssociation) closeSessions() {
+	a.mu.Lock()
+	ids := make([]string, 0, len(a.sessions))
+	for id := range a.sessions {
+		ids = append(ids, id)
+	}
+	a.mu.Unlock()
+
+	for _, id := range ids {
+		a.server.tracker.Remove(id)
+	}
+}
+
+// socksDatagramConn is how the tracker delivers replies to one session:
+// each write becomes a datagram to the client, headed by the destination
+// the reply comes from. Close only ends the session, the socket belongs to
+// the association.
+type socksDatagramConn struct {
+	*net.UDPConn
+	assoc  *socksAssociation
+	connID string
+	client netip.AddrPort
+	header []byte
+}
+
+func (c *socksDatagramConn) Write(b []byte) (int, error) {
+	datagram := append(append([]byte(nil), c.header...), b...)
+	if _, err := c.UDPConn.WriteToUDPAddrPort(datagram, c.client); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socksDatagramConn) Close() error {
+	c.assoc.endSession(c.connID)
+	return nil
+}
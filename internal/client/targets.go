@@ -0,0 +1,217 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"network-tunneler/pkg/netfilter"
+)
+
+// Target selects traffic by destination prefix and, optionally, protocol
+// and destination ports. Ports are single ports or ranges like "8000-8100".
+type Target struct {
+	CIDR     string   `mapstructure:"cidr" json:"cidr" yaml:"cidr"`
+	Protocol string   `mapstructure:"protocol" json:"protocol,omitempty" yaml:"protocol,omitempty"`
+	Ports    []string `mapstructure:"ports" json:"ports,omitempty" yaml:"ports,omitempty"`
+}
+
+// trafficMatch is a parsed Target. An empty Protocol matches both TCP and
+// UDP and Ports uses the iptables syntax ("80,443,8000:8100").
+type trafficMatch struct {
+	Prefix   netip.Prefix
+	Protocol netfilter.Protocol
+	Ports    string
+}
+
+func (m trafficMatch) key() string {
+	return fmt.Sprintf("%s/%s/%s", m.Prefix, m.Protocol, m.Ports)
+}
+
+func (m trafficMatch) covers(proto netfilter.Protocol) bool {
+	return m.Protocol == "" || m.Protocol == proto
+}
+
+// matches reports whether a connection of proto to addr and port falls
+// under m, for ingresses that filter in the client rather than in netfilter.
+func (m trafficMatch) matches(addr netip.Addr, proto netfilter.Protocol, port uint16) bool {
+	if !m.covers(proto) || !m.Prefix.Contains(addr.Unmap()) {
+		return false
+	}
+	if m.Ports == "" {
+		return true
+	}
+	for _, r := range strings.Split(m.Ports, ",") {
+		lo, hi, isRange := strings.Cut(r, ":")
+		if !isRange {
+			hi = lo
+		}
+		first, _ := strconv.ParseUint(lo, 10, 16)
+		last, _ := strconv.ParseUint(hi, 10, 16)
+		if uint64(port) >= first && uint64(port) <= last {
+			return true
+		}
+	}
+	return false
+}
+
+func (m trafficMatch) String() string {
+	s := m.Prefix.String()
+	if m.Protocol != "" {
+		s += " " + string(m.Protocol)
+	}
+	if m.Ports != "" {
+		s += " ports " + m.Ports
+	}
+	return s
+}
+
+// interceptTargets falls back to the single target_cidr when no targets
+// list is configured.
+func (c *Config) interceptTargets() []Target {
+	if len(c.Targets) > 0 {
+		return c.Targets
+	}
+	if c.TargetCIDR == "" {
+		return nil
+	}
+	return []Target{{CIDR: c.TargetCIDR}}
+}
+
+// parseIncludes parses the targets to intercept. TCP is redirected to the
+// local listener and UDP is diverted with TPROXY.
+func parseIncludes(targets []Target) ([]trafficMatch, error) {
+	matches := make([]trafficMatch, 0, len(targets))
+	for _, t := range targets {
+		m, err := parseTarget(t)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %w", t.CIDR, err)
+		}
+		matches = append(matches, m)
+	}
+	return matches, nil
+}
+
+// parseExcludes parses the targets left alone. Excludes are checked before
+// any include, for every protocol they cover.
+func parseExcludes(targets []Target) ([]trafficMatch, error) {
+	matches := make([]trafficMatch, 0, len(targets))
+	for _, t := range targets {
+		m, err := parseTarget(t)
+		if err != nil {
+			return nil, fmt.Errorf("exclude %q: %w", t.CIDR, err)
+		}
+		matches = append(matches, m)
+	}
+	return matches, nil
+}
+
+func interceptsUDP(includes []trafficMatch) bool {
+	for _, m := range includes {
+		if m.covers(netfilter.ProtocolUDP) {
+			return true
+		}
+	}
+	return false
+}
+
+// byFamily keeps the matches of one address family.
+func byFamily(matches []trafficMatch, ipv6 bool) []trafficMatch {
+	var out []trafficMatch
+	for _, m := range matches {
+		if m.Prefix.Addr().Is6() == ipv6 {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func parseTarget(t Target) (trafficMatch, error) {
+	prefix, err := netip.ParsePrefix(t.CIDR)
+	if err != nil {
+		return trafficMatch{}, fmt.Errorf("invalid CIDR: %w", err)
+	}
+	if prefix.Addr().Is4In6() {
+		return trafficMatch{}, fmt.Errorf("IPv4-mapped prefixes are not supported, use the IPv4 form")
+	}
+
+	m := trafficMatch{Prefix: prefix.Masked()}
+
+	switch proto := netfilter.Protocol(strings.ToLower(t.Protocol)); proto {
+	case "", netfilter.ProtocolTCP, netfilter.ProtocolUDP:
+		m.Protocol = proto
+	default:
+		return trafficMatch{}, fmt.Errorf("unsupported protocol %q", t.Protocol)
+	}
+
+	if len(t.Ports) > 0 {
+		ports := make([]string, 0, len(t.Ports))
+		for _, p := range t.Ports {
+			port, err := parsePortRange(p)
+			if err != nil {
+				return trafficMatch{}, err
+			}
+			ports = append(ports, port)
+		}
+		m.Ports = strings.Join(ports, ",")
+	}
+
+	return m, nil
+}
+
+func parsePortRange(s string) (string, error) {
+	lo, hi, isRange := strings.Cut(strings.TrimSpace(s), "-")
+
+	first, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil || first == 0 {
+		return "", fmt.Errorf("invalid port %q", s)
+	}
+	if !isRange {
+		return lo, nil
+	}
+
+	last, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil || last < first {
+		return "", fmt.Errorf("invalid port range %q", s)
+	}
+	return fmt.Sprintf("%d:%d", first, last), nil
+}
+
+// serverExcludes resolves the server address so the tunnel's own connection
+// is never redirected into itself. Addresses outside every include need no
+// rule.
+func serverExcludes(serverAddr string, includes []trafficMatch) ([]trafficMatch, error) {
+	host, _, err := net.SplitHostPort(serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server address %s: %w", serverAddr, err)
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve server address %s: %w", host, err)
+	}
+
+	var excludes []trafficMatch
+	seen := make(map[netip.Addr]bool)
+	for _, ip := range ips {
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+
+		for _, inc := range includes {
+			if inc.Prefix.Contains(addr) {
+				excludes = append(excludes, trafficMatch{Prefix: netip.PrefixFrom(addr, addr.BitLen())})
+				break
+			}
+		}
+	}
+	return excludes, nil
+}
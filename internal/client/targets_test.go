@@ -0,0 +1,135 @@
+package client
+
+import (
+	"net/netip"
+	"testing"
+
+	"network-tunneler/pkg/netfilter"
+)
+
+func TestParseIncludes(t *testing.T) {
+	matches, err := parseIncludes([]Target{
+		{CIDR: "10.1.2.3/8"},
+		{CIDR: "192.168.1.0/24", Protocol: "TCP", Ports: []string{"443", "8000-8100"}},
+		{CIDR: "fd00::1/8"},
+	})
+	if err != nil {
+		t.Fatalf("parseIncludes failed: %v", err)
+	}
+
+	if matches[0].Prefix != netip.MustParsePrefix("10.0.0.0/8") {
+		t.Errorf("expected masked prefix 10.0.0.0/8, got %s", matches[0].Prefix)
+	}
+	if !matches[0].covers(netfilter.ProtocolTCP) || !matches[0].covers(netfilter.ProtocolUDP) {
+		t.Errorf("expected a target without protocol to cover tcp and udp")
+	}
+	if matches[1].covers(netfilter.ProtocolUDP) {
+		t.Errorf("expected a tcp target not to cover udp")
+	}
+	if matches[1].Ports != "443,8000:8100" {
+		t.Errorf("expected ports 443,8000:8100, got %s", matches[1].Ports)
+	}
+	if matches[2].Prefix != netip.MustParsePrefix("fd00::/8") {
+		t.Errorf("expected masked prefix fd00::/8, got %s", matches[2].Prefix)
+	}
+	if v6 := byFamily(matches, true); len(v6) != 1 || v6[0] != matches[2] {
+		t.Errorf("expected only fd00::/8 in the IPv6 family, got %v", v6)
+	}
+
+	for _, bad := range []Target{
+		{CIDR: "10.0.0.0/8", Protocol: "sctp"},
+		{CIDR: "10.0.0.0/8", Ports: []string{"0"}},
+		{CIDR: "10.0.0.0/8", Ports: []string{"90-80"}},
+		{CIDR: "::ffff:10.0.0.0/104"},
+		{CIDR: "not-a-cidr"},
+	} {
+		if _, err := parseIncludes([]Target{bad}); err == nil {
+			t.Errorf("expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestParseExcludes(t *testing.T) {
+	matches, err := parseExcludes([]Target{
+		{CIDR: "10.0.5.0/24"},
+		{CIDR: "10.0.6.0/24", Ports: []string{"22"}},
+		{CIDR: "10.0.7.0/24", Protocol: "udp"},
+	})
+	if err != nil {
+		t.Fatalf("parseExcludes failed: %v", err)
+	}
+
+	if matches[0].Protocol != "" || matches[1].Protocol != "" {
+		t.Errorf("expected excludes without protocol to cover every protocol")
+	}
+	if matches[1].Ports != "22" {
+		t.Errorf("expected exclude port 22, got %q", matches[1].Ports)
+	}
+	if matches[2].covers(netfilter.ProtocolTCP) {
+		t.Errorf("expected a udp exclude not to cover tcp")
+	}
+}
+
+func TestServerExcludes(t *testing.T) {
+	includes, err := parseIncludes([]Target{{CIDR: "100.64.0.0/10"}})
+	if err != nil {
+		t.Fatalf("parseIncludes failed: %v", err)
+	}
+
+	excludes, err := serverExcludes("100.64.0.1:8080", includes)
+	if err != nil {
+		t.Fatalf("serverExcludes failed: %v", err)
+	}
+	if len(excludes) != 1 || excludes[0].Prefix != netip.MustParsePrefix("100.64.0.1/32") {
+		t.Errorf("expected server address to be excluded, got %v", excludes)
+	}
+	if excludes[0].Protocol != "" {
+		t.Errorf("expected server exclude to cover every protocol, got %q", excludes[0].Protocol)
+	}
+
+	includes6, err := parseIncludes([]Target{{CIDR: "fd00::/8"}})
+	if err != nil {
+		t.Fatalf("parseIncludes failed: %v", err)
+	}
+	excludes, err = serverExcludes("[fd00::1]:8080", includes6)
+	if err != nil {
+		t.Fatalf("serverExcludes failed: %v", err)
+	}
+	if len(excludes) != 1 || excludes[0].Prefix != netip.MustParsePrefix("fd00::1/128") {
+		t.Errorf("expected IPv6 server address to be excluded, got %v", excludes)
+	}
+
+	excludes, err = serverExcludes("203.0.113.10:8080", includes)
+	if err != nil {
+		t.Fatalf("serverExcludes failed: %v", err)
+	}
+	if len(excludes) != 0 {
+		t.Errorf("expected no exclude for a server outside the targets, got %v", excludes)
+	}
+}
+
+func TestTrafficMatch_Matches(t *testing.T) {
+	m, err := parseTarget(Target{CIDR: "10.0.0.0/8", Protocol: "tcp", Ports: []string{"443", "8000-8100"}})
+	if err != nil {
+		t.Fatalf("parseTarget failed: %v", err)
+	}
+
+	tests := []struct {
+		addr  string
+		proto netfilter.Protocol
+		port  uint16
+		want  bool
+	}{
+		{"10.1.2.3", netfilter.ProtocolTCP, 443, true},
+		{"10.1.2.3", netfilter.ProtocolTCP, 8050, true},
+		{"::ffff:10.1.2.3", netfilter.ProtocolTCP, 8100, true},
+		{"10.1.2.3", netfilter.ProtocolTCP, 80, false},
+		{"10.1.2.3", netfilter.ProtocolUDP, 443, false},
+		{"192.168.1.1", netfilter.ProtocolTCP, 443, false},
+	}
+	for _, tt := range tests {
+		if got := m.matches(netip.MustParseAddr(tt.addr), tt.proto, tt.port); got != tt.want {
+			t.Errorf("matches(%s, %s, %d) = %v, want %v", tt.addr, tt.proto, tt.port, got, tt.want)
+		}
+	}
+}
@@ -7,49 +7,147 @@ import (
 	"time"
 
 	"network-tunneler/pkg/logger"
+	pb "network-tunneler/proto"
 
 	"go.uber.org/fx"
 )
 
+const (
+	// SlowConsumerPause asks the proxy to stop reading from the target while
+	// a connection's queue drains.
+	SlowConsumerPause = "pause"
+	// SlowConsumerReset drops a connection whose queue fills up.
+	SlowConsumerReset = "reset"
+)
+
+// DeliveryConfig controls how replies are written to local connections.
+// Each connection has its own queue and writer, so a local application
+// that stops reading only stalls itself.
+type DeliveryConfig struct {
+	// QueueSize is the number of replies buffered per connection.
+	QueueSize int `mapstructure:"queue_size" json:"queue_size" yaml:"queue_size"`
+	// WriteTimeout resets a connection whose local side accepts no data
+	// for this long.
+	WriteTimeout time.Duration `mapstructure:"write_timeout" json:"write_timeout" yaml:"write_timeout"`
+	// SlowConsumer is "pause" (the default) or "reset".
+	SlowConsumer string `mapstructure:"slow_consumer" json:"slow_consumer" yaml:"slow_consumer"`
+}
+
+func DefaultDeliveryConfig() DeliveryConfig {
+	return DeliveryConfig{
+		QueueSize:    256,
+		WriteTimeout: 30 * time.Second,
+		SlowConsumer: SlowConsumerPause,
+	}
+}
+
+// withDefaults fills unset fields from DefaultDeliveryConfig.
+func (c DeliveryConfig) withDefaults() DeliveryConfig {
+	def := DefaultDeliveryConfig()
+	if c.QueueSize == 0 {
+		c.QueueSize = def.QueueSize
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = def.WriteTimeout
+	}
+	if c.SlowConsumer == "" {
+		c.SlowConsumer = def.SlowConsumer
+	}
+	return c
+}
+
+func (c DeliveryConfig) Validate() error {
+	c = c.withDefaults()
+	if c.QueueSize < 1 {
+		return fmt.Errorf("delivery queue size must be positive")
+	}
+	if c.WriteTimeout < 0 {
+		return fmt.Errorf("delivery write timeout must be positive")
+	}
+	switch c.SlowConsumer {
+	case SlowConsumerPause, SlowConsumerReset:
+	default:
+		return fmt.Errorf("unknown slow consumer policy %q", c.SlowConsumer)
+	}
+	return nil
+}
+
 type ConnectionState struct {
 	ConnectionID string
 	OriginalDest string
 	LocalConn    net.Conn
 	CreatedAt    time.Time
 	LastActivity time.Time
+	// BytesOut counts data sent to the server, BytesIn replies delivered
+	// to the local side.
+	BytesOut uint64
+	BytesIn  uint64
+
+	// queue holds replies for the connection's writer, which exits once
+	// done is closed.
+	queue chan []byte
+	done  chan struct{}
+	// paused is set while the proxy has been asked to hold the
+	// connection's data back.
+	paused bool
 }
 
 type ConnectionTracker struct {
 	connections map[string]*ConnectionState
 	mu          sync.RWMutex
 	logger      logger.Logger
+	config      DeliveryConfig
+	// onControl sends flow control signals for a connection to the proxy.
+	onControl func(connID string, ctrl pb.Control)
 }
 
 type TrackerParams struct {
 	fx.In
 
+	// Config is optional; without it the delivery defaults apply.
+	Config *Config `optional:"true"`
 	Logger logger.Logger
 }
 
 func NewConnectionTracker(p TrackerParams) *ConnectionTracker {
+	cfg := DefaultDeliveryConfig()
+	if p.Config != nil {
+		cfg = p.Config.Delivery.withDefaults()
+	}
 	return &ConnectionTracker{
 		connections: make(map[string]*ConnectionState),
 		logger:      p.Logger.With(logger.String("component", "tracker")),
+		config:      cfg,
 	}
 }
 
+// OnControl sets where flow control signals go. It must be called before
+// connections are tracked. PAUSE and RESUME are signalled with the tracker
+// locked, so fn must not block or call back into the tracker.
+func (ct *ConnectionTracker) OnControl(fn func(connID string, ctrl pb.Control)) {
+	ct.onControl = fn
+}
+
 func (ct *ConnectionTracker) Track(connID string, originalDest string, localConn net.Conn) {
 	ct.mu.Lock()
 	defer ct.mu.Unlock()
 
+	if old, exists := ct.connections[connID]; exists {
+		close(old.done)
+	}
+
 	now := time.Now()
-	ct.connections[connID] = &ConnectionState{
+	state := &ConnectionState{
 		ConnectionID: connID,
 		OriginalDest: originalDest,
 		LocalConn:    localConn,
 		CreatedAt:    now,
 		LastActivity: now,
+		queue:        make(chan []byte, ct.config.QueueSize),
+		done:         make(chan struct{}),
 	}
+	ct.connections[connID] = state
+	go ct.writeLoop(state)
 
 	ct.logger.Debug("connection tracked",
 		logger.String("connection_id", connID),
@@ -74,12 +172,56 @@ func (ct *ConnectionTracker) UpdateActivity(connID string) {
 	}
 }
 
+// IdleFor reports how long the connection has been inactive.
+func (ct *ConnectionTracker) IdleFor(connID string) (time.Duration, bool) {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+
+	state, exists := ct.connections[connID]
+	if !exists {
+		return 0, false
+	}
+	return time.Since(state.LastActivity), true
+}
+
+// ResetByPeer closes a connection the proxy refused or dropped. TCP sockets
+// are reset rather than closed, so the application sees a failure instead
+// of an empty reply. Nothing is signalled back.
+func (ct *ConnectionTracker) ResetByPeer(connID string) {
+	ct.mu.RLock()
+	state, exists := ct.connections[connID]
+	ct.mu.RUnlock()
+	if !exists {
+		return
+	}
+
+	if tcp, ok := state.LocalConn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	ct.Remove(connID)
+}
+
+// Reset closes a connection and tells the server, which passes the RESET on
+// to the proxy. It reports whether the connection was tracked.
+func (ct *ConnectionTracker) Reset(connID string, reason string) bool {
+	ct.mu.RLock()
+	state, exists := ct.connections[connID]
+	ct.mu.RUnlock()
+	if !exists {
+		return false
+	}
+
+	ct.reset(state, reason)
+	return true
+}
+
 func (ct *ConnectionTracker) Remove(connID string) {
 	ct.mu.Lock()
 	defer ct.mu.Unlock()
 
 	if state, exists := ct.connections[connID]; exists {
 		state.LocalConn.Close()
+		close(state.done)
 		delete(ct.connections, connID)
 
 		ct.logger.Debug("connection removed",
@@ -98,6 +240,7 @@ func (ct *ConnectionTracker) Cleanup(maxIdleTime time.Duration) int {
 	for connID, state := range ct.connections {
 		if now.Sub(state.LastActivity) > maxIdleTime {
 			state.LocalConn.Close()
+			close(state.done)
 			delete(ct.connections, connID)
 			removed++
 
@@ -117,30 +260,122 @@ func (ct *ConnectionTracker) Cleanup(maxIdleTime time.Duration) int {
 	return removed
 }
 
+// DeliverResponse queues data for the connection's writer without waiting
+// for the local side to accept it.
 func (ct *ConnectionTracker) DeliverResponse(connID string, data []byte) error {
-	ct.mu.RLock()
+	ct.mu.Lock()
 	state, exists := ct.connections[connID]
-	ct.mu.RUnlock()
-
 	if !exists {
+		ct.mu.Unlock()
 		return fmt.Errorf("connection not found: %s", connID)
 	}
 
-	ct.mu.Lock()
 	state.LastActivity = time.Now()
+
+	select {
+	case state.queue <- data:
+	default:
+		ct.mu.Unlock()
+		ct.reset(state, "delivery queue full")
+		return fmt.Errorf("delivery queue of connection %s is full", connID)
+	}
+
+	// Pausing early leaves room for the data already on its way. The signal
+	// is queued under the lock so it cannot overtake the writer's RESUME.
+	pause := ct.config.SlowConsumer == SlowConsumerPause && !state.paused &&
+		len(state.queue) >= (cap(state.queue)+3)/4
+	if pause {
+		state.paused = true
+		ct.signal(connID, pb.Control_CONTROL_PAUSE)
+	}
 	ct.mu.Unlock()
 
-	_, err := state.LocalConn.Write(data)
-	if err != nil {
-		return fmt.Errorf("failed to write to local connection: %w", err)
+	if pause {
+		ct.logger.Debug("local side is slow, pausing connection",
+			logger.String("connection_id", connID),
+		)
 	}
+	return nil
+}
 
-	ct.logger.Debug("response delivered",
-		logger.String("connection_id", connID),
-		logger.Int("bytes", len(data)),
+// writeLoop writes the connection's queued replies to the local side until
+// the connection is removed.
+func (ct *ConnectionTracker) writeLoop(state *ConnectionState) {
+	for {
+		var data []byte
+		select {
+		case <-state.done:
+			return
+		case data = <-state.queue:
+		}
+
+		state.LocalConn.SetWriteDeadline(time.Now().Add(ct.config.WriteTimeout))
+		if _, err := state.LocalConn.Write(data); err != nil {
+			ct.reset(state, fmt.Sprintf("failed to write to local connection: %v", err))
+			return
+		}
+
+		ct.mu.Lock()
+		state.BytesIn += uint64(len(data))
+		if state.paused && len(state.queue) == 0 {
+			state.paused = false
+			ct.signal(state.ConnectionID, pb.Control_CONTROL_RESUME)
+		}
+		ct.mu.Unlock()
+
+		ct.logger.Debug("response delivered",
+			logger.String("connection_id", state.ConnectionID),
+			logger.Int("bytes", len(data)),
+		)
+	}
+}
+
+// reset drops a connection the local side cannot keep up with and tells
+// the proxy to close it too. A connection removed meanwhile is left alone.
+func (ct *ConnectionTracker) reset(state *ConnectionState, reason string) {
+	ct.mu.Lock()
+	if ct.connections[state.ConnectionID] != state {
+		ct.mu.Unlock()
+		return
+	}
+	state.LocalConn.Close()
+	close(state.done)
+	delete(ct.connections, state.ConnectionID)
+	ct.mu.Unlock()
+
+	ct.logger.Warn("connection reset",
+		logger.String("connection_id", state.ConnectionID),
+		logger.String("reason", reason),
 	)
+	ct.signal(state.ConnectionID, pb.Control_CONTROL_RESET)
+}
 
-	return nil
+func (ct *ConnectionTracker) signal(connID string, ctrl pb.Control) {
+	if ct.onControl != nil {
+		ct.onControl(connID, ctrl)
+	}
+}
+
+// AddBytesOut counts data of the connection sent to the server.
+func (ct *ConnectionTracker) AddBytesOut(connID string, n int) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if state, exists := ct.connections[connID]; exists {
+		state.BytesOut += uint64(n)
+	}
+}
+
+// List returns a copy of every tracked connection's state.
+func (ct *ConnectionTracker) List() []ConnectionState {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+
+	states := make([]ConnectionState, 0, len(ct.connections))
+	for _, state := range ct.connections {
+		states = append(states, *state)
+	}
+	return states
 }
 
 func (ct *ConnectionTracker) Count() int {
@@ -1,12 +1,59 @@
 package client
 
 import (
+	"io"
+	"net"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
 	testutil "network-tunneler/internal/testing"
+	pb "network-tunneler/proto"
 )
 
+// waitDelivered waits until the connection's writer has delivered n bytes.
+func waitDelivered(t *testing.T, tracker *ConnectionTracker, connID string, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		tracker.mu.RLock()
+		state, exists := tracker.connections[connID]
+		delivered := exists && state.BytesIn >= uint64(n)
+		tracker.mu.RUnlock()
+		if delivered {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %d bytes to be delivered to %s", n, connID)
+}
+
+// expectControl waits for the next flow control signal.
+func expectControl(t *testing.T, signals <-chan pb.Control, want pb.Control) {
+	t.Helper()
+
+	select {
+	case got := <-signals:
+		if got != want {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for %v", want)
+	}
+}
+
+func newSignalingTracker(delivery DeliveryConfig) (*ConnectionTracker, chan pb.Control) {
+	cfg := DefaultConfig()
+	cfg.Delivery = delivery
+	tracker := NewConnectionTracker(TrackerParams{Config: cfg, Logger: testutil.NewTestLogger()})
+
+	signals := make(chan pb.Control, 10)
+	tracker.OnControl(func(connID string, ctrl pb.Control) { signals <- ctrl })
+	return tracker, signals
+}
+
 func TestConnectionTracker_Track(t *testing.T) {
 	log := testutil.NewTestLogger()
 	tracker := NewConnectionTracker(TrackerParams{Logger: log})
@@ -184,8 +231,9 @@ func TestConnectionTracker_DeliverResponse(t *testing.T) {
 	if err != nil {
 		t.Fatalf("DeliverResponse failed: %v", err)
 	}
+	waitDelivered(t, tracker, connID, len(responseData))
 
-	writtenData := mockConn.WriteBuf.Bytes()
+	writtenData := mockConn.Written()
 	if string(writtenData) != string(responseData) {
 		t.Errorf("expected data %s, got %s", responseData, writtenData)
 	}
@@ -208,6 +256,116 @@ func TestConnectionTracker_DeliverResponse_NotFound(t *testing.T) {
 	}
 }
 
+func TestConnectionTracker_SlowConsumerPause(t *testing.T) {
+	tracker, signals := newSignalingTracker(DeliveryConfig{QueueSize: 4})
+
+	local, app := net.Pipe()
+	defer app.Close()
+	tracker.Track("tcp-1", "192.168.1.1:80", local)
+
+	// Nothing reads from app, so the replies back up.
+	for _, data := range []string{"a", "b"} {
+		if err := tracker.DeliverResponse("tcp-1", []byte(data)); err != nil {
+			t.Fatalf("DeliverResponse failed: %v", err)
+		}
+	}
+	expectControl(t, signals, pb.Control_CONTROL_PAUSE)
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(app, buf); err != nil || string(buf) != "ab" {
+		t.Fatalf("expected %q, got %q (%v)", "ab", buf, err)
+	}
+	expectControl(t, signals, pb.Control_CONTROL_RESUME)
+
+	if tracker.Count() != 1 {
+		t.Error("expected the connection to stay open")
+	}
+}
+
+func TestConnectionTracker_PauseResumeAlternate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Delivery = DeliveryConfig{QueueSize: 64}
+	tracker := NewConnectionTracker(TrackerParams{Config: cfg, Logger: testutil.NewTestLogger()})
+
+	var mu sync.Mutex
+	var signals []pb.Control
+	tracker.OnControl(func(connID string, ctrl pb.Control) {
+		mu.Lock()
+		signals = append(signals, ctrl)
+		mu.Unlock()
+	})
+	tracker.Track("tcp-1", "192.168.1.1:80", testutil.NewMockNetConn())
+
+	// The writer drains the queue as fast as replies arrive, so pausing and
+	// resuming race on every few replies.
+	const replies = 5000
+	for i := 0; i < replies; i++ {
+		if err := tracker.DeliverResponse("tcp-1", []byte("x")); err != nil {
+			t.Fatalf("DeliverResponse failed: %v", err)
+		}
+		if i%8 == 0 {
+			runtime.Gosched()
+		}
+	}
+	waitDelivered(t, tracker, "tcp-1", replies)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, ctrl := range signals {
+		want := pb.Control_CONTROL_PAUSE
+		if i%2 == 1 {
+			want = pb.Control_CONTROL_RESUME
+		}
+		if ctrl != want {
+			t.Fatalf("signal %d is %v, want %v (pause and resume must alternate)", i, ctrl, want)
+		}
+	}
+	if len(signals)%2 != 0 {
+		t.Error("expected the connection to end up resumed")
+	}
+}
+
+func TestConnectionTracker_SlowConsumerReset(t *testing.T) {
+	tracker, signals := newSignalingTracker(DeliveryConfig{QueueSize: 2, SlowConsumer: SlowConsumerReset})
+
+	local, app := net.Pipe()
+	defer app.Close()
+	tracker.Track("tcp-1", "192.168.1.1:80", local)
+
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = tracker.DeliverResponse("tcp-1", []byte("data"))
+	}
+	if err == nil {
+		t.Fatal("expected the full queue to be reported")
+	}
+	expectControl(t, signals, pb.Control_CONTROL_RESET)
+
+	if tracker.Count() != 0 {
+		t.Error("expected the connection to be removed")
+	}
+	if _, err := app.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the local connection to be closed, got %v", err)
+	}
+}
+
+func TestConnectionTracker_WriteTimeout(t *testing.T) {
+	tracker, signals := newSignalingTracker(DeliveryConfig{WriteTimeout: 50 * time.Millisecond})
+
+	local, app := net.Pipe()
+	defer app.Close()
+	tracker.Track("tcp-1", "192.168.1.1:80", local)
+
+	if err := tracker.DeliverResponse("tcp-1", []byte("data")); err != nil {
+		t.Fatalf("DeliverResponse failed: %v", err)
+	}
+	expectControl(t, signals, pb.Control_CONTROL_RESET)
+
+	if tracker.Count() != 0 {
+		t.Error("expected the connection to be removed")
+	}
+}
+
 func TestConnectionTracker_Count(t *testing.T) {
 	log := testutil.NewTestLogger()
 	tracker := NewConnectionTracker(TrackerParams{Logger: log})
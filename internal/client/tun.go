@@ -0,0 +1,372 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/fx"
+
+	"network-tunneler/pkg/logger"
+	"network-tunneler/pkg/network"
+	pb "network-tunneler/proto"
+)
+
+const (
+	ModeRedirect = "redirect"
+	ModeTUN      = "tun"
+	ModeSOCKS    = "socks"
+)
+
+type TUNConfig struct {
+	Name string `mapstructure:"name" json:"name" yaml:"name"`
+	// Address is the interface address, which becomes the source of every
+	// tunneled packet. It should not be reachable through any target.
+	Address string `mapstructure:"address" json:"address" yaml:"address"`
+	MTU     int    `mapstructure:"mtu" json:"mtu" yaml:"mtu"`
+}
+
+func DefaultTUNConfig() TUNConfig {
+	return TUNConfig{
+		Name:    "tunnel0",
+		Address: "198.18.0.1/32",
+		MTU:     1400,
+	}
+}
+
+// withDefaults fills unset fields from DefaultTUNConfig.
+func (c TUNConfig) withDefaults() TUNConfig {
+	def := DefaultTUNConfig()
+	if c.Name == "" {
+		c.Name = def.Name
+	}
+	if c.Address == "" {
+		c.Address = def.Address
+	}
+	if c.MTU == 0 {
+		c.MTU = def.MTU
+	}
+	return c
+}
+
+func (c TUNConfig) Validate() error {
+	c = c.withDefaults()
+	if len(c.Name) >= 16 {
+		return fmt.Errorf("tun name %q is too long", c.Name)
+	}
+	addr, err := netip.ParsePrefix(c.Address)
+	if err != nil {
+		return fmt.Errorf("invalid tun address: %w", err)
+	}
+	if !addr.Addr().Is4() {
+		return fmt.Errorf("tun address must be IPv4")
+	}
+	if c.MTU < 576 || c.MTU > 65535 {
+		return fmt.Errorf("tun mtu must be between 576 and 65535")
+	}
+	return nil
+}
+
+// TUNManager is the layer-3 alternative to NetfilterManager: the prefixes
+// pushed by the server are routed into a TUN device and every packet read
+// from it is sent to the server whole. Excludes are cut out of the routes,
+// so targets cannot be narrowed by protocol or port.
+type TUNManager struct {
+	config *Config
+	tun    TUNConfig
+	logger logger.Logger
+	active bool
+
+	dev      *network.TUN
+	includes []netip.Prefix
+	excludes []netip.Prefix
+	routes   map[netip.Prefix]bool
+	// salt keeps flow IDs from different clients apart on the server.
+	salt []byte
+	mu   sync.Mutex
+}
+
+type TUNParams struct {
+	fx.In
+
+	Config *Config
+	Logger logger.Logger
+}
+
+func NewTUNManager(p TUNParams) *TUNManager {
+	return &TUNManager{
+		config: p.Config,
+		tun:    p.Config.TUN.withDefaults(),
+		logger: p.Logger.With(logger.String("component", "tun")),
+		routes: make(map[netip.Prefix]bool),
+	}
+}
+
+func (tm *TUNManager) Setup() error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if tm.active {
+		tm.logger.Warn("tun device already active")
+		return nil
+	}
+
+	includes, err := parseIncludes(tm.config.interceptTargets())
+	if err != nil {
+		return err
+	}
+	excludes, err := parseExcludes(tm.config.Exclude)
+	if err != nil {
+		return err
+	}
+	server, err := serverExcludes(tm.config.ServerAddr, includes)
+	if err != nil {
+		tm.logger.Warn("server address not excluded from interception", logger.Error(err))
+	}
+	for _, m := range server {
+		tm.logger.Info("excluding server address", logger.String("prefix", m.Prefix.String()))
+	}
+	excludes = append(excludes, server...)
+
+	addr, err := netip.ParsePrefix(tm.tun.Address)
+	if err != nil {
+		return fmt.Errorf("invalid tun address: %w", err)
+	}
+
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("failed to generate flow salt: %w", err)
+	}
+
+	dev, err := network.OpenTUN(tm.tun.Name)
+	if err != nil {
+		return err
+	}
+	if err := dev.Configure(addr, tm.tun.MTU); err != nil {
+		dev.Close()
+		return fmt.Errorf("failed to configure tun device: %w", err)
+	}
+
+	tm.dev = dev
+	tm.salt = salt
+	tm.includes = tm.includes[:0]
+	for _, m := range includes {
+		tm.includes = append(tm.includes, m.Prefix)
+	}
+	tm.excludes = tm.excludes[:0]
+	for _, m := range excludes {
+		tm.excludes = append(tm.excludes, m.Prefix)
+	}
+
+	tm.logger.Info("tun device ready, waiting for routes from server",
+		logger.String("device", dev.Name()),
+		logger.String("address", addr.String()),
+		logger.Int("mtu", tm.tun.MTU),
+		logger.Int("targets", len(tm.includes)),
+		logger.Int("excludes", len(tm.excludes)),
+	)
+
+	tm.active = true
+	return nil
+}
+
+// SyncRoutes points the pushed prefixes, clipped to the targets and minus
+// the excludes, at the device.
+func (tm *TUNManager) SyncRoutes(prefixes []string) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if !tm.active {
+		return fmt.Errorf("tun device not set up")
+	}
+
+	var pushed []netip.Prefix
+	for _, s := range prefixes {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			tm.logger.Warn("ignoring invalid route from server", logger.String("prefix", s))
+			continue
+		}
+		pushed = append(pushed, p)
+	}
+
+	desired := make(map[netip.Prefix]bool)
+	for _, p := range network.SubtractPrefixes(network.IntersectPrefixes(pushed, tm.includes), tm.excludes) {
+		desired[p] = true
+	}
+
+	var errs []error
+
+	for p := range tm.routes {
+		if desired[p] {
+			continue
+		}
+		if err := tm.dev.DeleteRoute(p); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(tm.routes, p)
+		tm.logger.Info("stopped routing prefix", logger.String("prefix", p.String()))
+	}
+
+	for p := range desired {
+		if tm.routes[p] {
+			continue
+		}
+		if err := tm.dev.AddRoute(p); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		tm.routes[p] = true
+		tm.logger.Info("routing prefix into tun device", logger.String("prefix", p.String()))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to sync %d route(s): %w", len(errs), errs[0])
+	}
+	return nil
+}
+
+// Serve sends every IPv4 packet read from the device to the server until
+// the device is closed. Packets are dropped rather than queued when the
+// server connection is saturated, like a congested link would.
+func (tm *TUNManager) Serve(serverWriter chan<- *pb.Packet) {
+	tm.mu.Lock()
+	dev := tm.dev
+	tm.mu.Unlock()
+
+	if dev == nil {
+		return
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := dev.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				tm.logger.Error("failed to read from tun device", logger.Error(err))
+			}
+			return
+		}
+
+		flow, err := network.ParseFlow(buf[:n])
+		if err != nil {
+			tm.logger.Debug("dropping packet from tun device", logger.Error(err))
+			continue
+		}
+
+		packet := &pb.Packet{
+			ConnectionId: tm.flowID(flow),
+			Data:         append([]byte(nil), buf[:n]...),
+			ConnTuple: &pb.ConnectionTuple{
+				SrcIp:   flow.Src.String(),
+				SrcPort: uint32(flow.SrcPort),
+				DstIp:   flow.Dst.String(),
+				DstPort: uint32(flow.DstPort),
+			},
+			Protocol:  pb.Protocol(flow.Protocol),
+			Direction: pb.Direction_DIRECTION_FORWARD,
+			Timestamp: time.Now().Unix(),
+			IpPacket:  true,
+		}
+
+		select {
+		case serverWriter <- packet:
+		default:
+			tm.logger.Warn("server writer channel full, dropping packet",
+				logger.String("connection_id", packet.ConnectionId),
+			)
+		}
+	}
+}
+
+// flowID names a flow in one direction. Connection IDs are global on the
+// server, and every client may use the same tun address, hence the salt.
+func (tm *TUNManager) flowID(f network.Flow) string {
+	src, dst := f.Src.As4(), f.Dst.As4()
+
+	h := sha256.New()
+	h.Write(tm.salt)
+	h.Write([]byte{byte(f.Protocol)})
+	h.Write(src[:])
+	h.Write(dst[:])
+	binary.Write(h, binary.BigEndian, [2]uint16{f.SrcPort, f.DstPort})
+
+	return fmt.Sprintf("ip-%x", h.Sum(nil)[:16])
+}
+
+// Deliver injects a packet received from the server.
+func (tm *TUNManager) Deliver(data []byte) error {
+	tm.mu.Lock()
+	dev := tm.dev
+	tm.mu.Unlock()
+
+	if dev == nil {
+		return fmt.Errorf("tun device not set up")
+	}
+	_, err := dev.Write(data)
+	return err
+}
+
+// Routes returns the prefixes currently routed into the device.
+func (tm *TUNManager) Routes() []netip.Prefix {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	routes := make([]netip.Prefix, 0, len(tm.routes))
+	for p := range tm.routes {
+		routes = append(routes, p)
+	}
+	network.SortPrefixes(routes)
+	return routes
+}
+
+// Close removes the device, and with it every route, which stops Serve.
+func (tm *TUNManager) Close() error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	return tm.closeLocked()
+}
+
+func (tm *TUNManager) closeLocked() error {
+	if tm.dev == nil {
+		return nil
+	}
+	err := tm.dev.Close()
+	tm.dev = nil
+	tm.routes = make(map[netip.Prefix]bool)
+	return err
+}
+
+func (tm *TUNManager) Cleanup() error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if !tm.active {
+		tm.logger.Debug("tun device not active, nothing to clean up")
+		return nil
+	}
+
+	if err := tm.closeLocked(); err != nil {
+		return fmt.Errorf("failed to close tun device: %w", err)
+	}
+
+	tm.active = false
+	tm.logger.Info("tun device removed")
+
+	return nil
+}
+
+func (tm *TUNManager) IsActive() bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	return tm.active
+}
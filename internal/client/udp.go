@@ -0,0 +1,224 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"network-tunneler/pkg/logger"
+	pkgnet "network-tunneler/pkg/network"
+	"network-tunneler/proto"
+)
+
+type UDPConfig struct {
+	// FwMark and RouteTable route marked datagrams back into the local
+	// stack, where the TPROXY rule hands them to the listener.
+	FwMark      int           `mapstructure:"fwmark" json:"fwmark" yaml:"fwmark"`
+	RouteTable  int           `mapstructure:"route_table" json:"route_table" yaml:"route_table"`
+	IdleTimeout time.Duration `mapstructure:"idle_timeout" json:"idle_timeout" yaml:"idle_timeout"`
+}
+
+func DefaultUDPConfig() UDPConfig {
+	return UDPConfig{
+		FwMark:      0x2a,
+		RouteTable:  100,
+		IdleTimeout: 60 * time.Second,
+	}
+}
+
+// withDefaults fills unset fields from DefaultUDPConfig.
+func (c UDPConfig) withDefaults() UDPConfig {
+	def := DefaultUDPConfig()
+	if c.FwMark == 0 {
+		c.FwMark = def.FwMark
+	}
+	if c.RouteTable == 0 {
+		c.RouteTable = def.RouteTable
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = def.IdleTimeout
+	}
+	return c
+}
+
+func (c UDPConfig) Validate() error {
+	c = c.withDefaults()
+	if c.FwMark < 0 {
+		return fmt.Errorf("udp fwmark must be positive")
+	}
+	// 253-255 are the kernel's default, main and local tables.
+	if c.RouteTable < 0 || (c.RouteTable >= 253 && c.RouteTable <= 255) {
+		return fmt.Errorf("udp route table %d is reserved or invalid", c.RouteTable)
+	}
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("udp idle timeout must be positive")
+	}
+	return nil
+}
+
+// UDPRelay tunnels datagrams diverted by TPROXY. Each flow gets a socket
+// bound to its original destination: replies from the server are written to
+// it, and the kernel delivers the application's later datagrams to it rather
+// than to the listener.
+type UDPRelay struct {
+	tracker      *ConnectionTracker
+	serverWriter chan<- *proto.Packet
+	idleTimeout  time.Duration
+	logger       logger.Logger
+	dialReply    func(from, to *net.UDPAddr) (*net.UDPConn, error)
+
+	sessions map[string]*net.UDPConn
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+}
+
+func NewUDPRelay(tracker *ConnectionTracker, serverWriter chan<- *proto.Packet, idleTimeout time.Duration, log logger.Logger) *UDPRelay {
+	return &UDPRelay{
+		tracker:      tracker,
+		serverWriter: serverWriter,
+		idleTimeout:  idleTimeout,
+		logger:       log.With(logger.String("component", "udp_relay")),
+		dialReply:    pkgnet.DialTransparentUDP,
+		sessions:     make(map[string]*net.UDPConn),
+	}
+}
+
+// Serve reads diverted datagrams until conn is closed, then closes every
+// session.
+func (r *UDPRelay) Serve(conn *net.UDPConn) {
+	defer r.closeSessions()
+
+	buf := make([]byte, 65535)
+	for {
+		n, src, dst, err := pkgnet.ReadFromUDPOrigDst(conn, buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			r.logger.Warn("failed to read datagram", logger.Error(err))
+			continue
+		}
+
+		r.handleDatagram(src, dst, buf[:n])
+	}
+}
+
+func (r *UDPRelay) handleDatagram(src, dst *net.UDPAddr, data []byte) {
+	connID := "udp-" + pkgnet.GenerateConnectionID(src.IP, uint16(src.Port), dst.IP, uint16(dst.Port))
+
+	r.mu.Lock()
+	_, exists := r.sessions[connID]
+	if !exists {
+		reply, err := r.dialReply(dst, src)
+		if err != nil {
+			r.mu.Unlock()
+			r.logger.Error("failed to open UDP session",
+				logger.Error(err),
+				logger.String("connection_id", connID),
+			)
+			return
+		}
+		r.sessions[connID] = reply
+		r.tracker.Track(connID, dst.String(), reply)
+
+		r.wg.Add(1)
+		go r.readSession(connID, src, dst, reply)
+
+		r.logger.Info("new UDP session",
+			logger.String("connection_id", connID),
+			logger.String("source", src.String()),
+			logger.String("original_dest", dst.String()),
+		)
+	}
+	r.mu.Unlock()
+
+	r.tracker.UpdateActivity(connID)
+	r.forward(connID, src, dst, data)
+}
+
+// readSession forwards datagrams the kernel delivers to the session socket
+// and ends the session once neither direction has been active for the idle
+// timeout.
+func (r *UDPRelay) readSession(connID string, src, dst *net.UDPAddr, reply *net.UDPConn) {
+	defer r.wg.Done()
+	defer r.endSession(connID)
+
+	buf := make([]byte, 65535)
+	for {
+		_ = reply.SetReadDeadline(time.Now().Add(r.idleTimeout))
+
+		n, err := reply.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if idle, ok := r.tracker.IdleFor(connID); ok && idle < r.idleTimeout {
+					continue
+				}
+				r.logger.Debug("UDP session expired", logger.String("connection_id", connID))
+				return
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				r.logger.Debug("UDP session closed",
+					logger.Error(err),
+					logger.String("connection_id", connID),
+				)
+			}
+			return
+		}
+
+		r.tracker.UpdateActivity(connID)
+		r.forward(connID, src, dst, buf[:n])
+	}
+}
+
+func (r *UDPRelay) endSession(connID string) {
+	r.mu.Lock()
+	delete(r.sessions, connID)
+	r.mu.Unlock()
+
+	r.tracker.Remove(connID)
+}
+
+func (r *UDPRelay) forward(connID string, src, dst *net.UDPAddr, data []byte) {
+	packet := &proto.Packet{
+		ConnectionId: connID,
+		Data:         append([]byte(nil), data...),
+		ConnTuple: &proto.ConnectionTuple{
+			SrcIp:   src.IP.String(),
+			SrcPort: uint32(src.Port),
+			DstIp:   dst.IP.String(),
+			DstPort: uint32(dst.Port),
+		},
+		Protocol:  proto.Protocol_PROTOCOL_UDP,
+		Direction: proto.Direction_DIRECTION_FORWARD,
+		Timestamp: time.Now().Unix(),
+	}
+
+	// Datagrams may be lost anyway; waiting here would stall every flow.
+	select {
+	case r.serverWriter <- packet:
+	default:
+		r.logger.Warn("server writer channel full, dropping datagram",
+			logger.String("connection_id", connID),
+		)
+	}
+}
+
+func (r *UDPRelay) closeSessions() {
+	r.mu.Lock()
+	for _, reply := range r.sessions {
+		reply.Close()
+	}
+	r.mu.Unlock()
+
+	r.wg.Wait()
+}
+
+func (r *UDPRelay) Count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.sessions)
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	testutil "network-tunneler/internal/testing"
+	pb "network-tunneler/proto"
+)
+
+func newTestUDPRelay(tracker *ConnectionTracker, serverChan chan *pb.Packet, idle time.Duration) *UDPRelay {
+	relay := NewUDPRelay(tracker, serverChan, idle, testutil.NewTestLogger())
+	// A plain socket stands in for the transparent one, which needs TPROXY.
+	relay.dialReply = func(from, to *net.UDPAddr) (*net.UDPConn, error) {
+		return net.DialUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, to)
+	}
+	return relay
+}
+
+func TestUDPRelay_PreservesDatagrams(t *testing.T) {
+	log := testutil.NewTestLogger()
+	tracker := NewConnectionTracker(TrackerParams{Logger: log})
+	serverChan := make(chan *pb.Packet, 10)
+	relay := newTestUDPRelay(tracker, serverChan, time.Minute)
+	defer relay.closeSessions()
+
+	app, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to open app socket: %v", err)
+	}
+	defer app.Close()
+
+	src := app.LocalAddr().(*net.UDPAddr)
+	dst := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 53), Port: 53}
+
+	relay.handleDatagram(src, dst, []byte("first"))
+	relay.handleDatagram(src, dst, []byte("second"))
+
+	var connID string
+	for _, want := range []string{"first", "second"} {
+		select {
+		case pkt := <-serverChan:
+			if string(pkt.Data) != want {
+				t.Errorf("expected datagram %q, got %q", want, pkt.Data)
+			}
+			if pkt.Protocol != pb.Protocol_PROTOCOL_UDP {
+				t.Errorf("expected UDP protocol, got %v", pkt.Protocol)
+			}
+			if pkt.ConnTuple.DstIp != "10.0.0.53" || pkt.ConnTuple.DstPort != 53 {
+				t.Errorf("expected original destination 10.0.0.53:53, got %s:%d", pkt.ConnTuple.DstIp, pkt.ConnTuple.DstPort)
+			}
+			if connID != "" && pkt.ConnectionId != connID {
+				t.Errorf("expected one session, got %s and %s", connID, pkt.ConnectionId)
+			}
+			connID = pkt.ConnectionId
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for datagram")
+		}
+	}
+
+	if relay.Count() != 1 {
+		t.Errorf("expected 1 session, got %d", relay.Count())
+	}
+
+	if err := tracker.DeliverResponse(connID, []byte("answer")); err != nil {
+		t.Fatalf("DeliverResponse failed: %v", err)
+	}
+
+	buf := make([]byte, 1500)
+	app.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := app.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if string(buf[:n]) != "answer" {
+		t.Errorf("expected reply answer, got %q", buf[:n])
+	}
+
+	// Later datagrams arrive on the session socket rather than the listener.
+	if _, err := app.WriteToUDP([]byte("third"), from); err != nil {
+		t.Fatalf("failed to send to session socket: %v", err)
+	}
+
+	select {
+	case pkt := <-serverChan:
+		if string(pkt.Data) != "third" || pkt.ConnectionId != connID {
+			t.Errorf("expected third datagram on %s, got %q on %s", connID, pkt.Data, pkt.ConnectionId)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for datagram from session socket")
+	}
+}
+
+func TestUDPRelay_IdleTimeout(t *testing.T) {
+	log := testutil.NewTestLogger()
+	tracker := NewConnectionTracker(TrackerParams{Logger: log})
+	serverChan := make(chan *pb.Packet, 10)
+	relay := newTestUDPRelay(tracker, serverChan, 100*time.Millisecond)
+	defer relay.closeSessions()
+
+	src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	dst := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 53), Port: 53}
+	relay.handleDatagram(src, dst, []byte("query"))
+
+	pkt := <-serverChan
+
+	deadline := time.Now().Add(2 * time.Second)
+	for relay.Count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if relay.Count() != 0 {
+		t.Error("expected idle session to expire")
+	}
+	if _, ok := tracker.Get(pkt.ConnectionId); ok {
+		t.Error("expected expired session to be removed from the tracker")
+	}
+}
@@ -0,0 +1,78 @@
+package control
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	testutil "network-tunneler/internal/testing"
+)
+
+func TestServerClient_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+
+	s := NewServer(path, testutil.NewTestLogger())
+	s.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		var in map[string]string
+		if err := DecodeJSON(r, &in); err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, in)
+	})
+	s.HandleFunc("/fail", func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, http.StatusNotFound, fmt.Errorf("proxy proxy-9 not found"))
+	})
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Stop(ctx)
+	}()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("socket not created: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("expected socket permissions 0600, got %o", perm)
+	}
+
+	client := NewClient(path)
+
+	var out map[string]string
+	if err := client.Post("/echo", map[string]string{"id": "proxy-1"}, &out); err != nil {
+		t.Fatalf("Post failed: %v", err)
+	}
+	if out["id"] != "proxy-1" {
+		t.Errorf("expected echoed id, got %v", out)
+	}
+
+	err = client.Get("/fail", nil)
+	if err == nil || err.Error() != "proxy proxy-9 not found" {
+		t.Errorf("expected server error message, got %v", err)
+	}
+}
+
+func TestServer_RefusesSocketInUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+
+	first := NewServer(path, testutil.NewTestLogger())
+	if err := first.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer first.Stop(context.Background())
+
+	second := NewServer(path, testutil.NewTestLogger())
+	if err := second.Start(); err == nil {
+		t.Error("expected second server to refuse a socket in use")
+		second.Stop(context.Background())
+	}
+}
@@ -0,0 +1,62 @@
+package health
+
+import (
+	"sync"
+)
+
+type Config struct {
+	ListenAddr string `mapstructure:"listen_addr" json:"listen_addr" yaml:"listen_addr"`
+}
+
+type Check func() error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+type Checker struct {
+	checks []namedCheck
+	mu     sync.RWMutex
+}
+
+type Status struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+func NewChecker() *Checker {
+	return &Checker{
+		checks: make([]namedCheck, 0),
+	}
+}
+
+func (c *Checker) AddReadinessCheck(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+func (c *Checker) Readiness() Status {
+	c.mu.RLock()
+	checks := make([]namedCheck, len(c.checks))
+	copy(checks, c.checks)
+	c.mu.RUnlock()
+
+	status := Status{
+		Ready:  true,
+		Checks: make(map[string]string, len(checks)),
+	}
+
+	for _, nc := range checks {
+		if err := nc.check(); err != nil {
+			status.Ready = false
+			status.Checks[nc.name] = err.Error()
+			continue
+		}
+		status.Checks[nc.name] = "ok"
+	}
+
+	return status
+}
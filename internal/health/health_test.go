@@ -0,0 +1,80 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	testutil "network-tunneler/internal/testing"
+)
+
+func TestChecker_NoChecksIsReady(t *testing.T) {
+	checker := NewChecker()
+
+	status := checker.Readiness()
+	if !status.Ready {
+		t.Error("expected checker without checks to be ready")
+	}
+}
+
+func TestChecker_FailingCheck(t *testing.T) {
+	checker := NewChecker()
+	checker.AddReadinessCheck("ok", func() error { return nil })
+	checker.AddReadinessCheck("broken", func() error { return errors.New("not registered") })
+
+	status := checker.Readiness()
+	if status.Ready {
+		t.Error("expected checker to be not ready")
+	}
+
+	if status.Checks["ok"] != "ok" {
+		t.Errorf("expected check 'ok' to pass, got %q", status.Checks["ok"])
+	}
+
+	if status.Checks["broken"] != "not registered" {
+		t.Errorf("expected check 'broken' to report error, got %q", status.Checks["broken"])
+	}
+}
+
+func TestServer_Endpoints(t *testing.T) {
+	ready := false
+	checker := NewChecker()
+	checker.AddReadinessCheck("listeners", func() error {
+		if !ready {
+			return errors.New("listeners not started")
+		}
+		return nil
+	})
+
+	s := NewServer("127.0.0.1:0", checker, testutil.NewTestLogger())
+
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected /healthz 200, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected /readyz 503 before ready, got %d", rec.Code)
+	}
+
+	ready = true
+
+	rec = httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected /readyz 200 when ready, got %d", rec.Code)
+	}
+
+	var status Status
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatalf("failed to decode readiness response: %v", err)
+	}
+	if status.Checks["listeners"] != "ok" {
+		t.Errorf("expected listeners check ok, got %q", status.Checks["listeners"])
+	}
+}
@@ -0,0 +1,98 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"network-tunneler/pkg/logger"
+)
+
+type Server struct {
+	addr       string
+	checker    *Checker
+	logger     logger.Logger
+	mux        *http.ServeMux
+	httpServer *http.Server
+	wg         sync.WaitGroup
+}
+
+func NewServer(addr string, checker *Checker, log logger.Logger) *Server {
+	s := &Server{
+		addr:    addr,
+		checker: checker,
+		logger:  log.With(logger.String("component", "health")),
+		mux:     http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/healthz", s.handleLiveness)
+	s.mux.HandleFunc("/readyz", s.handleReadiness)
+
+	return s
+}
+
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+func (s *Server) Start() error {
+	lis, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for health checks on %s: %w", s.addr, err)
+	}
+
+	s.httpServer = &http.Server{
+		Handler:           s.mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	s.logger.Info("health server listening", logger.String("addr", lis.Addr().String()))
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.httpServer.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("health server error", logger.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+func (s *Server) Stop(ctx context.Context) error {
+	if s.httpServer == nil {
+		return nil
+	}
+
+	err := s.httpServer.Shutdown(ctx)
+	s.wg.Wait()
+
+	s.logger.Info("health server stopped")
+	return err
+}
+
+func (s *Server) handleLiveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (s *Server) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	status := s.checker.Readiness()
+
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		s.logger.Debug("failed to write readiness response", logger.Error(err))
+	}
+}
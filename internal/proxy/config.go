@@ -2,18 +2,35 @@ package proxy
 
 import (
 	"fmt"
+	"net"
+	"strings"
 
 	"network-tunneler/internal/config"
+	"network-tunneler/internal/health"
+	"network-tunneler/internal/reconnect"
 	"network-tunneler/pkg/crypto"
 	"network-tunneler/pkg/logger"
 )
 
 type Config struct {
-	ServerAddr  string            `mapstructure:"server_addr" json:"server_addr" yaml:"server_addr"`
-	ProxyID     string            `mapstructure:"proxy_id" json:"proxy_id" yaml:"proxy_id"`
-	ManagedCIDR string            `mapstructure:"managed_cidr" json:"managed_cidr" yaml:"managed_cidr"`
-	TLS         crypto.TLSOptions `mapstructure:"tls" json:"tls" yaml:"tls"`
-	Log         logger.Config     `mapstructure:"log" json:"log" yaml:"log"`
+	ServerAddr  string `mapstructure:"server_addr" json:"server_addr" yaml:"server_addr"`
+	ProxyID     string `mapstructure:"proxy_id" json:"proxy_id" yaml:"proxy_id"`
+	ManagedCIDR string `mapstructure:"managed_cidr" json:"managed_cidr" yaml:"managed_cidr"`
+	// TranslateCIDR is the network actually dialed for the managed CIDR,
+	// mapped 1:1 by host bits. Empty dials managed addresses as they are.
+	TranslateCIDR string `mapstructure:"translate_cidr" json:"translate_cidr" yaml:"translate_cidr"`
+	// Domains are DNS suffixes; connections to hostnames under them (from
+	// SOCKS clients) are routed here and resolved by this proxy.
+	Domains []string `mapstructure:"domains" json:"domains" yaml:"domains"`
+	// ProbeTargets are host:port addresses in the managed network; readiness
+	// needs one of them to accept TCP. Required when health is enabled.
+	ProbeTargets []string          `mapstructure:"probe_targets" json:"probe_targets" yaml:"probe_targets"`
+	TLS          crypto.TLSOptions `mapstructure:"tls" json:"tls" yaml:"tls"`
+	Health       health.Config     `mapstructure:"health" json:"health" yaml:"health"`
+	TUN          TUNConfig         `mapstructure:"tun" json:"tun" yaml:"tun"`
+	Egress       EgressConfig      `mapstructure:"egress" json:"egress" yaml:"egress"`
+	Reconnect    reconnect.Config  `mapstructure:"reconnect" json:"reconnect" yaml:"reconnect"`
+	Log          logger.Config     `mapstructure:"log" json:"log" yaml:"log"`
 }
 
 func DefaultConfig() *Config {
@@ -22,6 +39,9 @@ func DefaultConfig() *Config {
 		ProxyID:     "proxy-1",
 		ManagedCIDR: "192.168.1.0/24",
 		TLS:         crypto.TLSOptions{},
+		Health:      health.Config{},
+		TUN:         DefaultTUNConfig(),
+		Reconnect:   reconnect.DefaultConfig(),
 		Log:         config.DefaultLogConfig(),
 	}
 }
@@ -44,5 +64,27 @@ func (c *Config) Validate() error {
 	if c.ManagedCIDR == "" {
 		return fmt.Errorf("managed CIDR is required")
 	}
+	if _, err := newCIDRTranslation(c.ManagedCIDR, c.TranslateCIDR); err != nil {
+		return err
+	}
+	for _, d := range c.Domains {
+		if strings.Trim(d, ".") == "" || strings.ContainsAny(d, " /:") {
+			return fmt.Errorf("invalid domain %q", d)
+		}
+	}
+	if c.Health.ListenAddr != "" && len(c.ProbeTargets) == 0 {
+		return fmt.Errorf("probe_targets are required when health.listen_addr is set")
+	}
+	for _, t := range c.ProbeTargets {
+		if _, _, err := net.SplitHostPort(t); err != nil {
+			return fmt.Errorf("invalid probe target %q: %w", t, err)
+		}
+	}
+	if err := c.TUN.Validate(); err != nil {
+		return err
+	}
+	if err := c.Egress.Validate(); err != nil {
+		return err
+	}
 	return nil
 }
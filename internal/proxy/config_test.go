@@ -2,6 +2,8 @@ package proxy
 
 import (
 	"testing"
+
+	"network-tunneler/internal/health"
 )
 
 func TestDefaultConfig(t *testing.T) {
@@ -47,6 +49,67 @@ func TestConfigValidation(t *testing.T) {
 			},
 			expectErr: true,
 		},
+		{
+			name: "tun address without room for a translated source",
+			cfg: &Config{
+				ServerAddr:  "localhost:8081",
+				ProxyID:     "proxy-1",
+				ManagedCIDR: "192.168.1.0/24",
+				TUN:         TUNConfig{Enabled: true, Name: "tunnel0", Address: "198.19.0.1/32", MTU: 1400},
+			},
+			expectErr: true,
+		},
+		{
+			name: "translated managed CIDR",
+			cfg: &Config{
+				ServerAddr:    "localhost:8081",
+				ProxyID:       "proxy-1",
+				ManagedCIDR:   "100.64.1.0/24",
+				TranslateCIDR: "192.168.1.0/24",
+			},
+			expectErr: false,
+		},
+		{
+			name: "translate CIDR of another size",
+			cfg: &Config{
+				ServerAddr:    "localhost:8081",
+				ProxyID:       "proxy-1",
+				ManagedCIDR:   "100.64.1.0/24",
+				TranslateCIDR: "192.168.0.0/16",
+			},
+			expectErr: true,
+		},
+		{
+			name: "health without probe targets",
+			cfg: &Config{
+				ServerAddr:  "localhost:8081",
+				ProxyID:     "proxy-1",
+				ManagedCIDR: "192.168.1.0/24",
+				Health:      health.Config{ListenAddr: ":8083"},
+			},
+			expectErr: true,
+		},
+		{
+			name: "health with probe targets",
+			cfg: &Config{
+				ServerAddr:   "localhost:8081",
+				ProxyID:      "proxy-1",
+				ManagedCIDR:  "192.168.1.0/24",
+				ProbeTargets: []string{"192.168.1.1:22"},
+				Health:       health.Config{ListenAddr: ":8083"},
+			},
+			expectErr: false,
+		},
+		{
+			name: "probe target without port",
+			cfg: &Config{
+				ServerAddr:   "localhost:8081",
+				ProxyID:      "proxy-1",
+				ManagedCIDR:  "192.168.1.0/24",
+				ProbeTargets: []string{"192.168.1.1"},
+			},
+			expectErr: true,
+		},
 		{
 			name: "missing managed CIDR",
 			cfg: &Config{
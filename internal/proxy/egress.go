@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"network-tunneler/pkg/logger"
+)
+
+// errEgressDenied is wrapped by every refusal of the egress checks, so a
+// refused connection can be told apart from an unreachable target.
+var errEgressDenied = errors.New("egress denied")
+
+// EgressConfig limits what the server can make the proxy dial. It applies
+// to the address actually dialed: after CIDR translation, and to every
+// address a hostname resolves to. Loopback and link-local destinations,
+// which include the proxy host itself and cloud metadata endpoints, are
+// refused unless allowed here.
+type EgressConfig struct {
+	// Allow limits destinations to these prefixes; empty allows any.
+	Allow []string `mapstructure:"allow" json:"allow" yaml:"allow"`
+	Deny  []string `mapstructure:"deny" json:"deny" yaml:"deny"`
+	// Ports limits destination ports to single ports or ranges like
+	// "8000-8100"; empty allows any.
+	Ports          []string `mapstructure:"ports" json:"ports" yaml:"ports"`
+	DenyPorts      []string `mapstructure:"deny_ports" json:"deny_ports" yaml:"deny_ports"`
+	AllowLoopback  bool     `mapstructure:"allow_loopback" json:"allow_loopback" yaml:"allow_loopback"`
+	AllowLinkLocal bool     `mapstructure:"allow_link_local" json:"allow_link_local" yaml:"allow_link_local"`
+}
+
+func (c EgressConfig) Validate() error {
+	_, err := c.parse()
+	return err
+}
+
+type portRange struct {
+	first, last uint16
+}
+
+func (r portRange) contains(port uint16) bool {
+	return port >= r.first && port <= r.last
+}
+
+// egressPolicy is the parsed EgressConfig together with what the proxy
+// advertises. A nil policy allows everything.
+type egressPolicy struct {
+	managed   netip.Prefix
+	domains   []string
+	allow     []netip.Prefix
+	deny      []netip.Prefix
+	ports     []portRange
+	denyPorts []portRange
+
+	allowLoopback  bool
+	allowLinkLocal bool
+}
+
+func newEgressPolicy(cfg *Config) (*egressPolicy, error) {
+	policy, err := cfg.Egress.parse()
+	if err != nil {
+		return nil, err
+	}
+	managed, err := netip.ParsePrefix(cfg.ManagedCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid managed CIDR: %w", err)
+	}
+	policy.managed = managed.Masked()
+	for _, d := range cfg.Domains {
+		policy.domains = append(policy.domains, strings.Trim(strings.ToLower(d), "."))
+	}
+	return policy, nil
+}
+
+func (c EgressConfig) parse() (*egressPolicy, error) {
+	policy := &egressPolicy{
+		allowLoopback:  c.AllowLoopback,
+		allowLinkLocal: c.AllowLinkLocal,
+	}
+
+	var err error
+	if policy.allow, err = parsePrefixes(c.Allow); err != nil {
+		return nil, fmt.Errorf("egress allow: %w", err)
+	}
+	if policy.deny, err = parsePrefixes(c.Deny); err != nil {
+		return nil, fmt.Errorf("egress deny: %w", err)
+	}
+	if policy.ports, err = parsePortRanges(c.Ports); err != nil {
+		return nil, fmt.Errorf("egress ports: %w", err)
+	}
+	if policy.denyPorts, err = parsePortRanges(c.DenyPorts); err != nil {
+		return nil, fmt.Errorf("egress deny ports: %w", err)
+	}
+	return policy, nil
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, c := range cidrs {
+		prefix, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", c, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func parsePortRanges(ports []string) ([]portRange, error) {
+	ranges := make([]portRange, 0, len(ports))
+	for _, p := range ports {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(p), "-")
+		if !isRange {
+			hi = lo
+		}
+		first, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil || first == 0 {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+		last, err := strconv.ParseUint(hi, 10, 16)
+		if err != nil || last < first {
+			return nil, fmt.Errorf("invalid port range %q", p)
+		}
+		ranges = append(ranges, portRange{first: uint16(first), last: uint16(last)})
+	}
+	return ranges, nil
+}
+
+// checkRequested verifies that a destination from the server is one this
+// proxy advertises: an address inside the managed CIDR, or a hostname under
+// one of its domains.
+func (p *egressPolicy) checkRequested(addr netip.Addr, host string) error {
+	if p == nil {
+		return nil
+	}
+	if addr.IsValid() {
+		if !p.managed.Contains(addr.Unmap()) {
+			return fmt.Errorf("%w: %s is outside the managed CIDR %s", errEgressDenied, addr, p.managed)
+		}
+		return nil
+	}
+
+	name := strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, d := range p.domains {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is not under a managed domain", errEgressDenied, host)
+}
+
+// checkDial applies the local policy to an address about to be dialed.
+// Port 0 stands for protocols without ports, which port rules leave alone.
+func (p *egressPolicy) checkDial(addr netip.Addr, port uint16) error {
+	if p == nil {
+		return nil
+	}
+	addr = addr.Unmap()
+
+	switch {
+	case (addr.IsLoopback() || addr.IsUnspecified()) && !p.allowLoopback:
+		return fmt.Errorf("%w: %s is a loopback address", errEgressDenied, addr)
+	case (addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast()) && !p.allowLinkLocal:
+		return fmt.Errorf("%w: %s is a link-local address", errEgressDenied, addr)
+	}
+
+	for _, prefix := range p.deny {
+		if prefix.Contains(addr) {
+			return fmt.Errorf("%w: %s is in denied prefix %s", errEgressDenied, addr, prefix)
+		}
+	}
+	if len(p.allow) > 0 && !containsAddr(p.allow, addr) {
+		return fmt.Errorf("%w: %s is outside the allowed prefixes", errEgressDenied, addr)
+	}
+
+	if port == 0 {
+		return nil
+	}
+	for _, r := range p.denyPorts {
+		if r.contains(port) {
+			return fmt.Errorf("%w: port %d is denied", errEgressDenied, port)
+		}
+	}
+	if len(p.ports) > 0 && !containsPort(p.ports, port) {
+		return fmt.Errorf("%w: port %d is not allowed", errEgressDenied, port)
+	}
+	return nil
+}
+
+// dialControl checks every address the dialer is about to connect to, so
+// hostnames are held to the policy with whatever they resolve to.
+func (p *egressPolicy) dialControl(network, address string, c syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: unparsable address %s", errEgressDenied, address)
+	}
+	return p.checkDial(ap.Addr(), ap.Port())
+}
+
+// logEgressDenied records a refused connection as a security event: the
+// server asked for something this proxy does not serve.
+func logEgressDenied(log logger.Logger, connID, requested string, err error) {
+	log.Warn("security event: connection refused by egress policy",
+		logger.String("event", "egress_denied"),
+		logger.String("conn_id", connID),
+		logger.String("requested", requested),
+		logger.Error(err),
+	)
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(ranges []portRange, port uint16) bool {
+	for _, r := range ranges {
+		if r.contains(port) {
+			return true
+		}
+	}
+	return false
+}
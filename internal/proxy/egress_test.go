@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestEgressPolicy_CheckDial(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Egress = EgressConfig{
+		Allow:     []string{"192.168.0.0/16", "169.254.0.0/16"},
+		Deny:      []string{"192.168.1.1/32"},
+		Ports:     []string{"22", "8000-8999"},
+		DenyPorts: []string{"8080"},
+	}
+	policy, err := newEgressPolicy(cfg)
+	if err != nil {
+		t.Fatalf("newEgressPolicy failed: %v", err)
+	}
+
+	tests := []struct {
+		addr    string
+		port    uint16
+		allowed bool
+	}{
+		{"192.168.1.5", 22, true},
+		{"192.168.1.5", 8443, true},
+		{"192.168.1.5", 0, true},
+		{"192.168.1.5", 80, false},
+		{"192.168.1.5", 8080, false},
+		{"192.168.1.1", 22, false},
+		{"10.0.0.1", 22, false},
+		{"127.0.0.1", 22, false},
+		{"::ffff:127.0.0.1", 22, false},
+		{"0.0.0.0", 22, false},
+		{"169.254.169.254", 22, false},
+	}
+
+	for _, tt := range tests {
+		err := policy.checkDial(netip.MustParseAddr(tt.addr), tt.port)
+		if tt.allowed && err != nil {
+			t.Errorf("%s port %d: expected allowed, got %v", tt.addr, tt.port, err)
+		}
+		if !tt.allowed && !errors.Is(err, errEgressDenied) {
+			t.Errorf("%s port %d: expected an egress denial, got %v", tt.addr, tt.port, err)
+		}
+	}
+
+	cfg.Egress.AllowLinkLocal = true
+	policy, _ = newEgressPolicy(cfg)
+	if err := policy.checkDial(netip.MustParseAddr("169.254.169.254"), 22); err != nil {
+		t.Errorf("expected link-local to be allowed, got %v", err)
+	}
+}
+
+func TestEgressPolicy_CheckRequested(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Domains = []string{".corp.internal."}
+	policy, err := newEgressPolicy(cfg)
+	if err != nil {
+		t.Fatalf("newEgressPolicy failed: %v", err)
+	}
+
+	if err := policy.checkRequested(netip.MustParseAddr("192.168.1.5"), ""); err != nil {
+		t.Errorf("expected managed address to be allowed, got %v", err)
+	}
+	if err := policy.checkRequested(netip.MustParseAddr("192.168.2.5"), ""); !errors.Is(err, errEgressDenied) {
+		t.Errorf("expected an egress denial, got %v", err)
+	}
+	if err := policy.checkRequested(netip.Addr{}, "Git.Corp.Internal"); err != nil {
+		t.Errorf("expected managed hostname to be allowed, got %v", err)
+	}
+	if err := policy.checkRequested(netip.Addr{}, "corp.internal.evil.com"); !errors.Is(err, errEgressDenied) {
+		t.Errorf("expected an egress denial, got %v", err)
+	}
+}
+
+func TestEgressConfig_Validate(t *testing.T) {
+	for _, cfg := range []EgressConfig{
+		{Allow: []string{"10.0.0.0/33"}},
+		{Deny: []string{"not-a-cidr"}},
+		{Ports: []string{"0"}},
+		{DenyPorts: []string{"90-80"}},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("expected validation error for %+v", cfg)
+		}
+	}
+}
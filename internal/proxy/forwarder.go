@@ -2,65 +2,163 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"sync"
 	"time"
 
+	"go.uber.org/fx"
+
 	"network-tunneler/pkg/logger"
 	pb "network-tunneler/proto"
 )
 
+// udpIdleTimeout ends a UDP flow once the target has sent nothing for this
+// long; there is no close to wait for.
+const udpIdleTimeout = 2 * time.Minute
+
 type ConnectionState struct {
 	ConnectionID string
 	TargetAddr   string
+	Protocol     pb.Protocol
 	TargetConn   net.Conn
 	CreatedAt    time.Time
 	LastActivity time.Time
+
+	// resume is set while the client has paused the connection and closed
+	// when it resumes.
+	resume chan struct{}
 }
 
 type PacketForwarder struct {
 	logger       logger.Logger
 	responseChan chan<- *pb.Packet
+	tun          *TUNRelay
+	translation  cidrTranslation
+	egress       *egressPolicy
+	dialer       *net.Dialer
 	connections  map[string]*ConnectionState
-	mu           sync.RWMutex
-	ctx          context.Context
-	cancel       context.CancelFunc
-	wg           sync.WaitGroup
+	// refused remembers connections the egress policy turned down, so their
+	// later packets are dropped without another security event.
+	refused map[string]time.Time
+	mu      sync.RWMutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
 }
 
 type ForwarderParams struct {
+	fx.In
+
+	// Config is optional; without it managed addresses are dialed as they
+	// are and no egress checks apply.
+	Config       *Config `optional:"true"`
 	Logger       logger.Logger
 	ResponseChan chan<- *pb.Packet
+	TUN          *TUNRelay
 }
 
 func NewPacketForwarder(p ForwarderParams) *PacketForwarder {
+	var translation cidrTranslation
+	var egress *egressPolicy
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if p.Config != nil {
+		// Both were checked when the config was validated.
+		translation, _ = newCIDRTranslation(p.Config.ManagedCIDR, p.Config.TranslateCIDR)
+		egress, _ = newEgressPolicy(p.Config)
+	}
+	if egress != nil {
+		dialer.Control = egress.dialControl
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	return &PacketForwarder{
 		logger:       p.Logger.With(logger.String("component", "forwarder")),
 		responseChan: p.ResponseChan,
+		tun:          p.TUN,
+		translation:  translation,
+		egress:       egress,
+		dialer:       dialer,
 		connections:  make(map[string]*ConnectionState),
+		refused:      make(map[string]time.Time),
 		ctx:          ctx,
 		cancel:       cancel,
 	}
 }
 
 func (pf *PacketForwarder) Forward(pkt *pb.Packet) error {
+	if pkt.IpPacket {
+		if pf.tun == nil {
+			return fmt.Errorf("tun mode is not enabled on this proxy")
+		}
+		return pf.tun.Forward(pkt)
+	}
+
+	if pkt.Control != pb.Control_CONTROL_NONE {
+		pf.control(pkt.ConnectionId, pkt.Control)
+		return nil
+	}
+
 	pf.mu.Lock()
 	state, exists := pf.connections[pkt.ConnectionId]
+	if _, refused := pf.refused[pkt.ConnectionId]; !exists && refused {
+		pf.mu.Unlock()
+		return fmt.Errorf("%w: connection %s was already refused", errEgressDenied, pkt.ConnectionId)
+	}
 	if !exists {
-		targetAddr := net.JoinHostPort(pkt.ConnTuple.DstIp, fmt.Sprintf("%d", pkt.ConnTuple.DstPort))
+		// Hostnames from SOCKS clients are resolved here, by the dialer.
+		host := pkt.ConnTuple.DstIp
+		if host == "" {
+			host = pkt.ConnTuple.DstHost
+		}
+		port := fmt.Sprintf("%d", pkt.ConnTuple.DstPort)
+		requestedAddr := net.JoinHostPort(host, port)
+		addr, _ := netip.ParseAddr(pkt.ConnTuple.DstIp)
+		if err := pf.egress.checkRequested(addr, host); err != nil {
+			pf.refused[pkt.ConnectionId] = time.Now()
+			pf.mu.Unlock()
+			logEgressDenied(pf.logger, pkt.ConnectionId, requestedAddr, err)
+			pf.refuse(pkt.ConnectionId, pkt.Protocol)
+			return err
+		}
 
-		conn, err := net.DialTimeout("tcp", targetAddr, 5*time.Second)
+		targetAddr := requestedAddr
+		if actual, ok := pf.translation.ToActual(addr); ok {
+			targetAddr = net.JoinHostPort(actual.String(), port)
+		}
+
+		network := "tcp"
+		if pkt.Protocol == pb.Protocol_PROTOCOL_UDP {
+			// Each write on a connected UDP socket is one datagram, which
+			// keeps the client's message boundaries.
+			network = "udp"
+		}
+
+		// The dialer checks the egress policy on the address it connects to.
+		conn, err := pf.dialer.Dial(network, targetAddr)
 		if err != nil {
+			denied := errors.Is(err, errEgressDenied)
+			if denied {
+				pf.refused[pkt.ConnectionId] = time.Now()
+			}
 			pf.mu.Unlock()
+			if denied {
+				logEgressDenied(pf.logger, pkt.ConnectionId, requestedAddr, err)
+				pf.refuse(pkt.ConnectionId, pkt.Protocol)
+			}
+			if targetAddr != requestedAddr {
+				return fmt.Errorf("failed to dial target %s (translated from %s): %w", targetAddr, requestedAddr, err)
+			}
 			return fmt.Errorf("failed to dial target %s: %w", targetAddr, err)
 		}
 
 		state = &ConnectionState{
 			ConnectionID: pkt.ConnectionId,
 			TargetAddr:   targetAddr,
+			Protocol:     pkt.Protocol,
 			TargetConn:   conn,
 			CreatedAt:    time.Now(),
 			LastActivity: time.Now(),
@@ -68,10 +166,15 @@ func (pf *PacketForwarder) Forward(pkt *pb.Packet) error {
 
 		pf.connections[pkt.ConnectionId] = state
 
-		pf.logger.Info("new target connection established",
+		fields := []logger.Field{
 			logger.String("conn_id", pkt.ConnectionId),
 			logger.String("target", targetAddr),
-		)
+			logger.String("network", network),
+		}
+		if targetAddr != requestedAddr {
+			fields = append(fields, logger.String("requested", requestedAddr))
+		}
+		pf.logger.Info("new target connection established", fields...)
 
 		pf.wg.Add(1)
 		go pf.readFromTarget(state)
@@ -94,10 +197,70 @@ func (pf *PacketForwarder) Forward(pkt *pb.Packet) error {
 	return nil
 }
 
+// control applies a flow control signal from the client. A paused
+// connection is not read from, so the target's own flow control slows it
+// down until the client catches up.
+func (pf *PacketForwarder) control(connID string, ctrl pb.Control) {
+	if ctrl == pb.Control_CONTROL_RESET {
+		pf.logger.Debug("connection reset by client", logger.String("conn_id", connID))
+		pf.removeConnection(connID)
+		pf.mu.Lock()
+		delete(pf.refused, connID)
+		pf.mu.Unlock()
+		return
+	}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	state, exists := pf.connections[connID]
+	if !exists {
+		return
+	}
+
+	switch ctrl {
+	case pb.Control_CONTROL_PAUSE:
+		if state.resume == nil {
+			state.resume = make(chan struct{})
+		}
+	case pb.Control_CONTROL_RESUME:
+		state.unpause()
+	}
+
+	pf.logger.Debug("flow control signal received",
+		logger.String("conn_id", connID),
+		logger.String("control", ctrl.String()),
+	)
+}
+
+// refuse tells the client, through the server, that the connection will not
+// be opened, so it can close its side instead of waiting for replies.
+func (pf *PacketForwarder) refuse(connID string, protocol pb.Protocol) {
+	pkt := &pb.Packet{
+		ConnectionId: connID,
+		Protocol:     protocol,
+		Direction:    pb.Direction_DIRECTION_REVERSE,
+		Control:      pb.Control_CONTROL_RESET,
+		Timestamp:    time.Now().Unix(),
+	}
+
+	select {
+	case pf.responseChan <- pkt:
+	case <-pf.ctx.Done():
+	}
+}
+
 func (pf *PacketForwarder) readFromTarget(state *ConnectionState) {
 	defer pf.wg.Done()
 	defer pf.removeConnection(state.ConnectionID)
 
+	protocol := pb.Protocol_PROTOCOL_TCP
+	idleTimeout := 5 * time.Minute
+	if state.Protocol == pb.Protocol_PROTOCOL_UDP {
+		protocol = pb.Protocol_PROTOCOL_UDP
+		idleTimeout = udpIdleTimeout
+	}
+
 	buf := make([]byte, 65535)
 
 	for {
@@ -110,7 +273,18 @@ func (pf *PacketForwarder) readFromTarget(state *ConnectionState) {
 		default:
 		}
 
-		state.TargetConn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		pf.mu.RLock()
+		resume := state.resume
+		pf.mu.RUnlock()
+		if resume != nil {
+			select {
+			case <-resume:
+			case <-pf.ctx.Done():
+				return
+			}
+		}
+
+		state.TargetConn.SetReadDeadline(time.Now().Add(idleTimeout))
 
 		n, err := state.TargetConn.Read(buf)
 		if err != nil {
@@ -138,7 +312,7 @@ func (pf *PacketForwarder) readFromTarget(state *ConnectionState) {
 		responsePkt := &pb.Packet{
 			ConnectionId: state.ConnectionID,
 			Data:         append([]byte(nil), buf[:n]...),
-			Protocol:     pb.Protocol_PROTOCOL_TCP,
+			Protocol:     protocol,
 			Direction:    pb.Direction_DIRECTION_REVERSE,
 			Timestamp:    time.Now().Unix(),
 		}
@@ -165,6 +339,7 @@ func (pf *PacketForwarder) removeConnection(connID string) {
 
 	if state, exists := pf.connections[connID]; exists {
 		state.TargetConn.Close()
+		state.unpause()
 		delete(pf.connections, connID)
 
 		pf.logger.Debug("connection removed",
@@ -183,6 +358,7 @@ func (pf *PacketForwarder) Cleanup(maxIdleTime time.Duration) int {
 	for connID, state := range pf.connections {
 		if now.Sub(state.LastActivity) > maxIdleTime {
 			state.TargetConn.Close()
+			state.unpause()
 			delete(pf.connections, connID)
 			removed++
 
@@ -193,6 +369,12 @@ func (pf *PacketForwarder) Cleanup(maxIdleTime time.Duration) int {
 		}
 	}
 
+	for connID, at := range pf.refused {
+		if now.Sub(at) > maxIdleTime {
+			delete(pf.refused, connID)
+		}
+	}
+
 	if removed > 0 {
 		pf.logger.Info("cleanup completed",
 			logger.Int("removed_connections", removed),
@@ -202,6 +384,14 @@ func (pf *PacketForwarder) Cleanup(maxIdleTime time.Duration) int {
 	return removed
 }
 
+// unpause releases a reader waiting for the connection to be resumed.
+func (state *ConnectionState) unpause() {
+	if state.resume != nil {
+		close(state.resume)
+		state.resume = nil
+	}
+}
+
 func (pf *PacketForwarder) Count() int {
 	pf.mu.RLock()
 	defer pf.mu.RUnlock()
@@ -211,6 +401,14 @@ func (pf *PacketForwarder) Count() int {
 
 func (pf *PacketForwarder) Stop() {
 	pf.cancel()
+
+	// Unblock readers waiting on their target.
+	pf.mu.Lock()
+	for _, state := range pf.connections {
+		state.TargetConn.Close()
+	}
+	pf.mu.Unlock()
+
 	pf.wg.Wait()
 
 	pf.logger.Info("packet forwarder stopped")
@@ -1,10 +1,14 @@
 package proxy
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"testing"
 	"time"
 
 	testutil "network-tunneler/internal/testing"
+	pb "network-tunneler/proto"
 )
 
 func TestPacketForwarder_Count(t *testing.T) {
@@ -212,3 +216,232 @@ func BenchmarkPacketForwarder_Cleanup(b *testing.B) {
 		forwarder.Cleanup(5 * time.Minute)
 	}
 }
+
+func TestPacketForwarder_UDPDatagrams(t *testing.T) {
+	target, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer target.Close()
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := target.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			target.WriteToUDP(append([]byte("echo:"), buf[:n]...), from)
+		}
+	}()
+
+	log := testutil.NewTestLogger()
+	responseChan := make(chan *pb.Packet, 10)
+	forwarder := NewPacketForwarder(ForwarderParams{Logger: log, ResponseChan: responseChan})
+	defer forwarder.Stop()
+
+	addr := target.LocalAddr().(*net.UDPAddr)
+	for _, data := range []string{"one", "two"} {
+		err := forwarder.Forward(&pb.Packet{
+			ConnectionId: "udp-conn-1",
+			Data:         []byte(data),
+			Protocol:     pb.Protocol_PROTOCOL_UDP,
+			ConnTuple: &pb.ConnectionTuple{
+				DstIp:   addr.IP.String(),
+				DstPort: uint32(addr.Port),
+			},
+		})
+		if err != nil {
+			t.Fatalf("Forward failed: %v", err)
+		}
+	}
+
+	for _, want := range []string{"echo:one", "echo:two"} {
+		select {
+		case pkt := <-responseChan:
+			if string(pkt.Data) != want {
+				t.Errorf("expected datagram %q, got %q", want, pkt.Data)
+			}
+			if pkt.Protocol != pb.Protocol_PROTOCOL_UDP {
+				t.Errorf("expected UDP response, got %v", pkt.Protocol)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for response")
+		}
+	}
+
+	if forwarder.Count() != 1 {
+		t.Errorf("expected one UDP flow, got %d", forwarder.Count())
+	}
+}
+
+func TestPacketForwarder_FlowControl(t *testing.T) {
+	log := testutil.NewTestLogger()
+	responseChan := make(chan *pb.Packet, 10)
+	forwarder := NewPacketForwarder(ForwarderParams{Logger: log, ResponseChan: responseChan})
+	defer forwarder.Stop()
+
+	target, remote := net.Pipe()
+	defer remote.Close()
+
+	state := &ConnectionState{
+		ConnectionID: "tcp-conn-1",
+		TargetAddr:   "192.168.1.1:80",
+		Protocol:     pb.Protocol_PROTOCOL_TCP,
+		TargetConn:   target,
+		CreatedAt:    time.Now(),
+		LastActivity: time.Now(),
+	}
+	forwarder.connections[state.ConnectionID] = state
+
+	control := func(ctrl pb.Control) {
+		if err := forwarder.Forward(&pb.Packet{ConnectionId: state.ConnectionID, Control: ctrl}); err != nil {
+			t.Fatalf("Forward failed: %v", err)
+		}
+	}
+
+	// Paused before the reader starts, so nothing is read from the target.
+	control(pb.Control_CONTROL_PAUSE)
+	forwarder.wg.Add(1)
+	go forwarder.readFromTarget(state)
+
+	go remote.Write([]byte("held back"))
+
+	select {
+	case pkt := <-responseChan:
+		t.Fatalf("expected no data while paused, got %q", pkt.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	control(pb.Control_CONTROL_RESUME)
+
+	select {
+	case pkt := <-responseChan:
+		if string(pkt.Data) != "held back" {
+			t.Errorf("expected %q, got %q", "held back", pkt.Data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for data after resume")
+	}
+
+	control(pb.Control_CONTROL_RESET)
+
+	if forwarder.Count() != 0 {
+		t.Errorf("expected the connection to be removed, got %d", forwarder.Count())
+	}
+	if err := forwarder.Forward(&pb.Packet{ConnectionId: state.ConnectionID, Control: pb.Control_CONTROL_PAUSE}); err != nil {
+		t.Errorf("expected signals for unknown connections to be ignored, got %v", err)
+	}
+}
+
+func TestPacketForwarder_TranslatesManagedCIDR(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer target.Close()
+
+	cfg := DefaultConfig()
+	cfg.ManagedCIDR = "100.64.0.0/8"
+	cfg.TranslateCIDR = "127.0.0.0/8"
+	cfg.Egress.AllowLoopback = true
+
+	responseChan := make(chan *pb.Packet, 10)
+	forwarder := NewPacketForwarder(ForwarderParams{Config: cfg, Logger: testutil.NewTestLogger(), ResponseChan: responseChan})
+	defer forwarder.Stop()
+
+	port := target.LocalAddr().(*net.UDPAddr).Port
+	err = forwarder.Forward(&pb.Packet{
+		ConnectionId: "udp-conn-1",
+		Data:         []byte("hello"),
+		Protocol:     pb.Protocol_PROTOCOL_UDP,
+		ConnTuple: &pb.ConnectionTuple{
+			DstIp:   "100.0.0.1",
+			DstPort: uint32(port),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Forward failed: %v", err)
+	}
+
+	buf := make([]byte, 64)
+	target.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := target.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("expected the datagram at the translated address: %v", err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Errorf("expected %q, got %q", "hello", buf[:n])
+	}
+
+	forwarder.mu.RLock()
+	state := forwarder.connections["udp-conn-1"]
+	forwarder.mu.RUnlock()
+	if want := fmt.Sprintf("127.0.0.1:%d", port); state == nil || state.TargetAddr != want {
+		t.Errorf("expected target %s, got %+v", want, state)
+	}
+}
+
+func TestPacketForwarder_RefusesEgress(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ManagedCIDR = "127.0.0.0/8"
+	cfg.Domains = []string{"localhost"}
+
+	responseChan := make(chan *pb.Packet, 10)
+	forwarder := NewPacketForwarder(ForwarderParams{Config: cfg, Logger: testutil.NewTestLogger(), ResponseChan: responseChan})
+	defer forwarder.Stop()
+
+	tests := []struct {
+		name  string
+		tuple *pb.ConnectionTuple
+	}{
+		{"outside the managed CIDR", &pb.ConnectionTuple{DstIp: "10.0.0.1", DstPort: 80}},
+		{"loopback", &pb.ConnectionTuple{DstIp: "127.0.0.1", DstPort: 80}},
+		{"hostname outside the domains", &pb.ConnectionTuple{DstHost: "example.com", DstPort: 80}},
+		{"hostname resolving to loopback", &pb.ConnectionTuple{DstHost: "localhost", DstPort: 80}},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connID := fmt.Sprintf("conn-%d", i)
+			err := forwarder.Forward(&pb.Packet{
+				ConnectionId: connID,
+				Data:         []byte("hello"),
+				Protocol:     pb.Protocol_PROTOCOL_TCP,
+				ConnTuple:    tt.tuple,
+			})
+			if !errors.Is(err, errEgressDenied) {
+				t.Errorf("expected an egress denial, got %v", err)
+			}
+
+			select {
+			case pkt := <-responseChan:
+				if pkt.ConnectionId != connID || pkt.Control != pb.Control_CONTROL_RESET || pkt.Direction != pb.Direction_DIRECTION_REVERSE {
+					t.Errorf("expected a reverse reset for %s, got %+v", connID, pkt)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for the refusal")
+			}
+
+			// Later data is dropped without another refusal.
+			err = forwarder.Forward(&pb.Packet{
+				ConnectionId: connID,
+				Data:         []byte("again"),
+				Protocol:     pb.Protocol_PROTOCOL_TCP,
+				ConnTuple:    tt.tuple,
+			})
+			if !errors.Is(err, errEgressDenied) {
+				t.Errorf("expected the connection to stay refused, got %v", err)
+			}
+			select {
+			case pkt := <-responseChan:
+				t.Errorf("unexpected second refusal %+v", pkt)
+			default:
+			}
+		})
+	}
+
+	if forwarder.Count() != 0 {
+		t.Errorf("expected no connections, got %d", forwarder.Count())
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"go.uber.org/fx"
 
 	"network-tunneler/internal/certs"
+	"network-tunneler/internal/health"
 	"network-tunneler/pkg/crypto"
 	"network-tunneler/pkg/logger"
 	pb "network-tunneler/proto"
@@ -18,6 +19,9 @@ var Module = fx.Options(
 		ProvideConfig,
 		ProvideResponseChannel,
 
+		health.NewChecker,
+		NewReachabilityProber,
+		NewTUNRelay,
 		NewPacketForwarder,
 		NewServerConnection,
 
@@ -30,11 +34,14 @@ type ProvidedConfig struct {
 
 	Config       *Config
 	TlsConfig    *tls.Config
-	LoggerConfig logger.Config
+	LoggerConfig *logger.Config
 }
 
-func ProvideConfig() (ProvidedConfig, error) {
-	cfg := DefaultConfig()
+func ProvideConfig(configFile string) (ProvidedConfig, error) {
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		return ProvidedConfig{}, err
+	}
 
 	tlsOpts := cfg.TLS
 	if tlsOpts.CertPath == "" && tlsOpts.CertPEM == nil {
@@ -55,10 +62,20 @@ func ProvideConfig() (ProvidedConfig, error) {
 	return ProvidedConfig{
 		Config:       cfg,
 		TlsConfig:    tlsConfig,
-		LoggerConfig: cfg.Log,
+		LoggerConfig: &cfg.Log,
 	}, nil
 }
 
-func ProvideResponseChannel() chan *pb.Packet {
-	return make(chan *pb.Packet, channelBuffer)
+// ResponseChannels hands the forwarder the sending end and the server
+// connection the receiving end of the same channel.
+type ResponseChannels struct {
+	fx.Out
+
+	Send    chan<- *pb.Packet
+	Receive <-chan *pb.Packet
+}
+
+func ProvideResponseChannel() ResponseChannels {
+	ch := make(chan *pb.Packet, channelBuffer)
+	return ResponseChannels{Send: ch, Receive: ch}
 }
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"go.uber.org/fx"
+
+	"network-tunneler/pkg/logger"
+)
+
+const (
+	probeInterval = 10 * time.Second
+	probeTimeout  = 2 * time.Second
+)
+
+type ReachabilityProber struct {
+	managedCIDR string
+	targets     []string
+	logger      logger.Logger
+
+	lastErr error
+	mu      sync.RWMutex
+}
+
+type ProberParams struct {
+	fx.In
+
+	Config *Config
+	Logger logger.Logger
+}
+
+func NewReachabilityProber(p ProberParams) *ReachabilityProber {
+	// A translated managed CIDR only exists for clients; the route needed
+	// is to the network it maps to.
+	managedCIDR := p.Config.ManagedCIDR
+	if p.Config.TranslateCIDR != "" {
+		managedCIDR = p.Config.TranslateCIDR
+	}
+
+	return &ReachabilityProber{
+		managedCIDR: managedCIDR,
+		targets:     p.Config.ProbeTargets,
+		logger:      p.Logger.With(logger.String("component", "prober")),
+		lastErr:     fmt.Errorf("reachability not probed yet"),
+	}
+}
+
+func (p *ReachabilityProber) Run(stopChan <-chan struct{}) {
+	defer p.logger.Debug("probe loop stopped")
+
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+
+	for {
+		p.update(p.Probe())
+
+		select {
+		case <-ticker.C:
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// Probe dials the configured probe targets and succeeds as soon as one of
+// them answers. Without explicit targets it only verifies that the host has
+// a route into the managed CIDR, which any default route satisfies; config
+// validation therefore requires targets once readiness is served.
+func (p *ReachabilityProber) Probe() error {
+	if len(p.targets) == 0 {
+		return p.probeRoute()
+	}
+
+	var lastErr error
+	for _, target := range p.targets {
+		conn, err := net.DialTimeout("tcp", target, probeTimeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		conn.Close()
+		return nil
+	}
+
+	return fmt.Errorf("no probe target reachable: %w", lastErr)
+}
+
+func (p *ReachabilityProber) probeRoute() error {
+	prefix, err := netip.ParsePrefix(p.managedCIDR)
+	if err != nil {
+		return fmt.Errorf("invalid managed CIDR %s: %w", p.managedCIDR, err)
+	}
+
+	host := prefix.Masked().Addr()
+	if prefix.Bits() < host.BitLen() {
+		host = host.Next()
+	}
+
+	// Connecting a UDP socket performs a route lookup without sending packets.
+	conn, err := net.DialTimeout("udp", netip.AddrPortFrom(host, 9).String(), probeTimeout)
+	if err != nil {
+		return fmt.Errorf("no route to managed CIDR %s: %w", p.managedCIDR, err)
+	}
+	conn.Close()
+
+	return nil
+}
+
+func (p *ReachabilityProber) Ready() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.lastErr
+}
+
+func (p *ReachabilityProber) update(err error) {
+	p.mu.Lock()
+	prev := p.lastErr
+	p.lastErr = err
+	p.mu.Unlock()
+
+	if err != nil && (prev == nil || prev.Error() != err.Error()) {
+		p.logger.Warn("managed CIDR unreachable",
+			logger.String("managed_cidr", p.managedCIDR),
+			logger.Error(err),
+		)
+	} else if err == nil && prev != nil {
+		p.logger.Info("managed CIDR reachable",
+			logger.String("managed_cidr", p.managedCIDR),
+		)
+	}
+}
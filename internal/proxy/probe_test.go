@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	testutil "network-tunneler/internal/testing"
+)
+
+func TestReachabilityProber_NotProbedYet(t *testing.T) {
+	prober := NewReachabilityProber(ProberParams{
+		Config: DefaultConfig(),
+		Logger: testutil.NewTestLogger(),
+	})
+
+	if err := prober.Ready(); err == nil {
+		t.Error("expected prober to be not ready before first probe")
+	}
+}
+
+func TestReachabilityProber_ProbeTargets(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer lis.Close()
+
+	cfg := DefaultConfig()
+	cfg.ProbeTargets = []string{"127.0.0.1:1", lis.Addr().String()}
+
+	prober := NewReachabilityProber(ProberParams{
+		Config: cfg,
+		Logger: testutil.NewTestLogger(),
+	})
+
+	if err := prober.Probe(); err != nil {
+		t.Errorf("expected probe to succeed with one reachable target, got %v", err)
+	}
+
+	cfg.ProbeTargets = []string{"127.0.0.1:1"}
+	prober = NewReachabilityProber(ProberParams{
+		Config: cfg,
+		Logger: testutil.NewTestLogger(),
+	})
+
+	if err := prober.Probe(); err == nil {
+		t.Error("expected probe to fail when no target is reachable")
+	}
+}
+
+func TestReachabilityProber_RouteProbe(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ManagedCIDR = "127.0.0.0/8"
+
+	prober := NewReachabilityProber(ProberParams{
+		Config: cfg,
+		Logger: testutil.NewTestLogger(),
+	})
+
+	if err := prober.Probe(); err != nil {
+		t.Errorf("expected loopback CIDR to be routable, got %v", err)
+	}
+}
@@ -2,11 +2,14 @@ package proxy
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"time"
 
 	"go.uber.org/fx"
 
+	"network-tunneler/internal/health"
 	"network-tunneler/pkg/logger"
 )
 
@@ -15,6 +18,11 @@ type Proxy struct {
 	logger     logger.Logger
 	serverConn *ServerConnection
 	forwarder  *PacketForwarder
+	tun        *TUNRelay
+	prober     *ReachabilityProber
+	checker    *health.Checker
+	health     *health.Server
+	stopChan   chan struct{}
 }
 
 type Params struct {
@@ -25,6 +33,9 @@ type Params struct {
 	Logger     logger.Logger
 	ServerConn *ServerConnection
 	Forwarder  *PacketForwarder
+	TUN        *TUNRelay
+	Prober     *ReachabilityProber
+	Checker    *health.Checker
 }
 
 func New(p Params) (*Proxy, error) {
@@ -33,8 +44,20 @@ func New(p Params) (*Proxy, error) {
 		logger:     p.Logger.With(logger.String("component", "proxy")),
 		serverConn: p.ServerConn,
 		forwarder:  p.Forwarder,
+		tun:        p.TUN,
+		prober:     p.Prober,
+		checker:    p.Checker,
+		stopChan:   make(chan struct{}),
 	}
 
+	proxy.checker.AddReadinessCheck("registration", func() error {
+		if !proxy.serverConn.IsRegistered() {
+			return fmt.Errorf("not registered with server (%s)", proxy.serverConn.Status().State)
+		}
+		return nil
+	})
+	proxy.checker.AddReadinessCheck("target_reachability", proxy.prober.Ready)
+
 	p.Lifecycle.Append(fx.Hook{
 		OnStart: proxy.start,
 		OnStop:  proxy.stop,
@@ -48,13 +71,28 @@ func (i *Proxy) start(ctx context.Context) error {
 		logger.String("server_addr", i.config.ServerAddr),
 		logger.String("proxy_id", i.config.ProxyID),
 		logger.String("managed_cidr", i.config.ManagedCIDR),
+		logger.Bool("tun", i.config.TUN.Enabled),
 	)
 
-	if err := i.serverConn.Connect(ctx); err != nil {
-		return fmt.Errorf("failed to connect to server: %w", err)
+	if err := i.tun.Start(); err != nil {
+		return fmt.Errorf("failed to start tun relay: %w", err)
 	}
 
+	i.serverConn.Start()
+
 	go i.heartbeatLoop()
+	go i.prober.Run(i.stopChan)
+
+	if i.config.Health.ListenAddr != "" {
+		i.health = health.NewServer(i.config.Health.ListenAddr, i.checker, i.logger)
+		i.health.Handle("/status", http.HandlerFunc(i.handleStatus))
+		if err := i.health.Start(); err != nil {
+			close(i.stopChan)
+			i.serverConn.Close()
+			i.tun.Stop()
+			return err
+		}
+	}
 
 	return nil
 }
@@ -62,11 +100,20 @@ func (i *Proxy) start(ctx context.Context) error {
 func (i *Proxy) stop(ctx context.Context) error {
 	i.logger.Info("stopping proxy")
 
+	close(i.stopChan)
+
+	if i.health != nil {
+		if err := i.health.Stop(ctx); err != nil {
+			i.logger.Error("failed to stop health server", logger.Error(err))
+		}
+	}
+
 	if err := i.serverConn.Close(); err != nil {
 		i.logger.Error("failed to close server connection", logger.Error(err))
 	}
 
 	i.forwarder.Stop()
+	i.tun.Stop()
 
 	i.logger.Info("proxy stopped")
 
@@ -82,11 +129,21 @@ func (i *Proxy) heartbeatLoop() {
 	for {
 		select {
 		case <-ticker.C:
+			if !i.serverConn.IsRegistered() {
+				continue
+			}
 			if err := i.serverConn.SendHeartbeat(); err != nil {
 				i.logger.Error("failed to send heartbeat", logger.Error(err))
 			}
-		case <-i.serverConn.stopChan:
+		case <-i.stopChan:
 			return
 		}
 	}
 }
+
+func (i *Proxy) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(i.serverConn.Status()); err != nil {
+		i.logger.Debug("failed to write status response", logger.Error(err))
+	}
+}
@@ -3,15 +3,19 @@ package proxy
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.uber.org/fx"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 
+	"network-tunneler/internal/reconnect"
 	"network-tunneler/pkg/logger"
 	pb "network-tunneler/proto"
 )
@@ -20,22 +24,38 @@ type ServerConnection struct {
 	serverAddr   string
 	proxyID    string
 	managedCIDR  string
+	domains      []string
 	tlsConfig    *tls.Config
 	logger       logger.Logger
 	forwarder    *PacketForwarder
 	grpcInsecure bool
+	supervisor   *reconnect.Supervisor
 
-	grpcConn   *grpc.ClientConn
-	grpcClient pb.TunnelProxyClient
-	stream     pb.TunnelProxy_ConnectClient
+	session *session
+	mu      sync.Mutex
 
+	registered   atomic.Bool
 	responseChan <-chan *pb.Packet
 	stopChan     chan struct{}
 	stopOnce     sync.Once
+	cancel       context.CancelFunc
+	runDone      chan struct{}
 	wg           sync.WaitGroup
 }
 
+// session is one gRPC stream to the server. done is closed by the read loop
+// once the stream fails, after err has been set.
+type session struct {
+	conn   *grpc.ClientConn
+	stream pb.TunnelProxy_ConnectClient
+	sendMu sync.Mutex
+	done   chan struct{}
+	err    error
+}
+
 type ServerConnParams struct {
+	fx.In
+
 	Config       *Config
 	TLSConfig    *tls.Config
 	Forwarder    *PacketForwarder
@@ -44,18 +64,55 @@ type ServerConnParams struct {
 }
 
 func NewServerConnection(p ServerConnParams) *ServerConnection {
+	log := p.Logger.With(logger.String("component", "server_conn"))
 	return &ServerConnection{
 		serverAddr:   p.Config.ServerAddr,
 		proxyID:    p.Config.ProxyID,
 		managedCIDR:  p.Config.ManagedCIDR,
+		domains:      p.Config.Domains,
 		tlsConfig:    p.TLSConfig,
 		forwarder:    p.Forwarder,
-		logger:       p.Logger.With(logger.String("component", "server_conn")),
+		supervisor:   reconnect.NewSupervisor(p.Config.Reconnect, log),
+		logger:       log,
 		responseChan: p.ResponseChan,
 		stopChan:     make(chan struct{}),
 	}
 }
 
+// Start keeps a session to the server alive in the background. Every new
+// session registers again, re-advertising the managed CIDR.
+func (sc *ServerConnection) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	sc.cancel = cancel
+	sc.runDone = make(chan struct{})
+
+	go func() {
+		defer close(sc.runDone)
+		sc.supervisor.Run(ctx, sc.runSession)
+	}()
+}
+
+func (sc *ServerConnection) runSession(ctx context.Context, registered func()) error {
+	if err := sc.Connect(ctx); err != nil {
+		return err
+	}
+	registered()
+
+	sc.mu.Lock()
+	s := sc.session
+	sc.mu.Unlock()
+
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+	case <-sc.stopChan:
+	}
+
+	sc.closeSession()
+	return s.err
+}
+
+// Connect establishes a single session and starts its read and write loops.
 func (sc *ServerConnection) Connect(ctx context.Context) error {
 	sc.logger.Info("connecting to server via gRPC",
 		logger.String("server_addr", sc.serverAddr),
@@ -68,48 +125,56 @@ func (sc *ServerConnection) Connect(ctx context.Context) error {
 		creds := credentials.NewTLS(sc.tlsConfig)
 		opts = append(opts, grpc.WithTransportCredentials(creds))
 	}
+	opts = append(opts, reconnect.KeepaliveOption())
 
 	conn, err := grpc.NewClient(sc.serverAddr, opts...)
 	if err != nil {
 		return fmt.Errorf("failed to create gRPC client: %w", err)
 	}
 
-	sc.grpcConn = conn
-	sc.grpcClient = pb.NewTunnelProxyClient(conn)
-
-	stream, err := sc.grpcClient.Connect(ctx)
+	stream, err := pb.NewTunnelProxyClient(conn).Connect(ctx)
 	if err != nil {
 		conn.Close()
 		return fmt.Errorf("failed to create stream: %w", err)
 	}
 
-	sc.stream = stream
-
 	sc.logger.Info("gRPC stream established")
 
-	if err := sc.register(); err != nil {
+	if err := sc.register(stream); err != nil {
+		stream.CloseSend()
 		conn.Close()
 		return fmt.Errorf("registration failed: %w", err)
 	}
 
+	s := &session{
+		conn:   conn,
+		stream: stream,
+		done:   make(chan struct{}),
+	}
+
+	sc.mu.Lock()
+	sc.session = s
+	sc.mu.Unlock()
+
 	sc.wg.Add(2)
-	go sc.readLoop()
-	go sc.writeLoop()
+	go sc.readLoop(s)
+	go sc.writeLoop(s)
 
 	return nil
 }
 
-func (sc *ServerConnection) register() error {
+func (sc *ServerConnection) register(stream pb.TunnelProxy_ConnectClient) error {
 	regMsg := &pb.ProxyMessage{
 		Message: &pb.ProxyMessage_Register{
 			Register: &pb.ProxyRegister{
 				ProxyId:   sc.proxyID,
 				ManagedCidr: sc.managedCIDR,
+				Domains:     sc.domains,
 			},
 		},
 	}
 
-	if err := sc.stream.Send(regMsg); err != nil {
+	if err := stream.Send(regMsg); err != nil {
 		return fmt.Errorf("failed to send registration: %w", err)
 	}
 
@@ -118,7 +183,7 @@ func (sc *ServerConnection) register() error {
 		logger.String("managed_cidr", sc.managedCIDR),
 	)
 
-	ackMsg, err := sc.stream.Recv()
+	ackMsg, err := stream.Recv()
 	if err != nil {
 		return fmt.Errorf("failed to receive ack: %w", err)
 	}
@@ -132,25 +197,34 @@ func (sc *ServerConnection) register() error {
 		return fmt.Errorf("registration rejected: %s", ack.Ack.Message)
 	}
 
-	sc.logger.Info("registered with server successfully")
+	sc.registered.Store(true)
+	sc.logger.Info("registered with server successfully",
+		logger.String("status", ack.Ack.Message),
+	)
 
 	return nil
 }
 
-func (sc *ServerConnection) readLoop() {
+func (sc *ServerConnection) readLoop(s *session) {
 	defer sc.wg.Done()
 	defer sc.logger.Info("read loop stopped")
+	defer close(s.done)
+	defer sc.registered.Store(false)
 
 	for {
-		msg, err := sc.stream.Recv()
+		msg, err := s.stream.Recv()
 		if err == io.EOF {
 			sc.logger.Info("stream closed by server")
-			sc.stopOnce.Do(func() { close(sc.stopChan) })
+			s.err = fmt.Errorf("server closed stream")
 			return
 		}
 		if err != nil {
-			sc.logger.Error("stream recv error", logger.Error(err))
-			sc.stopOnce.Do(func() { close(sc.stopChan) })
+			select {
+			case <-sc.stopChan:
+			default:
+				sc.logger.Error("stream recv error", logger.Error(err))
+			}
+			s.err = err
 			return
 		}
 
@@ -161,7 +235,9 @@ func (sc *ServerConnection) readLoop() {
 				logger.Int("bytes", len(m.Packet.Data)),
 			)
 
-			if err := sc.forwarder.Forward(m.Packet); err != nil {
+			// Egress refusals are logged by the forwarder as security events
+			// and reported back to the client as a reset.
+			if err := sc.forwarder.Forward(m.Packet); err != nil && !errors.Is(err, errEgressDenied) {
 				sc.logger.Error("failed to forward packet",
 					logger.String("conn_id", m.Packet.ConnectionId),
 					logger.Error(err),
@@ -174,7 +250,7 @@ func (sc *ServerConnection) readLoop() {
 	}
 }
 
-func (sc *ServerConnection) writeLoop() {
+func (sc *ServerConnection) writeLoop(s *session) {
 	defer sc.wg.Done()
 	defer sc.logger.Info("write loop stopped")
 
@@ -187,29 +263,48 @@ func (sc *ServerConnection) writeLoop() {
 				},
 			}
 
-			if err := sc.stream.Send(msg); err != nil {
+			if err := s.send(msg); err != nil {
 				sc.logger.Error("failed to send packet",
 					logger.String("conn_id", pkt.ConnectionId),
 					logger.Error(err),
 				)
 			}
 
+		case <-s.done:
+			return
+
 		case <-sc.stopChan:
 			return
 		}
 	}
 }
 
+func (s *session) send(msg *pb.ProxyMessage) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	return s.stream.Send(msg)
+}
+
 func (sc *ServerConnection) SendHeartbeat() error {
+	sc.mu.Lock()
+	s := sc.session
+	sc.mu.Unlock()
+
+	if s == nil {
+		return fmt.Errorf("not connected to server")
+	}
+
 	msg := &pb.ProxyMessage{
 		Message: &pb.ProxyMessage_Heartbeat{
 			Heartbeat: &pb.Heartbeat{
+				SenderId:  sc.proxyID,
 				Timestamp: time.Now().Unix(),
 			},
 		},
 	}
 
-	if err := sc.stream.Send(msg); err != nil {
+	if err := s.send(msg); err != nil {
 		return fmt.Errorf("failed to send heartbeat: %w", err)
 	}
 
@@ -217,18 +312,43 @@ func (sc *ServerConnection) SendHeartbeat() error {
 	return nil
 }
 
-func (sc *ServerConnection) Close() error {
-	sc.stopOnce.Do(func() { close(sc.stopChan) })
+// closeSession tears down the current session, if any, and waits for its
+// loops to exit.
+func (sc *ServerConnection) closeSession() error {
+	sc.mu.Lock()
+	s := sc.session
+	sc.session = nil
+	sc.mu.Unlock()
 
-	if sc.stream != nil {
-		sc.stream.CloseSend()
+	if s == nil {
+		return nil
 	}
 
+	// CloseSend must not run concurrently with a send.
+	s.sendMu.Lock()
+	s.stream.CloseSend()
+	s.sendMu.Unlock()
+	err := s.conn.Close()
 	sc.wg.Wait()
 
-	if sc.grpcConn != nil {
-		return sc.grpcConn.Close()
+	return err
+}
+
+func (sc *ServerConnection) IsRegistered() bool {
+	return sc.registered.Load()
+}
+
+func (sc *ServerConnection) Status() reconnect.Status {
+	return sc.supervisor.Status()
+}
+
+func (sc *ServerConnection) Close() error {
+	sc.stopOnce.Do(func() { close(sc.stopChan) })
+
+	if sc.cancel != nil {
+		sc.cancel()
+		<-sc.runDone
 	}
 
-	return nil
+	return sc.closeSession()
 }
@@ -8,6 +8,7 @@ import (
 
 	"google.golang.org/grpc"
 
+	"network-tunneler/internal/reconnect"
 	testutil "network-tunneler/internal/testing"
 	"network-tunneler/pkg/logger"
 	pb "network-tunneler/proto"
@@ -55,7 +56,11 @@ func (m *mockProxyServer) Connect(stream pb.TunnelProxy_ConnectServer) error {
 }
 
 func setupMockServer(t *testing.T) (*grpc.Server, string, *mockProxyServer) {
-	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	return setupMockServerAt(t, "127.0.0.1:0")
+}
+
+func setupMockServerAt(t *testing.T, addr string) (*grpc.Server, string, *mockProxyServer) {
+	lis, err := net.Listen("tcp", addr)
 	if err != nil {
 		t.Fatalf("failed to listen: %v", err)
 	}
@@ -85,6 +90,10 @@ func newTestServerConnection(addr string, forwarder *PacketForwarder, responseCh
 		responseChan: responseChan,
 		stopChan:     make(chan struct{}),
 		grpcInsecure: true,
+		supervisor: reconnect.NewSupervisor(reconnect.Config{
+			InitialBackoff: 50 * time.Millisecond,
+			MaxBackoff:     200 * time.Millisecond,
+		}, log),
 	}
 }
 
@@ -286,3 +295,50 @@ func TestServerConnection_Close(t *testing.T) {
 		t.Log("Cannot send packet after close")
 	}
 }
+
+func TestServerConnection_ReregistersAfterServerRestart(t *testing.T) {
+	server, addr, mock := setupMockServer(t)
+
+	log := testutil.NewTestLogger()
+	responseChan := make(chan *pb.Packet, 100)
+	forwarder := NewPacketForwarder(ForwarderParams{
+		Logger:       log,
+		ResponseChan: responseChan,
+	})
+	defer forwarder.Stop()
+
+	sc := newTestServerConnection(addr, forwarder, responseChan, log)
+	sc.Start()
+	defer sc.Close()
+
+	select {
+	case <-mock.registerChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for registration")
+	}
+
+	server.Stop()
+
+	server, _, mock = setupMockServerAt(t, addr)
+	defer server.Stop()
+
+	select {
+	case reg := <-mock.registerChan:
+		if reg.ManagedCidr != "192.168.1.0/24" {
+			t.Errorf("expected managed_cidr to be re-advertised, got %s", reg.ManagedCidr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for re-registration")
+	}
+
+	responseChan <- &pb.Packet{ConnectionId: "after-reconnect"}
+
+	select {
+	case pkt := <-mock.packetChan:
+		if pkt.ConnectionId != "after-reconnect" {
+			t.Errorf("expected packet after reconnect, got %s", pkt.ConnectionId)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for packet after reconnect")
+	}
+}
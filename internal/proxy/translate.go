@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+
+	"network-tunneler/pkg/network"
+)
+
+// cidrTranslation maps the managed CIDR clients see onto the network behind
+// the proxy, one address to one address. It lets sites whose address space
+// overlaps sit behind distinct advertised prefixes. The zero value maps
+// nothing.
+type cidrTranslation struct {
+	advertised netip.Prefix
+	actual     netip.Prefix
+}
+
+func newCIDRTranslation(managed, translate string) (cidrTranslation, error) {
+	if translate == "" {
+		return cidrTranslation{}, nil
+	}
+
+	advertised, err := netip.ParsePrefix(managed)
+	if err != nil {
+		return cidrTranslation{}, fmt.Errorf("invalid managed CIDR: %w", err)
+	}
+	actual, err := netip.ParsePrefix(translate)
+	if err != nil {
+		return cidrTranslation{}, fmt.Errorf("invalid translate CIDR: %w", err)
+	}
+	if advertised.Addr().BitLen() != actual.Addr().BitLen() || advertised.Bits() != actual.Bits() {
+		return cidrTranslation{}, fmt.Errorf("translate CIDR %s must be the same family and size as managed CIDR %s", translate, managed)
+	}
+
+	return cidrTranslation{advertised: advertised.Masked(), actual: actual.Masked()}, nil
+}
+
+// Enabled reports whether addresses are translated at all.
+func (t cidrTranslation) Enabled() bool {
+	return t.actual.IsValid()
+}
+
+// ToActual returns the address behind the proxy for an advertised one.
+func (t cidrTranslation) ToActual(addr netip.Addr) (netip.Addr, bool) {
+	if !t.Enabled() {
+		return addr, false
+	}
+	return network.MapPrefix(addr.Unmap(), t.advertised, t.actual)
+}
+
+// ToAdvertised is the reverse of ToActual.
+func (t cidrTranslation) ToAdvertised(addr netip.Addr) (netip.Addr, bool) {
+	if !t.Enabled() {
+		return addr, false
+	}
+	return network.MapPrefix(addr.Unmap(), t.actual, t.advertised)
+}
@@ -0,0 +1,510 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/fx"
+
+	"network-tunneler/pkg/logger"
+	"network-tunneler/pkg/netfilter"
+	"network-tunneler/pkg/network"
+	pb "network-tunneler/proto"
+)
+
+const (
+	// tunFlowTimeout forgets a translation once neither side has sent a
+	// packet for this long.
+	tunFlowTimeout = 5 * time.Minute
+
+	natPortFirst = 10000
+	natPortLast  = 65535
+)
+
+type TUNConfig struct {
+	// Enabled lets the proxy accept whole IP packets from clients in tun
+	// mode. Stream and datagram forwarding is unaffected.
+	Enabled bool   `mapstructure:"enabled" json:"enabled" yaml:"enabled"`
+	Name    string `mapstructure:"name" json:"name" yaml:"name"`
+	// Address is the interface address. Packets are rewritten to come from
+	// the next address in the prefix, which is masqueraded on egress.
+	Address string `mapstructure:"address" json:"address" yaml:"address"`
+	MTU     int    `mapstructure:"mtu" json:"mtu" yaml:"mtu"`
+}
+
+func DefaultTUNConfig() TUNConfig {
+	return TUNConfig{
+		Name:    "tunnel0",
+		Address: "198.19.0.1/30",
+		MTU:     1400,
+	}
+}
+
+func (c TUNConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Name == "" || len(c.Name) >= 16 {
+		return fmt.Errorf("tun name %q is invalid", c.Name)
+	}
+	if _, _, err := c.addresses(); err != nil {
+		return err
+	}
+	if c.MTU < 576 || c.MTU > 65535 {
+		return fmt.Errorf("tun mtu must be between 576 and 65535")
+	}
+	return nil
+}
+
+// addresses returns the interface prefix and the translated source address.
+func (c TUNConfig) addresses() (netip.Prefix, netip.Addr, error) {
+	prefix, err := netip.ParsePrefix(c.Address)
+	if err != nil {
+		return netip.Prefix{}, netip.Addr{}, fmt.Errorf("invalid tun address: %w", err)
+	}
+	if !prefix.Addr().Is4() {
+		return netip.Prefix{}, netip.Addr{}, fmt.Errorf("tun address must be IPv4")
+	}
+	source := prefix.Addr().Next()
+	if !prefix.Contains(source) {
+		return netip.Prefix{}, netip.Addr{}, fmt.Errorf("tun address %s leaves no address to translate to", c.Address)
+	}
+	return prefix, source, nil
+}
+
+type natKey struct {
+	protocol network.IPProtocol
+	port     uint16
+	// remote tells apart flows of protocols without ports.
+	remote netip.Addr
+}
+
+type natEntry struct {
+	connID     string
+	key        natKey
+	client     netip.Addr
+	clientPort uint16
+	// The destination the egress policy admitted; later packets of the
+	// connection must keep it.
+	dst          netip.Addr
+	dstPort      uint16
+	lastActivity time.Time
+}
+
+// matches reports whether a packet belongs to the flow the entry was
+// created for.
+func (e *natEntry) matches(flow network.Flow) bool {
+	return flow.Protocol == e.key.protocol && flow.Dst == e.dst && flow.DstPort == e.dstPort
+}
+
+// TUNRelay forwards whole IP packets from clients in tun mode. Each flow's
+// source is rewritten to the proxy's translated address and a unique port
+// (the ICMP echo identifier, for pings), and the packet is injected into a
+// TUN device; the kernel forwards it and masquerades it on egress. Replies
+// come back through the device and are translated back to the flow they
+// belong to.
+type TUNRelay struct {
+	config       TUNConfig
+	translation  cidrTranslation
+	egress       *egressPolicy
+	logger       logger.Logger
+	responseChan chan<- *pb.Packet
+	netfilter    netfilter.Manager
+
+	dev      *network.TUN
+	source   netip.Addr
+	byConn   map[string]*natEntry
+	byKey    map[natKey]*natEntry
+	nextPort uint16
+	mu       sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type TUNRelayParams struct {
+	fx.In
+
+	Config       *Config
+	Logger       logger.Logger
+	ResponseChan chan<- *pb.Packet
+}
+
+func NewTUNRelay(p TUNRelayParams) *TUNRelay {
+	// Both were checked when the config was validated.
+	translation, _ := newCIDRTranslation(p.Config.ManagedCIDR, p.Config.TranslateCIDR)
+	egress, _ := newEgressPolicy(p.Config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TUNRelay{
+		config:       p.Config.TUN,
+		translation:  translation,
+		egress:       egress,
+		logger:       p.Logger.With(logger.String("component", "tun_relay")),
+		responseChan: p.ResponseChan,
+		byConn:       make(map[string]*natEntry),
+		byKey:        make(map[natKey]*natEntry),
+		nextPort:     natPortFirst,
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+func (tr *TUNRelay) Start() error {
+	if !tr.config.Enabled {
+		return nil
+	}
+
+	prefix, source, err := tr.config.addresses()
+	if err != nil {
+		return err
+	}
+
+	if err := checkIPForwarding(); err != nil {
+		return err
+	}
+
+	dev, err := network.OpenTUN(tr.config.Name)
+	if err != nil {
+		return err
+	}
+	if err := dev.Configure(prefix, tr.config.MTU); err != nil {
+		dev.Close()
+		return fmt.Errorf("failed to configure tun device: %w", err)
+	}
+
+	manager, err := netfilter.NewManager(netfilter.BackendAuto, netfilter.Owner{Table: "network_tunneler_proxy"})
+	if err != nil {
+		dev.Close()
+		return fmt.Errorf("failed to select netfilter backend: %w", err)
+	}
+
+	masquerade, err := netfilter.NewRule().
+		Table(netfilter.TableNat).
+		Chain(netfilter.ChainPostrouting).
+		Source(source.String() + "/32").
+		Target(netfilter.TargetMasquerade).
+		Comment("network-tunneler-proxy tun masquerade").
+		Build()
+	if err == nil {
+		err = manager.Insert(masquerade)
+	}
+	if err != nil {
+		dev.Close()
+		return fmt.Errorf("failed to masquerade tun traffic: %w", err)
+	}
+
+	tr.mu.Lock()
+	tr.dev = dev
+	tr.source = source
+	tr.netfilter = manager
+	tr.mu.Unlock()
+
+	tr.logger.Info("tun relay ready",
+		logger.String("device", dev.Name()),
+		logger.String("address", prefix.String()),
+		logger.String("source", source.String()),
+	)
+
+	tr.wg.Add(2)
+	go tr.readLoop(dev)
+	go tr.expireLoop()
+
+	return nil
+}
+
+// checkIPForwarding fails early: without forwarding the kernel silently
+// drops every injected packet.
+func checkIPForwarding() error {
+	data, err := os.ReadFile("/proc/sys/net/ipv4/ip_forward")
+	if err != nil {
+		return fmt.Errorf("failed to read ip_forward: %w", err)
+	}
+	if strings.TrimSpace(string(data)) != "1" {
+		return fmt.Errorf("tun mode requires IP forwarding (sysctl net.ipv4.ip_forward=1)")
+	}
+	return nil
+}
+
+// Forward translates a client packet and injects it into the device.
+func (tr *TUNRelay) Forward(pkt *pb.Packet) error {
+	tr.mu.Lock()
+	dev := tr.dev
+	if dev == nil {
+		tr.mu.Unlock()
+		return fmt.Errorf("tun mode is not enabled on this proxy")
+	}
+
+	flow, err := network.ParseFlow(pkt.Data)
+	if err != nil {
+		tr.mu.Unlock()
+		return fmt.Errorf("invalid IP packet: %w", err)
+	}
+	requested := flow.Dst
+	dst, translated := tr.translation.ToActual(flow.Dst)
+	flow.Dst = dst
+
+	entry, err := tr.entryLocked(pkt.ConnectionId, requested, flow)
+	if err != nil {
+		tr.mu.Unlock()
+		return err
+	}
+	entry.lastActivity = time.Now()
+	source := tr.source
+	tr.mu.Unlock()
+
+	data := append([]byte(nil), pkt.Data...)
+	if translated {
+		if err := network.SetDestination(data, dst, flow.DstPort); err != nil {
+			return fmt.Errorf("failed to translate packet: %w", err)
+		}
+	}
+	if err := network.SetSource(data, source, entry.key.port); err != nil {
+		return fmt.Errorf("failed to translate packet: %w", err)
+	}
+
+	if _, err := dev.Write(data); err != nil {
+		return fmt.Errorf("failed to write to tun device: %w", err)
+	}
+	return nil
+}
+
+// entryLocked returns the connection's translation, creating it if the
+// egress policy admits the flow. Only the first packet is checked against
+// the policy, so later ones must stay within the flow it admitted.
+func (tr *TUNRelay) entryLocked(connID string, requested netip.Addr, flow network.Flow) (*natEntry, error) {
+	entry, exists := tr.byConn[connID]
+	if !exists {
+		if err := tr.checkEgress(requested, flow); err != nil {
+			logEgressDenied(tr.logger, connID, requested.String(), err)
+			return nil, err
+		}
+		return tr.newEntryLocked(connID, flow)
+	}
+
+	if !entry.matches(flow) {
+		tr.logger.Warn("security event: packet does not match its tun flow",
+			logger.String("event", "tun_flow_mismatch"),
+			logger.String("conn_id", connID),
+			logger.String("flow", flow.String()),
+			logger.String("admitted", netip.AddrPortFrom(entry.dst, entry.dstPort).String()),
+		)
+		return nil, fmt.Errorf("%w: packet of connection %s leaves its flow", errEgressDenied, connID)
+	}
+	return entry, nil
+}
+
+// checkEgress holds a new flow to the egress policy. Only TCP and UDP ports
+// are subject to port rules.
+func (tr *TUNRelay) checkEgress(requested netip.Addr, flow network.Flow) error {
+	if err := tr.egress.checkRequested(requested, ""); err != nil {
+		return err
+	}
+	var port uint16
+	if flow.Protocol == network.ProtocolTCP || flow.Protocol == network.ProtocolUDP {
+		port = flow.DstPort
+	}
+	return tr.egress.checkDial(flow.Dst, port)
+}
+
+func (tr *TUNRelay) newEntryLocked(connID string, flow network.Flow) (*natEntry, error) {
+	key := natKey{protocol: flow.Protocol}
+	if flow.HasPorts() {
+		port, ok := tr.allocatePortLocked(flow.Protocol)
+		if !ok {
+			return nil, fmt.Errorf("no free translation port for protocol %d", flow.Protocol)
+		}
+		key.port = port
+	} else {
+		key.remote = flow.Dst
+		if other, taken := tr.byKey[key]; taken {
+			// Without ports only one flow per remote host can be told apart;
+			// the newest one wins.
+			tr.removeLocked(other)
+		}
+	}
+
+	entry := &natEntry{
+		connID:     connID,
+		key:        key,
+		client:     flow.Src,
+		clientPort: flow.SrcPort,
+		dst:        flow.Dst,
+		dstPort:    flow.DstPort,
+	}
+	tr.byConn[connID] = entry
+	tr.byKey[key] = entry
+
+	tr.logger.Debug("new tun flow",
+		logger.String("conn_id", connID),
+		logger.String("flow", flow.String()),
+		logger.Int("nat_port", int(key.port)),
+	)
+
+	return entry, nil
+}
+
+func (tr *TUNRelay) allocatePortLocked(proto network.IPProtocol) (uint16, bool) {
+	for range natPortLast - natPortFirst + 1 {
+		port := tr.nextPort
+		if tr.nextPort == natPortLast {
+			tr.nextPort = natPortFirst
+		} else {
+			tr.nextPort++
+		}
+		if _, taken := tr.byKey[natKey{protocol: proto, port: port}]; !taken {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+func (tr *TUNRelay) removeLocked(entry *natEntry) {
+	delete(tr.byConn, entry.connID)
+	delete(tr.byKey, entry.key)
+}
+
+// readLoop translates replies read from the device back to their flow and
+// sends them to the server.
+func (tr *TUNRelay) readLoop(dev *network.TUN) {
+	defer tr.wg.Done()
+	defer tr.logger.Info("tun read loop stopped")
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := dev.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				tr.logger.Error("failed to read from tun device", logger.Error(err))
+			}
+			return
+		}
+
+		pkt, ok := tr.translateReply(buf[:n])
+		if !ok {
+			continue
+		}
+
+		select {
+		case tr.responseChan <- pkt:
+		case <-tr.ctx.Done():
+			return
+		}
+	}
+}
+
+func (tr *TUNRelay) translateReply(data []byte) (*pb.Packet, bool) {
+	flow, err := network.ParseFlow(data)
+	if err != nil {
+		tr.logger.Debug("dropping packet from tun device", logger.Error(err))
+		return nil, false
+	}
+
+	key := natKey{protocol: flow.Protocol}
+	if flow.HasPorts() {
+		key.port = flow.DstPort
+	} else {
+		key.remote = flow.Src
+	}
+
+	tr.mu.Lock()
+	entry, exists := tr.byKey[key]
+	if exists {
+		entry.lastActivity = time.Now()
+	}
+	tr.mu.Unlock()
+
+	if !exists {
+		tr.logger.Debug("dropping packet without translation", logger.String("flow", flow.String()))
+		return nil, false
+	}
+
+	out := append([]byte(nil), data...)
+	if src, ok := tr.translation.ToAdvertised(flow.Src); ok {
+		if err := network.SetSource(out, src, flow.SrcPort); err != nil {
+			tr.logger.Debug("failed to translate reply", logger.Error(err))
+			return nil, false
+		}
+	}
+	if err := network.SetDestination(out, entry.client, entry.clientPort); err != nil {
+		tr.logger.Debug("failed to translate reply", logger.Error(err))
+		return nil, false
+	}
+
+	return &pb.Packet{
+		ConnectionId: entry.connID,
+		Data:         out,
+		Protocol:     pb.Protocol(flow.Protocol),
+		Direction:    pb.Direction_DIRECTION_REVERSE,
+		Timestamp:    time.Now().Unix(),
+		IpPacket:     true,
+	}, true
+}
+
+func (tr *TUNRelay) expireLoop() {
+	defer tr.wg.Done()
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-tr.ctx.Done():
+			return
+		case <-ticker.C:
+			tr.expire(tunFlowTimeout)
+		}
+	}
+}
+
+func (tr *TUNRelay) expire(idle time.Duration) int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	removed := 0
+	now := time.Now()
+	for _, entry := range tr.byConn {
+		if now.Sub(entry.lastActivity) > idle {
+			tr.removeLocked(entry)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Count returns the number of translated flows.
+func (tr *TUNRelay) Count() int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	return len(tr.byConn)
+}
+
+func (tr *TUNRelay) Stop() {
+	tr.cancel()
+
+	tr.mu.Lock()
+	dev := tr.dev
+	tr.dev = nil
+	tr.mu.Unlock()
+
+	if dev == nil {
+		return
+	}
+
+	dev.Close()
+	tr.wg.Wait()
+
+	if err := tr.netfilter.Remove(); err != nil {
+		tr.logger.Error("failed to remove tun masquerade rule", logger.Error(err))
+	}
+
+	tr.logger.Info("tun relay stopped")
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"testing"
+
+	testutil "network-tunneler/internal/testing"
+	"network-tunneler/pkg/network"
+	pb "network-tunneler/proto"
+)
+
+func udpPacket(src, dst netip.AddrPort) []byte {
+	pkt := make([]byte, 28)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = byte(network.ProtocolUDP)
+	s, d := src.Addr().As4(), dst.Addr().As4()
+	copy(pkt[12:16], s[:])
+	copy(pkt[16:20], d[:])
+	binary.BigEndian.PutUint16(pkt[20:22], src.Port())
+	binary.BigEndian.PutUint16(pkt[22:24], dst.Port())
+	binary.BigEndian.PutUint16(pkt[24:26], 8)
+	return pkt
+}
+
+func TestTUNRelay_TranslatesRepliesPerFlow(t *testing.T) {
+	relay := NewTUNRelay(TUNRelayParams{
+		Config:       DefaultConfig(),
+		Logger:       testutil.NewTestLogger(),
+		ResponseChan: make(chan *pb.Packet, 1),
+	})
+	relay.source = netip.MustParseAddr("198.19.0.2")
+
+	// Two clients using the same tun address and source port.
+	client := netip.MustParseAddrPort("198.18.0.1:40000")
+	target := netip.MustParseAddrPort("10.0.0.5:53")
+	flow, err := network.ParseFlow(udpPacket(client, target))
+	if err != nil {
+		t.Fatalf("ParseFlow failed: %v", err)
+	}
+
+	first, err := relay.newEntryLocked("ip-a", flow)
+	if err != nil {
+		t.Fatalf("newEntryLocked failed: %v", err)
+	}
+	second, err := relay.newEntryLocked("ip-b", flow)
+	if err != nil {
+		t.Fatalf("newEntryLocked failed: %v", err)
+	}
+	if first.key.port == second.key.port {
+		t.Fatalf("expected distinct translation ports, both got %d", first.key.port)
+	}
+
+	reply := udpPacket(target, netip.AddrPortFrom(relay.source, second.key.port))
+	pkt, ok := relay.translateReply(reply)
+	if !ok {
+		t.Fatal("expected reply to be translated")
+	}
+	if pkt.ConnectionId != "ip-b" || !pkt.IpPacket || pkt.Direction != pb.Direction_DIRECTION_REVERSE {
+		t.Errorf("unexpected response packet: %+v", pkt)
+	}
+
+	back, err := network.ParseFlow(pkt.Data)
+	if err != nil {
+		t.Fatalf("ParseFlow failed: %v", err)
+	}
+	if back.Dst != client.Addr() || back.DstPort != client.Port() {
+		t.Errorf("expected reply to %s, got %s:%d", client, back.Dst, back.DstPort)
+	}
+
+	if _, ok := relay.translateReply(udpPacket(target, netip.AddrPortFrom(relay.source, 9))); ok {
+		t.Error("expected packet without a translation to be dropped")
+	}
+
+	if removed := relay.expire(0); removed != 2 || relay.Count() != 0 {
+		t.Errorf("expected both flows to expire, removed %d, %d left", removed, relay.Count())
+	}
+}
+
+func TestTUNRelay_TranslatesReplySourceToManagedCIDR(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ManagedCIDR = "100.64.1.0/24"
+	cfg.TranslateCIDR = "192.168.1.0/24"
+
+	relay := NewTUNRelay(TUNRelayParams{
+		Config:       cfg,
+		Logger:       testutil.NewTestLogger(),
+		ResponseChan: make(chan *pb.Packet, 1),
+	})
+	relay.source = netip.MustParseAddr("198.19.0.2")
+
+	client := netip.MustParseAddrPort("198.18.0.1:40000")
+	flow, err := network.ParseFlow(udpPacket(client, netip.MustParseAddrPort("100.64.1.5:53")))
+	if err != nil {
+		t.Fatalf("ParseFlow failed: %v", err)
+	}
+	entry, err := relay.newEntryLocked("ip-a", flow)
+	if err != nil {
+		t.Fatalf("newEntryLocked failed: %v", err)
+	}
+
+	reply := udpPacket(netip.MustParseAddrPort("192.168.1.5:53"), netip.AddrPortFrom(relay.source, entry.key.port))
+	pkt, ok := relay.translateReply(reply)
+	if !ok {
+		t.Fatal("expected reply to be translated")
+	}
+
+	back, err := network.ParseFlow(pkt.Data)
+	if err != nil {
+		t.Fatalf("ParseFlow failed: %v", err)
+	}
+	if back.Src != netip.MustParseAddr("100.64.1.5") || back.SrcPort != 53 {
+		t.Errorf("expected reply from 100.64.1.5:53, got %s:%d", back.Src, back.SrcPort)
+	}
+	if back.Dst != client.Addr() || back.DstPort != client.Port() {
+		t.Errorf("expected reply to %s, got %s:%d", client, back.Dst, back.DstPort)
+	}
+}
+
+func TestTUNRelay_CheckEgress(t *testing.T) {
+	relay := NewTUNRelay(TUNRelayParams{
+		Config:       DefaultConfig(),
+		Logger:       testutil.NewTestLogger(),
+		ResponseChan: make(chan *pb.Packet, 1),
+	})
+
+	client := netip.MustParseAddrPort("198.18.0.1:40000")
+	for dst, allowed := range map[string]bool{
+		"192.168.1.5:53": true,
+		"10.0.0.5:53":    false,
+	} {
+		target := netip.MustParseAddrPort(dst)
+		flow, err := network.ParseFlow(udpPacket(client, target))
+		if err != nil {
+			t.Fatalf("ParseFlow failed: %v", err)
+		}
+		err = relay.checkEgress(target.Addr(), flow)
+		if allowed && err != nil {
+			t.Errorf("%s: expected allowed, got %v", dst, err)
+		}
+		if !allowed && !errors.Is(err, errEgressDenied) {
+			t.Errorf("%s: expected an egress denial, got %v", dst, err)
+		}
+	}
+}
+
+func TestTUNRelay_PinsFlowDestination(t *testing.T) {
+	relay := NewTUNRelay(TUNRelayParams{
+		Config:       DefaultConfig(),
+		Logger:       testutil.NewTestLogger(),
+		ResponseChan: make(chan *pb.Packet, 1),
+	})
+
+	client := netip.MustParseAddrPort("198.18.0.1:40000")
+	entryFor := func(dst string) (*natEntry, error) {
+		target := netip.MustParseAddrPort(dst)
+		flow, err := network.ParseFlow(udpPacket(client, target))
+		if err != nil {
+			t.Fatalf("ParseFlow failed: %v", err)
+		}
+		return relay.entryLocked("ip-a", target.Addr(), flow)
+	}
+
+	first, err := entryFor("192.168.1.5:53")
+	if err != nil {
+		t.Fatalf("expected the first packet to be admitted, got %v", err)
+	}
+
+	// Only the first packet is checked against the egress policy, so a
+	// later one cannot switch to a denied destination or another port.
+	for _, dst := range []string{"10.0.0.5:53", "192.168.1.5:22"} {
+		if _, err := entryFor(dst); !errors.Is(err, errEgressDenied) {
+			t.Errorf("%s: expected the packet to be refused, got %v", dst, err)
+		}
+	}
+
+	again, err := entryFor("192.168.1.5:53")
+	if err != nil || again != first {
+		t.Errorf("expected packets of the admitted flow to keep passing, got %v", err)
+	}
+	if relay.Count() != 1 {
+		t.Errorf("expected one flow, got %d", relay.Count())
+	}
+}
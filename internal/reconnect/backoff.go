@@ -0,0 +1,66 @@
+package reconnect
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+type Config struct {
+	InitialBackoff time.Duration `mapstructure:"initial_backoff" json:"initial_backoff" yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `mapstructure:"max_backoff" json:"max_backoff" yaml:"max_backoff"`
+	Multiplier     float64       `mapstructure:"multiplier" json:"multiplier" yaml:"multiplier"`
+	// Jitter randomizes each delay by up to this fraction in either direction
+	// so a fleet does not reconnect in lockstep after a server restart.
+	Jitter float64 `mapstructure:"jitter" json:"jitter" yaml:"jitter"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+type Backoff struct {
+	cfg     Config
+	attempt int
+}
+
+func NewBackoff(cfg Config) *Backoff {
+	def := DefaultConfig()
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = def.InitialBackoff
+	}
+	if cfg.MaxBackoff < cfg.InitialBackoff {
+		cfg.MaxBackoff = max(def.MaxBackoff, cfg.InitialBackoff)
+	}
+	if cfg.Multiplier < 1 {
+		cfg.Multiplier = def.Multiplier
+	}
+	cfg.Jitter = min(max(cfg.Jitter, 0), 1)
+
+	return &Backoff{cfg: cfg}
+}
+
+// Next returns the delay before the next attempt and advances the schedule.
+func (b *Backoff) Next() time.Duration {
+	delay := float64(b.cfg.InitialBackoff) * math.Pow(b.cfg.Multiplier, float64(b.attempt))
+	delay = min(delay, float64(b.cfg.MaxBackoff))
+	b.attempt++
+
+	if b.cfg.Jitter > 0 {
+		delay *= 1 + b.cfg.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(delay)
+}
+
+func (b *Backoff) Attempt() int {
+	return b.attempt
+}
+
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,25 @@
+package reconnect
+
+import (
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// Keepalive pings surface a half-open connection to the server so the
+// supervisor can reconnect; the server accepts pings every 10s at most.
+const (
+	KeepaliveTime    = 20 * time.Second
+	KeepaliveTimeout = 10 * time.Second
+)
+
+// KeepaliveOption configures client keepalive pings on a connection to the
+// server.
+func KeepaliveOption() grpc.DialOption {
+	return grpc.WithKeepaliveParams(keepalive.ClientParameters{
+		Time:                KeepaliveTime,
+		Timeout:             KeepaliveTimeout,
+		PermitWithoutStream: true,
+	})
+}
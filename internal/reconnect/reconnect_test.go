@@ -0,0 +1,108 @@
+package reconnect
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	testutil "network-tunneler/internal/testing"
+)
+
+func TestBackoff_GrowsAndCaps(t *testing.T) {
+	b := NewBackoff(Config{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 2})
+
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, w := range want {
+		if got := b.Next(); got != w*time.Millisecond {
+			t.Errorf("attempt %d: delay %v, want %v", i, got, w*time.Millisecond)
+		}
+	}
+
+	b.Reset()
+	if got := b.Next(); got != 100*time.Millisecond {
+		t.Errorf("expected reset to restart the schedule, got %v", got)
+	}
+}
+
+func TestBackoff_JitterBounds(t *testing.T) {
+	b := NewBackoff(Config{InitialBackoff: time.Second, MaxBackoff: time.Second, Multiplier: 2, Jitter: 0.5})
+
+	for range 100 {
+		d := b.Next()
+		if d < 500*time.Millisecond || d > 1500*time.Millisecond {
+			t.Fatalf("jittered delay %v outside [500ms, 1.5s]", d)
+		}
+	}
+}
+
+func TestSupervisor_RetriesUntilRegistered(t *testing.T) {
+	s := NewSupervisor(Config{InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}, testutil.NewTestLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var attempts atomic.Int32
+	registered := make(chan struct{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx, func(ctx context.Context, onRegistered func()) error {
+			if attempts.Add(1) < 3 {
+				return errors.New("connection refused")
+			}
+			onRegistered()
+			close(registered)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	}()
+
+	select {
+	case <-registered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for registration")
+	}
+
+	if st := s.Status(); st.State != StateRegistered || st.Attempt != 0 {
+		t.Errorf("expected registered with reset backoff, got %+v", st)
+	}
+
+	cancel()
+	<-done
+
+	if s.State() != StateStopped {
+		t.Errorf("expected stopped state, got %s", s.State())
+	}
+	if attempts.Load() != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts.Load())
+	}
+}
+
+func TestSupervisor_ReportsBackoff(t *testing.T) {
+	s := NewSupervisor(Config{InitialBackoff: time.Hour, MaxBackoff: time.Hour}, testutil.NewTestLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx, func(ctx context.Context, registered func()) error {
+			return errors.New("server unavailable")
+		})
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.State() != StateBackoff && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	st := s.Status()
+	if st.State != StateBackoff || st.LastError != "server unavailable" || st.NextRetry.IsZero() {
+		t.Errorf("expected backoff status with error and retry time, got %+v", st)
+	}
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,121 @@
+package reconnect
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"network-tunneler/pkg/logger"
+)
+
+type State string
+
+const (
+	StateConnecting State = "connecting"
+	StateRegistered State = "registered"
+	StateBackoff    State = "backoff"
+	StateStopped    State = "stopped"
+)
+
+type Status struct {
+	State     State     `json:"state"`
+	Since     time.Time `json:"since"`
+	Attempt   int       `json:"attempt"`
+	LastError string    `json:"last_error,omitempty"`
+	NextRetry time.Time `json:"next_retry,omitzero"`
+}
+
+// Session connects and registers, calls registered once that succeeded, then
+// blocks until the connection is lost or ctx is cancelled.
+type Session func(ctx context.Context, registered func()) error
+
+// Supervisor runs a Session until its context is cancelled, backing off
+// between failed attempts. The backoff resets once a session registers.
+type Supervisor struct {
+	backoff *Backoff
+	logger  logger.Logger
+
+	status Status
+	mu     sync.RWMutex
+}
+
+func NewSupervisor(cfg Config, log logger.Logger) *Supervisor {
+	return &Supervisor{
+		backoff: NewBackoff(cfg),
+		logger:  log,
+		status:  Status{State: StateStopped, Since: time.Now()},
+	}
+}
+
+func (s *Supervisor) Run(ctx context.Context, session Session) {
+	for {
+		s.transition(StateConnecting, nil, time.Time{})
+
+		err := session(ctx, func() {
+			s.backoff.Reset()
+			s.transition(StateRegistered, nil, time.Time{})
+		})
+
+		if ctx.Err() != nil {
+			s.transition(StateStopped, nil, time.Time{})
+			return
+		}
+
+		delay := s.backoff.Next()
+		s.transition(StateBackoff, err, time.Now().Add(delay))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			s.transition(StateStopped, nil, time.Time{})
+			return
+		}
+	}
+}
+
+func (s *Supervisor) transition(state State, err error, nextRetry time.Time) {
+	s.mu.Lock()
+	prev := s.status.State
+	s.status = Status{
+		State:     state,
+		Since:     time.Now(),
+		Attempt:   s.backoff.Attempt(),
+		NextRetry: nextRetry,
+	}
+	if err != nil {
+		s.status.LastError = err.Error()
+	}
+	s.mu.Unlock()
+
+	fields := []logger.Field{
+		logger.String("state", string(state)),
+		logger.String("previous", string(prev)),
+	}
+
+	switch state {
+	case StateBackoff:
+		fields = append(fields,
+			logger.Int("attempt", s.backoff.Attempt()),
+			logger.Duration("retry_in", time.Until(nextRetry).Round(time.Millisecond)),
+		)
+		if err != nil {
+			fields = append(fields, logger.Error(err))
+		}
+		s.logger.Warn("connection state changed", fields...)
+	default:
+		s.logger.Info("connection state changed", fields...)
+	}
+}
+
+func (s *Supervisor) Status() Status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.status
+}
+
+func (s *Supervisor) State() State {
+	return s.Status().State
+}
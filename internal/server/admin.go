@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"network-tunneler/internal/control"
+)
+
+// DefaultAdminSocket is where the server exposes its admin API and where the
+// admin subcommands look for it.
+const DefaultAdminSocket = "/run/network-tunneler/server.sock"
+
+type ProxyRequest struct {
+	ProxyID string `json:"proxy_id"`
+}
+
+func (r *Registry) RegisterAdminHandlers(s *control.Server) {
+	s.HandleFunc("GET /proxies", func(w http.ResponseWriter, req *http.Request) {
+		control.WriteJSON(w, http.StatusOK, r.ProxyStatuses())
+	})
+	s.HandleFunc("POST /proxies/approve", r.proxyAction(r.ApproveProxy))
+	s.HandleFunc("POST /proxies/revoke", r.proxyAction(r.RevokeProxy))
+	s.Handle("GET /routes", r.RoutesHandler())
+}
+
+func (r *Registry) proxyAction(action func(id string) (ProxyStatus, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var in ProxyRequest
+		if err := control.DecodeJSON(req, &in); err != nil {
+			control.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		if in.ProxyID == "" {
+			control.WriteError(w, http.StatusBadRequest, errors.New("proxy_id is required"))
+			return
+		}
+
+		st, err := action(in.ProxyID)
+		if err != nil {
+			control.WriteError(w, http.StatusConflict, err)
+			return
+		}
+		control.WriteJSON(w, http.StatusOK, st)
+	}
+}
+
+type TapRequest struct {
+	Filter TapFilter `json:"filter"`
+	Path   string    `json:"path,omitempty"`
+}
+
+type TapStopRequest struct {
+	ID string `json:"id"`
+}
+
+func (m *TapManager) RegisterAdminHandlers(s *control.Server) {
+	s.HandleFunc("GET /taps", func(w http.ResponseWriter, req *http.Request) {
+		control.WriteJSON(w, http.StatusOK, m.List())
+	})
+
+	s.HandleFunc("POST /taps", func(w http.ResponseWriter, req *http.Request) {
+		var in TapRequest
+		if err := control.DecodeJSON(req, &in); err != nil {
+			control.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		info, err := m.Start(in.Filter, in.Path)
+		if err != nil {
+			control.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		control.WriteJSON(w, http.StatusCreated, info)
+	})
+
+	s.HandleFunc("POST /taps/stop", func(w http.ResponseWriter, req *http.Request) {
+		var in TapStopRequest
+		if err := control.DecodeJSON(req, &in); err != nil {
+			control.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		info, err := m.Stop(in.ID)
+		if err != nil {
+			control.WriteError(w, http.StatusNotFound, err)
+			return
+		}
+		control.WriteJSON(w, http.StatusOK, info)
+	})
+}
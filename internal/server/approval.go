@@ -0,0 +1,393 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"network-tunneler/pkg/logger"
+)
+
+type ApprovalConfig struct {
+	// Required keeps proxies with unknown IDs pending until an operator
+	// approves them through the admin socket.
+	Required  bool   `mapstructure:"required" json:"required" yaml:"required"`
+	StateFile string `mapstructure:"state_file" json:"state_file" yaml:"state_file"`
+}
+
+// ApprovalRecord binds an approved proxy ID to the claim it was approved
+// with. A record without a claim, from pre-approving an offline proxy or an
+// older state file, takes the claim of the next registration.
+type ApprovalRecord struct {
+	ProxyID     string    `json:"proxy_id"`
+	ManagedCIDR string    `json:"managed_cidr,omitempty"`
+	Domains     []string  `json:"domains,omitempty"`
+	ApprovedAt  time.Time `json:"approved_at"`
+}
+
+func (rec ApprovalRecord) hasClaim() bool {
+	return rec.ManagedCIDR != ""
+}
+
+func (rec ApprovalRecord) claims(managedCIDR string, domains []string) bool {
+	return rec.ManagedCIDR == managedCIDR && slices.Equal(rec.Domains, sortedDomains(domains))
+}
+
+func sortedDomains(domains []string) []string {
+	if len(domains) == 0 {
+		return nil
+	}
+	sorted := slices.Clone(domains)
+	slices.Sort(sorted)
+	return slices.Compact(sorted)
+}
+
+type approvalState struct {
+	Approved []ApprovalRecord `json:"approved"`
+}
+
+// ApprovalStore remembers which proxy IDs an operator has approved. Every
+// change is written to the state file before it takes effect.
+type ApprovalStore struct {
+	path     string
+	approved map[string]ApprovalRecord
+	mu       sync.Mutex
+}
+
+// NewApprovalStore returns nil when approval is disabled, which the registry
+// treats as "every proxy is approved".
+func NewApprovalStore(cfg *Config) (*ApprovalStore, error) {
+	if !cfg.ProxyApproval.Required {
+		return nil, nil
+	}
+	return LoadApprovalStore(cfg.ProxyApproval.StateFile)
+}
+
+func LoadApprovalStore(path string) (*ApprovalStore, error) {
+	s := &ApprovalStore{
+		path:     path,
+		approved: make(map[string]ApprovalRecord),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read approval state: %w", err)
+	}
+
+	var state approvalState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse approval state %s: %w", path, err)
+	}
+
+	for _, rec := range state.Approved {
+		s.approved[rec.ProxyID] = rec
+	}
+
+	return s, nil
+}
+
+func (s *ApprovalStore) IsApproved(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.approved[id]
+	return ok
+}
+
+// Admits reports whether id is approved for exactly this claim. An approval
+// that has no claim yet is bound to it first.
+func (s *ApprovalStore) Admits(id, managedCIDR string, domains []string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.approved[id]
+	if !ok {
+		return false, nil
+	}
+	if rec.hasClaim() {
+		return rec.claims(managedCIDR, domains), nil
+	}
+
+	bound := rec
+	bound.ManagedCIDR = managedCIDR
+	bound.Domains = sortedDomains(domains)
+	s.approved[id] = bound
+	if err := s.save(); err != nil {
+		s.approved[id] = rec
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *ApprovalStore) Get(id string) (ApprovalRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.approved[id]
+	return rec, ok
+}
+
+// Approve records the approval of id for the given claim; an empty CIDR
+// approves an offline proxy for whatever it claims first. Approving again
+// with a different claim replaces the recorded one.
+func (s *ApprovalStore) Approve(id, managedCIDR string, domains []string) (ApprovalRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, existed := s.approved[id]
+	if existed && (managedCIDR == "" || prev.claims(managedCIDR, domains)) {
+		return prev, nil
+	}
+
+	rec := ApprovalRecord{
+		ProxyID:     id,
+		ManagedCIDR: managedCIDR,
+		Domains:     sortedDomains(domains),
+		ApprovedAt:  time.Now().UTC(),
+	}
+	s.approved[id] = rec
+
+	if err := s.save(); err != nil {
+		if existed {
+			s.approved[id] = prev
+		} else {
+			delete(s.approved, id)
+		}
+		return ApprovalRecord{}, err
+	}
+	return rec, nil
+}
+
+func (s *ApprovalStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.approved[id]
+	if !ok {
+		return fmt.Errorf("proxy %s is not approved", id)
+	}
+
+	delete(s.approved, id)
+
+	if err := s.save(); err != nil {
+		s.approved[id] = rec
+		return err
+	}
+	return nil
+}
+
+func (s *ApprovalStore) List() []ApprovalRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sortedLocked()
+}
+
+func (s *ApprovalStore) sortedLocked() []ApprovalRecord {
+	records := make([]ApprovalRecord, 0, len(s.approved))
+	for _, rec := range s.approved {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ProxyID < records[j].ProxyID })
+	return records
+}
+
+func (s *ApprovalStore) save() error {
+	data, err := json.MarshalIndent(approvalState{Approved: s.sortedLocked()}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode approval state: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create approval state directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".approvals-*")
+	if err != nil {
+		return fmt.Errorf("failed to write approval state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write approval state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write approval state: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to replace approval state: %w", err)
+	}
+	return nil
+}
+
+type ProxyState string
+
+const (
+	ProxyStateApproved ProxyState = "approved"
+	ProxyStatePending  ProxyState = "pending"
+	ProxyStateOffline  ProxyState = "offline"
+)
+
+type ProxyStatus struct {
+	ProxyID     string     `json:"proxy_id"`
+	State       ProxyState `json:"state"`
+	ManagedCIDR string     `json:"managed_cidr,omitempty"`
+	ConnectedAt time.Time  `json:"connected_at,omitzero"`
+	ApprovedAt  time.Time  `json:"approved_at,omitzero"`
+}
+
+// ProxyStatuses lists connected proxies along with approved IDs that are
+// currently offline.
+func (r *Registry) ProxyStatuses() []ProxyStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	statuses := make([]ProxyStatus, 0, len(r.proxys))
+	seen := make(map[string]bool, len(r.proxys))
+
+	for _, p := range r.proxys {
+		st := ProxyStatus{
+			ProxyID:     p.ID,
+			State:       ProxyStatePending,
+			ManagedCIDR: p.ManagedCIDR,
+			ConnectedAt: p.ConnectedAt,
+		}
+		if p.Approved {
+			st.State = ProxyStateApproved
+		}
+		if r.approvals != nil {
+			if rec, ok := r.approvals.Get(p.ID); ok {
+				st.ApprovedAt = rec.ApprovedAt
+			}
+		}
+		statuses = append(statuses, st)
+		seen[p.ID] = true
+	}
+
+	if r.approvals != nil {
+		for _, rec := range r.approvals.List() {
+			if seen[rec.ProxyID] {
+				continue
+			}
+			statuses = append(statuses, ProxyStatus{
+				ProxyID:    rec.ProxyID,
+				State:      ProxyStateOffline,
+				ApprovedAt: rec.ApprovedAt,
+			})
+		}
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ProxyID < statuses[j].ProxyID })
+	return statuses
+}
+
+// ApproveProxy records the approval and, if the proxy is connected, makes its
+// CIDR routable and binds the approval to its current claim. The approval is refused when the CIDR conflicts with an
+// already routable proxy under the configured policy.
+func (r *Registry) ApproveProxy(id string) (ProxyStatus, error) {
+	if r.approvals == nil {
+		return ProxyStatus{}, fmt.Errorf("proxy approval is not enabled")
+	}
+
+	var routesChanged bool
+	defer func() {
+		if routesChanged {
+			r.pushRoutes()
+		}
+	}()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	proxy, connected := r.proxys[id]
+	if connected && !proxy.Approved {
+		if err := r.admitRoutesLocked(id, proxy.Prefix); err != nil {
+			return ProxyStatus{}, err
+		}
+	}
+
+	var rec ApprovalRecord
+	var err error
+	if connected {
+		rec, err = r.approvals.Approve(id, proxy.ManagedCIDR, proxy.Domains)
+	} else {
+		rec, err = r.approvals.Approve(id, "", nil)
+	}
+	if err != nil {
+		return ProxyStatus{}, err
+	}
+
+	st := ProxyStatus{ProxyID: id, State: ProxyStateOffline, ApprovedAt: rec.ApprovedAt}
+	if connected {
+		routesChanged = !proxy.Approved
+		proxy.Approved = true
+		st.State = ProxyStateApproved
+		st.ManagedCIDR = proxy.ManagedCIDR
+		st.ConnectedAt = proxy.ConnectedAt
+	}
+
+	r.logger.Info("proxy approved",
+		logger.String("proxy_id", id),
+		logger.String("state", string(st.State)),
+	)
+
+	return st, nil
+}
+
+// RevokeProxy forgets the approval. A connected proxy stays connected but
+// returns to pending and its active connection routes are dropped.
+func (r *Registry) RevokeProxy(id string) (ProxyStatus, error) {
+	if r.approvals == nil {
+		return ProxyStatus{}, fmt.Errorf("proxy approval is not enabled")
+	}
+
+	var routesChanged bool
+	defer func() {
+		if routesChanged {
+			r.pushRoutes()
+		}
+	}()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.approvals.Revoke(id); err != nil {
+		return ProxyStatus{}, err
+	}
+
+	st := ProxyStatus{ProxyID: id, State: ProxyStateOffline}
+
+	dropped := 0
+	if proxy, connected := r.proxys[id]; connected {
+		routesChanged = proxy.Approved
+		proxy.Approved = false
+		st.State = ProxyStatePending
+		st.ManagedCIDR = proxy.ManagedCIDR
+		st.ConnectedAt = proxy.ConnectedAt
+
+		for connID, route := range r.connections {
+			if route.ProxyID == id {
+				r.closeTap(route)
+				delete(r.connections, connID)
+				dropped++
+			}
+		}
+	}
+
+	r.logger.Warn("proxy approval revoked",
+		logger.String("proxy_id", id),
+		logger.Int("dropped_connections", dropped),
+	)
+
+	return st, nil
+}
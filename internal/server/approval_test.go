@@ -0,0 +1,204 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+
+	testutil "network-tunneler/internal/testing"
+)
+
+func newApprovalRegistry(t *testing.T, stateFile string) *Registry {
+	t.Helper()
+
+	store, err := LoadApprovalStore(stateFile)
+	if err != nil {
+		t.Fatalf("LoadApprovalStore failed: %v", err)
+	}
+
+	return NewRegistry(RegistryParams{
+		Config:    DefaultConfig(),
+		Logger:    testutil.NewTestLogger(),
+		Approvals: store,
+	})
+}
+
+func TestApprovalStore_Persists(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state", "approvals.json")
+
+	store, err := LoadApprovalStore(stateFile)
+	if err != nil {
+		t.Fatalf("LoadApprovalStore failed: %v", err)
+	}
+	if _, err := store.Approve("proxy-1", "", nil); err != nil {
+		t.Fatalf("Approve failed: %v", err)
+	}
+	if _, err := store.Approve("proxy-2", "", nil); err != nil {
+		t.Fatalf("Approve failed: %v", err)
+	}
+	if err := store.Revoke("proxy-2"); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if err := store.Revoke("proxy-3"); err == nil {
+		t.Error("expected revoking an unknown proxy to fail")
+	}
+
+	reloaded, err := LoadApprovalStore(stateFile)
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if !reloaded.IsApproved("proxy-1") {
+		t.Error("expected proxy-1 approval to survive reload")
+	}
+	if reloaded.IsApproved("proxy-2") {
+		t.Error("expected proxy-2 revocation to survive reload")
+	}
+}
+
+func TestRegistry_PendingProxyNotRoutable(t *testing.T) {
+	registry := newApprovalRegistry(t, filepath.Join(t.TempDir(), "approvals.json"))
+
+	if err := registry.RegisterProxyStream("proxy-1", &mockProxyStream{}, "10.0.0.0/8"); err != nil {
+		t.Fatalf("RegisterProxyStream failed: %v", err)
+	}
+
+	if registry.IsProxyApproved("proxy-1") {
+		t.Error("expected unknown proxy to be pending")
+	}
+	if _, found := registry.FindProxyByCIDR("10.1.2.3"); found {
+		t.Error("expected pending proxy to receive no routes")
+	}
+
+	st, err := registry.ApproveProxy("proxy-1")
+	if err != nil {
+		t.Fatalf("ApproveProxy failed: %v", err)
+	}
+	if st.State != ProxyStateApproved {
+		t.Errorf("expected approved state, got %s", st.State)
+	}
+	if _, found := registry.FindProxyByCIDR("10.1.2.3"); !found {
+		t.Error("expected approved proxy to be routable")
+	}
+
+	registry.connections["conn-1"] = &ConnectionRoute{ConnectionID: "conn-1", ProxyID: "proxy-1"}
+
+	st, err = registry.RevokeProxy("proxy-1")
+	if err != nil {
+		t.Fatalf("RevokeProxy failed: %v", err)
+	}
+	if st.State != ProxyStatePending {
+		t.Errorf("expected pending state after revoke, got %s", st.State)
+	}
+	if _, found := registry.FindProxyByCIDR("10.1.2.3"); found {
+		t.Error("expected revoked proxy to receive no routes")
+	}
+	if registry.GetConnectionCount() != 0 {
+		t.Error("expected routes through revoked proxy to be dropped")
+	}
+}
+
+func TestRegistry_ApprovalRemembered(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "approvals.json")
+
+	registry := newApprovalRegistry(t, stateFile)
+	if _, err := registry.ApproveProxy("proxy-1"); err != nil {
+		t.Fatalf("ApproveProxy failed: %v", err)
+	}
+
+	statuses := registry.ProxyStatuses()
+	if len(statuses) != 1 || statuses[0].State != ProxyStateOffline {
+		t.Fatalf("expected pre-approved proxy to be listed offline, got %+v", statuses)
+	}
+
+	restarted := newApprovalRegistry(t, stateFile)
+	if err := restarted.RegisterProxyStream("proxy-1", &mockProxyStream{}, "10.0.0.0/8"); err != nil {
+		t.Fatalf("RegisterProxyStream failed: %v", err)
+	}
+	if !restarted.IsProxyApproved("proxy-1") {
+		t.Error("expected remembered approval to apply on registration")
+	}
+}
+
+func TestRegistry_ApprovalChecksConflicts(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "approvals.json")
+
+	registry := newApprovalRegistry(t, stateFile)
+	registry.ApproveProxy("proxy-prod")
+	registry.RegisterProxyStream("proxy-prod", &mockProxyStream{}, "10.0.0.0/8")
+
+	// A pending proxy may claim an overlapping CIDR without affecting routing.
+	if err := registry.RegisterProxyStream("proxy-new", &mockProxyStream{}, "10.1.0.0/16"); err != nil {
+		t.Fatalf("expected pending overlapping proxy to register, got %v", err)
+	}
+	if p, _ := registry.FindProxyByCIDR("10.1.0.1"); p == nil || p.ID != "proxy-prod" {
+		t.Error("expected pending proxy not to shadow the approved route")
+	}
+
+	if _, err := registry.ApproveProxy("proxy-new"); err == nil {
+		t.Error("expected approval of a conflicting CIDR to be refused")
+	}
+	if store, _ := LoadApprovalStore(stateFile); store.IsApproved("proxy-new") {
+		t.Error("expected refused approval not to be persisted")
+	}
+}
+
+func TestRegistry_ApprovalDisabled(t *testing.T) {
+	registry := NewRegistry(RegistryParams{Config: DefaultConfig(), Logger: testutil.NewTestLogger()})
+
+	registry.RegisterProxyStream("proxy-1", &mockProxyStream{}, "10.0.0.0/8")
+	if !registry.IsProxyApproved("proxy-1") {
+		t.Error("expected proxies to be routable when approval is disabled")
+	}
+	if _, err := registry.ApproveProxy("proxy-1"); err == nil {
+		t.Error("expected approve to fail when approval is disabled")
+	}
+}
+
+func TestRegistry_ApprovalBoundToClaim(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "approvals.json")
+
+	registry := newApprovalRegistry(t, stateFile)
+	if err := registry.RegisterProxyStream("proxy-1", &mockProxyStream{}, "10.0.0.0/8", "corp.internal"); err != nil {
+		t.Fatalf("RegisterProxyStream failed: %v", err)
+	}
+	if _, err := registry.ApproveProxy("proxy-1"); err != nil {
+		t.Fatalf("ApproveProxy failed: %v", err)
+	}
+	registry.UnregisterProxy("proxy-1")
+
+	// The same ID claiming something else waits for a new approval.
+	restarted := newApprovalRegistry(t, stateFile)
+	if err := restarted.RegisterProxyStream("proxy-1", &mockProxyStream{}, "172.16.0.0/12", "corp.internal"); err != nil {
+		t.Fatalf("RegisterProxyStream failed: %v", err)
+	}
+	if restarted.IsProxyApproved("proxy-1") {
+		t.Error("expected a different CIDR to keep the proxy pending")
+	}
+	restarted.UnregisterProxy("proxy-1")
+
+	restarted.RegisterProxyStream("proxy-1", &mockProxyStream{}, "10.0.0.0/8", "other.internal")
+	if restarted.IsProxyApproved("proxy-1") {
+		t.Error("expected different domains to keep the proxy pending")
+	}
+	restarted.UnregisterProxy("proxy-1")
+
+	restarted.RegisterProxyStream("proxy-1", &mockProxyStream{}, "10.0.0.0/8", "corp.internal")
+	if !restarted.IsProxyApproved("proxy-1") {
+		t.Error("expected the approved claim to be admitted")
+	}
+}
+
+func TestRegistry_PreApprovalBindsFirstClaim(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "approvals.json")
+
+	registry := newApprovalRegistry(t, stateFile)
+	registry.ApproveProxy("proxy-1")
+	registry.RegisterProxyStream("proxy-1", &mockProxyStream{}, "10.0.0.0/8")
+	if !registry.IsProxyApproved("proxy-1") {
+		t.Fatal("expected pre-approved proxy to be admitted")
+	}
+
+	store, _ := LoadApprovalStore(stateFile)
+	if rec, _ := store.Get("proxy-1"); rec.ManagedCIDR != "10.0.0.0/8" {
+		t.Errorf("expected the first claim to be recorded, got %+v", rec)
+	}
+}
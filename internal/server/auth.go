@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"network-tunneler/pkg/crypto"
+	pb "network-tunneler/proto"
+)
+
+// requiredRole maps a full gRPC method name to the certificate role allowed
+// to call it. Methods of other services (e.g. grpc.health.v1) are open to
+// any authenticated peer.
+func requiredRole(fullMethod string) crypto.Role {
+	switch {
+	case strings.HasPrefix(fullMethod, "/"+pb.TunnelClient_ServiceDesc.ServiceName+"/"):
+		return crypto.RoleClient
+	case strings.HasPrefix(fullMethod, "/"+pb.TunnelProxy_ServiceDesc.ServiceName+"/"):
+		return crypto.RoleProxy
+	default:
+		return crypto.RoleUnknown
+	}
+}
+
+func peerRole(ctx context.Context) (crypto.Role, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return crypto.RoleUnknown, status.Error(codes.Unauthenticated, "no peer information")
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return crypto.RoleUnknown, status.Error(codes.Unauthenticated, "no client certificate presented")
+	}
+
+	return crypto.CertRole(tlsInfo.State.PeerCertificates[0]), nil
+}
+
+// streamIdentity fingerprints the certificate the stream's peer presented;
+// it is empty for peers without one.
+func streamIdentity(stream grpc.ServerStream) string {
+	p, ok := peer.FromContext(stream.Context())
+	if !ok {
+		return ""
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(tlsInfo.State.PeerCertificates[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func authorize(ctx context.Context, fullMethod string) error {
+	required := requiredRole(fullMethod)
+	if required == crypto.RoleUnknown {
+		return nil
+	}
+
+	role, err := peerRole(ctx)
+	if err != nil {
+		return err
+	}
+
+	if role != required {
+		return status.Errorf(codes.PermissionDenied,
+			"certificate role %q is not allowed to call %s", role, fullMethod)
+	}
+
+	return nil
+}
+
+func authorizeUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := authorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func authorizeStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := authorize(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	testutil "network-tunneler/internal/testing"
+	"network-tunneler/pkg/crypto"
+	pb "network-tunneler/proto"
+)
+
+type testPKI struct {
+	ca *crypto.CA
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	ca, err := crypto.GenerateCA("test")
+	if err != nil {
+		t.Fatalf("GenerateCA failed: %v", err)
+	}
+	return &testPKI{ca: ca}
+}
+
+func (p *testPKI) tlsOptions(t *testing.T, opts crypto.CertOptions) crypto.TLSOptions {
+	t.Helper()
+	cert, key, err := crypto.GenerateCert(p.ca, opts)
+	if err != nil {
+		t.Fatalf("GenerateCert failed: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey failed: %v", err)
+	}
+	return crypto.TLSOptions{
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		CAPEM:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.ca.Cert.Raw}),
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+func startSinglePortServer(t *testing.T, pki *testPKI) string {
+	t.Helper()
+
+	serverTLS, err := crypto.LoadServerTLSConfig(pki.tlsOptions(t, crypto.CertOptions{
+		CommonName: "server",
+		IPAddr:     []net.IP{net.ParseIP("127.0.0.1")},
+		Type:       crypto.ServerCert,
+		Role:       crypto.RoleServer,
+	}))
+	if err != nil {
+		t.Fatalf("LoadServerTLSConfig failed: %v", err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.ListenAddr = freeAddr(t)
+
+	log := testutil.NewTestLogger()
+	registry := NewRegistry(RegistryParams{Config: cfg, Logger: log})
+	s := NewGRPCServer(cfg, log, serverTLS, registry)
+
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Stop(ctx)
+		registry.Cleanup(ctx)
+	})
+
+	return cfg.ListenAddr
+}
+
+func dialAs(t *testing.T, pki *testPKI, addr string, role crypto.Role) *grpc.ClientConn {
+	t.Helper()
+
+	clientTLS, err := crypto.LoadClientTLSConfig(pki.tlsOptions(t, crypto.CertOptions{
+		CommonName: string(role) + "-test",
+		Type:       crypto.ClientCert,
+		Role:       role,
+	}))
+	if err != nil {
+		t.Fatalf("LoadClientTLSConfig failed: %v", err)
+	}
+	clientTLS.ServerName = "127.0.0.1"
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(credentials.NewTLS(clientTLS)))
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func expectCode(t *testing.T, err error, want codes.Code) {
+	t.Helper()
+	if got := status.Code(err); got != want {
+		t.Errorf("expected code %s, got %s (%v)", want, got, err)
+	}
+}
+
+func TestSinglePort_RoleAuthorization(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := startSinglePortServer(t, pki)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clientConn := dialAs(t, pki, addr, crypto.RoleClient)
+	proxyConn := dialAs(t, pki, addr, crypto.RoleProxy)
+
+	// A client certificate may use the client service but not the proxy service.
+	stream, err := pb.NewTunnelClientClient(clientConn).Connect(ctx)
+	if err != nil {
+		t.Fatalf("client Connect failed: %v", err)
+	}
+	if err := stream.Send(&pb.ClientMessage{Message: &pb.ClientMessage_Register{
+		Register: &pb.ClientRegister{ClientId: "client-1"},
+	}}); err != nil {
+		t.Fatalf("client Send failed: %v", err)
+	}
+	msg, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("expected client registration to be accepted, got %v", err)
+	}
+	if ack := msg.GetAck(); ack == nil || !ack.Success {
+		t.Errorf("expected successful ack, got %v", msg)
+	}
+
+	proxyStream, err := pb.NewTunnelProxyClient(clientConn).Connect(ctx)
+	if err != nil {
+		t.Fatalf("proxy Connect failed: %v", err)
+	}
+	_, err = proxyStream.Recv()
+	expectCode(t, err, codes.PermissionDenied)
+
+	// A proxy certificate may not use the client service.
+	clientStream, err := pb.NewTunnelClientClient(proxyConn).Connect(ctx)
+	if err != nil {
+		t.Fatalf("client Connect failed: %v", err)
+	}
+	_, err = clientStream.Recv()
+	expectCode(t, err, codes.PermissionDenied)
+
+	// Health checks are open to any authenticated peer.
+	resp, err := healthpb.NewHealthClient(proxyConn).Check(ctx, &healthpb.HealthCheckRequest{
+		Service: pb.TunnelProxy_ServiceDesc.ServiceName,
+	})
+	if err != nil {
+		t.Fatalf("health Check failed: %v", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("expected SERVING, got %s", resp.Status)
+	}
+}
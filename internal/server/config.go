@@ -4,23 +4,38 @@ import (
 	"fmt"
 
 	"network-tunneler/internal/config"
+	"network-tunneler/internal/health"
 	"network-tunneler/pkg/crypto"
 	"network-tunneler/pkg/logger"
 )
 
 type Config struct {
-	ClientListenAddr string            `mapstructure:"client_listen_addr" json:"client_listen_addr" yaml:"client_listen_addr"`
-	ProxyListenAddr  string            `mapstructure:"proxy_listen_addr" json:"proxy_listen_addr" yaml:"proxy_listen_addr"`
-	TLS              crypto.TLSOptions `mapstructure:"tls" json:"tls" yaml:"tls"`
-	Log              logger.Config     `mapstructure:"log" json:"log" yaml:"log"`
+	// ListenAddr enables single-port mode: both services share one listener
+	// and access is authorized per RPC from the peer certificate's role.
+	ListenAddr         string            `mapstructure:"listen_addr" json:"listen_addr" yaml:"listen_addr"`
+	ClientListenAddr   string            `mapstructure:"client_listen_addr" json:"client_listen_addr" yaml:"client_listen_addr"`
+	ProxyListenAddr    string            `mapstructure:"proxy_listen_addr" json:"proxy_listen_addr" yaml:"proxy_listen_addr"`
+	CIDRConflictPolicy ConflictPolicy    `mapstructure:"cidr_conflict_policy" json:"cidr_conflict_policy" yaml:"cidr_conflict_policy"`
+	ProxyApproval      ApprovalConfig    `mapstructure:"proxy_approval" json:"proxy_approval" yaml:"proxy_approval"`
+	ClientPolicies     []ClientPolicy    `mapstructure:"client_policies" json:"client_policies" yaml:"client_policies"`
+	AdminSocket        string            `mapstructure:"admin_socket" json:"admin_socket" yaml:"admin_socket"`
+	TLS                crypto.TLSOptions `mapstructure:"tls" json:"tls" yaml:"tls"`
+	Health             health.Config     `mapstructure:"health" json:"health" yaml:"health"`
+	Log                logger.Config     `mapstructure:"log" json:"log" yaml:"log"`
 }
 
 func DefaultConfig() *Config {
 	return &Config{
-		ClientListenAddr: ":8080",
-		ProxyListenAddr:  ":8081",
-		TLS:              crypto.TLSOptions{},
-		Log:              config.DefaultLogConfig(),
+		ClientListenAddr:   ":8080",
+		ProxyListenAddr:    ":8081",
+		CIDRConflictPolicy: ConflictPolicyReject,
+		ProxyApproval: ApprovalConfig{
+			StateFile: "/var/lib/network-tunneler/proxy-approvals.json",
+		},
+		AdminSocket: DefaultAdminSocket,
+		TLS:         crypto.TLSOptions{},
+		Health:      health.Config{ListenAddr: ":8082"},
+		Log:         config.DefaultLogConfig(),
 	}
 }
 
@@ -32,7 +47,17 @@ func LoadConfig(configFile string) (*Config, error) {
 	return cfg, nil
 }
 
+func (c *Config) SinglePort() bool {
+	return c.ListenAddr != ""
+}
+
 func (c *Config) Validate() error {
+	if c.SinglePort() {
+		if c.Health.ListenAddr != "" && c.Health.ListenAddr == c.ListenAddr {
+			return fmt.Errorf("health listen address must differ from gRPC listen address")
+		}
+		return c.validateShared()
+	}
 	if c.ClientListenAddr == "" {
 		return fmt.Errorf("client listen address is required")
 	}
@@ -42,5 +67,33 @@ func (c *Config) Validate() error {
 	if c.ClientListenAddr == c.ProxyListenAddr {
 		return fmt.Errorf("client and proxy listen addresses must be different")
 	}
-	return nil
+	if c.Health.ListenAddr != "" &&
+		(c.Health.ListenAddr == c.ClientListenAddr || c.Health.ListenAddr == c.ProxyListenAddr) {
+		return fmt.Errorf("health listen address must differ from gRPC listen addresses")
+	}
+	return c.validateShared()
+}
+
+func (c *Config) validateShared() error {
+	if c.ProxyApproval.Required {
+		if c.ProxyApproval.StateFile == "" {
+			return fmt.Errorf("proxy approval requires a state file")
+		}
+		if c.AdminSocket == "" {
+			return fmt.Errorf("proxy approval requires an admin socket")
+		}
+	}
+	if _, err := parseClientPolicies(c.ClientPolicies); err != nil {
+		return err
+	}
+	return c.validateConflictPolicy()
+}
+
+func (c *Config) validateConflictPolicy() error {
+	switch c.CIDRConflictPolicy {
+	case "", ConflictPolicyReject, ConflictPolicyPreferSpecific, ConflictPolicyPool:
+		return nil
+	default:
+		return fmt.Errorf("unknown CIDR conflict policy: %s", c.CIDRConflictPolicy)
+	}
 }
@@ -2,6 +2,8 @@ package server
 
 import (
 	"testing"
+
+	"network-tunneler/internal/health"
 )
 
 func TestDefaultConfig(t *testing.T) {
@@ -42,6 +44,50 @@ func TestConfigValidation(t *testing.T) {
 			},
 			expectErr: true,
 		},
+		{
+			name: "health addr collides with client addr",
+			cfg: &Config{
+				ClientListenAddr: ":8080",
+				ProxyListenAddr:  ":8081",
+				Health:           health.Config{ListenAddr: ":8080"},
+			},
+			expectErr: true,
+		},
+		{
+			name: "single-port mode ignores per-role addresses",
+			cfg: &Config{
+				ListenAddr:       ":8443",
+				ClientListenAddr: ":8080",
+				ProxyListenAddr:  ":8080",
+			},
+			expectErr: false,
+		},
+		{
+			name: "single-port health addr collides",
+			cfg: &Config{
+				ListenAddr: ":8443",
+				Health:     health.Config{ListenAddr: ":8443"},
+			},
+			expectErr: true,
+		},
+		{
+			name: "unknown conflict policy",
+			cfg: &Config{
+				ClientListenAddr:   ":8080",
+				ProxyListenAddr:    ":8081",
+				CIDRConflictPolicy: "first_wins",
+			},
+			expectErr: true,
+		},
+		{
+			name: "approval without admin socket",
+			cfg: &Config{
+				ClientListenAddr: ":8080",
+				ProxyListenAddr:  ":8081",
+				ProxyApproval:    ApprovalConfig{Required: true, StateFile: "approvals.json"},
+			},
+			expectErr: true,
+		},
 		{
 			name: "same addresses",
 			cfg: &Config{
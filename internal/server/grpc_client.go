@@ -3,6 +3,9 @@ package server
 import (
 	"io"
 
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
 	"network-tunneler/pkg/logger"
 	pb "network-tunneler/proto"
 )
@@ -27,18 +30,30 @@ func (s *ClientService) Connect(stream pb.TunnelClient_ConnectServer) error {
 	s.logger.Debug("new client connection stream")
 
 	ctx := stream.Context()
+	msgs, recvErr := recvMessages(ctx, stream.Recv)
+
+	// Set once registered; closed if a reconnect takes over the ID.
+	var replaced <-chan struct{}
 
 	for {
+		var msg *pb.ClientMessage
+		var err error
+
 		select {
 		case <-ctx.Done():
 			s.logger.Info("client stream context cancelled",
 				logger.String("client_id", clientID),
 			)
 			return ctx.Err()
-		default:
+		case <-replaced:
+			s.logger.Info("client stream replaced by a newer registration",
+				logger.String("client_id", clientID),
+			)
+			return status.Error(codes.Aborted, "replaced by a newer registration")
+		case err = <-recvErr:
+		case msg = <-msgs:
 		}
 
-		msg, err := stream.Recv()
 		if err == io.EOF {
 			s.logger.Info("client disconnected", logger.String("client_id", clientID))
 			return nil
@@ -70,7 +85,8 @@ func (s *ClientService) Connect(stream pb.TunnelClient_ConnectServer) error {
 				ack.Message = err.Error()
 			} else {
 				registered = true
-				defer s.registry.UnregisterClient(clientID)
+				replaced = s.registry.clientReplaced(clientID, stream)
+				defer s.registry.UnregisterClientStream(clientID, stream)
 			}
 
 			if err := stream.Send(&pb.ClientMessage{
@@ -80,6 +96,10 @@ func (s *ClientService) Connect(stream pb.TunnelClient_ConnectServer) error {
 				return err
 			}
 
+			if registered {
+				s.registry.EnableRoutePush(clientID)
+			}
+
 		case *pb.ClientMessage_Packet:
 			if !registered {
 				s.logger.Warn("packet from unregistered client")
@@ -109,6 +129,18 @@ func (s *ClientService) Connect(stream pb.TunnelClient_ConnectServer) error {
 				logger.String("client_id", clientID),
 			)
 
+			// Echoed so the client can measure the round trip.
+			if client, ok := s.registry.GetClient(clientID); ok {
+				if err := client.Send(&pb.ClientMessage{
+					Message: &pb.ClientMessage_Heartbeat{Heartbeat: m.Heartbeat},
+				}); err != nil {
+					s.logger.Warn("failed to echo heartbeat",
+						logger.String("client_id", clientID),
+						logger.Error(err),
+					)
+				}
+			}
+
 		default:
 			s.logger.Warn("unknown message type from client",
 				logger.String("client_id", clientID),
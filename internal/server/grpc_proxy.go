@@ -3,6 +3,9 @@ package server
 import (
 	"io"
 
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
 	"network-tunneler/pkg/logger"
 	pb "network-tunneler/proto"
 )
@@ -28,18 +31,30 @@ func (s *ProxyService) Connect(stream pb.TunnelProxy_ConnectServer) error {
 	s.logger.Debug("new proxy connection stream")
 
 	ctx := stream.Context()
+	msgs, recvErr := recvMessages(ctx, stream.Recv)
+
+	// Set once registered; closed if a reconnect takes over the ID.
+	var replaced <-chan struct{}
 
 	for {
+		var msg *pb.ProxyMessage
+		var err error
+
 		select {
 		case <-ctx.Done():
 			s.logger.Info("proxy stream context cancelled",
 				logger.String("proxy_id", proxyID),
 			)
 			return ctx.Err()
-		default:
+		case <-replaced:
+			s.logger.Info("proxy stream replaced by a newer registration",
+				logger.String("proxy_id", proxyID),
+			)
+			return status.Error(codes.Aborted, "replaced by a newer registration")
+		case err = <-recvErr:
+		case msg = <-msgs:
 		}
 
-		msg, err := stream.Recv()
 		if err == io.EOF {
 			s.logger.Info("proxy disconnected",
 				logger.String("proxy_id", proxyID),
@@ -69,7 +84,7 @@ func (s *ProxyService) Connect(stream pb.TunnelProxy_ConnectServer) error {
 				Message: "registered successfully",
 			}
 
-			if err := s.registry.RegisterProxyStream(proxyID, stream, managedCIDR); err != nil {
+			if err := s.registry.RegisterProxyStream(proxyID, stream, managedCIDR, m.Register.Domains...); err != nil {
 				s.logger.Error("failed to register proxy",
 					logger.String("proxy_id", proxyID),
 					logger.Error(err),
@@ -78,7 +93,12 @@ func (s *ProxyService) Connect(stream pb.TunnelProxy_ConnectServer) error {
 				ack.Message = err.Error()
 			} else {
 				registered = true
-				defer s.registry.UnregisterProxy(proxyID)
+				replaced = s.registry.proxyReplaced(proxyID, stream)
+				defer s.registry.UnregisterProxyStream(proxyID, stream)
+
+				if !s.registry.IsProxyApproved(proxyID) {
+					ack.Message = "registered, pending operator approval"
+				}
 			}
 
 			if err := stream.Send(&pb.ProxyMessage{
@@ -6,14 +6,42 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
 
 	"network-tunneler/pkg/logger"
 	pb "network-tunneler/proto"
 )
 
+// Keepalive pings detect half-open streams (NAT timeouts, rebooted peers)
+// well before TCP gives up on them.
+const (
+	keepaliveTime    = 30 * time.Second
+	keepaliveTimeout = 10 * time.Second
+	// keepaliveMinTime is the most frequent ping accepted from peers; it
+	// must stay below the interval clients and proxies ping at.
+	keepaliveMinTime = 10 * time.Second
+)
+
+func keepaliveOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    keepaliveTime,
+			Timeout: keepaliveTimeout,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             keepaliveMinTime,
+			PermitWithoutStream: true,
+		}),
+	}
+}
+
 type GRPCServer struct {
 	cfg            *Config
 	logger         logger.Logger
@@ -24,8 +52,11 @@ type GRPCServer struct {
 
 	clientServer   *grpc.Server
 	proxyServer *grpc.Server
+	sharedServer *grpc.Server
+	healthServer *grpchealth.Server
 
-	wg sync.WaitGroup
+	listening atomic.Bool
+	wg        sync.WaitGroup
 }
 
 func NewGRPCServer(
@@ -41,17 +72,26 @@ func NewGRPCServer(
 		registry:       registry,
 		clientService:   NewClientService(registry, log),
 		proxyService: NewProxyService(registry, log),
+		healthServer: grpchealth.NewServer(),
 	}
 }
 
 func (s *GRPCServer) Start(ctx context.Context) error {
 	creds := credentials.NewTLS(s.tlsConfig)
 
-	s.clientServer = grpc.NewServer(grpc.Creds(creds))
+	s.setServingStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+
+	if s.cfg.SinglePort() {
+		return s.startSinglePort(creds)
+	}
+
+	s.clientServer = grpc.NewServer(append(keepaliveOptions(), grpc.Creds(creds))...)
 	pb.RegisterTunnelClientServer(s.clientServer, s.clientService)
+	healthpb.RegisterHealthServer(s.clientServer, s.healthServer)
 
-	s.proxyServer = grpc.NewServer(grpc.Creds(creds))
+	s.proxyServer = grpc.NewServer(append(keepaliveOptions(), grpc.Creds(creds))...)
 	pb.RegisterTunnelProxyServer(s.proxyServer, s.proxyService)
+	healthpb.RegisterHealthServer(s.proxyServer, s.healthServer)
 
 	clientLis, err := net.Listen("tcp", s.cfg.ClientListenAddr)
 	if err != nil {
@@ -87,13 +127,54 @@ func (s *GRPCServer) Start(ctx context.Context) error {
 		s.logger.Debug("proxy gRPC server goroutine stopped")
 	}()
 
+	s.listening.Store(true)
+	s.setServingStatus(healthpb.HealthCheckResponse_SERVING)
+
 	s.logger.Info("gRPC servers started successfully")
 	return nil
 }
 
+func (s *GRPCServer) startSinglePort(creds credentials.TransportCredentials) error {
+	s.sharedServer = grpc.NewServer(append(keepaliveOptions(),
+		grpc.Creds(creds),
+		grpc.ChainUnaryInterceptor(authorizeUnary),
+		grpc.ChainStreamInterceptor(authorizeStream),
+	)...)
+	pb.RegisterTunnelClientServer(s.sharedServer, s.clientService)
+	pb.RegisterTunnelProxyServer(s.sharedServer, s.proxyService)
+	healthpb.RegisterHealthServer(s.sharedServer, s.healthServer)
+
+	lis, err := net.Listen("tcp", s.cfg.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	s.logger.Info("gRPC server starting in single-port mode",
+		logger.String("addr", s.cfg.ListenAddr),
+	)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.sharedServer.Serve(lis); err != nil {
+			s.logger.Error("gRPC server error", logger.Error(err))
+		}
+		s.logger.Debug("shared gRPC server goroutine stopped")
+	}()
+
+	s.listening.Store(true)
+	s.setServingStatus(healthpb.HealthCheckResponse_SERVING)
+
+	s.logger.Info("gRPC server started successfully")
+	return nil
+}
+
 func (s *GRPCServer) Stop(ctx context.Context) error {
 	s.logger.Info("stopping gRPC servers")
 
+	s.listening.Store(false)
+	s.healthServer.Shutdown()
+
 	// Use a goroutine to perform graceful stop with context timeout protection
 	done := make(chan struct{})
 	go func() {
@@ -103,6 +184,9 @@ func (s *GRPCServer) Stop(ctx context.Context) error {
 		if s.proxyServer != nil {
 			s.proxyServer.GracefulStop()
 		}
+		if s.sharedServer != nil {
+			s.sharedServer.GracefulStop()
+		}
 		close(done)
 	}()
 
@@ -119,6 +203,9 @@ func (s *GRPCServer) Stop(ctx context.Context) error {
 		if s.proxyServer != nil {
 			s.proxyServer.Stop()
 		}
+		if s.sharedServer != nil {
+			s.sharedServer.Stop()
+		}
 	}
 
 	// Wait for server goroutines to complete
@@ -127,3 +214,41 @@ func (s *GRPCServer) Stop(ctx context.Context) error {
 	s.logger.Info("all gRPC server goroutines stopped")
 	return nil
 }
+
+func (s *GRPCServer) Ready() error {
+	if !s.listening.Load() {
+		return fmt.Errorf("gRPC listeners not started")
+	}
+	return nil
+}
+
+func (s *GRPCServer) setServingStatus(status healthpb.HealthCheckResponse_ServingStatus) {
+	s.healthServer.SetServingStatus("", status)
+	s.healthServer.SetServingStatus(pb.TunnelClient_ServiceDesc.ServiceName, status)
+	s.healthServer.SetServingStatus(pb.TunnelProxy_ServiceDesc.ServiceName, status)
+}
+
+// recvMessages moves a stream's blocking Recv off the handler goroutine so
+// Connect can also wait on the stream being replaced. The goroutine ends
+// once Recv fails, which happens when the handler returns.
+func recvMessages[T any](ctx context.Context, recv func() (T, error)) (<-chan T, <-chan error) {
+	msgs := make(chan T)
+	errs := make(chan error, 1)
+
+	go func() {
+		for {
+			msg, err := recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case msgs <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return msgs, errs
+}
@@ -6,6 +6,7 @@ import (
 	"go.uber.org/fx"
 
 	"network-tunneler/internal/certs"
+	"network-tunneler/internal/health"
 	"network-tunneler/pkg/crypto"
 	"network-tunneler/pkg/logger"
 )
@@ -14,6 +15,9 @@ var Module = fx.Module("server",
 	fx.Provide(
 		ProvideConfig,
 
+		health.NewChecker,
+		NewApprovalStore,
+		NewTapManager,
 		NewRegistry,
 		NewGRPCServer,
 
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+
+	"network-tunneler/pkg/logger"
+	"network-tunneler/pkg/network"
+	pb "network-tunneler/proto"
+)
+
+// AnyClient is the client_id of the policy applied to clients without their
+// own entry.
+const AnyClient = "*"
+
+// ClientPolicy limits the destinations a client may reach. Once any policy
+// is configured, clients matching neither their own ID nor AnyClient are
+// denied everything.
+type ClientPolicy struct {
+	ClientID     string   `mapstructure:"client_id" json:"client_id" yaml:"client_id"`
+	AllowedCIDRs []string `mapstructure:"allowed_cidrs" json:"allowed_cidrs" yaml:"allowed_cidrs"`
+}
+
+func parseClientPolicies(policies []ClientPolicy) (map[string][]netip.Prefix, error) {
+	parsed := make(map[string][]netip.Prefix, len(policies))
+
+	for _, p := range policies {
+		if p.ClientID == "" {
+			return nil, fmt.Errorf("client policy requires a client_id")
+		}
+		if _, dup := parsed[p.ClientID]; dup {
+			return nil, fmt.Errorf("duplicate client policy for %s", p.ClientID)
+		}
+
+		prefixes := make([]netip.Prefix, 0, len(p.AllowedCIDRs))
+		for _, cidr := range p.AllowedCIDRs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("client policy %s: invalid CIDR %q: %w", p.ClientID, cidr, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		}
+		parsed[p.ClientID] = prefixes
+	}
+
+	return parsed, nil
+}
+
+// allowedPrefixes returns the client's allowed destinations, or nil and false
+// when no policies are configured at all.
+func (r *Registry) allowedPrefixes(clientID string) ([]netip.Prefix, bool) {
+	if len(r.policies) == 0 {
+		return nil, false
+	}
+	if allowed, ok := r.policies[clientID]; ok {
+		return allowed, true
+	}
+	return r.policies[AnyClient], true
+}
+
+func (r *Registry) clientMayReach(clientID string, addr netip.Addr) bool {
+	allowed, restricted := r.allowedPrefixes(clientID)
+	if !restricted {
+		return true
+	}
+	for _, p := range allowed {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// routesForClientLocked lists the routable prefixes visible to a client.
+func (r *Registry) routesForClientLocked(clientID string) []string {
+	seen := make(map[netip.Prefix]bool)
+	var routable []netip.Prefix
+	for _, p := range r.proxys {
+		if p.Approved && !seen[p.Prefix] {
+			seen[p.Prefix] = true
+			routable = append(routable, p.Prefix)
+		}
+	}
+
+	if allowed, restricted := r.allowedPrefixes(clientID); restricted {
+		routable = network.IntersectPrefixes(routable, allowed)
+	} else {
+		network.SortPrefixes(routable)
+	}
+
+	prefixes := make([]string, 0, len(routable))
+	for _, p := range routable {
+		prefixes = append(prefixes, p.String())
+	}
+	return prefixes
+}
+
+// pushRoutes queues every client its current route table. Tables are built
+// under the read lock and handed to each client's route writer; versions let
+// the writer and clients discard tables that arrive out of order.
+func (r *Registry) pushRoutes() {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	version := r.routeVersion.Add(1)
+	for _, c := range r.clients {
+		c.queueRoutes(&pb.RouteTable{Version: version, Prefixes: r.routesForClientLocked(c.ID)})
+	}
+}
+
+// EnableRoutePush queues a client's initial table and starts its route
+// writer. It must be called after the registration ack has been sent so the
+// ack stays the first message on the stream.
+func (r *Registry) EnableRoutePush(clientID string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	client, exists := r.clients[clientID]
+	if !exists {
+		return
+	}
+	client.queueRoutes(&pb.RouteTable{Version: r.routeVersion.Add(1), Prefixes: r.routesForClientLocked(clientID)})
+
+	client.routesMu.Lock()
+	started := client.routesStarted
+	client.routesStarted = true
+	client.routesMu.Unlock()
+
+	if !started {
+		go r.routeWriter(client)
+	}
+}
+
+// queueRoutes replaces the pending table unless a newer one has already been
+// queued.
+func (c *ClientConn) queueRoutes(table *pb.RouteTable) {
+	c.routesMu.Lock()
+	if table.Version <= c.routeVersion {
+		c.routesMu.Unlock()
+		return
+	}
+	c.routeVersion = table.Version
+	c.pendingRoutes = table
+	c.routesMu.Unlock()
+
+	select {
+	case c.routesReady <- struct{}{}:
+	default:
+	}
+}
+
+// routeWriter sends a client's pending route tables until the stream ends,
+// is replaced, or the registry shuts down.
+func (r *Registry) routeWriter(c *ClientConn) {
+	for {
+		select {
+		case <-c.routesReady:
+		case <-c.replaced:
+			return
+		case <-c.Stream.Context().Done():
+			return
+		case <-r.ctx.Done():
+			return
+		}
+
+		c.routesMu.Lock()
+		table := c.pendingRoutes
+		c.pendingRoutes = nil
+		c.routesMu.Unlock()
+
+		if table == nil {
+			continue
+		}
+
+		if err := c.Send(&pb.ClientMessage{
+			Message: &pb.ClientMessage_Routes{Routes: table},
+		}); err != nil {
+			r.logger.Warn("failed to push routes",
+				logger.String("client_id", c.ID),
+				logger.Error(err),
+			)
+			continue
+		}
+
+		r.logger.Debug("pushed routes to client",
+			logger.String("client_id", c.ID),
+			logger.Int("version", int(table.Version)),
+			logger.Int("prefixes", len(table.Prefixes)),
+		)
+	}
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	testutil "network-tunneler/internal/testing"
+	pb "network-tunneler/proto"
+)
+
+type recordingClientStream struct {
+	pb.TunnelClient_ConnectServer
+
+	mu      sync.Mutex
+	tables  []*pb.RouteTable
+	packets []*pb.Packet
+}
+
+func (s *recordingClientStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *recordingClientStream) Send(msg *pb.ClientMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch m := msg.Message.(type) {
+	case *pb.ClientMessage_Routes:
+		s.tables = append(s.tables, m.Routes)
+	case *pb.ClientMessage_Packet:
+		s.packets = append(s.packets, m.Packet)
+	}
+	return nil
+}
+
+func (s *recordingClientStream) last() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.tables) == 0 {
+		return nil
+	}
+	return s.tables[len(s.tables)-1].Prefixes
+}
+
+// waitRoutes waits for the route writer to deliver a table matching want.
+func (s *recordingClientStream) waitRoutes(t *testing.T, want string) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.mu.Lock()
+		n := len(s.tables)
+		var got string
+		if n > 0 {
+			got = strings.Join(s.tables[n-1].Prefixes, ",")
+		}
+		s.mu.Unlock()
+
+		if n > 0 && got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("routes = %q, want %q", got, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// blockingClientStream holds every Send until release is closed.
+type blockingClientStream struct {
+	recordingClientStream
+	release chan struct{}
+}
+
+func (s *blockingClientStream) Send(msg *pb.ClientMessage) error {
+	<-s.release
+	return s.recordingClientStream.Send(msg)
+}
+
+func TestParseClientPolicies(t *testing.T) {
+	if _, err := parseClientPolicies([]ClientPolicy{{ClientID: "c", AllowedCIDRs: []string{"10.0.0.0/8"}}}); err != nil {
+		t.Errorf("expected valid policy, got %v", err)
+	}
+	if _, err := parseClientPolicies([]ClientPolicy{{AllowedCIDRs: []string{"10.0.0.0/8"}}}); err == nil {
+		t.Error("expected missing client_id to be rejected")
+	}
+	if _, err := parseClientPolicies([]ClientPolicy{{ClientID: "c", AllowedCIDRs: []string{"10.0.0.0"}}}); err == nil {
+		t.Error("expected invalid CIDR to be rejected")
+	}
+	if _, err := parseClientPolicies([]ClientPolicy{{ClientID: "c"}, {ClientID: "c"}}); err == nil {
+		t.Error("expected duplicate client policy to be rejected")
+	}
+}
+
+func TestRegistry_PushesRoutesFilteredByPolicy(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ClientPolicies = []ClientPolicy{
+		{ClientID: "client-1", AllowedCIDRs: []string{"10.1.0.0/16", "192.168.0.0/16"}},
+		{ClientID: AnyClient, AllowedCIDRs: []string{"192.168.1.0/24"}},
+	}
+	registry := NewRegistry(RegistryParams{Config: cfg, Logger: testutil.NewTestLogger()})
+
+	s1 := &recordingClientStream{}
+	s2 := &recordingClientStream{}
+	registry.RegisterClientStream("client-1", s1)
+	registry.RegisterClientStream("client-2", s2)
+
+	// Nothing is pushed before the registration ack has gone out.
+	registry.RegisterProxyStream("proxy-a", &mockProxyStream{}, "10.0.0.0/8")
+	if s1.last() != nil {
+		t.Fatal("expected no route push before EnableRoutePush")
+	}
+
+	registry.EnableRoutePush("client-1")
+	registry.EnableRoutePush("client-2")
+
+	s1.waitRoutes(t, "10.1.0.0/16")
+	s2.waitRoutes(t, "")
+
+	registry.RegisterProxyStream("proxy-b", &mockProxyStream{}, "192.168.1.0/24")
+	s1.waitRoutes(t, "10.1.0.0/16,192.168.1.0/24")
+	s2.waitRoutes(t, "192.168.1.0/24")
+
+	registry.UnregisterProxy("proxy-a")
+	s1.waitRoutes(t, "192.168.1.0/24")
+
+	s1.mu.Lock()
+	defer s1.mu.Unlock()
+	for i := 1; i < len(s1.tables); i++ {
+		if s1.tables[i].Version <= s1.tables[i-1].Version {
+			t.Errorf("expected increasing versions, got %d after %d", s1.tables[i].Version, s1.tables[i-1].Version)
+		}
+	}
+}
+
+func TestRegistry_RoutePushSkipsSlowClient(t *testing.T) {
+	registry := NewRegistry(RegistryParams{Config: DefaultConfig(), Logger: testutil.NewTestLogger()})
+
+	slow := &blockingClientStream{release: make(chan struct{})}
+	fast := &recordingClientStream{}
+	registry.RegisterClientStream("client-slow", slow)
+	registry.RegisterClientStream("client-fast", fast)
+	registry.EnableRoutePush("client-slow")
+	registry.EnableRoutePush("client-fast")
+
+	done := make(chan struct{})
+	go func() {
+		registry.RegisterProxyStream("proxy-a", &mockProxyStream{}, "10.0.0.0/8")
+		registry.RegisterProxyStream("proxy-b", &mockProxyStream{}, "192.168.1.0/24")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("route push blocked on a client that is not reading")
+	}
+	fast.waitRoutes(t, "10.0.0.0/8,192.168.1.0/24")
+
+	// The slow client skips the tables superseded while it was stuck.
+	close(slow.release)
+	slow.waitRoutes(t, "10.0.0.0/8,192.168.1.0/24")
+	slow.mu.Lock()
+	defer slow.mu.Unlock()
+	if len(slow.tables) > 2 {
+		t.Errorf("slow client received %d tables, want the stuck one and the latest", len(slow.tables))
+	}
+}
+
+func TestRegistry_RouteFromClientEnforcesPolicy(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ClientPolicies = []ClientPolicy{
+		{ClientID: "client-1", AllowedCIDRs: []string{"10.1.0.0/16", "fd00:1::/64"}},
+	}
+	registry := NewRegistry(RegistryParams{Config: cfg, Logger: testutil.NewTestLogger()})
+	registry.RegisterClientStream("client-1", &recordingClientStream{})
+	registry.RegisterProxyStream("proxy-a", &mockProxyStream{}, "10.0.0.0/8")
+	registry.RegisterProxyStream("proxy-6", &mockProxyStream{}, "fd00::/16")
+
+	err := registry.RouteFromClient("client-1", &pb.Packet{
+		ConnectionId: "conn-1",
+		ConnTuple:    &pb.ConnectionTuple{SrcIp: "127.0.0.1", SrcPort: 40000, DstIp: "10.2.0.1", DstPort: 80},
+	})
+	if err == nil || !strings.Contains(err.Error(), "not permitted") {
+		t.Errorf("expected destination outside policy to be refused, got %v", err)
+	}
+	if registry.GetConnectionCount() != 0 {
+		t.Error("expected no connection route for a refused destination")
+	}
+
+	err = registry.RouteFromClient("client-1", &pb.Packet{
+		ConnectionId: "conn-6",
+		ConnTuple:    &pb.ConnectionTuple{SrcIp: "::1", SrcPort: 40000, DstIp: "fd00:2::1", DstPort: 80},
+	})
+	if err == nil || !strings.Contains(err.Error(), "not permitted") {
+		t.Errorf("expected IPv6 destination outside policy to be refused, got %v", err)
+	}
+
+	err = registry.RouteFromClient("client-1", &pb.Packet{
+		ConnectionId: "conn-host",
+		ConnTuple:    &pb.ConnectionTuple{SrcIp: "127.0.0.1", SrcPort: 40002, DstHost: "db.corp.internal", DstPort: 5432},
+	})
+	if err == nil || !strings.Contains(err.Error(), "not permitted") {
+		t.Errorf("expected hostname destination to be refused for a restricted client, got %v", err)
+	}
+
+	err = registry.RouteFromClient("client-2", &pb.Packet{
+		ConnectionId: "conn-2",
+		ConnTuple:    &pb.ConnectionTuple{SrcIp: "127.0.0.1", SrcPort: 40001, DstIp: "10.1.0.1", DstPort: 80},
+	})
+	if err == nil {
+		t.Error("expected client without a policy to be refused")
+	}
+}
+
+func TestRegistry_RouteFromClientChecksOwner(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ClientPolicies = []ClientPolicy{
+		{ClientID: "client-restricted", AllowedCIDRs: []string{"10.1.0.0/16"}},
+		{ClientID: "*", AllowedCIDRs: []string{"10.0.0.0/8"}},
+	}
+	registry := NewRegistry(RegistryParams{Config: cfg, Logger: testutil.NewTestLogger()})
+	registry.RegisterClientStream("client-1", &recordingClientStream{})
+	registry.RegisterClientStream("client-restricted", &recordingClientStream{})
+	registry.RegisterProxyStream("proxy-a", &discardProxyStream{}, "10.0.0.0/8")
+
+	tuple := &pb.ConnectionTuple{SrcIp: "127.0.0.1", SrcPort: 40000, DstIp: "10.2.0.1", DstPort: 22}
+	if err := registry.RouteFromClient("client-1", &pb.Packet{ConnectionId: "conn-1", ConnTuple: tuple}); err != nil {
+		t.Fatalf("RouteFromClient failed: %v", err)
+	}
+
+	// Reusing another client's connection ID would bypass the policy.
+	err := registry.RouteFromClient("client-restricted", &pb.Packet{ConnectionId: "conn-1", ConnTuple: tuple, Data: []byte("x")})
+	if err == nil {
+		t.Error("expected data on another client's connection to be refused")
+	}
+	err = registry.RouteFromClient("client-restricted", &pb.Packet{ConnectionId: "conn-1", Control: pb.Control_CONTROL_RESET})
+	if err == nil {
+		t.Error("expected a reset of another client's connection to be refused")
+	}
+	if registry.GetConnectionCount() != 1 {
+		t.Error("expected the other client's route to survive")
+	}
+}
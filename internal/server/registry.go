@@ -3,10 +3,14 @@ package server
 import (
 	"context"
 	"fmt"
-	"net"
+	"net/netip"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.uber.org/fx"
+
 	"network-tunneler/pkg/logger"
 	pb "network-tunneler/proto"
 )
@@ -16,6 +20,31 @@ type ClientConn struct {
 	Stream      pb.TunnelClient_ConnectServer
 	RemoteAddr  string
 	ConnectedAt time.Time
+
+	// gRPC streams do not allow concurrent Send calls.
+	sendMu   sync.Mutex
+	identity string
+	replaced chan struct{}
+
+	// Route tables wait in a latest-only slot for the client's route
+	// writer, so a slow client never holds up pushes to the others.
+	routesMu      sync.Mutex
+	routesStarted bool
+	routeVersion  uint64
+	pendingRoutes *pb.RouteTable
+	routesReady   chan struct{}
+}
+
+// Replaced is closed when a newer stream registers under the same ID.
+func (c *ClientConn) Replaced() <-chan struct{} {
+	return c.replaced
+}
+
+func (c *ClientConn) Send(msg *pb.ClientMessage) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	return c.Stream.Send(msg)
 }
 
 type ProxyConn struct {
@@ -23,13 +52,49 @@ type ProxyConn struct {
 	Stream      pb.TunnelProxy_ConnectServer
 	RemoteAddr  string
 	ManagedCIDR string
+	Prefix      netip.Prefix
+	// Domains are the DNS suffixes whose hostnames the proxy resolves.
+	Domains     []string
 	ConnectedAt time.Time
+	// Approved proxies are routable. Pending ones stay connected but are
+	// ignored by route selection and conflict checks.
+	Approved bool
+
+	sendMu sync.Mutex
+	// identity is the fingerprint of the peer certificate, empty without
+	// TLS; only a stream with the same one may replace this one.
+	identity string
+	replaced chan struct{}
+}
+
+// Replaced is closed when a newer stream registers under the same ID.
+func (p *ProxyConn) Replaced() <-chan struct{} {
+	return p.replaced
+}
+
+func (p *ProxyConn) Send(msg *pb.ProxyMessage) error {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+
+	return p.Stream.Send(msg)
 }
 
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
 type Registry struct {
 	clients      map[string]*ClientConn
 	proxys    map[string]*ProxyConn
 	connections map[string]*ConnectionRoute // connectionID -> route
+	conflictPolicy ConflictPolicy
+	poolCursor     atomic.Uint64
+	approvals      *ApprovalStore
+	taps           *TapManager
+	policies       map[string][]netip.Prefix
+	routeVersion   atomic.Uint64
 	mu          sync.RWMutex
 	logger      logger.Logger
 	ctx         context.Context
@@ -41,6 +106,10 @@ type ConnectionRoute struct {
 	ConnectionID     string
 	ClientID          string
 	ProxyID        string
+	Tuple            *pb.ConnectionTuple
+	Protocol         pb.Protocol
+	// IPPacket routes carry whole IP packets from a TUN mode client.
+	IPPacket         bool
 	CreatedAt        time.Time
 	LastActivity     time.Time
 	PacketsToClient   uint64
@@ -49,13 +118,39 @@ type ConnectionRoute struct {
 	BytesToProxy   uint64
 }
 
-func NewRegistry(log logger.Logger) *Registry {
+type RegistryParams struct {
+	fx.In
+
+	Config    *Config
+	Logger    logger.Logger
+	Approvals *ApprovalStore `optional:"true"`
+	Taps      *TapManager    `optional:"true"`
+}
+
+func NewRegistry(p RegistryParams) *Registry {
+	policy := p.Config.CIDRConflictPolicy
+	if policy == "" {
+		policy = ConflictPolicyReject
+	}
+
+	log := p.Logger.With(logger.String("component", "registry"))
+
+	// Config validation rejects malformed policies before we get here.
+	policies, err := parseClientPolicies(p.Config.ClientPolicies)
+	if err != nil {
+		log.Error("ignoring invalid client policies", logger.Error(err))
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	r := &Registry{
 		clients:      make(map[string]*ClientConn),
 		proxys:    make(map[string]*ProxyConn),
 		connections: make(map[string]*ConnectionRoute),
-		logger:      log.With(logger.String("component", "registry")),
+		conflictPolicy: policy,
+		approvals:      p.Approvals,
+		taps:           p.Taps,
+		policies:       policies,
+		logger:      log,
 		ctx:         ctx,
 		cancel:      cancel,
 	}
@@ -100,6 +195,7 @@ func (r *Registry) cleanupStaleConnections() {
 	}
 
 	for _, connID := range stale {
+		r.closeTap(r.connections[connID])
 		delete(r.connections, connID)
 		r.logger.Info("cleaned up stale connection",
 			logger.String("conn_id", connID),
@@ -118,8 +214,19 @@ func (r *Registry) RegisterClientStream(id string, stream pb.TunnelClient_Connec
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if _, exists := r.clients[id]; exists {
-		return fmt.Errorf("client %s already registered", id)
+	// A reconnecting client reuses its ID, possibly before the server has
+	// noticed the old stream is dead, so the newest stream wins as long as
+	// it comes with the same certificate.
+	identity := streamIdentity(stream)
+	if old, exists := r.clients[id]; exists {
+		if old.identity != identity {
+			return fmt.Errorf("client %s is already connected with a different certificate", id)
+		}
+		close(old.replaced)
+		r.logger.Warn("client re-registered, replacing previous stream",
+			logger.String("client_id", id),
+			logger.String("previous_connected_at", old.ConnectedAt.Format(time.RFC3339)),
+		)
 	}
 
 	client := &ClientConn{
@@ -127,6 +234,9 @@ func (r *Registry) RegisterClientStream(id string, stream pb.TunnelClient_Connec
 		Stream:      stream,
 		RemoteAddr:  "grpc-stream",
 		ConnectedAt: time.Now(),
+		identity:    identity,
+		replaced:    make(chan struct{}),
+		routesReady: make(chan struct{}, 1),
 	}
 
 	r.clients[id] = client
@@ -138,10 +248,17 @@ func (r *Registry) RegisterClientStream(id string, stream pb.TunnelClient_Connec
 }
 
 func (r *Registry) UnregisterClient(id string) {
+	r.UnregisterClientStream(id, nil)
+}
+
+// UnregisterClientStream removes the client only while stream is still the
+// registered one, so a replaced stream shutting down leaves its successor
+// alone. A nil stream matches any.
+func (r *Registry) UnregisterClientStream(id string, stream pb.TunnelClient_ConnectServer) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if client, exists := r.clients[id]; exists {
+	if client, exists := r.clients[id]; exists && (stream == nil || client.Stream == stream) {
 		delete(r.clients, id)
 		r.logger.Info("client unregistered",
 			logger.String("client_id", id),
@@ -150,6 +267,18 @@ func (r *Registry) UnregisterClient(id string) {
 	}
 }
 
+// clientReplaced returns the replacement signal for stream, already closed
+// if another stream has taken over the ID in the meantime.
+func (r *Registry) clientReplaced(id string, stream pb.TunnelClient_ConnectServer) <-chan struct{} {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if client, exists := r.clients[id]; exists && client.Stream == stream {
+		return client.replaced
+	}
+	return closedChan
+}
+
 func (r *Registry) GetClient(id string) (*ClientConn, bool) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -158,37 +287,156 @@ func (r *Registry) GetClient(id string) (*ClientConn, bool) {
 	return client, exists
 }
 
-func (r *Registry) RegisterProxyStream(id string, stream pb.TunnelProxy_ConnectServer, managedCIDR string) error {
+func (r *Registry) RegisterProxyStream(id string, stream pb.TunnelProxy_ConnectServer, managedCIDR string, domains ...string) error {
+	prefix, err := parseManagedCIDR(managedCIDR)
+	if err != nil {
+		return err
+	}
+	domains, err = parseDomains(domains)
+	if err != nil {
+		return err
+	}
+
+	var routesChanged bool
+	defer func() {
+		if routesChanged {
+			r.pushRoutes()
+		}
+	}()
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if _, exists := r.proxys[id]; exists {
-		return fmt.Errorf("proxy %s already registered", id)
+	// Same as for clients: a reconnect takes over from a stream the server
+	// may not yet know is dead, but only with the certificate it had.
+	identity := streamIdentity(stream)
+	old, replacing := r.proxys[id]
+	if replacing && old.identity != identity {
+		return fmt.Errorf("proxy %s is already connected with a different certificate", id)
+	}
+
+	approved := true
+	if r.approvals != nil {
+		if approved, err = r.approvals.Admits(id, prefix.String(), domains); err != nil {
+			return err
+		}
+		if !approved && r.approvals.IsApproved(id) {
+			r.logger.Warn("proxy claim differs from its approval, keeping it pending",
+				logger.String("proxy_id", id),
+				logger.String("managed_cidr", prefix.String()),
+				logger.String("domains", strings.Join(domains, ",")),
+			)
+		}
+	}
+
+	// Pending proxies cannot claim anything yet, so their CIDR is checked
+	// when they get approved instead. Conflict checks skip the proxy's own
+	// ID, so its previous stream is no conflict.
+	if approved {
+		if err := r.admitRoutesLocked(id, prefix); err != nil {
+			return err
+		}
+	}
+
+	if replacing {
+		close(old.replaced)
+		routesChanged = old.Approved
+		r.logger.Warn("proxy re-registered, replacing previous stream",
+			logger.String("proxy_id", id),
+			logger.String("previous_cidr", old.ManagedCIDR),
+		)
 	}
 
 	proxy := &ProxyConn{
 		ID:          id,
 		Stream:      stream,
 		RemoteAddr:  "grpc-stream",
-		ManagedCIDR: managedCIDR,
+		ManagedCIDR: prefix.String(),
+		Prefix:      prefix,
+		Domains:     domains,
 		ConnectedAt: time.Now(),
+		Approved:    approved,
+		identity:    identity,
+		replaced:    make(chan struct{}),
 	}
 
 	r.proxys[id] = proxy
+
+	if !approved {
+		r.logger.Warn("proxy registered pending approval",
+			logger.String("proxy_id", id),
+			logger.String("managed_cidr", managedCIDR),
+		)
+		return nil
+	}
+
 	r.logger.Info("proxy registered via gRPC",
 		logger.String("proxy_id", id),
 		logger.String("managed_cidr", managedCIDR),
+		logger.Int("domains", len(domains)),
 	)
 
+	routesChanged = true
 	return nil
 }
 
+func (r *Registry) admitRoutesLocked(id string, prefix netip.Prefix) error {
+	conflicts, err := checkConflicts(r.conflictPolicy, id, prefix, r.routableProxysLocked())
+	if err != nil {
+		return err
+	}
+
+	for _, c := range conflicts {
+		r.logger.Warn("proxy CIDR overlaps existing route",
+			logger.String("proxy_id", id),
+			logger.String("managed_cidr", c.Prefix),
+			logger.String("other_proxy_id", c.OtherProxyID),
+			logger.String("other_cidr", c.OtherPrefix),
+			logger.String("kind", string(c.Kind)),
+			logger.String("policy", string(r.conflictPolicy)),
+		)
+	}
+
+	return nil
+}
+
+func (r *Registry) routableProxysLocked() map[string]*ProxyConn {
+	routable := make(map[string]*ProxyConn, len(r.proxys))
+	for id, p := range r.proxys {
+		if p.Approved {
+			routable[id] = p
+		}
+	}
+	return routable
+}
+
+func (r *Registry) IsProxyApproved(id string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	proxy, exists := r.proxys[id]
+	return exists && proxy.Approved
+}
+
 func (r *Registry) UnregisterProxy(id string) {
+	r.UnregisterProxyStream(id, nil)
+}
+
+// UnregisterProxyStream is the proxy counterpart of UnregisterClientStream.
+func (r *Registry) UnregisterProxyStream(id string, stream pb.TunnelProxy_ConnectServer) {
+	var routesChanged bool
+	defer func() {
+		if routesChanged {
+			r.pushRoutes()
+		}
+	}()
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if proxy, exists := r.proxys[id]; exists {
+	if proxy, exists := r.proxys[id]; exists && (stream == nil || proxy.Stream == stream) {
 		delete(r.proxys, id)
+		routesChanged = proxy.Approved
 		r.logger.Info("proxy unregistered",
 			logger.String("proxy_id", id),
 			logger.String("remote", proxy.RemoteAddr),
@@ -196,6 +444,16 @@ func (r *Registry) UnregisterProxy(id string) {
 	}
 }
 
+func (r *Registry) proxyReplaced(id string, stream pb.TunnelProxy_ConnectServer) <-chan struct{} {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if proxy, exists := r.proxys[id]; exists && proxy.Stream == stream {
+		return proxy.replaced
+	}
+	return closedChan
+}
+
 func (r *Registry) GetProxy(id string) (*ProxyConn, bool) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -208,35 +466,18 @@ func (r *Registry) FindProxyByCIDR(targetIP string) (*ProxyConn, bool) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	ip := net.ParseIP(targetIP)
-	if ip == nil {
-		r.logger.Warn("invalid target IP", logger.String("ip", targetIP))
+	proxy, found := r.findProxyByCIDR(targetIP)
+	if !found {
+		r.logger.Warn("no proxy found for target IP", logger.String("ip", targetIP))
 		return nil, false
 	}
 
-	for _, proxy := range r.proxys {
-		_, cidr, err := net.ParseCIDR(proxy.ManagedCIDR)
-		if err != nil {
-			r.logger.Warn("invalid proxy CIDR",
-				logger.String("proxy_id", proxy.ID),
-				logger.String("cidr", proxy.ManagedCIDR),
-				logger.Error(err),
-			)
-			continue
-		}
-
-		if cidr.Contains(ip) {
-			r.logger.Debug("found proxy for target IP",
-				logger.String("target_ip", targetIP),
-				logger.String("proxy_id", proxy.ID),
-				logger.String("managed_cidr", proxy.ManagedCIDR),
-			)
-			return proxy, true
-		}
-	}
-
-	r.logger.Warn("no proxy found for target IP", logger.String("ip", targetIP))
-	return nil, false
+	r.logger.Debug("found proxy for target IP",
+		logger.String("target_ip", targetIP),
+		logger.String("proxy_id", proxy.ID),
+		logger.String("managed_cidr", proxy.ManagedCIDR),
+	)
+	return proxy, true
 }
 
 func (r *Registry) ListClients() []*ClientConn {
@@ -286,15 +527,43 @@ func (r *Registry) RouteFromClient(clientID string, pkt *pb.Packet) error {
 	r.mu.Lock()
 
 	route, exists := r.connections[pkt.ConnectionId]
+	if !exists && pkt.Control != pb.Control_CONTROL_NONE {
+		// Signals for connections that are already gone need no route.
+		r.mu.Unlock()
+		return nil
+	}
 	if !exists {
-		destIP := ""
+		destIP, destHost := "", ""
 		if pkt.ConnTuple != nil {
 			destIP = pkt.ConnTuple.DstIp
+			destHost = pkt.ConnTuple.DstHost
 		}
-		proxy, found := r.findProxyByCIDR(destIP)
-		if !found {
-			r.mu.Unlock()
-			return fmt.Errorf("no proxy found for destination: %s", destIP)
+
+		var proxy *ProxyConn
+		var found bool
+		if destIP == "" && destHost != "" {
+			// Policies are prefixes, which a hostname cannot be checked
+			// against before the proxy resolves it.
+			if _, restricted := r.allowedPrefixes(clientID); restricted {
+				r.mu.Unlock()
+				return fmt.Errorf("hostname destination %s not permitted for client %s", destHost, clientID)
+			}
+			proxy, found = r.findProxyByDomain(destHost)
+			if !found {
+				r.mu.Unlock()
+				return fmt.Errorf("no proxy found for destination: %s", destHost)
+			}
+		} else {
+			if addr, err := netip.ParseAddr(destIP); err == nil && !r.clientMayReach(clientID, addr.Unmap()) {
+				r.mu.Unlock()
+				return fmt.Errorf("destination %s not permitted for client %s", destIP, clientID)
+			}
+
+			proxy, found = r.findProxyByCIDR(destIP)
+			if !found {
+				r.mu.Unlock()
+				return fmt.Errorf("no proxy found for destination: %s", destIP)
+			}
 		}
 
 		now := time.Now()
@@ -302,6 +571,9 @@ func (r *Registry) RouteFromClient(clientID string, pkt *pb.Packet) error {
 			ConnectionID: pkt.ConnectionId,
 			ClientID:      clientID,
 			ProxyID:    proxy.ID,
+			Tuple:        pkt.ConnTuple,
+			Protocol:     pkt.Protocol,
+			IPPacket:     pkt.IpPacket,
 			CreatedAt:    now,
 			LastActivity: now,
 		}
@@ -312,6 +584,11 @@ func (r *Registry) RouteFromClient(clientID string, pkt *pb.Packet) error {
 			logger.String("client_id", clientID),
 			logger.String("proxy_id", proxy.ID),
 		)
+	} else if route.ClientID != clientID {
+		// Connection IDs are not secret; the policy above was checked for
+		// the client that opened the route only.
+		r.mu.Unlock()
+		return fmt.Errorf("connection %s belongs to another client", pkt.ConnectionId)
 	} else {
 		route.LastActivity = time.Now()
 	}
@@ -334,9 +611,19 @@ func (r *Registry) RouteFromClient(clientID string, pkt *pb.Packet) error {
 		logger.Int("size", len(pkt.Data)),
 	)
 
-	return proxy.Stream.Send(&pb.ProxyMessage{
+	if err := proxy.Send(&pb.ProxyMessage{
 		Message: &pb.ProxyMessage_Packet{Packet: pkt},
-	})
+	}); err != nil {
+		return err
+	}
+
+	switch pkt.Control {
+	case pb.Control_CONTROL_NONE:
+		r.capture(route, pb.Direction_DIRECTION_FORWARD, pkt.Data)
+	case pb.Control_CONTROL_RESET:
+		r.RemoveConnection(pkt.ConnectionId)
+	}
+	return nil
 }
 
 func (r *Registry) RouteFromProxy(proxyID string, pkt *pb.Packet) error {
@@ -346,6 +633,15 @@ func (r *Registry) RouteFromProxy(proxyID string, pkt *pb.Packet) error {
 		r.mu.Unlock()
 		return fmt.Errorf("connection not found: %s", pkt.ConnectionId)
 	}
+	// Only the proxy the connection was routed to may answer or reset it.
+	if route.ProxyID != proxyID {
+		r.mu.Unlock()
+		return fmt.Errorf("connection %s belongs to another proxy", pkt.ConnectionId)
+	}
+	if proxy, ok := r.proxys[proxyID]; !ok || !proxy.Approved {
+		r.mu.Unlock()
+		return fmt.Errorf("proxy %s is not approved", proxyID)
+	}
 
 	route.LastActivity = time.Now()
 	client, clientExists := r.clients[route.ClientID]
@@ -366,15 +662,39 @@ func (r *Registry) RouteFromProxy(proxyID string, pkt *pb.Packet) error {
 		logger.Int("size", len(pkt.Data)),
 	)
 
-	return client.Stream.Send(&pb.ClientMessage{
+	if err := client.Send(&pb.ClientMessage{
 		Message: &pb.ClientMessage_Packet{Packet: pkt},
-	})
+	}); err != nil {
+		return err
+	}
+
+	switch pkt.Control {
+	case pb.Control_CONTROL_NONE:
+		r.capture(route, pb.Direction_DIRECTION_REVERSE, pkt.Data)
+	case pb.Control_CONTROL_RESET:
+		// The proxy refused or dropped the connection.
+		r.RemoveConnection(pkt.ConnectionId)
+	}
+	return nil
+}
+
+func (r *Registry) capture(route *ConnectionRoute, dir pb.Direction, data []byte) {
+	if r.taps != nil {
+		r.taps.Capture(route, dir, data)
+	}
+}
+
+func (r *Registry) closeTap(route *ConnectionRoute) {
+	if r.taps != nil && route != nil {
+		r.taps.CloseConnection(route)
+	}
 }
 
 func (r *Registry) RemoveConnection(connID string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	r.closeTap(r.connections[connID])
 	delete(r.connections, connID)
 	r.logger.Debug("connection route removed", logger.String("conn_id", connID))
 }
@@ -445,26 +765,33 @@ func (r *Registry) GetAllConnectionMetrics() []*ConnectionMetrics {
 }
 
 func (r *Registry) findProxyByCIDR(targetIP string) (*ProxyConn, bool) {
-	ip := net.ParseIP(targetIP)
-	if ip == nil {
+	addr, err := netip.ParseAddr(targetIP)
+	if err != nil {
 		r.logger.Warn("invalid target IP", logger.String("ip", targetIP))
 		return nil, false
 	}
 
-	for _, proxy := range r.proxys {
-		_, cidr, err := net.ParseCIDR(proxy.ManagedCIDR)
-		if err != nil {
-			r.logger.Warn("invalid proxy CIDR",
-				logger.String("proxy_id", proxy.ID),
-				logger.String("cidr", proxy.ManagedCIDR),
-				logger.Error(err),
-			)
-			continue
-		}
+	matches := longestPrefixMatch(addr.Unmap(), r.routableProxysLocked())
+	switch len(matches) {
+	case 0:
+		return nil, false
+	case 1:
+		return matches[0], true
+	default:
+		next := r.poolCursor.Add(1)
+		return matches[next%uint64(len(matches))], true
+	}
+}
 
-		if cidr.Contains(ip) {
-			return proxy, true
-		}
+func (r *Registry) findProxyByDomain(host string) (*ProxyConn, bool) {
+	matches := longestDomainMatch(host, r.routableProxysLocked())
+	switch len(matches) {
+	case 0:
+		return nil, false
+	case 1:
+		return matches[0], true
+	default:
+		next := r.poolCursor.Add(1)
+		return matches[next%uint64(len(matches))], true
 	}
-	return nil, false
 }
@@ -2,9 +2,14 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"testing"
 	"time"
 
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
 	testutil "network-tunneler/internal/testing"
 	pb "network-tunneler/proto"
 )
@@ -13,14 +18,48 @@ type mockClientStream struct {
 	pb.TunnelClient_ConnectServer
 }
 
+func (s *mockClientStream) Context() context.Context {
+	return context.Background()
+}
+
 type mockProxyStream struct {
 	pb.TunnelProxy_ConnectServer
+	ctx context.Context
+}
+
+func (s *mockProxyStream) Context() context.Context {
+	if s.ctx != nil {
+		return s.ctx
+	}
+	return context.Background()
+}
+
+// withPeerCert returns a stream context whose peer presented a certificate
+// with the given DER bytes.
+func withPeerCert(raw string) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{Raw: []byte(raw)}},
+		}},
+	})
+}
+
+type discardProxyStream struct {
+	pb.TunnelProxy_ConnectServer
+}
+
+func (s *discardProxyStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *discardProxyStream) Send(msg *pb.ProxyMessage) error {
+	return nil
 }
 
 func TestRegistry_RegisterClientStream(t *testing.T) {
 	log := testutil.NewTestLogger()
 
-	registry := NewRegistry(log)
+	registry := NewRegistry(RegistryParams{Config: DefaultConfig(), Logger: log})
 	stream := &mockClientStream{}
 
 	err := registry.RegisterClientStream("client-1", stream)
@@ -42,27 +81,41 @@ func TestRegistry_RegisterClientStream(t *testing.T) {
 	}
 }
 
-func TestRegistry_RegisterClientStream_Duplicate(t *testing.T) {
+func TestRegistry_RegisterClientStream_ReplacesExisting(t *testing.T) {
 	log := testutil.NewTestLogger()
 
-	registry := NewRegistry(log)
-	stream := &mockClientStream{}
+	registry := NewRegistry(RegistryParams{Config: DefaultConfig(), Logger: log})
+	oldStream := &mockClientStream{}
+	newStream := &mockClientStream{}
 
-	err := registry.RegisterClientStream("client-1", stream)
-	if err != nil {
+	if err := registry.RegisterClientStream("client-1", oldStream); err != nil {
 		t.Fatalf("RegisterClientStream failed: %v", err)
 	}
+	replaced := registry.clientReplaced("client-1", oldStream)
 
-	err = registry.RegisterClientStream("client-1", stream)
-	if err == nil {
-		t.Error("expected error for duplicate client registration")
+	if err := registry.RegisterClientStream("client-1", newStream); err != nil {
+		t.Fatalf("expected reconnect to replace the old stream, got %v", err)
+	}
+
+	select {
+	case <-replaced:
+	default:
+		t.Error("expected old stream to be signalled as replaced")
+	}
+
+	// The old handler shutting down must not remove its successor.
+	registry.UnregisterClientStream("client-1", oldStream)
+
+	client, exists := registry.GetClient("client-1")
+	if !exists || client.Stream != newStream {
+		t.Error("expected the new stream to stay registered")
 	}
 }
 
 func TestRegistry_UnregisterClient(t *testing.T) {
 	log := testutil.NewTestLogger()
 
-	registry := NewRegistry(log)
+	registry := NewRegistry(RegistryParams{Config: DefaultConfig(), Logger: log})
 	stream := &mockClientStream{}
 
 	registry.RegisterClientStream("client-1", stream)
@@ -77,7 +130,7 @@ func TestRegistry_UnregisterClient(t *testing.T) {
 func TestRegistry_RegisterProxyStream(t *testing.T) {
 	log := testutil.NewTestLogger()
 
-	registry := NewRegistry(log)
+	registry := NewRegistry(RegistryParams{Config: DefaultConfig(), Logger: log})
 	stream := &mockProxyStream{}
 
 	err := registry.RegisterProxyStream("proxy-1", stream, "192.168.1.0/24")
@@ -102,7 +155,7 @@ func TestRegistry_RegisterProxyStream(t *testing.T) {
 func TestRegistry_FindProxyByCIDR(t *testing.T) {
 	log := testutil.NewTestLogger()
 
-	registry := NewRegistry(log)
+	registry := NewRegistry(RegistryParams{Config: DefaultConfig(), Logger: log})
 	stream := &mockProxyStream{}
 
 	registry.RegisterProxyStream("proxy-1", stream, "192.168.1.0/24")
@@ -120,12 +173,22 @@ func TestRegistry_FindProxyByCIDR(t *testing.T) {
 	if found {
 		t.Error("expected not to find proxy for IP outside CIDR range")
 	}
+
+	registry.RegisterProxyStream("proxy-6", &mockProxyStream{}, "fd00:1::/64")
+
+	proxy, found = registry.FindProxyByCIDR("fd00:1::10")
+	if !found || proxy.ID != "proxy-6" {
+		t.Errorf("expected proxy-6 for an IPv6 address in its CIDR, got %v", proxy)
+	}
+	if _, found = registry.FindProxyByCIDR("fd00:2::10"); found {
+		t.Error("expected not to find proxy for IPv6 address outside CIDR range")
+	}
 }
 
 func TestRegistry_Cleanup(t *testing.T) {
 	log := testutil.NewTestLogger()
 
-	registry := NewRegistry(log)
+	registry := NewRegistry(RegistryParams{Config: DefaultConfig(), Logger: log})
 
 	registry.RegisterClientStream("client-1", &mockClientStream{})
 	registry.RegisterProxyStream("proxy-1", &mockProxyStream{}, "192.168.1.0/24")
@@ -146,3 +209,267 @@ func TestRegistry_Cleanup(t *testing.T) {
 		t.Error("expected all proxys to be cleaned up")
 	}
 }
+
+func TestRegistry_RegisterProxyStream_InvalidCIDR(t *testing.T) {
+	log := testutil.NewTestLogger()
+
+	registry := NewRegistry(RegistryParams{Config: DefaultConfig(), Logger: log})
+
+	tests := []string{"", "not-a-cidr", "192.168.1.0", "192.168.1.5/24"}
+	for _, cidr := range tests {
+		if err := registry.RegisterProxyStream("proxy-"+cidr, &mockProxyStream{}, cidr); err == nil {
+			t.Errorf("expected error for CIDR %q", cidr)
+		}
+	}
+}
+
+func TestRegistry_ConflictPolicyReject(t *testing.T) {
+	log := testutil.NewTestLogger()
+
+	registry := NewRegistry(RegistryParams{Config: DefaultConfig(), Logger: log})
+
+	if err := registry.RegisterProxyStream("proxy-1", &mockProxyStream{}, "10.0.0.0/8"); err != nil {
+		t.Fatalf("RegisterProxyStream failed: %v", err)
+	}
+
+	for _, cidr := range []string{"10.0.0.0/8", "10.1.0.0/16", "0.0.0.0/0"} {
+		if err := registry.RegisterProxyStream("proxy-2", &mockProxyStream{}, cidr); err == nil {
+			t.Errorf("expected overlapping CIDR %s to be rejected", cidr)
+		}
+	}
+
+	if err := registry.RegisterProxyStream("proxy-2", &mockProxyStream{}, "192.168.0.0/16"); err != nil {
+		t.Errorf("expected disjoint CIDR to be accepted, got %v", err)
+	}
+}
+
+func TestRegistry_ConflictPolicyPreferSpecific(t *testing.T) {
+	log := testutil.NewTestLogger()
+
+	cfg := DefaultConfig()
+	cfg.CIDRConflictPolicy = ConflictPolicyPreferSpecific
+	registry := NewRegistry(RegistryParams{Config: cfg, Logger: log})
+
+	if err := registry.RegisterProxyStream("proxy-wide", &mockProxyStream{}, "10.0.0.0/8"); err != nil {
+		t.Fatalf("RegisterProxyStream failed: %v", err)
+	}
+	if err := registry.RegisterProxyStream("proxy-narrow", &mockProxyStream{}, "10.1.0.0/16"); err != nil {
+		t.Fatalf("expected nested CIDR to be accepted, got %v", err)
+	}
+	if err := registry.RegisterProxyStream("proxy-dup", &mockProxyStream{}, "10.1.0.0/16"); err == nil {
+		t.Error("expected duplicate CIDR to be rejected")
+	}
+
+	proxy, found := registry.FindProxyByCIDR("10.1.2.3")
+	if !found || proxy.ID != "proxy-narrow" {
+		t.Errorf("expected longest prefix match proxy-narrow, got %v", proxy)
+	}
+
+	proxy, found = registry.FindProxyByCIDR("10.2.0.1")
+	if !found || proxy.ID != "proxy-wide" {
+		t.Errorf("expected proxy-wide, got %v", proxy)
+	}
+
+	table := registry.RoutingTable()
+	if len(table.Conflicts) != 2 {
+		t.Fatalf("expected 2 conflict entries, got %d", len(table.Conflicts))
+	}
+
+	var shadowed bool
+	for _, c := range table.Conflicts {
+		if c.ProxyID == "proxy-wide" && c.Kind == ConflictSuperset && c.Shadowed == "10.1.0.0/16" {
+			shadowed = true
+		}
+	}
+	if !shadowed {
+		t.Errorf("expected proxy-wide to report 10.1.0.0/16 as shadowed, got %+v", table.Conflicts)
+	}
+}
+
+func TestRegistry_ConflictPolicyPool(t *testing.T) {
+	log := testutil.NewTestLogger()
+
+	cfg := DefaultConfig()
+	cfg.CIDRConflictPolicy = ConflictPolicyPool
+	registry := NewRegistry(RegistryParams{Config: cfg, Logger: log})
+
+	registry.RegisterProxyStream("proxy-a", &mockProxyStream{}, "192.168.1.0/24")
+	if err := registry.RegisterProxyStream("proxy-b", &mockProxyStream{}, "192.168.1.0/24"); err != nil {
+		t.Fatalf("expected duplicate CIDR to join pool, got %v", err)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		proxy, found := registry.FindProxyByCIDR("192.168.1.10")
+		if !found {
+			t.Fatal("expected to find pooled proxy")
+		}
+		seen[proxy.ID] = true
+	}
+
+	if !seen["proxy-a"] || !seen["proxy-b"] {
+		t.Errorf("expected both pool members to be selected, got %v", seen)
+	}
+}
+
+func TestRegistry_FindProxyByDomain(t *testing.T) {
+	registry := NewRegistry(RegistryParams{Config: DefaultConfig(), Logger: testutil.NewTestLogger()})
+
+	registry.RegisterProxyStream("proxy-corp", &mockProxyStream{}, "10.0.0.0/8", "corp.internal")
+	registry.RegisterProxyStream("proxy-db", &mockProxyStream{}, "192.168.0.0/16", ".DB.corp.internal.")
+	if err := registry.RegisterProxyStream("proxy-bad", &mockProxyStream{}, "172.16.0.0/12", "bad domain"); err == nil {
+		t.Error("expected an invalid domain to be rejected")
+	}
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"corp.internal", "proxy-corp"},
+		{"wiki.corp.internal", "proxy-corp"},
+		{"pg.db.corp.internal.", "proxy-db"},
+		{"PG.DB.CORP.INTERNAL", "proxy-db"},
+		{"notcorp.internal", ""},
+		{"example.com", ""},
+	}
+	for _, tt := range tests {
+		registry.mu.RLock()
+		proxy, found := registry.findProxyByDomain(tt.host)
+		registry.mu.RUnlock()
+
+		got := ""
+		if found {
+			got = proxy.ID
+		}
+		if got != tt.want {
+			t.Errorf("findProxyByDomain(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestRegistry_RegisterProxyStream_ReplacesExisting(t *testing.T) {
+	log := testutil.NewTestLogger()
+
+	registry := NewRegistry(RegistryParams{Config: DefaultConfig(), Logger: log})
+	oldStream := &mockProxyStream{}
+	newStream := &mockProxyStream{}
+
+	if err := registry.RegisterProxyStream("proxy-1", oldStream, "10.0.0.0/8"); err != nil {
+		t.Fatalf("RegisterProxyStream failed: %v", err)
+	}
+	replaced := registry.proxyReplaced("proxy-1", oldStream)
+
+	// The proxy's own earlier claim is not a conflict.
+	if err := registry.RegisterProxyStream("proxy-1", newStream, "10.0.0.0/8"); err != nil {
+		t.Fatalf("expected reconnect to replace the old stream, got %v", err)
+	}
+
+	select {
+	case <-replaced:
+	default:
+		t.Error("expected old stream to be signalled as replaced")
+	}
+
+	registry.UnregisterProxyStream("proxy-1", oldStream)
+
+	proxy, exists := registry.GetProxy("proxy-1")
+	if !exists || proxy.Stream != newStream {
+		t.Error("expected the new stream to stay registered")
+	}
+}
+
+func TestRegistry_RouteFromProxyReset(t *testing.T) {
+	registry := NewRegistry(RegistryParams{Config: DefaultConfig(), Logger: testutil.NewTestLogger()})
+	registry.RegisterClientStream("client-1", &recordingClientStream{})
+	registry.RegisterProxyStream("proxy-1", &discardProxyStream{}, "10.0.0.0/8")
+
+	err := registry.RouteFromClient("client-1", &pb.Packet{
+		ConnectionId: "conn-1",
+		ConnTuple:    &pb.ConnectionTuple{SrcIp: "127.0.0.1", SrcPort: 40000, DstIp: "10.0.0.1", DstPort: 25},
+		Data:         []byte("hello"),
+	})
+	if err != nil {
+		t.Fatalf("RouteFromClient failed: %v", err)
+	}
+
+	// A proxy refusing the connection ends its route.
+	err = registry.RouteFromProxy("proxy-1", &pb.Packet{
+		ConnectionId: "conn-1",
+		Direction:    pb.Direction_DIRECTION_REVERSE,
+		Control:      pb.Control_CONTROL_RESET,
+	})
+	if err != nil {
+		t.Fatalf("RouteFromProxy failed: %v", err)
+	}
+	if registry.GetConnectionCount() != 0 {
+		t.Errorf("expected the route to be removed, got %d", registry.GetConnectionCount())
+	}
+}
+
+func TestRegistry_RouteFromProxyChecksOwner(t *testing.T) {
+	registry := NewRegistry(RegistryParams{Config: DefaultConfig(), Logger: testutil.NewTestLogger()})
+	client := &recordingClientStream{}
+	registry.RegisterClientStream("client-1", client)
+	registry.RegisterProxyStream("proxy-a", &discardProxyStream{}, "10.0.0.0/8")
+	registry.RegisterProxyStream("proxy-b", &discardProxyStream{}, "192.168.0.0/16")
+
+	err := registry.RouteFromClient("client-1", &pb.Packet{
+		ConnectionId: "conn-1",
+		ConnTuple:    &pb.ConnectionTuple{SrcIp: "127.0.0.1", SrcPort: 40000, DstIp: "10.0.0.1", DstPort: 25},
+	})
+	if err != nil {
+		t.Fatalf("RouteFromClient failed: %v", err)
+	}
+
+	// Another proxy can neither inject data into nor reset proxy-a's connection.
+	err = registry.RouteFromProxy("proxy-b", &pb.Packet{
+		ConnectionId: "conn-1",
+		Direction:    pb.Direction_DIRECTION_REVERSE,
+		Data:         []byte("injected"),
+	})
+	if err == nil {
+		t.Error("expected data from another proxy to be refused")
+	}
+	err = registry.RouteFromProxy("proxy-b", &pb.Packet{
+		ConnectionId: "conn-1",
+		Direction:    pb.Direction_DIRECTION_REVERSE,
+		Control:      pb.Control_CONTROL_RESET,
+	})
+	if err == nil {
+		t.Error("expected a reset from another proxy to be refused")
+	}
+
+	if registry.GetConnectionCount() != 1 {
+		t.Error("expected proxy-a's route to survive")
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if len(client.packets) != 0 {
+		t.Errorf("expected nothing to reach the client, got %d packets", len(client.packets))
+	}
+}
+
+func TestRegistry_ReplaceRequiresSameCertificate(t *testing.T) {
+	registry := NewRegistry(RegistryParams{Config: DefaultConfig(), Logger: testutil.NewTestLogger()})
+	live := &mockProxyStream{ctx: withPeerCert("proxy-a")}
+
+	if err := registry.RegisterProxyStream("proxy-1", live, "10.0.0.0/8"); err != nil {
+		t.Fatalf("RegisterProxyStream failed: %v", err)
+	}
+
+	// A copied config with another certificate cannot take over.
+	if err := registry.RegisterProxyStream("proxy-1", &mockProxyStream{ctx: withPeerCert("proxy-b")}, "10.0.0.0/8"); err == nil {
+		t.Error("expected a stream with a different certificate to be rejected")
+	}
+	if proxy, _ := registry.GetProxy("proxy-1"); proxy.Stream != live {
+		t.Error("expected the live stream to stay registered")
+	}
+
+	reconnect := &mockProxyStream{ctx: withPeerCert("proxy-a")}
+	if err := registry.RegisterProxyStream("proxy-1", reconnect, "10.0.0.0/8"); err != nil {
+		t.Fatalf("expected the same certificate to replace the stream, got %v", err)
+	}
+	if proxy, _ := registry.GetProxy("proxy-1"); proxy.Stream != reconnect {
+		t.Error("expected the reconnected stream to be registered")
+	}
+}
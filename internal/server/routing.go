@@ -0,0 +1,261 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyReject refuses any proxy whose CIDR overlaps another one.
+	ConflictPolicyReject ConflictPolicy = "reject"
+	// ConflictPolicyPreferSpecific accepts nested CIDRs and routes by longest
+	// prefix match. Exact duplicates are still rejected.
+	ConflictPolicyPreferSpecific ConflictPolicy = "prefer_specific"
+	// ConflictPolicyPool behaves like prefer_specific, but proxies claiming the
+	// exact same CIDR form a pool that new connections are spread across.
+	ConflictPolicyPool ConflictPolicy = "pool"
+)
+
+type ConflictKind string
+
+const (
+	ConflictDuplicate ConflictKind = "duplicate"
+	ConflictSuperset  ConflictKind = "superset"
+	ConflictSubset    ConflictKind = "subset"
+)
+
+// CIDRConflict describes how Prefix (claimed by ProxyID) relates to an
+// overlapping OtherPrefix. Shadowed is set when part of Prefix is routed to
+// OtherProxyID instead of ProxyID.
+type CIDRConflict struct {
+	ProxyID      string       `json:"proxy_id"`
+	Prefix       string       `json:"prefix"`
+	OtherProxyID string       `json:"other_proxy_id"`
+	OtherPrefix  string       `json:"other_prefix"`
+	Kind         ConflictKind `json:"kind"`
+	Shadowed     string       `json:"shadowed,omitempty"`
+}
+
+type ProxyRoute struct {
+	ProxyID string   `json:"proxy_id"`
+	Prefix  string   `json:"prefix"`
+	Domains []string `json:"domains,omitempty"`
+}
+
+type RoutingTable struct {
+	Policy    ConflictPolicy `json:"policy"`
+	Routes    []ProxyRoute   `json:"routes"`
+	Pending   []ProxyRoute   `json:"pending"`
+	Conflicts []CIDRConflict `json:"conflicts"`
+}
+
+func parseManagedCIDR(cidr string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid managed CIDR %q: %w", cidr, err)
+	}
+	prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits())
+	if !prefix.IsValid() {
+		return netip.Prefix{}, fmt.Errorf("invalid managed CIDR %q", cidr)
+	}
+	if masked := prefix.Masked(); masked != prefix {
+		return netip.Prefix{}, fmt.Errorf("managed CIDR %q has host bits set, did you mean %s", cidr, masked)
+	}
+	return prefix, nil
+}
+
+func classifyOverlap(a, b netip.Prefix) (ConflictKind, bool) {
+	if !a.Overlaps(b) {
+		return "", false
+	}
+	switch {
+	case a == b:
+		return ConflictDuplicate, true
+	case a.Bits() < b.Bits():
+		return ConflictSuperset, true
+	default:
+		return ConflictSubset, true
+	}
+}
+
+// checkConflicts validates a new claim against the proxies that are already
+// routable and returns the conflicts it introduces, or an error when the
+// configured policy forbids them.
+func checkConflicts(policy ConflictPolicy, id string, prefix netip.Prefix, proxys map[string]*ProxyConn) ([]CIDRConflict, error) {
+	var conflicts []CIDRConflict
+
+	for _, other := range proxys {
+		if other.ID == id {
+			continue
+		}
+
+		kind, overlaps := classifyOverlap(prefix, other.Prefix)
+		if !overlaps {
+			continue
+		}
+
+		switch policy {
+		case ConflictPolicyPreferSpecific:
+			if kind == ConflictDuplicate {
+				return nil, fmt.Errorf("CIDR %s is already claimed by proxy %s", prefix, other.ID)
+			}
+		case ConflictPolicyPool:
+		default:
+			return nil, fmt.Errorf("CIDR %s overlaps %s claimed by proxy %s (%s)", prefix, other.Prefix, other.ID, kind)
+		}
+
+		conflicts = append(conflicts, newConflict(id, prefix, other.ID, other.Prefix, kind))
+	}
+
+	return conflicts, nil
+}
+
+func newConflict(id string, prefix netip.Prefix, otherID string, otherPrefix netip.Prefix, kind ConflictKind) CIDRConflict {
+	c := CIDRConflict{
+		ProxyID:      id,
+		Prefix:       prefix.String(),
+		OtherProxyID: otherID,
+		OtherPrefix:  otherPrefix.String(),
+		Kind:         kind,
+	}
+	if kind == ConflictSuperset {
+		c.Shadowed = otherPrefix.String()
+	}
+	return c
+}
+
+func collectConflicts(proxys map[string]*ProxyConn) []CIDRConflict {
+	var conflicts []CIDRConflict
+
+	for _, p := range proxys {
+		for _, other := range proxys {
+			if p.ID == other.ID {
+				continue
+			}
+			if kind, overlaps := classifyOverlap(p.Prefix, other.Prefix); overlaps {
+				conflicts = append(conflicts, newConflict(p.ID, p.Prefix, other.ID, other.Prefix, kind))
+			}
+		}
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].ProxyID != conflicts[j].ProxyID {
+			return conflicts[i].ProxyID < conflicts[j].ProxyID
+		}
+		return conflicts[i].OtherProxyID < conflicts[j].OtherProxyID
+	})
+
+	return conflicts
+}
+
+// longestPrefixMatch returns every proxy claiming the most specific prefix
+// that contains addr, sorted by ID so pool selection is stable.
+func longestPrefixMatch(addr netip.Addr, proxys map[string]*ProxyConn) []*ProxyConn {
+	var matches []*ProxyConn
+	bestBits := -1
+
+	for _, p := range proxys {
+		if !p.Prefix.Contains(addr) {
+			continue
+		}
+		switch bits := p.Prefix.Bits(); {
+		case bits > bestBits:
+			bestBits = bits
+			matches = append(matches[:0], p)
+		case bits == bestBits:
+			matches = append(matches, p)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].ID < matches[j].ID })
+	return matches
+}
+
+// parseDomains normalizes the DNS suffixes a proxy resolves: lower case,
+// without leading or trailing dots.
+func parseDomains(domains []string) ([]string, error) {
+	var parsed []string
+	for _, d := range domains {
+		name := strings.Trim(strings.ToLower(d), ".")
+		if name == "" || strings.ContainsAny(name, " /:") {
+			return nil, fmt.Errorf("invalid domain %q", d)
+		}
+		parsed = append(parsed, name)
+	}
+	return parsed, nil
+}
+
+// longestDomainMatch returns every proxy claiming the most specific domain
+// that host falls under, sorted by ID like longestPrefixMatch.
+func longestDomainMatch(host string, proxys map[string]*ProxyConn) []*ProxyConn {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	var matches []*ProxyConn
+	bestLen := -1
+
+	for _, p := range proxys {
+		longest := -1
+		for _, d := range p.Domains {
+			if (host == d || strings.HasSuffix(host, "."+d)) && len(d) > longest {
+				longest = len(d)
+			}
+		}
+		switch {
+		case longest < 0:
+		case longest > bestLen:
+			bestLen = longest
+			matches = append(matches[:0], p)
+		case longest == bestLen:
+			matches = append(matches, p)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].ID < matches[j].ID })
+	return matches
+}
+
+func (r *Registry) RoutingTable() RoutingTable {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	routable := r.routableProxysLocked()
+
+	table := RoutingTable{
+		Policy:    r.conflictPolicy,
+		Routes:    make([]ProxyRoute, 0, len(routable)),
+		Pending:   []ProxyRoute{},
+		Conflicts: collectConflicts(routable),
+	}
+
+	for _, p := range r.proxys {
+		route := ProxyRoute{ProxyID: p.ID, Prefix: p.Prefix.String(), Domains: p.Domains}
+		if p.Approved {
+			table.Routes = append(table.Routes, route)
+		} else {
+			table.Pending = append(table.Pending, route)
+		}
+	}
+	sort.Slice(table.Routes, func(i, j int) bool { return table.Routes[i].ProxyID < table.Routes[j].ProxyID })
+	sort.Slice(table.Pending, func(i, j int) bool { return table.Pending[i].ProxyID < table.Pending[j].ProxyID })
+
+	if table.Conflicts == nil {
+		table.Conflicts = []CIDRConflict{}
+	}
+
+	return table
+}
+
+func (r *Registry) RoutesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(r.RoutingTable()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
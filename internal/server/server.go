@@ -5,6 +5,8 @@ import (
 
 	"go.uber.org/fx"
 
+	"network-tunneler/internal/control"
+	"network-tunneler/internal/health"
 	"network-tunneler/pkg/logger"
 )
 
@@ -12,7 +14,11 @@ type Server struct {
 	cfg        *Config
 	logger     logger.Logger
 	registry   *Registry
+	taps       *TapManager
 	grpcServer *GRPCServer
+	checker    *health.Checker
+	health     *health.Server
+	control    *control.Server
 }
 
 type Params struct {
@@ -21,7 +27,9 @@ type Params struct {
 	Config     *Config
 	Logger     logger.Logger
 	Registry   *Registry
+	Taps       *TapManager
 	GRPCServer *GRPCServer
+	Checker    *health.Checker
 }
 
 func New(lc fx.Lifecycle, p Params) *Server {
@@ -29,9 +37,13 @@ func New(lc fx.Lifecycle, p Params) *Server {
 		cfg:        p.Config,
 		logger:     p.Logger.With(logger.String("component", "server")),
 		registry:   p.Registry,
+		taps:       p.Taps,
 		grpcServer: p.GRPCServer,
+		checker:    p.Checker,
 	}
 
+	s.checker.AddReadinessCheck("listeners", s.grpcServer.Ready)
+
 	lc.Append(fx.Hook{
 		OnStart: func(ctx context.Context) error {
 			return s.start(ctx)
@@ -45,25 +57,76 @@ func New(lc fx.Lifecycle, p Params) *Server {
 }
 
 func (s *Server) start(ctx context.Context) error {
-	s.logger.Info("starting server",
-		logger.String("client_addr", s.cfg.ClientListenAddr),
-		logger.String("proxy_addr", s.cfg.ProxyListenAddr),
-	)
+	if s.cfg.SinglePort() {
+		s.logger.Info("starting server", logger.String("listen_addr", s.cfg.ListenAddr))
+	} else {
+		s.logger.Info("starting server",
+			logger.String("client_addr", s.cfg.ClientListenAddr),
+			logger.String("proxy_addr", s.cfg.ProxyListenAddr),
+		)
+	}
 
 	if err := s.grpcServer.Start(ctx); err != nil {
 		return err
 	}
 
+	if s.cfg.Health.ListenAddr != "" {
+		s.health = health.NewServer(s.cfg.Health.ListenAddr, s.checker, s.logger)
+		s.health.Handle("/routes", s.registry.RoutesHandler())
+		if err := s.health.Start(); err != nil {
+			s.grpcServer.Stop(ctx)
+			return err
+		}
+	}
+
+	if s.cfg.AdminSocket != "" {
+		if err := s.startControl(); err != nil {
+			if s.cfg.ProxyApproval.Required {
+				s.stopListeners(ctx)
+				return err
+			}
+			s.logger.Warn("admin socket unavailable", logger.Error(err))
+		}
+	}
+
 	s.logger.Info("server started successfully")
 	return nil
 }
 
-func (s *Server) stop(ctx context.Context) error {
-	s.logger.Info("stopping server")
+func (s *Server) startControl() error {
+	ctl := control.NewServer(s.cfg.AdminSocket, s.logger)
+	s.registry.RegisterAdminHandlers(ctl)
+	s.taps.RegisterAdminHandlers(ctl)
+	if err := ctl.Start(); err != nil {
+		return err
+	}
+	s.control = ctl
+	return nil
+}
+
+func (s *Server) stopListeners(ctx context.Context) {
+	if s.control != nil {
+		if err := s.control.Stop(ctx); err != nil {
+			s.logger.Warn("admin socket stop error", logger.Error(err))
+		}
+	}
+
+	if s.health != nil {
+		if err := s.health.Stop(ctx); err != nil {
+			s.logger.Warn("health server stop error", logger.Error(err))
+		}
+	}
 
 	if err := s.grpcServer.Stop(ctx); err != nil {
 		s.logger.Warn("grpc server stop error", logger.Error(err))
 	}
+}
+
+func (s *Server) stop(ctx context.Context) error {
+	s.logger.Info("stopping server")
+
+	s.stopListeners(ctx)
+	s.taps.StopAll()
 
 	if err := s.registry.Cleanup(ctx); err != nil {
 		s.logger.Warn("registry cleanup error", logger.Error(err))
@@ -0,0 +1,506 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"network-tunneler/pkg/logger"
+	"network-tunneler/pkg/network"
+	"network-tunneler/pkg/pcapng"
+	pb "network-tunneler/proto"
+)
+
+// maxTapSegment and maxTapDatagram keep synthesized IPv4 packets within the
+// 16-bit total length.
+const (
+	maxTapSegment  = 65535 - 40
+	maxTapDatagram = 65535 - 28
+)
+
+// TapFilter selects the connections a tap records. Empty fields match
+// everything, so an empty filter captures all traffic.
+type TapFilter struct {
+	ClientID     string `json:"client_id,omitempty"`
+	ProxyID      string `json:"proxy_id,omitempty"`
+	Prefix       string `json:"prefix,omitempty"`
+	ConnectionID string `json:"connection_id,omitempty"`
+}
+
+type TapInfo struct {
+	ID        string    `json:"id"`
+	Filter    TapFilter `json:"filter"`
+	Path      string    `json:"path"`
+	StartedAt time.Time `json:"started_at"`
+	Packets   uint64    `json:"packets"`
+	Bytes     uint64    `json:"bytes"`
+}
+
+// Tap writes the payloads relayed for matching connections to a pcapng file.
+// The tunnel only carries stream payloads, so each connection gets a
+// synthesized handshake and sequence numbers that follow the bytes seen.
+type Tap struct {
+	info    TapInfo
+	prefix  netip.Prefix
+	file    *os.File
+	writer  *pcapng.Writer
+	streams map[string]*tapStream // nil for connections it cannot synthesize
+	logger  logger.Logger
+	mu      sync.Mutex
+}
+
+type tapStream struct {
+	udp       bool
+	client    netip.AddrPort
+	target    netip.AddrPort
+	clientSeq uint32
+	targetSeq uint32
+	ipID      uint16
+}
+
+type TapManager struct {
+	taps   map[string]*Tap
+	nextID uint64
+	active atomic.Bool
+	mu     sync.RWMutex
+	logger logger.Logger
+}
+
+func NewTapManager(log logger.Logger) *TapManager {
+	return &TapManager{
+		taps:   make(map[string]*Tap),
+		logger: log.With(logger.String("component", "tap")),
+	}
+}
+
+func (m *TapManager) Start(filter TapFilter, path string) (TapInfo, error) {
+	var prefix netip.Prefix
+	if filter.Prefix != "" {
+		p, err := netip.ParsePrefix(filter.Prefix)
+		if err != nil {
+			return TapInfo{}, fmt.Errorf("invalid prefix filter %q: %w", filter.Prefix, err)
+		}
+		prefix = p.Masked()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID++
+	id := strconv.FormatUint(m.nextID, 10)
+
+	if path == "" {
+		path = filepath.Join(os.TempDir(),
+			fmt.Sprintf("network-tunneler-tap-%s-%s.pcapng", id, time.Now().Format("20060102-150405")))
+	}
+
+	// Captures contain application payloads, keep them private and never
+	// overwrite an existing file.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return TapInfo{}, fmt.Errorf("failed to create capture file: %w", err)
+	}
+
+	writer, err := pcapng.NewWriter(file, pcapng.LinkTypeRaw)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return TapInfo{}, err
+	}
+
+	tap := &Tap{
+		info: TapInfo{
+			ID:        id,
+			Filter:    filter,
+			Path:      path,
+			StartedAt: time.Now(),
+		},
+		prefix:  prefix,
+		file:    file,
+		writer:  writer,
+		streams: make(map[string]*tapStream),
+		logger:  m.logger.With(logger.String("tap_id", id)),
+	}
+
+	m.taps[id] = tap
+	m.active.Store(true)
+
+	m.logger.Info("tap started",
+		logger.String("tap_id", id),
+		logger.String("path", path),
+		logger.String("client_id", filter.ClientID),
+		logger.String("proxy_id", filter.ProxyID),
+		logger.String("prefix", filter.Prefix),
+		logger.String("conn_id", filter.ConnectionID),
+	)
+
+	return tap.info, nil
+}
+
+func (m *TapManager) Stop(id string) (TapInfo, error) {
+	m.mu.Lock()
+	tap, exists := m.taps[id]
+	if exists {
+		delete(m.taps, id)
+		m.active.Store(len(m.taps) > 0)
+	}
+	m.mu.Unlock()
+
+	if !exists {
+		return TapInfo{}, fmt.Errorf("tap %s not found", id)
+	}
+
+	info, err := tap.close()
+	m.logger.Info("tap stopped",
+		logger.String("tap_id", id),
+		logger.String("path", info.Path),
+		logger.Int("packets", int(info.Packets)),
+	)
+	return info, err
+}
+
+func (m *TapManager) StopAll() {
+	m.mu.RLock()
+	ids := make([]string, 0, len(m.taps))
+	for id := range m.taps {
+		ids = append(ids, id)
+	}
+	m.mu.RUnlock()
+
+	for _, id := range ids {
+		if _, err := m.Stop(id); err != nil {
+			m.logger.Warn("failed to stop tap", logger.String("tap_id", id), logger.Error(err))
+		}
+	}
+}
+
+func (m *TapManager) List() []TapInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	infos := make([]TapInfo, 0, len(m.taps))
+	for _, tap := range m.taps {
+		infos = append(infos, tap.snapshot())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].StartedAt.Before(infos[j].StartedAt) })
+	return infos
+}
+
+// Capture records a relayed payload in every tap whose filter matches.
+func (m *TapManager) Capture(route *ConnectionRoute, dir pb.Direction, payload []byte) {
+	if !m.active.Load() || len(payload) == 0 {
+		return
+	}
+
+	m.eachMatching(route, func(tap *Tap) error {
+		return tap.record(route, dir, payload, time.Now())
+	})
+}
+
+// CloseConnection ends the synthesized stream with a FIN exchange.
+func (m *TapManager) CloseConnection(route *ConnectionRoute) {
+	if !m.active.Load() {
+		return
+	}
+
+	m.eachMatching(route, func(tap *Tap) error {
+		return tap.closeStream(route.ConnectionID, time.Now())
+	})
+}
+
+func (m *TapManager) eachMatching(route *ConnectionRoute, fn func(*Tap) error) {
+	m.mu.RLock()
+	var failed []string
+	for id, tap := range m.taps {
+		if !tap.matches(route) {
+			continue
+		}
+		if err := fn(tap); err != nil {
+			m.logger.Error("tap write failed, stopping tap",
+				logger.String("tap_id", id),
+				logger.Error(err),
+			)
+			failed = append(failed, id)
+		}
+	}
+	m.mu.RUnlock()
+
+	for _, id := range failed {
+		m.Stop(id)
+	}
+}
+
+func (t *Tap) matches(route *ConnectionRoute) bool {
+	f := t.info.Filter
+	if f.ConnectionID != "" && f.ConnectionID != route.ConnectionID {
+		return false
+	}
+	if f.ClientID != "" && f.ClientID != route.ClientID {
+		return false
+	}
+	if f.ProxyID != "" && f.ProxyID != route.ProxyID {
+		return false
+	}
+	if t.prefix.IsValid() {
+		if route.Tuple == nil {
+			return false
+		}
+		addr, err := netip.ParseAddr(route.Tuple.DstIp)
+		if err != nil || !t.prefix.Contains(addr.Unmap()) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *Tap) record(route *ConnectionRoute, dir pb.Direction, payload []byte, at time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// TUN mode already carries real packets; nothing to synthesize.
+	if route.IPPacket {
+		if err := t.write(payload, route.ConnectionID, at); err != nil {
+			return err
+		}
+		t.info.Bytes += uint64(len(payload))
+		return nil
+	}
+
+	st, exists := t.streams[route.ConnectionID]
+	if exists && st == nil {
+		return nil
+	}
+	if !exists {
+		var ok bool
+		st, ok = newTapStream(route)
+		if !ok {
+			// Hostname-only tuples and mixed address families leave no
+			// addresses to build headers from.
+			t.streams[route.ConnectionID] = nil
+			t.logger.Debug("tap skipping connection without a usable address pair",
+				logger.String("conn_id", route.ConnectionID),
+			)
+			return nil
+		}
+		t.streams[route.ConnectionID] = st
+
+		if !st.udp {
+			if err := t.writeHandshake(st, route.ConnectionID, at); err != nil {
+				return err
+			}
+		}
+	}
+
+	fromClient := dir != pb.Direction_DIRECTION_REVERSE
+
+	// Each UDP packet is one datagram, so it is written whole.
+	if st.udp {
+		if len(payload) > maxTapDatagram {
+			payload = payload[:maxTapDatagram]
+		}
+		if err := t.write(st.datagram(fromClient, payload), route.ConnectionID, at); err != nil {
+			return err
+		}
+		t.info.Bytes += uint64(len(payload))
+		return nil
+	}
+
+	for len(payload) > 0 {
+		n := min(len(payload), maxTapSegment)
+		if err := t.write(st.segment(fromClient, network.FlagPSH|network.FlagACK, payload[:n]), route.ConnectionID, at); err != nil {
+			return err
+		}
+		t.info.Bytes += uint64(n)
+		payload = payload[n:]
+	}
+
+	return nil
+}
+
+func (t *Tap) writeHandshake(st *tapStream, connID string, at time.Time) error {
+	for _, seg := range [][]byte{
+		st.segment(true, network.FlagSYN, nil),
+		st.segment(false, network.FlagSYN|network.FlagACK, nil),
+		st.segment(true, network.FlagACK, nil),
+	} {
+		if err := t.write(seg, connID, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tap) closeStream(connID string, at time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st, exists := t.streams[connID]
+	if !exists {
+		return nil
+	}
+	delete(t.streams, connID)
+
+	if st == nil || st.udp {
+		return nil
+	}
+
+	for _, seg := range [][]byte{
+		st.segment(true, network.FlagFIN|network.FlagACK, nil),
+		st.segment(false, network.FlagFIN|network.FlagACK, nil),
+		st.segment(true, network.FlagACK, nil),
+	} {
+		if err := t.write(seg, connID, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tap) write(pkt []byte, connID string, at time.Time) error {
+	if err := t.writer.WritePacket(at, pkt, "conn "+connID); err != nil {
+		return err
+	}
+	t.info.Packets++
+	return nil
+}
+
+func (t *Tap) snapshot() TapInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.info
+}
+
+func (t *Tap) close() (TapInfo, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	flushErr := t.writer.Flush()
+	closeErr := t.file.Close()
+	if flushErr != nil {
+		return t.info, fmt.Errorf("failed to flush capture file: %w", flushErr)
+	}
+	if closeErr != nil {
+		return t.info, fmt.Errorf("failed to close capture file: %w", closeErr)
+	}
+	return t.info, nil
+}
+
+func newTapStream(route *ConnectionRoute) (*tapStream, bool) {
+	if route.Tuple == nil {
+		return nil, false
+	}
+
+	src, err := netip.ParseAddr(route.Tuple.SrcIp)
+	if err != nil {
+		return nil, false
+	}
+	dst, err := netip.ParseAddr(route.Tuple.DstIp)
+	if err != nil || src.Unmap().Is4() != dst.Unmap().Is4() {
+		return nil, false
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(route.ConnectionID))
+	isn := h.Sum32()
+
+	return &tapStream{
+		udp:       route.Protocol == pb.Protocol_PROTOCOL_UDP,
+		client:    netip.AddrPortFrom(src.Unmap(), uint16(route.Tuple.SrcPort)),
+		target:    netip.AddrPortFrom(dst.Unmap(), uint16(route.Tuple.DstPort)),
+		clientSeq: isn,
+		targetSeq: ^isn,
+	}, true
+}
+
+// segment builds one TCP packet and advances the sender's sequence
+// number by the payload length plus one for SYN and FIN.
+func (st *tapStream) segment(fromClient bool, flags network.TCPFlags, payload []byte) []byte {
+	src, dst := st.client, st.target
+	seq, ack := &st.clientSeq, st.targetSeq
+	if !fromClient {
+		src, dst = st.target, st.client
+		seq, ack = &st.targetSeq, st.clientSeq
+	}
+
+	srcIP := net.IP(src.Addr().AsSlice())
+	dstIP := net.IP(dst.Addr().AsSlice())
+
+	tcp := &network.TCPPacket{
+		SrcPort:    src.Port(),
+		DstPort:    dst.Port(),
+		SeqNum:     *seq,
+		DataOffset: 20,
+		Flags:      flags,
+		Window:     65535,
+		Payload:    payload,
+	}
+	if flags&network.FlagACK != 0 {
+		tcp.AckNum = ack
+	}
+	tcp.Checksum = network.CalculateTCPChecksum(srcIP, dstIP, tcp.Serialize())
+
+	*seq += uint32(len(payload))
+	if flags&(network.FlagSYN|network.FlagFIN) != 0 {
+		*seq++
+	}
+
+	return st.packet(network.ProtocolTCP, srcIP, dstIP, tcp.Serialize())
+}
+
+// datagram builds one UDP packet.
+func (st *tapStream) datagram(fromClient bool, payload []byte) []byte {
+	src, dst := st.client, st.target
+	if !fromClient {
+		src, dst = st.target, st.client
+	}
+
+	srcIP := net.IP(src.Addr().AsSlice())
+	dstIP := net.IP(dst.Addr().AsSlice())
+
+	udp := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:2], src.Port())
+	binary.BigEndian.PutUint16(udp[2:4], dst.Port())
+	binary.BigEndian.PutUint16(udp[4:6], uint16(len(udp)))
+	copy(udp[8:], payload)
+	binary.BigEndian.PutUint16(udp[6:8], network.CalculateUDPChecksum(srcIP, dstIP, udp))
+
+	return st.packet(network.ProtocolUDP, srcIP, dstIP, udp)
+}
+
+// packet wraps a transport payload in an IPv4 or IPv6 header, matching the
+// stream's addresses.
+func (st *tapStream) packet(proto network.IPProtocol, srcIP, dstIP net.IP, payload []byte) []byte {
+	ip := &network.IPPacket{
+		Version:   4,
+		HeaderLen: 20,
+		TTL:       64,
+		Protocol:  proto,
+		SrcIP:     srcIP,
+		DstIP:     dstIP,
+		Payload:   payload,
+	}
+	if srcIP.To4() == nil {
+		ip.Version = 6
+		ip.HeaderLen = 40
+	} else {
+		st.ipID++
+		ip.ID = st.ipID
+		if proto == network.ProtocolTCP {
+			ip.Flags = 0x2 // don't fragment
+		}
+	}
+	ip.TotalLen = uint16(int(ip.HeaderLen) + len(ip.Payload))
+	ip.RecalculateIPChecksum()
+
+	return ip.Serialize()
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	testutil "network-tunneler/internal/testing"
+	"network-tunneler/pkg/network"
+	pb "network-tunneler/proto"
+)
+
+// readCapturedPackets returns the packet data of every enhanced packet block.
+func readCapturedPackets(t *testing.T, path string) [][]byte {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read capture: %v", err)
+	}
+
+	var packets [][]byte
+	for len(data) >= 12 {
+		typ := binary.LittleEndian.Uint32(data[0:4])
+		total := binary.LittleEndian.Uint32(data[4:8])
+		if typ == 6 {
+			capLen := binary.LittleEndian.Uint32(data[20:24])
+			packets = append(packets, data[28:28+capLen])
+		}
+		data = data[total:]
+	}
+	return packets
+}
+
+func TestTapManager_CapturesMatchingStreams(t *testing.T) {
+	m := NewTapManager(testutil.NewTestLogger())
+	path := filepath.Join(t.TempDir(), "tap.pcapng")
+
+	info, err := m.Start(TapFilter{Prefix: "10.0.0.0/8"}, path)
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	route := &ConnectionRoute{
+		ConnectionID: "conn-1",
+		ClientID:     "client-1",
+		ProxyID:      "proxy-1",
+		Tuple:        &pb.ConnectionTuple{SrcIp: "127.0.0.1", SrcPort: 40000, DstIp: "10.1.2.3", DstPort: 80},
+	}
+	other := &ConnectionRoute{
+		ConnectionID: "conn-2",
+		Tuple:        &pb.ConnectionTuple{SrcIp: "127.0.0.1", SrcPort: 40001, DstIp: "192.168.1.1", DstPort: 80},
+	}
+
+	m.Capture(route, pb.Direction_DIRECTION_FORWARD, []byte("GET / HTTP/1.0\r\n\r\n"))
+	m.Capture(other, pb.Direction_DIRECTION_FORWARD, []byte("ignored"))
+	m.Capture(route, pb.Direction_DIRECTION_REVERSE, []byte("HTTP/1.0 200 OK\r\n\r\n"))
+	m.CloseConnection(route)
+
+	info, err = m.Stop(info.ID)
+	if err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if info.Bytes != 37 {
+		t.Errorf("expected 37 payload bytes, got %d", info.Bytes)
+	}
+
+	packets := readCapturedPackets(t, path)
+	// handshake (3) + two data segments + FIN exchange (3)
+	if len(packets) != 8 {
+		t.Fatalf("expected 8 packets, got %d", len(packets))
+	}
+
+	var clientNext, targetNext uint32
+	for i, raw := range packets {
+		ip, err := network.ParseIPPacket(raw)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if got := network.CalculateIPChecksum(raw[:ip.HeaderLen]); got != ip.Checksum {
+			t.Errorf("packet %d: IP checksum %#x, want %#x", i, ip.Checksum, got)
+		}
+
+		tcp, err := network.ParseTCPPacket(ip.Payload)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if got := network.CalculateTCPChecksum(ip.SrcIP, ip.DstIP, ip.Payload); got != tcp.Checksum {
+			t.Errorf("packet %d: TCP checksum %#x, want %#x", i, tcp.Checksum, got)
+		}
+
+		fromClient := tcp.SrcPort == 40000
+		if fromClient && ip.DstIP.String() != "10.1.2.3" {
+			t.Errorf("packet %d: unexpected destination %s", i, ip.DstIP)
+		}
+
+		expected := &clientNext
+		if !fromClient {
+			expected = &targetNext
+		}
+		if i > 1 && tcp.SeqNum != *expected {
+			t.Errorf("packet %d: seq %d, want %d", i, tcp.SeqNum, *expected)
+		}
+
+		next := tcp.SeqNum + uint32(len(tcp.Payload))
+		if tcp.HasFlag(network.FlagSYN) || tcp.HasFlag(network.FlagFIN) {
+			next++
+		}
+		*expected = next
+	}
+
+	first, _ := network.ParseIPPacket(packets[0])
+	if syn, _ := network.ParseTCPPacket(first.Payload); !syn.HasFlag(network.FlagSYN) || syn.HasFlag(network.FlagACK) {
+		t.Error("expected capture to start with a synthesized SYN")
+	}
+}
+
+func TestTapManager_CapturesUDPDatagrams(t *testing.T) {
+	m := NewTapManager(testutil.NewTestLogger())
+	path := filepath.Join(t.TempDir(), "tap.pcapng")
+
+	info, err := m.Start(TapFilter{}, path)
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	route := &ConnectionRoute{
+		ConnectionID: "udp-1",
+		Protocol:     pb.Protocol_PROTOCOL_UDP,
+		Tuple:        &pb.ConnectionTuple{SrcIp: "127.0.0.1", SrcPort: 40000, DstIp: "10.1.2.3", DstPort: 53},
+	}
+
+	m.Capture(route, pb.Direction_DIRECTION_FORWARD, []byte("query"))
+	m.Capture(route, pb.Direction_DIRECTION_REVERSE, []byte("answer"))
+	m.CloseConnection(route)
+
+	if _, err := m.Stop(info.ID); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	packets := readCapturedPackets(t, path)
+	if len(packets) != 2 {
+		t.Fatalf("expected 2 datagrams without handshake or FIN, got %d", len(packets))
+	}
+
+	for i, want := range []string{"query", "answer"} {
+		ip, err := network.ParseIPPacket(packets[i])
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if ip.Protocol != network.ProtocolUDP {
+			t.Fatalf("packet %d: expected UDP, got protocol %d", i, ip.Protocol)
+		}
+		udp := ip.Payload
+		if got := binary.BigEndian.Uint16(udp[4:6]); int(got) != len(udp) {
+			t.Errorf("packet %d: UDP length %d, want %d", i, got, len(udp))
+		}
+		if got := network.CalculateUDPChecksum(ip.SrcIP, ip.DstIP, udp); got != binary.BigEndian.Uint16(udp[6:8]) {
+			t.Errorf("packet %d: UDP checksum mismatch", i)
+		}
+		if string(udp[8:]) != want {
+			t.Errorf("packet %d: payload %q, want %q", i, udp[8:], want)
+		}
+	}
+}
+
+func TestTapManager_CapturesIPv6Streams(t *testing.T) {
+	m := NewTapManager(testutil.NewTestLogger())
+	path := filepath.Join(t.TempDir(), "tap.pcapng")
+
+	info, err := m.Start(TapFilter{Prefix: "fd00::/8"}, path)
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	route := &ConnectionRoute{
+		ConnectionID: "conn-6",
+		Tuple:        &pb.ConnectionTuple{SrcIp: "fd00::1", SrcPort: 40000, DstIp: "fd00::2", DstPort: 80},
+	}
+	m.Capture(route, pb.Direction_DIRECTION_FORWARD, []byte("hello"))
+	m.CloseConnection(route)
+
+	if _, err := m.Stop(info.ID); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	packets := readCapturedPackets(t, path)
+	// handshake (3) + one data segment + FIN exchange (3)
+	if len(packets) != 7 {
+		t.Fatalf("expected 7 packets, got %d", len(packets))
+	}
+	for i, raw := range packets {
+		ip, err := network.ParseIPPacket(raw)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if ip.Version != 6 || len(raw) != int(ip.TotalLen) {
+			t.Fatalf("packet %d: expected a whole IPv6 packet, got version %d", i, ip.Version)
+		}
+		tcp, err := network.ParseTCPPacket(ip.Payload)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if got := network.CalculateTCPChecksum(ip.SrcIP, ip.DstIP, ip.Payload); got != tcp.Checksum {
+			t.Errorf("packet %d: TCP checksum %#x, want %#x", i, tcp.Checksum, got)
+		}
+	}
+}
+
+func TestTapManager_SkipsHostnameTuples(t *testing.T) {
+	m := NewTapManager(testutil.NewTestLogger())
+	path := filepath.Join(t.TempDir(), "tap.pcapng")
+
+	info, err := m.Start(TapFilter{}, path)
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	route := &ConnectionRoute{
+		ConnectionID: "conn-host",
+		Tuple:        &pb.ConnectionTuple{SrcIp: "127.0.0.1", SrcPort: 40000, DstHost: "db.corp.internal", DstPort: 5432},
+	}
+	m.Capture(route, pb.Direction_DIRECTION_FORWARD, []byte("hello"))
+	m.Capture(route, pb.Direction_DIRECTION_REVERSE, []byte("world"))
+	m.CloseConnection(route)
+
+	if _, err := m.Stop(info.ID); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if packets := readCapturedPackets(t, path); len(packets) != 0 {
+		t.Errorf("expected no packets for a hostname-only tuple, got %d", len(packets))
+	}
+}
+
+func TestTapManager_Filters(t *testing.T) {
+	m := NewTapManager(testutil.NewTestLogger())
+
+	if _, err := m.Start(TapFilter{Prefix: "not-a-cidr"}, filepath.Join(t.TempDir(), "bad.pcapng")); err == nil {
+		t.Error("expected invalid prefix to be rejected")
+	}
+
+	path := filepath.Join(t.TempDir(), "tap.pcapng")
+	info, err := m.Start(TapFilter{ClientID: "client-1", ProxyID: "proxy-1"}, path)
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if _, err := m.Start(TapFilter{}, path); err == nil {
+		t.Error("expected existing capture file not to be overwritten")
+	}
+
+	tuple := &pb.ConnectionTuple{SrcIp: "127.0.0.1", SrcPort: 40000, DstIp: "10.1.2.3", DstPort: 80}
+	m.Capture(&ConnectionRoute{ConnectionID: "a", ClientID: "client-1", ProxyID: "proxy-2", Tuple: tuple}, pb.Direction_DIRECTION_FORWARD, []byte("x"))
+	m.Capture(&ConnectionRoute{ConnectionID: "b", ClientID: "client-2", ProxyID: "proxy-1", Tuple: tuple}, pb.Direction_DIRECTION_FORWARD, []byte("x"))
+
+	if taps := m.List(); len(taps) != 1 || taps[0].Packets != 0 {
+		t.Errorf("expected no packets for non-matching connections, got %+v", taps)
+	}
+
+	m.StopAll()
+	if len(m.List()) != 0 {
+		t.Errorf("expected StopAll to remove taps")
+	}
+	if _, err := m.Stop(info.ID); err == nil {
+		t.Error("expected stopping a removed tap to fail")
+	}
+}
@@ -46,13 +46,25 @@ func NewMockNetConn() *MockNetConn {
 }
 
 func (m *MockNetConn) Read(b []byte) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.ReadBuf.Read(b)
 }
 
 func (m *MockNetConn) Write(b []byte) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.WriteBuf.Write(b)
 }
 
+// Written returns a copy of what has been written so far; unlike WriteBuf
+// it is safe to call while another goroutine writes.
+func (m *MockNetConn) Written() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]byte(nil), m.WriteBuf.Bytes()...)
+}
+
 func (m *MockNetConn) Close() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
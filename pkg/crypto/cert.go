@@ -26,6 +26,7 @@ type CertOptions struct {
 	DNSNames   []string
 	IPAddr     []net.IP
 	Type       CertType
+	Role       Role
 }
 
 func GenerateCert(ca *CA, opts CertOptions) (*x509.Certificate, *ecdsa.PrivateKey, error) {
@@ -51,6 +52,10 @@ func GenerateCert(ca *CA, opts CertOptions) (*x509.Certificate, *ecdsa.PrivateKe
 		IPAddresses: opts.IPAddr,
 	}
 
+	if opts.Role != RoleUnknown {
+		template.Subject.OrganizationalUnit = []string{string(opts.Role)}
+	}
+
 	if opts.Type == ServerCert {
 		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
 	} else {
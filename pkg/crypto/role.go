@@ -0,0 +1,53 @@
+package crypto
+
+import (
+	"crypto/x509"
+	"strings"
+)
+
+type Role string
+
+const (
+	RoleUnknown Role = ""
+	RoleServer  Role = "server"
+	RoleClient  Role = "client"
+	RoleProxy   Role = "proxy"
+)
+
+func ParseRole(s string) Role {
+	switch Role(strings.ToLower(strings.TrimSpace(s))) {
+	case RoleServer:
+		return RoleServer
+	case RoleClient:
+		return RoleClient
+	case RoleProxy:
+		return RoleProxy
+	default:
+		return RoleUnknown
+	}
+}
+
+// CertRole detects the role a certificate was issued for. The
+// OrganizationalUnit written by gencerts takes precedence; certificates
+// without one fall back to a common name of "<role>" or "<role>-<id>".
+func CertRole(cert *x509.Certificate) Role {
+	if cert == nil {
+		return RoleUnknown
+	}
+
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if role := ParseRole(ou); role != RoleUnknown {
+			return role
+		}
+	}
+
+	cn := cert.Subject.CommonName
+	if role := ParseRole(cn); role != RoleUnknown {
+		return role
+	}
+	if i := strings.IndexByte(cn, '-'); i > 0 {
+		return ParseRole(cn[:i])
+	}
+
+	return RoleUnknown
+}
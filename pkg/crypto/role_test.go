@@ -0,0 +1,52 @@
+package crypto
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+func TestCertRole(t *testing.T) {
+	tests := []struct {
+		name    string
+		subject pkix.Name
+		want    Role
+	}{
+		{"OU client", pkix.Name{CommonName: "laptop", OrganizationalUnit: []string{"client"}}, RoleClient},
+		{"OU wins over CN", pkix.Name{CommonName: "client", OrganizationalUnit: []string{"proxy"}}, RoleProxy},
+		{"CN exact", pkix.Name{CommonName: "proxy"}, RoleProxy},
+		{"CN prefixed", pkix.Name{CommonName: "client-a1b2"}, RoleClient},
+		{"CN hostname", pkix.Name{CommonName: "server.example.com"}, RoleUnknown},
+		{"CN hostname with role label", pkix.Name{CommonName: "proxy.corp.example.com"}, RoleUnknown},
+		{"unknown", pkix.Name{CommonName: "workstation"}, RoleUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := CertRole(&x509.Certificate{Subject: tt.subject})
+			if got != tt.want {
+				t.Errorf("CertRole() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCertRole_GeneratedCert(t *testing.T) {
+	ca, err := GenerateCA("test")
+	if err != nil {
+		t.Fatalf("GenerateCA failed: %v", err)
+	}
+
+	cert, _, err := GenerateCert(ca, CertOptions{
+		CommonName: "edge-1",
+		Type:       ClientCert,
+		Role:       RoleProxy,
+	})
+	if err != nil {
+		t.Fatalf("GenerateCert failed: %v", err)
+	}
+
+	if got := CertRole(cert); got != RoleProxy {
+		t.Errorf("CertRole() = %q, want %q", got, RoleProxy)
+	}
+}
@@ -25,6 +25,11 @@ func (rb *RuleBuilder) Protocol(p Protocol) *RuleBuilder {
 	return rb
 }
 
+func (rb *RuleBuilder) InInterface(name string) *RuleBuilder {
+	rb.rule.InInterface = name
+	return rb
+}
+
 func (rb *RuleBuilder) Source(cidr string) *RuleBuilder {
 	rb.rule.Source = cidr
 	return rb
@@ -55,12 +60,51 @@ func (rb *RuleBuilder) ToPort(port string) *RuleBuilder {
 	return rb
 }
 
+func (rb *RuleBuilder) MatchMark(mark string) *RuleBuilder {
+	rb.rule.MatchMark = mark
+	return rb
+}
+
+func (rb *RuleBuilder) UIDOwner(uid string) *RuleBuilder {
+	rb.rule.UIDOwner = uid
+	return rb
+}
+
+func (rb *RuleBuilder) GIDOwner(gid string) *RuleBuilder {
+	rb.rule.GIDOwner = gid
+	return rb
+}
+
+func (rb *RuleBuilder) CgroupPath(path string) *RuleBuilder {
+	rb.rule.CgroupPath = path
+	return rb
+}
+
+func (rb *RuleBuilder) Mark(mark string) *RuleBuilder {
+	rb.rule.Mark = mark
+	return rb
+}
+
+func (rb *RuleBuilder) OnIP(ip string) *RuleBuilder {
+	rb.rule.OnIP = ip
+	return rb
+}
+
+// IPv6 selects ip6tables for a rule without addresses to infer it from.
+func (rb *RuleBuilder) IPv6() *RuleBuilder {
+	rb.rule.IPv6 = true
+	return rb
+}
+
 func (rb *RuleBuilder) Comment(comment string) *RuleBuilder {
 	rb.rule.Comment = comment
 	return rb
 }
 
 func (rb *RuleBuilder) Build() (*Rule, error) {
+	if rb.rule.hasIPv6Address() {
+		rb.rule.IPv6 = true
+	}
 	if err := rb.rule.Validate(); err != nil {
 		return nil, err
 	}
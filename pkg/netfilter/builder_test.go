@@ -119,6 +119,204 @@ func TestRuleBuilder_ValidCIDRFormats(t *testing.T) {
 	}
 }
 
+func TestRuleArgs_Multiport(t *testing.T) {
+	rule := netfilter.NewRule().
+		Table(netfilter.TableNat).
+		Chain(netfilter.ChainOutput).
+		Protocol(netfilter.ProtocolTCP).
+		Destination("10.0.0.0/8").
+		DstPort("80,443,8000:8100").
+		Target(netfilter.TargetRedirect).
+		ToPort("9999").
+		MustBuild()
+
+	got := strings.Join(rule.Args(), " ")
+	want := "-t nat -p tcp -d 10.0.0.0/8 -m multiport --dports 80,443,8000:8100 -j REDIRECT --to-ports 9999"
+	if got != want {
+		t.Errorf("Args() = %q, want %q", got, want)
+	}
+
+	single := netfilter.NewRule().
+		Table(netfilter.TableNat).
+		Chain(netfilter.ChainOutput).
+		Protocol(netfilter.ProtocolTCP).
+		DstPort("8000:8100").
+		Target(netfilter.TargetReturn).
+		MustBuild()
+
+	if got := strings.Join(single.Args(), " "); strings.Contains(got, "multiport") {
+		t.Errorf("expected a single range without multiport, got %q", got)
+	}
+}
+
+func TestRuleArgs_TProxy(t *testing.T) {
+	rule := netfilter.NewRule().
+		Table(netfilter.TableMangle).
+		Chain(netfilter.ChainPrerouting).
+		Protocol(netfilter.ProtocolUDP).
+		Destination("10.0.0.0/8").
+		MatchMark("0x2a").
+		Target(netfilter.TargetTProxy).
+		ToPort("9999").
+		OnIP("127.0.0.1").
+		Mark("0x2a").
+		MustBuild()
+
+	got := strings.Join(rule.Args(), " ")
+	want := "-t mangle -p udp -d 10.0.0.0/8 -m mark --mark 0x2a -j TPROXY --on-port 9999 --on-ip 127.0.0.1 --tproxy-mark 0x2a"
+	if got != want {
+		t.Errorf("Args() = %q, want %q", got, want)
+	}
+
+	_, err := netfilter.NewRule().
+		Table(netfilter.TableNat).
+		Chain(netfilter.ChainOutput).
+		Target(netfilter.TargetTProxy).
+		ToPort("9999").
+		Mark("0x2a").
+		Build()
+	if err == nil {
+		t.Error("expected TPROXY outside mangle PREROUTING to be rejected")
+	}
+}
+
+func TestRuleArgs_Mark(t *testing.T) {
+	rule := netfilter.NewRule().
+		Table(netfilter.TableMangle).
+		Chain(netfilter.ChainOutput).
+		Protocol(netfilter.ProtocolUDP).
+		Destination("10.0.0.0/8").
+		Target(netfilter.TargetMark).
+		Mark("0x2a").
+		MustBuild()
+
+	got := strings.Join(rule.Args(), " ")
+	want := "-t mangle -p udp -d 10.0.0.0/8 -j MARK --set-mark 0x2a"
+	if got != want {
+		t.Errorf("Args() = %q, want %q", got, want)
+	}
+}
+
+func TestRuleArgs_InInterface(t *testing.T) {
+	rule := netfilter.NewRule().
+		Table(netfilter.TableNat).
+		Chain(netfilter.ChainPrerouting).
+		Protocol(netfilter.ProtocolTCP).
+		InInterface("eth1").
+		Destination("10.0.0.0/8").
+		Target(netfilter.TargetRedirect).
+		ToPort("9999").
+		MustBuild()
+
+	got := strings.Join(rule.Args(), " ")
+	want := "-t nat -p tcp -i eth1 -d 10.0.0.0/8 -j REDIRECT --to-ports 9999"
+	if got != want {
+		t.Errorf("Args() = %q, want %q", got, want)
+	}
+
+	_, err := netfilter.NewRule().
+		Table(netfilter.TableNat).
+		Chain(netfilter.ChainOutput).
+		InInterface("eth1").
+		Target(netfilter.TargetReturn).
+		Build()
+	if err == nil {
+		t.Error("expected an input interface in OUTPUT to be rejected")
+	}
+}
+
+func TestRuleArgs_SocketOwner(t *testing.T) {
+	rule := netfilter.NewRule().
+		Table(netfilter.TableNat).
+		Chain(netfilter.ChainOutput).
+		Protocol(netfilter.ProtocolTCP).
+		Destination("10.0.0.0/8").
+		UIDOwner("1000").
+		GIDOwner("www-data").
+		CgroupPath("system.slice/app.service").
+		Target(netfilter.TargetRedirect).
+		ToPort("9999").
+		MustBuild()
+
+	got := strings.Join(rule.Args(), " ")
+	want := "-t nat -p tcp -d 10.0.0.0/8 -m owner --uid-owner 1000 --gid-owner www-data -m cgroup --path system.slice/app.service -j REDIRECT --to-ports 9999"
+	if got != want {
+		t.Errorf("Args() = %q, want %q", got, want)
+	}
+
+	invalid := []*netfilter.RuleBuilder{
+		netfilter.NewRule().Table(netfilter.TableNat).Chain(netfilter.ChainPrerouting).UIDOwner("1000"),
+		netfilter.NewRule().Table(netfilter.TableNat).Chain(netfilter.ChainOutput).UIDOwner("2000-1000"),
+		netfilter.NewRule().Table(netfilter.TableNat).Chain(netfilter.ChainOutput).GIDOwner("bad name"),
+		netfilter.NewRule().Table(netfilter.TableNat).Chain(netfilter.ChainOutput).CgroupPath("/system.slice"),
+		netfilter.NewRule().Table(netfilter.TableNat).Chain(netfilter.ChainOutput).CgroupPath("a/../b"),
+	}
+	for _, b := range invalid {
+		if rule, err := b.Target(netfilter.TargetReturn).Build(); err == nil {
+			t.Errorf("expected %s to be rejected", rule)
+		}
+	}
+}
+
+func TestRuleBuilder_IPv6(t *testing.T) {
+	rule := netfilter.NewRule().
+		Table(netfilter.TableMangle).
+		Chain(netfilter.ChainPrerouting).
+		Protocol(netfilter.ProtocolUDP).
+		Destination("fd00::/8").
+		MatchMark("0x2a").
+		Target(netfilter.TargetTProxy).
+		ToPort("9999").
+		OnIP("::1").
+		Mark("0x2a").
+		MustBuild()
+
+	if !rule.IPv6 || rule.Command() != "ip6tables" {
+		t.Errorf("expected an IPv6 destination to select ip6tables, got %s", rule.Command())
+	}
+	if got := rule.String(); !strings.HasPrefix(got, "table=mangle chain=PREROUTING family=ipv6 ") {
+		t.Errorf("expected the family in %q", got)
+	}
+
+	v4 := netfilter.NewRule().
+		Table(netfilter.TableNat).
+		Chain(netfilter.ChainOutput).
+		Destination("10.0.0.0/8").
+		Target(netfilter.TargetReturn).
+		MustBuild()
+	if v4.Command() != "iptables" {
+		t.Errorf("expected an IPv4 rule to use iptables, got %s", v4.Command())
+	}
+
+	_, err := netfilter.NewRule().
+		Table(netfilter.TableMangle).
+		Chain(netfilter.ChainPrerouting).
+		Protocol(netfilter.ProtocolUDP).
+		Destination("10.0.0.0/8").
+		Target(netfilter.TargetTProxy).
+		ToPort("9999").
+		OnIP("::1").
+		Mark("0x2a").
+		Build()
+	if err == nil {
+		t.Error("expected a rule mixing IPv4 and IPv6 addresses to be rejected")
+	}
+}
+
+func TestRuleBuilder_TooManyPorts(t *testing.T) {
+	_, err := netfilter.NewRule().
+		Table(netfilter.TableNat).
+		Chain(netfilter.ChainOutput).
+		Protocol(netfilter.ProtocolTCP).
+		DstPort("1,2,3,4,5,6,7,8,9,10,11,12,13,14,15:16").
+		Target(netfilter.TargetReturn).
+		Build()
+
+	if err == nil {
+		t.Error("expected error for more than 15 multiport entries")
+	}
+}
+
 func containsString(s, substr string) bool {
 	return strings.Contains(s, substr)
 }
@@ -8,17 +8,34 @@ import (
 	"strings"
 )
 
-type Manager struct {
+// IPTables is the Manager backend that runs iptables and ip6tables.
+type IPTables struct {
+	owner Owner
 	rules []*Rule
+	// chains are the owned chains created so far, jumps included.
+	chains map[ownedChain]bool
 }
 
-func NewManager() *Manager {
-	return &Manager{
-		rules: make([]*Rule, 0),
+// ownedChain is the owner's chain for one family, table and hook.
+type ownedChain struct {
+	IPv6  bool
+	Table Table
+	Hook  Chain
+}
+
+func NewIPTables(owner Owner) *IPTables {
+	return &IPTables{
+		owner:  owner,
+		rules:  make([]*Rule, 0),
+		chains: make(map[ownedChain]bool),
 	}
 }
 
-func (m *Manager) AddRule(rule *Rule) error {
+func (m *IPTables) Backend() Backend {
+	return BackendIPTables
+}
+
+func (m *IPTables) AddRule(rule *Rule) error {
 	if err := rule.Validate(); err != nil {
 		return fmt.Errorf("invalid rule: %w", err)
 	}
@@ -27,8 +44,12 @@ func (m *Manager) AddRule(rule *Rule) error {
 	return nil
 }
 
-func (m *Manager) Apply() error {
+func (m *IPTables) Apply() error {
 	for _, rule := range m.rules {
+		if err := m.ensureChain(rule); err != nil {
+			return err
+		}
+
 		exists, err := m.CheckRule(rule)
 		if err != nil {
 			return fmt.Errorf("failed to check rule %s: %w", rule.String(), err)
@@ -45,49 +66,307 @@ func (m *Manager) Apply() error {
 	return nil
 }
 
-func (m *Manager) Remove() error {
+func (m *IPTables) Remove() error {
 	for i := len(m.rules) - 1; i >= 0; i-- {
 		rule := m.rules[i]
 		if err := m.deleteRule(rule); err != nil {
 			return fmt.Errorf("failed to remove rule %s: %w", rule.String(), err)
 		}
+		m.rules = m.rules[:i]
+	}
+	return m.removeChains()
+}
+
+// Insert applies a single rule immediately and tracks it so Remove cleans
+// it up later.
+func (m *IPTables) Insert(rule *Rule) error {
+	if err := m.AddRule(rule); err != nil {
+		return err
+	}
+	if err := m.ensureChain(rule); err != nil {
+		m.forget(rule)
+		return err
+	}
+
+	exists, err := m.CheckRule(rule)
+	if err != nil {
+		m.forget(rule)
+		return fmt.Errorf("failed to check rule %s: %w", rule.String(), err)
+	}
+	if exists {
+		return nil
+	}
+
+	if err := m.insertRule(rule); err != nil {
+		m.forget(rule)
+		return fmt.Errorf("failed to apply rule %s: %w", rule.String(), err)
+	}
+	return nil
+}
+
+// Append adds a single rule at the end of its chain, after any rule placed
+// with Insert, and tracks it so Remove cleans it up later.
+func (m *IPTables) Append(rule *Rule) error {
+	if err := m.AddRule(rule); err != nil {
+		return err
+	}
+	if err := m.ensureChain(rule); err != nil {
+		m.forget(rule)
+		return err
+	}
+
+	exists, err := m.CheckRule(rule)
+	if err != nil {
+		m.forget(rule)
+		return fmt.Errorf("failed to check rule %s: %w", rule.String(), err)
+	}
+	if exists {
+		return nil
+	}
+
+	if err := m.appendRule(rule); err != nil {
+		m.forget(rule)
+		return fmt.Errorf("failed to apply rule %s: %w", rule.String(), err)
 	}
 	return nil
 }
 
-func (m *Manager) insertRule(rule *Rule) error {
-	args := []string{"-t", string(rule.Table), "-I", string(rule.Chain)}
+// Delete removes a single rule from the kernel and stops tracking it.
+func (m *IPTables) Delete(rule *Rule) error {
+	if err := m.deleteRule(rule); err != nil {
+		return fmt.Errorf("failed to remove rule %s: %w", rule.String(), err)
+	}
+	m.forget(rule)
+	return nil
+}
+
+func (m *IPTables) forget(rule *Rule) {
+	for i, r := range m.rules {
+		if r == rule {
+			m.rules = append(m.rules[:i], m.rules[i+1:]...)
+			return
+		}
+	}
+}
+
+// chain returns the chain a rule is placed in.
+func (m *IPTables) chain(rule *Rule) Chain {
+	if m.owner.Chain == "" {
+		return rule.Chain
+	}
+	return m.owner.chainFor(rule.Chain)
+}
+
+// ensureChain creates the owned chain for a rule and jumps to it from the
+// top of the built-in chain the rule is written for.
+func (m *IPTables) ensureChain(rule *Rule) error {
+	c := ownedChain{IPv6: rule.IPv6, Table: rule.Table, Hook: rule.Chain}
+	if m.owner.Chain == "" || m.chains[c] {
+		return nil
+	}
+
+	name := string(m.owner.chainFor(rule.Chain))
+	if err := runIPTables(rule.Command(), "-t", string(rule.Table), "-N", name); err != nil &&
+		!strings.Contains(err.Error(), "already exists") {
+		return fmt.Errorf("failed to create chain %s: %w", name, err)
+	}
+
+	jump := m.jumpArgs(c)
+	err := runIPTables(rule.Command(), append([]string{"-t", string(rule.Table), "-C"}, jump...)...)
+	if err != nil {
+		err = runIPTables(rule.Command(), append([]string{"-t", string(rule.Table), "-I"}, jump...)...)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to jump to chain %s: %w", name, err)
+	}
+
+	m.chains[c] = true
+	return nil
+}
+
+// jumpArgs returns the chain and rule of the jump to an owned chain.
+func (m *IPTables) jumpArgs(c ownedChain) []string {
+	args := []string{string(c.Hook)}
+	if m.owner.Tag != "" {
+		args = append(args, "-m", "comment", "--comment", m.owner.Tag)
+	}
+	return append(args, "-j", string(m.owner.chainFor(c.Hook)))
+}
+
+// removeChains deletes the jumps to the owned chains and then the chains.
+func (m *IPTables) removeChains() error {
+	for c := range m.chains {
+		command := "iptables"
+		if c.IPv6 {
+			command = "ip6tables"
+		}
+		table := string(c.Table)
+		name := string(m.owner.chainFor(c.Hook))
+
+		err := runIPTables(command, append([]string{"-t", table, "-D"}, m.jumpArgs(c)...)...)
+		if err == nil || isMissingRule(err) {
+			err = runIPTables(command, "-t", table, "-F", name)
+		}
+		if err == nil {
+			err = runIPTables(command, "-t", table, "-X", name)
+		}
+		if err != nil && !isMissingRule(err) {
+			return fmt.Errorf("failed to remove chain %s: %w", name, err)
+		}
+		delete(m.chains, c)
+	}
+	return nil
+}
+
+// Reset deletes every owned chain, every rule jumping to one and every
+// tagged rule elsewhere, in all tables of both families.
+func (m *IPTables) Reset() (bool, error) {
+	found := false
+	for _, command := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(command); err != nil {
+			continue
+		}
+		for _, table := range []Table{TableFilter, TableNat, TableMangle, TableRaw} {
+			stale, err := m.resetTable(command, table)
+			if err != nil {
+				return found, err
+			}
+			found = found || stale
+		}
+	}
+
+	m.rules = m.rules[:0]
+	m.chains = make(map[ownedChain]bool)
+	return found, nil
+}
+
+func (m *IPTables) resetTable(command string, table Table) (bool, error) {
+	out, err := exec.Command(command, "-t", string(table), "-S").CombinedOutput()
+	if err != nil {
+		// A table or family the kernel lacks holds nothing of ours.
+		if strings.Contains(string(out), "does not exist") ||
+			strings.Contains(string(out), "Address family not supported") {
+			return false, nil
+		}
+		return false, fmt.Errorf("%s list failed: %w, output: %s", command, err, strings.TrimSpace(string(out)))
+	}
+
+	var rules [][]string
+	var chains []string
+	for _, line := range strings.Split(string(out), "\n") {
+		spec, err := splitRuleSpec(line)
+		if err != nil {
+			return false, fmt.Errorf("unexpected %s rule %q: %w", command, line, err)
+		}
+		if len(spec) < 2 {
+			continue
+		}
+		// Rules inside owned chains go with the chains.
+		switch {
+		case spec[0] == "-N" && m.owner.owns(spec[1]):
+			chains = append(chains, spec[1])
+		case spec[0] == "-A" && !m.owner.owns(spec[1]) && m.owned(spec[2:]):
+			rules = append(rules, spec)
+		}
+	}
+
+	for _, spec := range rules {
+		spec[0] = "-D"
+		if err := runIPTables(command, append([]string{"-t", string(table)}, spec...)...); err != nil && !isMissingRule(err) {
+			return true, fmt.Errorf("failed to remove stale rule: %w", err)
+		}
+	}
+	for _, name := range chains {
+		if err := runIPTables(command, "-t", string(table), "-F", name); err != nil {
+			return true, fmt.Errorf("failed to flush stale chain %s: %w", name, err)
+		}
+	}
+	for _, name := range chains {
+		if err := runIPTables(command, "-t", string(table), "-X", name); err != nil {
+			return true, fmt.Errorf("failed to delete stale chain %s: %w", name, err)
+		}
+	}
+
+	return len(rules) > 0 || len(chains) > 0, nil
+}
+
+// owned reports whether a rule spec jumps to an owned chain or carries the
+// owner's tag.
+func (m *IPTables) owned(spec []string) bool {
+	for i := 0; i+1 < len(spec); i++ {
+		switch spec[i] {
+		case "-j", "-g":
+			if m.owner.owns(spec[i+1]) {
+				return true
+			}
+		case "--comment":
+			if m.owner.tagged(spec[i+1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func runIPTables(command string, args ...string) error {
+	out, err := exec.Command(command, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w, output: %s", command, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func isMissingRule(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "No chain/target/match by that name") ||
+		strings.Contains(msg, "does a matching rule exist")
+}
+
+func (m *IPTables) insertRule(rule *Rule) error {
+	args := []string{"-t", string(rule.Table), "-I", string(m.chain(rule))}
 	args = append(args, rule.Args()[2:]...) // Skip table flag
 
-	cmd := exec.Command("iptables", args...)
+	cmd := exec.Command(rule.Command(), args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s insert failed: %w, output: %s", rule.Command(), err, string(output))
+	}
+
+	return nil
+}
+
+func (m *IPTables) appendRule(rule *Rule) error {
+	args := []string{"-t", string(rule.Table), "-A", string(m.chain(rule))}
+	args = append(args, rule.Args()[2:]...)
+
+	cmd := exec.Command(rule.Command(), args...)
 	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("iptables insert failed: %w, output: %s", err, string(output))
+		return fmt.Errorf("%s append failed: %w, output: %s", rule.Command(), err, string(output))
 	}
 
 	return nil
 }
 
-func (m *Manager) deleteRule(rule *Rule) error {
-	args := []string{"-t", string(rule.Table), "-D", string(rule.Chain)}
+func (m *IPTables) deleteRule(rule *Rule) error {
+	args := []string{"-t", string(rule.Table), "-D", string(m.chain(rule))}
 	args = append(args, rule.Args()[2:]...)
 
-	cmd := exec.Command("iptables", args...)
+	cmd := exec.Command(rule.Command(), args...)
 	if output, err := cmd.CombinedOutput(); err != nil {
 		if strings.Contains(string(output), "No chain/target/match by that name") ||
 			strings.Contains(string(output), "does a matching rule exist") {
 			return nil
 		}
-		return fmt.Errorf("iptables delete failed: %w, output: %s", err, string(output))
+		return fmt.Errorf("%s delete failed: %w, output: %s", rule.Command(), err, string(output))
 	}
 
 	return nil
 }
 
-func (m *Manager) CheckRule(rule *Rule) (bool, error) {
-	args := []string{"-t", string(rule.Table), "-C", string(rule.Chain)}
+func (m *IPTables) CheckRule(rule *Rule) (bool, error) {
+	args := []string{"-t", string(rule.Table), "-C", string(m.chain(rule))}
 	args = append(args, rule.Args()[2:]...)
 
-	cmd := exec.Command("iptables", args...)
+	cmd := exec.Command(rule.Command(), args...)
 	if err := cmd.Run(); err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
 			return false, nil
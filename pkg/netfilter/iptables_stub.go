@@ -4,17 +4,24 @@ package netfilter
 
 import "fmt"
 
-type Manager struct {
+// IPTables is the Manager backend that runs iptables and ip6tables.
+type IPTables struct {
+	owner Owner
 	rules []*Rule
 }
 
-func NewManager() *Manager {
-	return &Manager{
+func NewIPTables(owner Owner) *IPTables {
+	return &IPTables{
+		owner: owner,
 		rules: make([]*Rule, 0),
 	}
 }
 
-func (m *Manager) AddRule(rule *Rule) error {
+func (m *IPTables) Backend() Backend {
+	return BackendIPTables
+}
+
+func (m *IPTables) AddRule(rule *Rule) error {
 	if err := rule.Validate(); err != nil {
 		return fmt.Errorf("invalid rule: %w", err)
 	}
@@ -23,15 +30,31 @@ func (m *Manager) AddRule(rule *Rule) error {
 	return nil
 }
 
-func (m *Manager) Apply() error {
+func (m *IPTables) Apply() error {
+	return fmt.Errorf("netfilter is only supported on Linux")
+}
+
+func (m *IPTables) Insert(rule *Rule) error {
+	return fmt.Errorf("netfilter is only supported on Linux")
+}
+
+func (m *IPTables) Append(rule *Rule) error {
+	return fmt.Errorf("netfilter is only supported on Linux")
+}
+
+func (m *IPTables) Delete(rule *Rule) error {
 	return fmt.Errorf("netfilter is only supported on Linux")
 }
 
-func (m *Manager) Remove() error {
+func (m *IPTables) Remove() error {
 	return fmt.Errorf("netfilter is only supported on Linux")
 }
 
-func (m *Manager) CheckRule(rule *Rule) (bool, error) {
+func (m *IPTables) Reset() (bool, error) {
+	return false, fmt.Errorf("netfilter is only supported on Linux")
+}
+
+func (m *IPTables) CheckRule(rule *Rule) (bool, error) {
 	return false, fmt.Errorf("netfilter is only supported on Linux")
 }
 
@@ -0,0 +1,98 @@
+package netfilter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Manager applies rules and tracks them so Remove can undo everything it
+// applied.
+type Manager interface {
+	// Insert places a rule before every rule already in its chain.
+	Insert(rule *Rule) error
+	// Append places a rule after every rule already in its chain.
+	Append(rule *Rule) error
+	Delete(rule *Rule) error
+	Remove() error
+	// Reset removes everything of the manager's owner from the host, such
+	// as what a killed process left behind, and reports whether there was
+	// anything to remove.
+	Reset() (bool, error)
+	Backend() Backend
+}
+
+// Owner names what a manager owns on the host, so that a later process can
+// find it again.
+type Owner struct {
+	// Table is the nftables table the manager replaces on every change.
+	Table string
+	// Chain is the iptables chain holding the rules, jumped to from the
+	// built-in chain they are written for. Rules for OUTPUT live in Chain
+	// itself and rules for other hooks in Chain suffixed with the hook,
+	// since a chain can only hold targets valid in every hook reaching it.
+	// Without Chain rules are placed in the built-in chains directly.
+	Chain string
+	// Tag is the first word of the comment of every rule of the owner.
+	// Reset removes tagged rules wherever they are.
+	Tag string
+}
+
+// chainFor returns the owned chain for rules written for a built-in chain.
+func (o Owner) chainFor(hook Chain) Chain {
+	if hook == ChainOutput {
+		return Chain(o.Chain)
+	}
+	return Chain(o.Chain + "-" + string(hook))
+}
+
+// owns reports whether an iptables chain is one of the owner's.
+func (o Owner) owns(chain string) bool {
+	return o.Chain != "" && (chain == o.Chain || strings.HasPrefix(chain, o.Chain+"-"))
+}
+
+// tagged reports whether a rule comment carries the owner's tag.
+func (o Owner) tagged(comment string) bool {
+	return o.Tag != "" && (comment == o.Tag || strings.HasPrefix(comment, o.Tag+" "))
+}
+
+type Backend string
+
+const (
+	// BackendAuto picks nftables on hosts without iptables or where iptables
+	// is the nft shim, and iptables otherwise.
+	BackendAuto     Backend = "auto"
+	BackendIPTables Backend = "iptables"
+	BackendNFTables Backend = "nftables"
+)
+
+func ParseBackend(s string) (Backend, error) {
+	switch b := Backend(s); b {
+	case "":
+		return BackendAuto, nil
+	case BackendAuto, BackendIPTables, BackendNFTables:
+		return b, nil
+	default:
+		return "", fmt.Errorf("unknown netfilter backend %q", s)
+	}
+}
+
+// NewManager returns a manager for the backend. Processes sharing a host
+// need distinct owners.
+func NewManager(backend Backend, owner Owner) (Manager, error) {
+	if backend == BackendAuto || backend == "" {
+		detected, err := DetectBackend()
+		if err != nil {
+			return nil, err
+		}
+		backend = detected
+	}
+
+	switch backend {
+	case BackendIPTables:
+		return NewIPTables(owner), nil
+	case BackendNFTables:
+		return NewNFTables(owner.Table), nil
+	default:
+		return nil, fmt.Errorf("unknown netfilter backend %q", backend)
+	}
+}
@@ -0,0 +1,177 @@
+package netfilter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// nftChain is the base chain standing in for an iptables table and chain.
+type nftChain struct {
+	Table Table
+	Chain Chain
+}
+
+func (c nftChain) name() string {
+	return strings.ToLower(string(c.Table) + "_" + string(c.Chain))
+}
+
+// spec returns the chain's type, hook and priority, matching where the
+// iptables chain sits in the kernel. MARK in mangle OUTPUT needs a route
+// chain so that marked packets are rerouted.
+func (c nftChain) spec() (string, error) {
+	hook := strings.ToLower(string(c.Chain))
+	typ, priority := "filter", 0
+
+	switch c.Table {
+	case TableFilter:
+	case TableRaw:
+		priority = -300
+	case TableMangle:
+		priority = -150
+		if c.Chain == ChainOutput {
+			typ = "route"
+		}
+	case TableNat:
+		typ, priority = "nat", -100
+		if c.Chain == ChainPostrouting || c.Chain == ChainInput {
+			priority = 100
+		}
+	default:
+		return "", fmt.Errorf("unsupported table %s", c.Table)
+	}
+
+	return fmt.Sprintf("type %s hook %s priority %d; policy accept;", typ, hook, priority), nil
+}
+
+// renderNFTables returns an nft script that atomically replaces the table
+// with the given chains. Declaring the table before deleting it makes the
+// script work whether or not the table exists; with no chains the table is
+// just removed.
+func renderNFTables(table string, chains map[nftChain][]*Rule) (string, error) {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "table inet %s\n", table)
+	fmt.Fprintf(&b, "delete table inet %s\n", table)
+
+	keys := make([]nftChain, 0, len(chains))
+	for c, rules := range chains {
+		if len(rules) > 0 {
+			keys = append(keys, c)
+		}
+	}
+	if len(keys) == 0 {
+		return b.String(), nil
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].name() < keys[j].name() })
+
+	fmt.Fprintf(&b, "table inet %s {\n", table)
+	for _, c := range keys {
+		spec, err := c.spec()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "\tchain %s {\n\t\t%s\n", c.name(), spec)
+		for _, rule := range chains[c] {
+			expr, err := rule.nftExpr()
+			if err != nil {
+				return "", fmt.Errorf("rule %s: %w", rule.String(), err)
+			}
+			fmt.Fprintf(&b, "\t\t%s\n", expr)
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+
+	return b.String(), nil
+}
+
+// nftExpr translates the rule to an nft rule in an inet table.
+func (r *Rule) nftExpr() (string, error) {
+	var parts []string
+
+	family := "ip"
+	if r.IPv6 {
+		family = "ip6"
+	}
+
+	switch r.Protocol {
+	case "", ProtocolAll:
+	case ProtocolTCP, ProtocolUDP:
+		parts = append(parts, "meta l4proto "+string(r.Protocol))
+	case ProtocolICMP:
+		if r.IPv6 {
+			parts = append(parts, "meta l4proto icmpv6")
+		} else {
+			parts = append(parts, "meta l4proto icmp")
+		}
+	default:
+		return "", fmt.Errorf("unsupported protocol %s", r.Protocol)
+	}
+
+	if r.InInterface != "" {
+		parts = append(parts, fmt.Sprintf("iifname %q", r.InInterface))
+	}
+	if r.Source != "" {
+		parts = append(parts, family+" saddr "+r.Source)
+	}
+	if r.Destination != "" {
+		parts = append(parts, family+" daddr "+r.Destination)
+	}
+	if r.SrcPort != "" {
+		parts = append(parts, fmt.Sprintf("%s sport %s", r.Protocol, nftPorts(r.SrcPort)))
+	}
+	if r.DstPort != "" {
+		parts = append(parts, fmt.Sprintf("%s dport %s", r.Protocol, nftPorts(r.DstPort)))
+	}
+	if r.MatchMark != "" {
+		parts = append(parts, "meta mark "+r.MatchMark)
+	}
+	if r.UIDOwner != "" {
+		parts = append(parts, "meta skuid "+r.UIDOwner)
+	}
+	if r.GIDOwner != "" {
+		parts = append(parts, "meta skgid "+r.GIDOwner)
+	}
+	if r.CgroupPath != "" {
+		// The level is the path's depth below the root.
+		level := strings.Count(r.CgroupPath, "/") + 1
+		parts = append(parts, fmt.Sprintf("socket cgroupv2 level %d %q", level, r.CgroupPath))
+	}
+
+	switch r.Target {
+	case TargetAccept, TargetDrop, TargetReject, TargetReturn, TargetMasquerade:
+		parts = append(parts, strings.ToLower(string(r.Target)))
+	case TargetRedirect:
+		parts = append(parts, "redirect to :"+r.ToPort)
+	case TargetMark:
+		parts = append(parts, "meta mark set "+r.Mark)
+	case TargetTProxy:
+		to := ":" + r.ToPort
+		if r.OnIP != "" {
+			to = r.OnIP + to
+			if r.IPv6 {
+				to = "[" + r.OnIP + "]:" + r.ToPort
+			}
+		}
+		parts = append(parts, fmt.Sprintf("tproxy %s to %s meta mark set %s accept", family, to, r.Mark))
+	default:
+		return "", fmt.Errorf("unsupported target %s", r.Target)
+	}
+
+	if r.Comment != "" {
+		parts = append(parts, fmt.Sprintf("comment %q", r.Comment))
+	}
+
+	return strings.Join(parts, " "), nil
+}
+
+// nftPorts converts iptables port syntax ("80,443,8000:8100") to an nft
+// value or anonymous set.
+func nftPorts(ports string) string {
+	ports = strings.ReplaceAll(ports, ":", "-")
+	if !strings.Contains(ports, ",") {
+		return ports
+	}
+	return "{ " + strings.ReplaceAll(ports, ",", ", ") + " }"
+}
@@ -0,0 +1,160 @@
+package netfilter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderNFTables(t *testing.T) {
+	exclude := NewRule().
+		Table(TableNat).
+		Chain(ChainOutput).
+		Destination("10.0.5.0/24").
+		Target(TargetReturn).
+		Comment("network-tunneler exclude").
+		MustBuild()
+	redirect := NewRule().
+		Table(TableNat).
+		Chain(ChainOutput).
+		Protocol(ProtocolTCP).
+		Destination("10.0.0.0/8").
+		DstPort("80,443,8000:8100").
+		Target(TargetRedirect).
+		ToPort("9999").
+		MustBuild()
+	mark := NewRule().
+		Table(TableMangle).
+		Chain(ChainOutput).
+		Protocol(ProtocolUDP).
+		Destination("fd00::/8").
+		Target(TargetMark).
+		Mark("0x2a").
+		MustBuild()
+	tproxy := NewRule().
+		Table(TableMangle).
+		Chain(ChainPrerouting).
+		Protocol(ProtocolUDP).
+		Destination("fd00::/8").
+		MatchMark("0x2a").
+		Target(TargetTProxy).
+		ToPort("9999").
+		OnIP("::1").
+		Mark("0x2a").
+		MustBuild()
+
+	script, err := renderNFTables("tunneler", map[nftChain][]*Rule{
+		{TableNat, ChainOutput}:        {exclude, redirect},
+		{TableMangle, ChainOutput}:     {mark},
+		{TableMangle, ChainPrerouting}: {tproxy},
+		{TableNat, ChainPostrouting}:   nil,
+		{TableFilter, ChainForward}:    {},
+	})
+	if err != nil {
+		t.Fatalf("renderNFTables failed: %v", err)
+	}
+
+	want := `table inet tunneler
+delete table inet tunneler
+table inet tunneler {
+	chain mangle_output {
+		type route hook output priority -150; policy accept;
+		meta l4proto udp ip6 daddr fd00::/8 meta mark set 0x2a
+	}
+	chain mangle_prerouting {
+		type filter hook prerouting priority -150; policy accept;
+		meta l4proto udp ip6 daddr fd00::/8 meta mark 0x2a tproxy ip6 to [::1]:9999 meta mark set 0x2a accept
+	}
+	chain nat_output {
+		type nat hook output priority -100; policy accept;
+		ip daddr 10.0.5.0/24 return comment "network-tunneler exclude"
+		meta l4proto tcp ip daddr 10.0.0.0/8 tcp dport { 80, 443, 8000-8100 } redirect to :9999
+	}
+}
+`
+	if script != want {
+		t.Errorf("unexpected script:\n%s\nwant:\n%s", script, want)
+	}
+
+	empty, err := renderNFTables("tunneler", nil)
+	if err != nil {
+		t.Fatalf("renderNFTables failed: %v", err)
+	}
+	if strings.Count(empty, "\n") != 2 || !strings.HasPrefix(empty, "table inet tunneler\ndelete table") {
+		t.Errorf("expected an empty ruleset to only delete the table, got:\n%s", empty)
+	}
+}
+
+func TestParseBackend(t *testing.T) {
+	for in, want := range map[string]Backend{"": BackendAuto, "auto": BackendAuto, "iptables": BackendIPTables, "nftables": BackendNFTables} {
+		if got, err := ParseBackend(in); err != nil || got != want {
+			t.Errorf("ParseBackend(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseBackend("ipfw"); err == nil {
+		t.Error("expected unknown backend to be rejected")
+	}
+}
+
+func TestNFTExpr_SocketOwner(t *testing.T) {
+	rule := NewRule().
+		Table(TableNat).
+		Chain(ChainOutput).
+		Protocol(ProtocolTCP).
+		Destination("10.0.0.0/8").
+		UIDOwner("1000-1999").
+		GIDOwner("developers").
+		CgroupPath("system.slice/app.service").
+		Target(TargetRedirect).
+		ToPort("9999").
+		MustBuild()
+
+	got, err := rule.nftExpr()
+	if err != nil {
+		t.Fatalf("nftExpr failed: %v", err)
+	}
+	want := `meta l4proto tcp ip daddr 10.0.0.0/8 meta skuid 1000-1999 meta skgid developers socket cgroupv2 level 2 "system.slice/app.service" redirect to :9999`
+	if got != want {
+		t.Errorf("nftExpr() = %q, want %q", got, want)
+	}
+}
+
+func TestOwner(t *testing.T) {
+	o := Owner{Chain: "NETWORK-TUNNELER", Tag: "network-tunneler"}
+
+	if got := o.chainFor(ChainOutput); got != "NETWORK-TUNNELER" {
+		t.Errorf("chainFor(OUTPUT) = %q", got)
+	}
+	if got := o.chainFor(ChainPrerouting); got != "NETWORK-TUNNELER-PREROUTING" {
+		t.Errorf("chainFor(PREROUTING) = %q", got)
+	}
+
+	for chain, want := range map[string]bool{"NETWORK-TUNNELER": true, "NETWORK-TUNNELER-PREROUTING": true, "NETWORK-TUNNELERS": false, "OUTPUT": false} {
+		if got := o.owns(chain); got != want {
+			t.Errorf("owns(%q) = %v, want %v", chain, got, want)
+		}
+	}
+	for comment, want := range map[string]bool{"network-tunneler": true, "network-tunneler exclude": true, "network-tunneler-proxy tun masquerade": false, "docker": false} {
+		if got := o.tagged(comment); got != want {
+			t.Errorf("tagged(%q) = %v, want %v", comment, got, want)
+		}
+	}
+
+	if (Owner{}).owns("") || (Owner{}).tagged("") {
+		t.Error("expected an empty owner to own nothing")
+	}
+}
+
+func TestSplitRuleSpec(t *testing.T) {
+	got, err := splitRuleSpec(`-A OUTPUT -d 10.0.0.0/8 -m comment --comment "network-tunneler \"TCP\" redirect" -j REDIRECT`)
+	if err != nil {
+		t.Fatalf("splitRuleSpec failed: %v", err)
+	}
+	want := []string{"-A", "OUTPUT", "-d", "10.0.0.0/8", "-m", "comment", "--comment", `network-tunneler "TCP" redirect`, "-j", "REDIRECT"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("splitRuleSpec() = %q, want %q", got, want)
+	}
+
+	if _, err := splitRuleSpec(`-A OUTPUT --comment "open`); err == nil {
+		t.Error("expected an unterminated quote to be rejected")
+	}
+}
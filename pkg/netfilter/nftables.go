@@ -0,0 +1,149 @@
+//go:build linux
+
+package netfilter
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// NFTables is the Manager backend for nftables. It owns one inet table
+// whose base chains mirror the iptables chains rules are written for, and
+// replaces the whole table with nft -f on every change, so the kernel never
+// sees a partial update.
+type NFTables struct {
+	table  string
+	chains map[nftChain][]*Rule
+}
+
+func NewNFTables(table string) *NFTables {
+	return &NFTables{
+		table:  table,
+		chains: make(map[nftChain][]*Rule),
+	}
+}
+
+func (m *NFTables) Backend() Backend {
+	return BackendNFTables
+}
+
+func (m *NFTables) Insert(rule *Rule) error {
+	return m.add(rule, true)
+}
+
+func (m *NFTables) Append(rule *Rule) error {
+	return m.add(rule, false)
+}
+
+func (m *NFTables) add(rule *Rule, first bool) error {
+	if err := rule.Validate(); err != nil {
+		return fmt.Errorf("invalid rule: %w", err)
+	}
+
+	c := nftChain{Table: rule.Table, Chain: rule.Chain}
+	prev := m.chains[c]
+
+	rules := make([]*Rule, 0, len(prev)+1)
+	if first {
+		rules = append(append(rules, rule), prev...)
+	} else {
+		rules = append(append(rules, prev...), rule)
+	}
+
+	m.chains[c] = rules
+	if err := m.apply(); err != nil {
+		m.chains[c] = prev
+		return fmt.Errorf("failed to apply rule %s: %w", rule.String(), err)
+	}
+	return nil
+}
+
+func (m *NFTables) Delete(rule *Rule) error {
+	c := nftChain{Table: rule.Table, Chain: rule.Chain}
+	prev := m.chains[c]
+
+	rules := make([]*Rule, 0, len(prev))
+	for _, r := range prev {
+		if r != rule {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == len(prev) {
+		return nil
+	}
+
+	m.chains[c] = rules
+	if err := m.apply(); err != nil {
+		m.chains[c] = prev
+		return fmt.Errorf("failed to remove rule %s: %w", rule.String(), err)
+	}
+	return nil
+}
+
+// Remove deletes the table and every rule in it.
+func (m *NFTables) Remove() error {
+	if len(m.chains) == 0 {
+		return nil
+	}
+
+	prev := m.chains
+	m.chains = make(map[nftChain][]*Rule)
+	if err := m.apply(); err != nil {
+		m.chains = prev
+		return fmt.Errorf("failed to remove table %s: %w", m.table, err)
+	}
+	return nil
+}
+
+// Reset deletes the table, whether or not this manager created it.
+func (m *NFTables) Reset() (bool, error) {
+	m.chains = make(map[nftChain][]*Rule)
+
+	if _, err := exec.LookPath("nft"); err != nil {
+		return false, nil
+	}
+	if err := exec.Command("nft", "list", "table", "inet", m.table).Run(); err != nil {
+		return false, nil
+	}
+
+	if err := m.apply(); err != nil {
+		return true, fmt.Errorf("failed to remove table %s: %w", m.table, err)
+	}
+	return true, nil
+}
+
+func (m *NFTables) apply() error {
+	script, err := renderNFTables(m.table, m.chains)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft failed: %w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// DetectBackend prefers iptables where it is the legacy binary and nftables
+// where iptables is missing or is the nft compatibility shim.
+func DetectBackend() (Backend, error) {
+	_, nftErr := exec.LookPath("nft")
+
+	if _, err := exec.LookPath("iptables"); err != nil {
+		if nftErr != nil {
+			return "", fmt.Errorf("neither iptables nor nft found in PATH")
+		}
+		return BackendNFTables, nil
+	}
+
+	if nftErr == nil {
+		out, err := exec.Command("iptables", "--version").CombinedOutput()
+		if err != nil || strings.Contains(string(out), "nf_tables") {
+			return BackendNFTables, nil
+		}
+	}
+	return BackendIPTables, nil
+}
@@ -0,0 +1,41 @@
+//go:build !linux
+
+package netfilter
+
+import "fmt"
+
+type NFTables struct {
+	table string
+}
+
+func NewNFTables(table string) *NFTables {
+	return &NFTables{table: table}
+}
+
+func (m *NFTables) Backend() Backend {
+	return BackendNFTables
+}
+
+func (m *NFTables) Insert(rule *Rule) error {
+	return fmt.Errorf("netfilter is only supported on Linux")
+}
+
+func (m *NFTables) Append(rule *Rule) error {
+	return fmt.Errorf("netfilter is only supported on Linux")
+}
+
+func (m *NFTables) Delete(rule *Rule) error {
+	return fmt.Errorf("netfilter is only supported on Linux")
+}
+
+func (m *NFTables) Remove() error {
+	return fmt.Errorf("netfilter is only supported on Linux")
+}
+
+func (m *NFTables) Reset() (bool, error) {
+	return false, fmt.Errorf("netfilter is only supported on Linux")
+}
+
+func DetectBackend() (Backend, error) {
+	return "", fmt.Errorf("netfilter is only supported on Linux")
+}
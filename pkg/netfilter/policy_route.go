@@ -0,0 +1,103 @@
+//go:build linux
+
+package netfilter
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// PolicyRoute delivers packets carrying Mark to the local stack through a
+// dedicated routing table. TPROXY needs it for locally generated traffic,
+// which only reaches PREROUTING after being looped back.
+type PolicyRoute struct {
+	Mark  int
+	Table int
+	// IPv6 manages the rule and route of the IPv6 routing policy instead.
+	IPv6 bool
+}
+
+func (p PolicyRoute) Add() error {
+	exists, err := p.ruleExists()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := p.runIP("rule", "add", "fwmark", p.mark(), "lookup", p.table()); err != nil {
+			return err
+		}
+	}
+
+	if err := p.runIP("route", "replace", "local", p.everything(), "dev", "lo", "table", p.table()); err != nil {
+		p.runIP("rule", "del", "fwmark", p.mark(), "lookup", p.table())
+		return err
+	}
+	return nil
+}
+
+func (p PolicyRoute) Delete() error {
+	var errs []string
+
+	if err := p.runIP("route", "del", "local", p.everything(), "dev", "lo", "table", p.table()); err != nil && !isMissing(err) {
+		errs = append(errs, err.Error())
+	}
+	if err := p.runIP("rule", "del", "fwmark", p.mark(), "lookup", p.table()); err != nil && !isMissing(err) {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to remove policy route: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (p PolicyRoute) ruleExists() (bool, error) {
+	out, err := exec.Command("ip", p.args("rule", "list", "fwmark", p.mark(), "lookup", p.table())...).CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("ip rule list failed: %w, output: %s", err, string(out))
+	}
+	return strings.TrimSpace(string(out)) != "", nil
+}
+
+func (p PolicyRoute) mark() string {
+	return fmt.Sprintf("%#x", p.Mark)
+}
+
+func (p PolicyRoute) table() string {
+	return strconv.Itoa(p.Table)
+}
+
+func (p PolicyRoute) everything() string {
+	if p.IPv6 {
+		return "::/0"
+	}
+	return "0.0.0.0/0"
+}
+
+// args selects the address family of an ip command.
+func (p PolicyRoute) args(args ...string) []string {
+	if p.IPv6 {
+		return append([]string{"-6"}, args...)
+	}
+	return args
+}
+
+func (p PolicyRoute) runIP(args ...string) error {
+	return runIP(p.args(args...)...)
+}
+
+func runIP(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s failed: %w, output: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func isMissing(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "No such process") || strings.Contains(msg, "No such file or directory") ||
+		strings.Contains(msg, "FIB table does not exist") || strings.Contains(msg, "Address family not supported")
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package netfilter
+
+import "fmt"
+
+type PolicyRoute struct {
+	Mark  int
+	Table int
+	IPv6  bool
+}
+
+func (p PolicyRoute) Add() error {
+	return fmt.Errorf("policy routing is only supported on Linux")
+}
+
+func (p PolicyRoute) Delete() error {
+	return fmt.Errorf("policy routing is only supported on Linux")
+}
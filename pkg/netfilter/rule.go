@@ -35,6 +35,8 @@ const (
 	TargetRedirect   Target = "REDIRECT"
 	TargetMasquerade Target = "MASQUERADE"
 	TargetReturn     Target = "RETURN"
+	TargetTProxy     Target = "TPROXY"
+	TargetMark       Target = "MARK"
 )
 
 type Protocol string
@@ -47,9 +49,11 @@ const (
 )
 
 type Rule struct {
-	Table       Table
-	Chain       Chain
-	Protocol    Protocol
+	Table    Table
+	Chain    Chain
+	Protocol Protocol
+	// InInterface matches the interface a packet arrived on.
+	InInterface string
 	Source      string
 	Destination string
 	SrcPort     string
@@ -57,6 +61,41 @@ type Rule struct {
 	Target      Target
 	ToPort      string
 	Comment     string
+
+	// MatchMark restricts the rule to packets carrying this fwmark.
+	MatchMark string
+	// UIDOwner and GIDOwner match the user and group, by name, ID or ID
+	// range, owning the sending socket; CgroupPath matches its cgroup v2
+	// path relative to the hierarchy root. Only locally generated packets
+	// have an owner.
+	UIDOwner   string
+	GIDOwner   string
+	CgroupPath string
+	// Mark is the value set by MARK and the --tproxy-mark of TPROXY.
+	Mark string
+	// OnIP is the address a TPROXY rule delivers to.
+	OnIP string
+	// IPv6 applies the rule with ip6tables. Build sets it when any address
+	// of the rule is IPv6.
+	IPv6 bool
+}
+
+// Command is the binary that manages the rule's address family.
+func (r *Rule) Command() string {
+	if r.IPv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+// hasIPv6Address reports whether any address of the rule is IPv6.
+func (r *Rule) hasIPv6Address() bool {
+	for _, addr := range []string{r.Source, r.Destination, r.OnIP} {
+		if addr != "" && isIPv6(addr) {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *Rule) Args() []string {
@@ -66,6 +105,10 @@ func (r *Rule) Args() []string {
 		args = append(args, "-p", string(r.Protocol))
 	}
 
+	if r.InInterface != "" {
+		args = append(args, "-i", r.InInterface)
+	}
+
 	if r.Source != "" {
 		args = append(args, "-s", r.Source)
 	}
@@ -74,12 +117,40 @@ func (r *Rule) Args() []string {
 		args = append(args, "-d", r.Destination)
 	}
 
-	if r.SrcPort != "" {
-		args = append(args, "--sport", r.SrcPort)
+	// Port lists need the multiport match; single ports and ranges do not.
+	if strings.Contains(r.SrcPort, ",") || strings.Contains(r.DstPort, ",") {
+		args = append(args, "-m", "multiport")
+		if r.SrcPort != "" {
+			args = append(args, "--sports", r.SrcPort)
+		}
+		if r.DstPort != "" {
+			args = append(args, "--dports", r.DstPort)
+		}
+	} else {
+		if r.SrcPort != "" {
+			args = append(args, "--sport", r.SrcPort)
+		}
+		if r.DstPort != "" {
+			args = append(args, "--dport", r.DstPort)
+		}
 	}
 
-	if r.DstPort != "" {
-		args = append(args, "--dport", r.DstPort)
+	if r.MatchMark != "" {
+		args = append(args, "-m", "mark", "--mark", r.MatchMark)
+	}
+
+	if r.UIDOwner != "" || r.GIDOwner != "" {
+		args = append(args, "-m", "owner")
+		if r.UIDOwner != "" {
+			args = append(args, "--uid-owner", r.UIDOwner)
+		}
+		if r.GIDOwner != "" {
+			args = append(args, "--gid-owner", r.GIDOwner)
+		}
+	}
+
+	if r.CgroupPath != "" {
+		args = append(args, "-m", "cgroup", "--path", r.CgroupPath)
 	}
 
 	if r.Comment != "" {
@@ -88,8 +159,19 @@ func (r *Rule) Args() []string {
 
 	args = append(args, "-j", string(r.Target))
 
-	if r.Target == TargetRedirect && r.ToPort != "" {
-		args = append(args, "--to-ports", r.ToPort)
+	switch r.Target {
+	case TargetRedirect:
+		if r.ToPort != "" {
+			args = append(args, "--to-ports", r.ToPort)
+		}
+	case TargetTProxy:
+		args = append(args, "--on-port", r.ToPort)
+		if r.OnIP != "" {
+			args = append(args, "--on-ip", r.OnIP)
+		}
+		args = append(args, "--tproxy-mark", r.Mark)
+	case TargetMark:
+		args = append(args, "--set-mark", r.Mark)
 	}
 
 	return args
@@ -101,10 +183,18 @@ func (r *Rule) String() string {
 	parts = append(parts, fmt.Sprintf("table=%s", r.Table))
 	parts = append(parts, fmt.Sprintf("chain=%s", r.Chain))
 
+	if r.IPv6 {
+		parts = append(parts, "family=ipv6")
+	}
+
 	if r.Protocol != "" {
 		parts = append(parts, fmt.Sprintf("proto=%s", r.Protocol))
 	}
 
+	if r.InInterface != "" {
+		parts = append(parts, fmt.Sprintf("in=%s", r.InInterface))
+	}
+
 	if r.Source != "" {
 		parts = append(parts, fmt.Sprintf("src=%s", r.Source))
 	}
@@ -121,12 +211,36 @@ func (r *Rule) String() string {
 		parts = append(parts, fmt.Sprintf("dport=%s", r.DstPort))
 	}
 
+	if r.MatchMark != "" {
+		parts = append(parts, fmt.Sprintf("mark=%s", r.MatchMark))
+	}
+
+	if r.UIDOwner != "" {
+		parts = append(parts, fmt.Sprintf("uid=%s", r.UIDOwner))
+	}
+
+	if r.GIDOwner != "" {
+		parts = append(parts, fmt.Sprintf("gid=%s", r.GIDOwner))
+	}
+
+	if r.CgroupPath != "" {
+		parts = append(parts, fmt.Sprintf("cgroup=%s", r.CgroupPath))
+	}
+
 	parts = append(parts, fmt.Sprintf("target=%s", r.Target))
 
 	if r.ToPort != "" {
 		parts = append(parts, fmt.Sprintf("toport=%s", r.ToPort))
 	}
 
+	if r.OnIP != "" {
+		parts = append(parts, fmt.Sprintf("onip=%s", r.OnIP))
+	}
+
+	if r.Mark != "" {
+		parts = append(parts, fmt.Sprintf("setmark=%s", r.Mark))
+	}
+
 	if r.Comment != "" {
 		parts = append(parts, fmt.Sprintf("comment=%q", r.Comment))
 	}
@@ -151,6 +265,52 @@ func (r *Rule) Validate() error {
 		return fmt.Errorf("REDIRECT target requires --to-ports")
 	}
 
+	if r.Target == TargetTProxy {
+		if r.Table != TableMangle || r.Chain != ChainPrerouting {
+			return fmt.Errorf("TPROXY target is only valid in mangle PREROUTING")
+		}
+		if r.ToPort == "" || r.Mark == "" {
+			return fmt.Errorf("TPROXY target requires --on-port and --tproxy-mark")
+		}
+		if r.OnIP != "" && net.ParseIP(r.OnIP) == nil {
+			return fmt.Errorf("invalid TPROXY address: %s", r.OnIP)
+		}
+	}
+
+	if r.InInterface != "" {
+		switch r.Chain {
+		case ChainPrerouting, ChainInput, ChainForward:
+		default:
+			return fmt.Errorf("input interface cannot be matched in %s", r.Chain)
+		}
+	}
+
+	if r.UIDOwner != "" || r.GIDOwner != "" || r.CgroupPath != "" {
+		switch r.Chain {
+		case ChainOutput, ChainPostrouting:
+		default:
+			return fmt.Errorf("socket owner cannot be matched in %s", r.Chain)
+		}
+	}
+
+	for _, owner := range []string{r.UIDOwner, r.GIDOwner} {
+		if owner != "" {
+			if err := ValidateOwner(owner); err != nil {
+				return err
+			}
+		}
+	}
+
+	if r.CgroupPath != "" {
+		if err := ValidateCgroupPath(r.CgroupPath); err != nil {
+			return err
+		}
+	}
+
+	if r.Target == TargetMark && r.Mark == "" {
+		return fmt.Errorf("MARK target requires --set-mark")
+	}
+
 	if (r.SrcPort != "" || r.DstPort != "") && r.Protocol == "" {
 		return fmt.Errorf("port specifications require protocol")
 	}
@@ -185,9 +345,102 @@ func (r *Rule) Validate() error {
 		}
 	}
 
+	for _, addr := range []string{r.Source, r.Destination, r.OnIP} {
+		if addr != "" && isIPv6(addr) != r.IPv6 {
+			return fmt.Errorf("address %s does not match the rule's address family", addr)
+		}
+	}
+
+	return nil
+}
+
+// ValidateOwner accepts a user or group name, a numeric ID or an ID range
+// like "1000-1999".
+func ValidateOwner(owner string) error {
+	if owner == "" || len(owner) > 32 {
+		return fmt.Errorf("invalid owner: %q", owner)
+	}
+	if lo, hi, isRange := strings.Cut(owner, "-"); isRange {
+		first, err1 := strconv.ParseUint(lo, 10, 32)
+		last, err2 := strconv.ParseUint(hi, 10, 32)
+		if err1 == nil && err2 == nil {
+			if first > last {
+				return fmt.Errorf("invalid owner ID range: %s", owner)
+			}
+			return nil
+		}
+	}
+	if _, err := strconv.ParseUint(owner, 10, 32); err == nil {
+		return nil
+	}
+	for i, c := range owner {
+		letter := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if !letter && (i == 0 || (c != '-' && c != '.' && (c < '0' || c > '9'))) {
+			return fmt.Errorf("invalid owner: %q", owner)
+		}
+	}
+	return nil
+}
+
+// ValidateCgroupPath accepts a cgroup v2 path relative to the root of the
+// hierarchy, like "system.slice/app.service".
+func ValidateCgroupPath(path string) error {
+	if path == "" || strings.HasPrefix(path, "/") || strings.HasSuffix(path, "/") {
+		return fmt.Errorf("cgroup path must be relative and non-empty: %q", path)
+	}
+	if strings.ContainsAny(path, " \t\"'") || strings.Contains(path, "//") {
+		return fmt.Errorf("invalid cgroup path: %q", path)
+	}
+	for _, part := range strings.Split(path, "/") {
+		if part == "." || part == ".." {
+			return fmt.Errorf("invalid cgroup path: %q", path)
+		}
+	}
 	return nil
 }
 
+// splitRuleSpec splits a rule as printed by iptables -S, which quotes
+// arguments containing spaces and escapes quotes inside them.
+func splitRuleSpec(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg, quoted := false, false
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(line):
+			i++
+			arg.WriteByte(line[i])
+		case c == '"':
+			quoted, inArg = !quoted, true
+		case (c == ' ' || c == '\t') && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteByte(c)
+			inArg = true
+		}
+	}
+
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// isIPv6 reports whether an address or CIDR, already validated, is IPv6.
+func isIPv6(addr string) bool {
+	ip, _, _ := strings.Cut(addr, "/")
+	return strings.Contains(ip, ":")
+}
+
 func validateCIDR(cidr string) error {
 	if strings.Contains(cidr, "/") {
 		_, _, err := net.ParseCIDR(cidr)
@@ -205,11 +458,35 @@ func validateCIDR(cidr string) error {
 	return nil
 }
 
+// maxMultiportEntries is the multiport match limit; a range counts twice.
+const maxMultiportEntries = 15
+
 func validatePort(port string) error {
 	if port == "" {
 		return nil
 	}
 
+	if strings.Contains(port, ",") {
+		entries := 0
+		for _, p := range strings.Split(port, ",") {
+			if err := validatePortRange(p); err != nil {
+				return err
+			}
+			entries++
+			if strings.Contains(p, ":") {
+				entries++
+			}
+		}
+		if entries > maxMultiportEntries {
+			return fmt.Errorf("too many ports in %s: multiport allows %d entries", port, maxMultiportEntries)
+		}
+		return nil
+	}
+
+	return validatePortRange(port)
+}
+
+func validatePortRange(port string) error {
 	if strings.Contains(port, ":") {
 		parts := strings.Split(port, ":")
 		if len(parts) != 2 {
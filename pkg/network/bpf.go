@@ -0,0 +1,287 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Instruction classes, sizes and operations of the eBPF instruction set,
+// as far as the programs in this package use them.
+const (
+	bpfLD    = 0x00
+	bpfLDX   = 0x01
+	bpfST    = 0x02
+	bpfSTX   = 0x03
+	bpfALU   = 0x04
+	bpfJMP   = 0x05
+	bpfALU64 = 0x07
+
+	bpfW  = 0x00
+	bpfH  = 0x08
+	bpfDW = 0x18
+
+	bpfIMM = 0x00
+	bpfMEM = 0x60
+
+	bpfK = 0x00
+	bpfX = 0x08
+
+	bpfADD  = 0x00
+	bpfMOV  = 0xb0
+	bpfEND  = 0xd0
+	bpfToBE = 0x08
+
+	bpfJA   = 0x00
+	bpfJEQ  = 0x10
+	bpfJGT  = 0x20
+	bpfJNE  = 0x50
+	bpfJLT  = 0xa0
+	bpfJLE  = 0xb0
+	bpfCALL = 0x80
+	bpfEXIT = 0x90
+)
+
+// Helper functions called by the programs.
+const (
+	bpfFuncMapLookupElem   = 1
+	bpfFuncMapUpdateElem   = 2
+	bpfFuncGetSocketCookie = 46
+)
+
+// Registers: r0 holds return values, r1-r5 arguments (clobbered by calls),
+// r6-r9 survive calls and r10 is the read-only frame pointer.
+const (
+	r0 = iota
+	r1
+	r2
+	r3
+	r4
+	r5
+	r6
+	r7
+	r8
+	r9
+	r10
+)
+
+type bpfInsn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+// bpfAsm assembles a program, resolving jumps to labels once it is
+// complete.
+type bpfAsm struct {
+	insns  []bpfInsn
+	labels map[string]int
+	jumps  map[int]string
+}
+
+func newBPFAsm() *bpfAsm {
+	return &bpfAsm{labels: make(map[string]int), jumps: make(map[int]string)}
+}
+
+func (a *bpfAsm) emit(code uint8, dst, src int, off int16, imm int32) {
+	a.insns = append(a.insns, bpfInsn{code: code, regs: uint8(src<<4 | dst), off: off, imm: imm})
+}
+
+func (a *bpfAsm) label(name string) {
+	a.labels[name] = len(a.insns)
+}
+
+func (a *bpfAsm) movReg(dst, src int)     { a.emit(bpfALU64|bpfMOV|bpfX, dst, src, 0, 0) }
+func (a *bpfAsm) movImm(dst int, v int32) { a.emit(bpfALU64|bpfMOV|bpfK, dst, 0, 0, v) }
+func (a *bpfAsm) addImm(dst int, v int32) { a.emit(bpfALU64|bpfADD|bpfK, dst, 0, 0, v) }
+
+// movImm32 loads v zero-extended rather than sign-extended.
+func (a *bpfAsm) movImm32(dst int, v int32) { a.emit(bpfALU|bpfMOV|bpfK, dst, 0, 0, v) }
+
+// be16 converts the low 16 bits of dst between network and host order.
+func (a *bpfAsm) be16(dst int) { a.emit(bpfALU|bpfEND|bpfToBE, dst, 0, 0, 16) }
+
+func (a *bpfAsm) ldxw(dst, src int, off int16)      { a.emit(bpfLDX|bpfMEM|bpfW, dst, src, off, 0) }
+func (a *bpfAsm) ldxh(dst, src int, off int16)      { a.emit(bpfLDX|bpfMEM|bpfH, dst, src, off, 0) }
+func (a *bpfAsm) stxw(dst int, off int16, src int)  { a.emit(bpfSTX|bpfMEM|bpfW, dst, src, off, 0) }
+func (a *bpfAsm) stxdw(dst int, off int16, src int) { a.emit(bpfSTX|bpfMEM|bpfDW, dst, src, off, 0) }
+func (a *bpfAsm) stw(dst int, off int16, v int32)   { a.emit(bpfST|bpfMEM|bpfW, dst, 0, off, v) }
+
+// ldMap loads the address of a map into dst; it takes two instructions.
+func (a *bpfAsm) ldMap(dst, fd int) {
+	a.emit(bpfLD|bpfIMM|bpfDW, dst, unix.BPF_PSEUDO_MAP_FD, 0, int32(fd))
+	a.emit(0, 0, 0, 0, 0)
+}
+
+func (a *bpfAsm) jmp(op uint8, dst int, v int32, target string) {
+	a.jumps[len(a.insns)] = target
+	a.emit(bpfJMP|op|bpfK, dst, 0, 0, v)
+}
+
+func (a *bpfAsm) jmpReg(op uint8, dst, src int, target string) {
+	a.jumps[len(a.insns)] = target
+	a.emit(bpfJMP|op|bpfX, dst, src, 0, 0)
+}
+
+func (a *bpfAsm) ja(target string) { a.jmp(bpfJA, 0, 0, target) }
+
+func (a *bpfAsm) call(fn int32) { a.emit(bpfJMP|bpfCALL, 0, 0, 0, fn) }
+func (a *bpfAsm) exit()         { a.emit(bpfJMP|bpfEXIT, 0, 0, 0, 0) }
+
+func (a *bpfAsm) assemble() ([]bpfInsn, error) {
+	for i, target := range a.jumps {
+		pos, ok := a.labels[target]
+		if !ok {
+			return nil, fmt.Errorf("undefined label %q", target)
+		}
+		a.insns[i].off = int16(pos - i - 1)
+	}
+	return a.insns, nil
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+type bpfMapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	flags      uint32
+}
+
+func bpfMapCreate(mapType, keySize, valueSize, maxEntries, flags uint32) (int, error) {
+	attr := bpfMapCreateAttr{
+		mapType:    mapType,
+		keySize:    keySize,
+		valueSize:  valueSize,
+		maxEntries: maxEntries,
+		flags:      flags,
+	}
+	fd, err := bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("failed to create BPF map: %w", err)
+	}
+	return fd, nil
+}
+
+type bpfMapElemAttr struct {
+	mapFD uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+func bpfMapElem(cmd, fd int, key, value []byte, flags uint64) error {
+	attr := bpfMapElemAttr{
+		mapFD: uint32(fd),
+		key:   uint64(uintptr(unsafe.Pointer(&key[0]))),
+		flags: flags,
+	}
+	if value != nil {
+		attr.value = uint64(uintptr(unsafe.Pointer(&value[0])))
+	}
+	_, err := bpf(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+func bpfMapUpdate(fd int, key, value []byte) error {
+	return bpfMapElem(unix.BPF_MAP_UPDATE_ELEM, fd, key, value, unix.BPF_ANY)
+}
+
+func bpfMapLookup(fd int, key, value []byte) error {
+	return bpfMapElem(unix.BPF_MAP_LOOKUP_ELEM, fd, key, value, 0)
+}
+
+// bpfMapDelete ignores missing keys.
+func bpfMapDelete(fd int, key []byte) error {
+	if err := bpfMapElem(unix.BPF_MAP_DELETE_ELEM, fd, key, nil, 0); err != nil && !errors.Is(err, unix.ENOENT) {
+		return err
+	}
+	return nil
+}
+
+type bpfProgLoadAttr struct {
+	progType           uint32
+	insnCnt            uint32
+	insns              uint64
+	license            uint64
+	logLevel           uint32
+	logSize            uint32
+	logBuf             uint64
+	kernVersion        uint32
+	progFlags          uint32
+	progName           [unix.BPF_OBJ_NAME_LEN]byte
+	progIfindex        uint32
+	expectedAttachType uint32
+}
+
+// bpfProgLoad loads a program, retrying with the verifier log enabled if it
+// is rejected so the error says why.
+func bpfProgLoad(progType, attachType uint32, name string, insns []bpfInsn) (int, error) {
+	license := []byte("Dual MIT/GPL\x00")
+	attr := bpfProgLoadAttr{
+		progType:           progType,
+		insnCnt:            uint32(len(insns)),
+		insns:              uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:            uint64(uintptr(unsafe.Pointer(&license[0]))),
+		expectedAttachType: attachType,
+	}
+	copy(attr.progName[:unix.BPF_OBJ_NAME_LEN-1], name)
+
+	fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil && !errors.Is(err, unix.EPERM) {
+		log := make([]byte, 64*1024)
+		attr.logLevel = 1
+		attr.logSize = uint32(len(log))
+		attr.logBuf = uint64(uintptr(unsafe.Pointer(&log[0])))
+		fd, err = bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		if msg := strings.TrimSpace(unix.ByteSliceToString(log)); err != nil && msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		runtime.KeepAlive(log)
+	}
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	if err != nil {
+		return -1, fmt.Errorf("failed to load BPF program %s: %w", name, err)
+	}
+	return fd, nil
+}
+
+type bpfLinkCreateAttr struct {
+	progFD     uint32
+	targetFD   uint32
+	attachType uint32
+	flags      uint32
+}
+
+// bpfLinkCreate attaches a program through a link, which detaches it once
+// the link's last descriptor is closed, including when the process dies.
+func bpfLinkCreate(progFD, targetFD int, attachType uint32) (int, error) {
+	attr := bpfLinkCreateAttr{
+		progFD:     uint32(progFD),
+		targetFD:   uint32(targetFD),
+		attachType: attachType,
+	}
+	fd, err := bpf(unix.BPF_LINK_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("failed to attach BPF program: %w", err)
+	}
+	return fd, nil
+}
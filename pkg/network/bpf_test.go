@@ -0,0 +1,79 @@
+//go:build linux
+
+package network
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestBPFAsm_ResolvesLabels(t *testing.T) {
+	a := newBPFAsm()
+	a.label("top")
+	a.movImm(r0, 0)                 // 0
+	a.jmp(bpfJEQ, r1, 7, "out")     // 1
+	a.jmpReg(bpfJGT, r2, r3, "top") // 2
+	a.ja("out")                     // 3
+	a.addImm(r0, 1)                 // 4
+	a.label("out")
+	a.exit() // 5
+
+	insns, err := a.assemble()
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+
+	// Offsets count from the instruction after the jump.
+	for i, want := range map[int]int16{1: 3, 2: -3, 3: 1} {
+		if insns[i].off != want {
+			t.Errorf("insn %d: offset %d, want %d", i, insns[i].off, want)
+		}
+	}
+
+	if jeq := insns[1]; jeq.code != bpfJMP|bpfJEQ|bpfK || jeq.regs != r1 || jeq.imm != 7 {
+		t.Errorf("unexpected JEQ %+v", jeq)
+	}
+	if jgt := insns[2]; jgt.code != bpfJMP|bpfJGT|bpfX || jgt.regs != r3<<4|r2 {
+		t.Errorf("unexpected JGT %+v", jgt)
+	}
+}
+
+func TestBPFAsm_UndefinedLabel(t *testing.T) {
+	a := newBPFAsm()
+	a.ja("missing")
+	a.exit()
+
+	if _, err := a.assemble(); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("expected undefined label error, got %v", err)
+	}
+}
+
+func TestBPFAsm_LdMap(t *testing.T) {
+	a := newBPFAsm()
+	a.ldMap(r1, 42)
+	a.ja("end")
+	a.label("end")
+	a.exit()
+
+	insns, err := a.assemble()
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	if len(insns) != 4 {
+		t.Fatalf("expected 4 instructions, got %d", len(insns))
+	}
+
+	// A 64-bit immediate load spans two slots, both counted by jumps.
+	ld := insns[0]
+	if ld.code != bpfLD|bpfIMM|bpfDW || ld.regs != unix.BPF_PSEUDO_MAP_FD<<4|r1 || ld.imm != 42 {
+		t.Errorf("unexpected map load %+v", ld)
+	}
+	if insns[1] != (bpfInsn{}) {
+		t.Errorf("expected an empty second slot, got %+v", insns[1])
+	}
+	if insns[2].off != 0 {
+		t.Errorf("expected the jump to fall through, got offset %d", insns[2].off)
+	}
+}
@@ -50,33 +50,45 @@ func CalculateIPChecksum(ipHeader []byte) uint16 {
 // +--------+--------+--------+--------+
 // |  zero  |  PTCL  |    TCP Length   |  (4 bytes)
 // +--------+--------+--------+--------+
+//
+// RFC 8200 §8.1 - the IPv6 pseudo header (40 bytes) carries both 16 byte
+// addresses, a 32-bit upper-layer length and the next header value.
 type pseudoHeader struct {
-	SrcIP    [4]byte
-	DstIP    [4]byte
+	SrcIP    net.IP
+	DstIP    net.IP
 	Zero     uint8
 	Protocol uint8
 	Length   uint16
 }
 
 func (ph *pseudoHeader) Serialize() []byte {
-	buf := make([]byte, 12)
-	copy(buf[0:4], ph.SrcIP[:])
-	copy(buf[4:8], ph.DstIP[:])
-	buf[8] = ph.Zero
-	buf[9] = ph.Protocol
-	binary.BigEndian.PutUint16(buf[10:12], ph.Length)
+	src4, dst4 := ph.SrcIP.To4(), ph.DstIP.To4()
+	if src4 != nil && dst4 != nil {
+		buf := make([]byte, 12)
+		copy(buf[0:4], src4)
+		copy(buf[4:8], dst4)
+		buf[8] = ph.Zero
+		buf[9] = ph.Protocol
+		binary.BigEndian.PutUint16(buf[10:12], ph.Length)
+		return buf
+	}
+
+	buf := make([]byte, 40)
+	copy(buf[0:16], ph.SrcIP.To16())
+	copy(buf[16:32], ph.DstIP.To16())
+	binary.BigEndian.PutUint32(buf[32:36], uint32(ph.Length))
+	buf[39] = ph.Protocol
 	return buf
 }
 
 func newPseudoHeader(srcIP, dstIP net.IP, protocol uint8, length uint16) *pseudoHeader {
-	ph := &pseudoHeader{
+	return &pseudoHeader{
+		SrcIP:    srcIP,
+		DstIP:    dstIP,
 		Zero:     0,
 		Protocol: protocol,
 		Length:   length,
 	}
-	copy(ph.SrcIP[:], srcIP.To4())
-	copy(ph.DstIP[:], dstIP.To4())
-	return ph
 }
 
 func CalculateTCPChecksum(srcIP, dstIP net.IP, tcpSegment []byte) uint16 {
@@ -109,7 +121,12 @@ func CalculateUDPChecksum(srcIP, dstIP net.IP, udpSegment []byte) uint16 {
 	return checksum
 }
 
+// RecalculateIPChecksum is a no-op for IPv6, which has no header checksum.
 func (p *IPPacket) RecalculateIPChecksum() {
+	if p.Version == 6 {
+		return
+	}
+
 	header := make([]byte, p.HeaderLen)
 	header[0] = (p.Version << 4) | (p.HeaderLen / 4)
 	header[1] = p.TOS
@@ -113,6 +113,33 @@ func TestCalculateTCPChecksum(t *testing.T) {
 	}
 }
 
+func TestCalculateTCPChecksum_IPv6(t *testing.T) {
+	srcIP := net.ParseIP("fd00::1")
+	dstIP := net.ParseIP("fd00::2")
+
+	tcpSegment := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcpSegment[0:2], 8080)
+	binary.BigEndian.PutUint16(tcpSegment[2:4], 80)
+	tcpSegment[12] = 0x50
+	tcpSegment[13] = uint8(FlagSYN)
+
+	checksum := CalculateTCPChecksum(srcIP, dstIP, tcpSegment)
+	binary.BigEndian.PutUint16(tcpSegment[16:18], checksum)
+
+	// RFC 8200 §8.1 pseudo header: addresses, 32-bit length, 3 zero bytes
+	// and the next header.
+	pseudoHeader := make([]byte, 40)
+	copy(pseudoHeader[0:16], srcIP)
+	copy(pseudoHeader[16:32], dstIP)
+	binary.BigEndian.PutUint32(pseudoHeader[32:36], uint32(len(tcpSegment)))
+	pseudoHeader[39] = uint8(ProtocolTCP)
+
+	verification := CalculateChecksum(append(pseudoHeader, tcpSegment...))
+	if verification != 0xffff && verification != 0x0000 {
+		t.Errorf("TCP checksum verification failed: got 0x%04x, want 0xffff or 0x0000", verification)
+	}
+}
+
 func TestCalculateUDPChecksum(t *testing.T) {
 	srcIP := net.ParseIP("10.0.0.1").To4()
 	dstIP := net.ParseIP("10.0.0.2").To4()
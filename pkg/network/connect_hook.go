@@ -0,0 +1,476 @@
+//go:build linux
+
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// MaxPortRules is how many port rules a connect hook holds per prefix.
+const MaxPortRules = 8
+
+// PortRule decides what happens to connects to a prefix whose port lies in
+// [First, Last]: they are intercepted, or left alone if Intercept is false.
+// The first matching rule of a prefix wins; a connect no rule matches is
+// left alone.
+type PortRule struct {
+	First, Last uint16
+	Intercept   bool
+}
+
+// ConnectHook intercepts TCP connects of the processes in a set of cgroups
+// with eBPF programs on the cgroup connect4 and connect6 hooks. A connect
+// to an intercepted destination is rewritten to the local listener and its
+// original destination stored under the socket's cookie, where
+// OriginalDest finds it once the listener has accepted the connection.
+//
+// The programs are attached through links, so they are detached when the
+// hook is closed or its process dies; nothing is left behind.
+type ConnectHook struct {
+	policy4 int
+	policy6 int
+	origins int
+	fds     []int
+}
+
+// Offsets into struct bpf_sock_addr, the context of connect hooks.
+const (
+	sockAddrUserIP4  = 4
+	sockAddrUserIP6  = 8
+	sockAddrUserPort = 24
+	sockAddrType     = 32
+)
+
+const (
+	policyMaxEntries  = 4096
+	originsMaxEntries = 65536
+
+	// policyValueSize is a rule count followed by MaxPortRules entries of
+	// first port, last port and action.
+	policyValueSize = 4 + 8*MaxPortRules
+	// originValueSize is the family, the port in network order and the
+	// address of an original destination.
+	originValueSize = 24
+)
+
+// NewConnectHook loads the programs and attaches them to every cgroup,
+// given as cgroup v2 directories. Intercepted connects go to port on the
+// loopback address of their family; IPv4 destinations connected through
+// an IPv6 socket go to ::ffff:127.0.0.1.
+func NewConnectHook(cgroups []string, port uint16) (hook *ConnectHook, err error) {
+	if len(cgroups) == 0 {
+		return nil, fmt.Errorf("connect hook needs at least one cgroup")
+	}
+
+	h := &ConnectHook{policy4: -1, policy6: -1, origins: -1}
+	defer func() {
+		if err != nil {
+			h.Close()
+		}
+	}()
+
+	if h.policy4, err = h.newMap(unix.BPF_MAP_TYPE_LPM_TRIE, 4+4, policyValueSize, policyMaxEntries, unix.BPF_F_NO_PREALLOC); err != nil {
+		return nil, err
+	}
+	if h.policy6, err = h.newMap(unix.BPF_MAP_TYPE_LPM_TRIE, 4+16, policyValueSize, policyMaxEntries, unix.BPF_F_NO_PREALLOC); err != nil {
+		return nil, err
+	}
+	// Entries of connections the listener never picks up are evicted.
+	if h.origins, err = h.newMap(unix.BPF_MAP_TYPE_LRU_HASH, 8, originValueSize, originsMaxEntries, 0); err != nil {
+		return nil, err
+	}
+
+	var progs []int
+	for _, ipv6 := range []bool{false, true} {
+		policy, attachType, name := h.policy4, uint32(unix.BPF_CGROUP_INET4_CONNECT), "nt_connect4"
+		if ipv6 {
+			policy, attachType, name = h.policy6, unix.BPF_CGROUP_INET6_CONNECT, "nt_connect6"
+		}
+		insns, err := connectProgram(ipv6, policy, h.origins, port)
+		if err != nil {
+			return nil, err
+		}
+		prog, err := bpfProgLoad(unix.BPF_PROG_TYPE_CGROUP_SOCK_ADDR, attachType, name, insns)
+		if err != nil {
+			return nil, err
+		}
+		h.fds = append(h.fds, prog)
+		progs = append(progs, prog)
+	}
+
+	for _, cgroup := range cgroups {
+		dir, err := unix.Open(cgroup, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open cgroup %s: %w", cgroup, err)
+		}
+		for i, attachType := range []uint32{unix.BPF_CGROUP_INET4_CONNECT, unix.BPF_CGROUP_INET6_CONNECT} {
+			link, linkErr := bpfLinkCreate(progs[i], dir, attachType)
+			if linkErr != nil {
+				unix.Close(dir)
+				return nil, fmt.Errorf("cgroup %s: %w", cgroup, linkErr)
+			}
+			h.fds = append(h.fds, link)
+		}
+		unix.Close(dir)
+	}
+
+	return h, nil
+}
+
+func (h *ConnectHook) newMap(mapType, keySize, valueSize, maxEntries, flags uint32) (int, error) {
+	fd, err := bpfMapCreate(mapType, keySize, valueSize, maxEntries, flags)
+	if err != nil {
+		return -1, err
+	}
+	h.fds = append(h.fds, fd)
+	return fd, nil
+}
+
+// SetRules replaces the port rules of prefix. An IPv4 prefix also covers
+// its IPv4-mapped IPv6 addresses.
+func (h *ConnectHook) SetRules(prefix netip.Prefix, rules []PortRule) error {
+	if len(rules) > MaxPortRules {
+		return fmt.Errorf("%s has %d port rules, at most %d are supported", prefix, len(rules), MaxPortRules)
+	}
+
+	value := policyValue(rules)
+	for _, k := range h.policyKeys(prefix) {
+		if err := bpfMapUpdate(k.fd, k.key, value); err != nil {
+			return fmt.Errorf("failed to set rules of %s: %w", prefix, err)
+		}
+	}
+	return nil
+}
+
+// policyValue encodes rules the way the programs read them, all in host
+// order.
+func policyValue(rules []PortRule) []byte {
+	value := make([]byte, policyValueSize)
+	binary.NativeEndian.PutUint32(value, uint32(len(rules)))
+	for i, r := range rules {
+		entry := value[4+8*i:]
+		binary.NativeEndian.PutUint16(entry, r.First)
+		binary.NativeEndian.PutUint16(entry[2:], r.Last)
+		if r.Intercept {
+			binary.NativeEndian.PutUint32(entry[4:], 1)
+		}
+	}
+	return value
+}
+
+// DeleteRules removes the rules of prefix, if it has any.
+func (h *ConnectHook) DeleteRules(prefix netip.Prefix) error {
+	for _, k := range h.policyKeys(prefix) {
+		if err := bpfMapDelete(k.fd, k.key); err != nil {
+			return fmt.Errorf("failed to delete rules of %s: %w", prefix, err)
+		}
+	}
+	return nil
+}
+
+type policyKey struct {
+	fd  int
+	key []byte
+}
+
+// policyKeys returns the LPM trie keys of prefix: the prefix length in host
+// order followed by the address.
+func (h *ConnectHook) policyKeys(prefix netip.Prefix) []policyKey {
+	key := func(bits int, addr []byte) []byte {
+		k := binary.NativeEndian.AppendUint32(nil, uint32(bits))
+		return append(k, addr...)
+	}
+
+	prefix = prefix.Masked()
+	if prefix.Addr().Is6() {
+		addr := prefix.Addr().As16()
+		return []policyKey{{h.policy6, key(prefix.Bits(), addr[:])}}
+	}
+
+	addr4 := prefix.Addr().As4()
+	mapped := prefix.Addr().As16()
+	return []policyKey{
+		{h.policy4, key(prefix.Bits(), addr4[:])},
+		{h.policy6, key(96+prefix.Bits(), mapped[:])},
+	}
+}
+
+// OriginalDest returns the destination a connection accepted from the hook's
+// listener was made to. The cookie the destination is stored under belongs
+// to the connecting socket, which is found through sock_diag.
+func (h *ConnectHook) OriginalDest(conn net.Conn) (string, error) {
+	local, err := netip.ParseAddrPort(conn.LocalAddr().String())
+	if err != nil {
+		return "", fmt.Errorf("failed to parse local address: %w", err)
+	}
+	remote, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return "", fmt.Errorf("failed to parse remote address: %w", err)
+	}
+	local = netip.AddrPortFrom(local.Addr().Unmap(), local.Port())
+	remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
+
+	cookie, err := socketCookie(remote, local)
+	if err != nil {
+		return "", fmt.Errorf("failed to find connecting socket of %s: %w", remote, err)
+	}
+
+	key := binary.NativeEndian.AppendUint64(nil, cookie)
+	value := make([]byte, originValueSize)
+	if err := bpfMapLookup(h.origins, key, value); err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return "", fmt.Errorf("connection from %s was not redirected by the connect hook", remote)
+		}
+		return "", fmt.Errorf("failed to look up original destination: %w", err)
+	}
+	bpfMapDelete(h.origins, key)
+
+	return decodeOrigin(value).String(), nil
+}
+
+// decodeOrigin reads an original destination stored by the programs.
+func decodeOrigin(value []byte) netip.AddrPort {
+	// The port was copied as the program read it: a network order u16 in
+	// a host order u32.
+	port := binary.BigEndian.Uint16(binary.NativeEndian.AppendUint16(nil, uint16(binary.NativeEndian.Uint32(value[4:]))))
+	var addr netip.Addr
+	if binary.NativeEndian.Uint32(value) == unix.AF_INET {
+		addr = netip.AddrFrom4([4]byte(value[8:12]))
+	} else {
+		addr = netip.AddrFrom16([16]byte(value[8:24])).Unmap()
+	}
+	return netip.AddrPortFrom(addr, port)
+}
+
+// Close detaches the programs and releases the maps.
+func (h *ConnectHook) Close() error {
+	var errs []error
+	for i := len(h.fds) - 1; i >= 0; i-- {
+		if err := unix.Close(h.fds[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	h.fds = nil
+	return errors.Join(errs...)
+}
+
+// connectProgram builds the program of one connect hook. For a SOCK_STREAM
+// connect it looks the destination up in the policy trie, walks the port
+// rules of the longest matching prefix and, if one intercepts, stores the
+// original destination under the socket cookie and rewrites the connect to
+// the loopback listener.
+func connectProgram(ipv6 bool, policy, origins int, port uint16) ([]bpfInsn, error) {
+	native32 := func(b [4]byte) int32 { return int32(binary.NativeEndian.Uint32(b[:])) }
+	loopback4 := native32([4]byte{127, 0, 0, 1})
+	var portBytes [2]byte
+	binary.BigEndian.PutUint16(portBytes[:], port)
+	listenPort := int32(binary.NativeEndian.Uint16(portBytes[:]))
+
+	a := newBPFAsm()
+	a.movReg(r6, r1)
+	a.ldxw(r2, r6, sockAddrType)
+	a.jmp(bpfJNE, r2, unix.SOCK_STREAM, "allow")
+
+	// Policy key: prefix length and destination address.
+	keyOff := int16(-8)
+	if ipv6 {
+		keyOff = -20
+		a.stw(r10, keyOff, 128)
+		for i := int16(0); i < 4; i++ {
+			a.ldxw(r2, r6, sockAddrUserIP6+4*i)
+			a.stxw(r10, keyOff+4+4*i, r2)
+		}
+	} else {
+		a.stw(r10, keyOff, 32)
+		a.ldxw(r2, r6, sockAddrUserIP4)
+		a.stxw(r10, keyOff+4, r2)
+	}
+	a.ldMap(r1, policy)
+	a.movReg(r2, r10)
+	a.addImm(r2, int32(keyOff))
+	a.call(bpfFuncMapLookupElem)
+	a.jmp(bpfJEQ, r0, 0, "allow")
+
+	// r7: port rules, r8: destination port, r9: rule count.
+	a.movReg(r7, r0)
+	a.ldxw(r8, r6, sockAddrUserPort)
+	a.be16(r8)
+	a.ldxw(r9, r7, 0)
+	for i := 0; i < MaxPortRules; i++ {
+		next := fmt.Sprintf("rule%d", i+1)
+		off := int16(4 + 8*i)
+		a.jmp(bpfJLE, r9, int32(i), "allow")
+		a.ldxh(r2, r7, off)
+		a.jmpReg(bpfJLT, r8, r2, next)
+		a.ldxh(r2, r7, off+2)
+		a.jmpReg(bpfJGT, r8, r2, next)
+		a.ldxw(r2, r7, off+4)
+		a.jmp(bpfJEQ, r2, 0, "allow")
+		a.ja("redirect")
+		a.label(next)
+	}
+	a.ja("allow")
+
+	// Origin: cookie at fp-56, value of family, port and address at fp-48.
+	a.label("redirect")
+	a.movReg(r1, r6)
+	a.call(bpfFuncGetSocketCookie)
+	a.stxdw(r10, -56, r0)
+	if ipv6 {
+		a.stw(r10, -48, unix.AF_INET6)
+	} else {
+		a.stw(r10, -48, unix.AF_INET)
+	}
+	a.ldxw(r2, r6, sockAddrUserPort)
+	a.stxw(r10, -44, r2)
+	for i := int16(0); i < 4; i++ {
+		switch {
+		case ipv6:
+			a.ldxw(r2, r6, sockAddrUserIP6+4*i)
+			a.stxw(r10, -40+4*i, r2)
+		case i == 0:
+			a.ldxw(r2, r6, sockAddrUserIP4)
+			a.stxw(r10, -40, r2)
+		default:
+			a.stw(r10, -40+4*i, 0)
+		}
+	}
+	a.ldMap(r1, origins)
+	a.movReg(r2, r10)
+	a.addImm(r2, -56)
+	a.movReg(r3, r10)
+	a.addImm(r3, -48)
+	a.movImm(r4, unix.BPF_ANY)
+	a.call(bpfFuncMapUpdateElem)
+
+	if ipv6 {
+		// IPv4-mapped destinations keep their prefix.
+		a.ldxw(r2, r6, sockAddrUserIP6)
+		a.jmp(bpfJNE, r2, 0, "loopback6")
+		a.ldxw(r2, r6, sockAddrUserIP6+4)
+		a.jmp(bpfJNE, r2, 0, "loopback6")
+		a.ldxw(r2, r6, sockAddrUserIP6+8)
+		a.movImm32(r3, native32([4]byte{0, 0, 0xff, 0xff}))
+		a.jmpReg(bpfJNE, r2, r3, "loopback6")
+		a.movImm(r2, loopback4)
+		a.stxw(r6, sockAddrUserIP6+12, r2)
+		a.ja("port")
+
+		a.label("loopback6")
+		a.movImm(r2, 0)
+		a.stxw(r6, sockAddrUserIP6, r2)
+		a.stxw(r6, sockAddrUserIP6+4, r2)
+		a.stxw(r6, sockAddrUserIP6+8, r2)
+		a.movImm(r2, native32([4]byte{0, 0, 0, 1}))
+		a.stxw(r6, sockAddrUserIP6+12, r2)
+		a.label("port")
+	} else {
+		a.movImm(r2, loopback4)
+		a.stxw(r6, sockAddrUserIP4, r2)
+	}
+	a.movImm(r2, listenPort)
+	a.stxw(r6, sockAddrUserPort, r2)
+
+	a.label("allow")
+	a.movImm(r0, 1)
+	a.exit()
+
+	return a.assemble()
+}
+
+// socketCookie returns the cookie of the local TCP socket bound to src and
+// connected to dst.
+func socketCookie(src, dst netip.AddrPort) (uint64, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open sock_diag socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	family := uint8(unix.AF_INET)
+	if src.Addr().Is6() {
+		family = unix.AF_INET6
+	}
+
+	// struct nlmsghdr followed by struct inet_diag_req_v2, looking up one
+	// socket by its addresses in any state.
+	req := make([]byte, unix.NLMSG_HDRLEN+56)
+	binary.NativeEndian.PutUint32(req[0:], uint32(len(req)))
+	binary.NativeEndian.PutUint16(req[4:], unix.SOCK_DIAG_BY_FAMILY)
+	binary.NativeEndian.PutUint16(req[6:], unix.NLM_F_REQUEST)
+	body := req[unix.NLMSG_HDRLEN:]
+	body[0] = family
+	body[1] = unix.IPPROTO_TCP
+	binary.NativeEndian.PutUint32(body[4:], 0xffffffff)
+	binary.BigEndian.PutUint16(body[8:], src.Port())
+	binary.BigEndian.PutUint16(body[10:], dst.Port())
+	copy(body[12:28], src.Addr().AsSlice())
+	copy(body[28:44], dst.Addr().AsSlice())
+	binary.NativeEndian.PutUint64(body[48:], 0xffffffffffffffff)
+
+	if err := unix.Sendto(fd, req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return 0, fmt.Errorf("sock_diag request failed: %w", err)
+	}
+
+	buf := make([]byte, 4096)
+	n, _, err := unix.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return 0, fmt.Errorf("sock_diag response failed: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return 0, fmt.Errorf("invalid sock_diag response: %w", err)
+	}
+	for _, m := range msgs {
+		switch m.Header.Type {
+		case unix.NLMSG_ERROR:
+			if len(m.Data) >= 4 {
+				if errno := -int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+					return 0, unix.Errno(errno)
+				}
+			}
+		case unix.SOCK_DIAG_BY_FAMILY:
+			// struct inet_diag_msg: the cookie ends the socket ID.
+			if len(m.Data) >= 52 {
+				lo := binary.NativeEndian.Uint32(m.Data[44:])
+				hi := binary.NativeEndian.Uint32(m.Data[48:])
+				return uint64(hi)<<32 | uint64(lo), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no socket in sock_diag response")
+}
+
+// CgroupRoot returns where the cgroup v2 hierarchy is mounted.
+func CgroupRoot() (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", fmt.Errorf("failed to read mounts: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Optional fields end with "-", followed by the filesystem type.
+		fields := strings.Fields(scanner.Text())
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) && fields[i+1] == "cgroup2" && len(fields) > 4 {
+				return fields[4], nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read mounts: %w", err)
+	}
+	return "", fmt.Errorf("no cgroup v2 hierarchy is mounted")
+}
@@ -0,0 +1,42 @@
+//go:build !linux
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+const MaxPortRules = 8
+
+type PortRule struct {
+	First, Last uint16
+	Intercept   bool
+}
+
+type ConnectHook struct{}
+
+func NewConnectHook(cgroups []string, port uint16) (*ConnectHook, error) {
+	return nil, fmt.Errorf("eBPF connect hooks are not supported on this platform (Linux only)")
+}
+
+func (h *ConnectHook) SetRules(prefix netip.Prefix, rules []PortRule) error {
+	return fmt.Errorf("eBPF connect hooks are not supported on this platform (Linux only)")
+}
+
+func (h *ConnectHook) DeleteRules(prefix netip.Prefix) error {
+	return fmt.Errorf("eBPF connect hooks are not supported on this platform (Linux only)")
+}
+
+func (h *ConnectHook) OriginalDest(conn net.Conn) (string, error) {
+	return "", fmt.Errorf("eBPF connect hooks are not supported on this platform (Linux only)")
+}
+
+func (h *ConnectHook) Close() error {
+	return nil
+}
+
+func CgroupRoot() (string, error) {
+	return "", fmt.Errorf("cgroups are not supported on this platform (Linux only)")
+}
@@ -0,0 +1,243 @@
+//go:build linux
+
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestPolicyValue(t *testing.T) {
+	value := policyValue([]PortRule{
+		{First: 22, Last: 22},
+		{First: 0, Last: 65535, Intercept: true},
+	})
+	if len(value) != policyValueSize {
+		t.Fatalf("value is %d bytes, want %d", len(value), policyValueSize)
+	}
+
+	u16 := func(off int) uint16 { return binary.NativeEndian.Uint16(value[off:]) }
+	u32 := func(off int) uint32 { return binary.NativeEndian.Uint32(value[off:]) }
+	if u32(0) != 2 {
+		t.Errorf("rule count %d, want 2", u32(0))
+	}
+	if u16(4) != 22 || u16(6) != 22 || u32(8) != 0 {
+		t.Errorf("unexpected first rule % x", value[4:12])
+	}
+	if u16(12) != 0 || u16(14) != 65535 || u32(16) != 1 {
+		t.Errorf("unexpected second rule % x", value[12:20])
+	}
+	if !bytes.Equal(value[20:], make([]byte, policyValueSize-20)) {
+		t.Error("expected unused rules to be zero")
+	}
+}
+
+func TestConnectHook_PolicyKeys(t *testing.T) {
+	h := &ConnectHook{policy4: 4, policy6: 6}
+
+	keys := h.policyKeys(netip.MustParsePrefix("10.1.2.3/16"))
+	if len(keys) != 2 {
+		t.Fatalf("expected an IPv4 and a mapped IPv6 key, got %d", len(keys))
+	}
+	want4 := append(binary.NativeEndian.AppendUint32(nil, 16), 10, 1, 0, 0)
+	if keys[0].fd != 4 || !bytes.Equal(keys[0].key, want4) {
+		t.Errorf("unexpected IPv4 key %d % x", keys[0].fd, keys[0].key)
+	}
+	mapped := netip.MustParseAddr("::ffff:10.1.0.0").As16()
+	want6 := append(binary.NativeEndian.AppendUint32(nil, 112), mapped[:]...)
+	if keys[1].fd != 6 || !bytes.Equal(keys[1].key, want6) {
+		t.Errorf("unexpected mapped key %d % x", keys[1].fd, keys[1].key)
+	}
+
+	keys = h.policyKeys(netip.MustParsePrefix("fd00::/8"))
+	if len(keys) != 1 || keys[0].fd != 6 || binary.NativeEndian.Uint32(keys[0].key) != 8 || keys[0].key[4] != 0xfd {
+		t.Errorf("unexpected IPv6 keys %+v", keys)
+	}
+}
+
+// originValue lays out a destination as the program stores it: the port is
+// the network order u16 of bpf_sock_addr copied as a host order u32.
+func originValue(family uint32, addr []byte, port uint16) []byte {
+	value := make([]byte, originValueSize)
+	binary.NativeEndian.PutUint32(value, family)
+	binary.BigEndian.PutUint16(value[4:], port)
+	copy(value[8:], addr)
+	return value
+}
+
+func TestDecodeOrigin(t *testing.T) {
+	tests := []struct {
+		name  string
+		value []byte
+		want  string
+	}{
+		{"ipv4", originValue(unix.AF_INET, []byte{10, 1, 2, 3}, 8080), "10.1.2.3:8080"},
+		{"ipv6", originValue(unix.AF_INET6, netip.MustParseAddr("fd00::1").AsSlice(), 443), "[fd00::1]:443"},
+		{"mapped", originValue(unix.AF_INET6, netip.MustParseAddr("::ffff:10.0.0.1").AsSlice(), 22), "10.0.0.1:22"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodeOrigin(tt.value).String(); got != tt.want {
+				t.Errorf("decodeOrigin = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSocketCookie(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer lis.Close()
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	accepted, err := lis.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %v", err)
+	}
+	defer accepted.Close()
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn failed: %v", err)
+	}
+	var want uint64
+	var sockErr error
+	raw.Control(func(fd uintptr) {
+		want, sockErr = unix.GetsockoptUint64(int(fd), unix.SOL_SOCKET, unix.SO_COOKIE)
+	})
+	if sockErr != nil {
+		t.Skipf("SO_COOKIE unavailable: %v", sockErr)
+	}
+
+	src := netip.MustParseAddrPort(conn.LocalAddr().String())
+	dst := netip.MustParseAddrPort(conn.RemoteAddr().String())
+	got, err := socketCookie(src, dst)
+	if err != nil {
+		t.Fatalf("socketCookie failed: %v", err)
+	}
+	if got != want {
+		t.Errorf("cookie %d, want %d", got, want)
+	}
+
+	// The accepted end has the addresses the other way round.
+	if other, err := socketCookie(dst, src); err != nil || other == want {
+		t.Errorf("expected the accepted socket's own cookie, got %d (%v)", other, err)
+	}
+}
+
+// joinCgroup moves the test process into dir and returns a function that
+// moves it back.
+func joinCgroup(t *testing.T, root, dir string) func() {
+	t.Helper()
+
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		t.Fatalf("failed to read cgroup: %v", err)
+	}
+	defer f.Close()
+
+	var current string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if path, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			current = filepath.Join(root, path)
+		}
+	}
+	if current == "" {
+		t.Skip("process is not in a cgroup v2 hierarchy")
+	}
+
+	pid := []byte(strconv.Itoa(os.Getpid()))
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.procs"), pid, 0644); err != nil {
+		t.Skipf("cannot join cgroup: %v", err)
+	}
+	return func() {
+		if err := os.WriteFile(filepath.Join(current, "cgroup.procs"), pid, 0644); err != nil {
+			t.Errorf("failed to leave cgroup: %v", err)
+		}
+	}
+}
+
+func TestConnectHook_RedirectsConnect(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("loading eBPF programs requires root")
+	}
+	root, err := CgroupRoot()
+	if err != nil {
+		t.Skip(err)
+	}
+	dir, err := os.MkdirTemp(root, "network-tunneler-test-")
+	if err != nil {
+		t.Skipf("cannot create cgroup: %v", err)
+	}
+	defer os.Remove(dir)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer lis.Close()
+	port := uint16(lis.Addr().(*net.TCPAddr).Port)
+
+	hook, err := NewConnectHook([]string{dir}, port)
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EINVAL) {
+		t.Skipf("eBPF connect hooks unavailable: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("NewConnectHook failed: %v", err)
+	}
+	defer hook.Close()
+
+	if err := hook.SetRules(netip.MustParsePrefix("127.0.0.2/32"), []PortRule{
+		{First: 22, Last: 22},
+		{First: 0, Last: 65535, Intercept: true},
+	}); err != nil {
+		t.Fatalf("SetRules failed: %v", err)
+	}
+
+	leave := joinCgroup(t, root, dir)
+	conn, err := net.Dial("tcp", "127.0.0.2:9")
+	leave()
+	if err != nil {
+		t.Fatalf("intercepted dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	accepted, err := lis.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %v", err)
+	}
+	defer accepted.Close()
+
+	dest, err := hook.OriginalDest(accepted)
+	if err != nil {
+		t.Fatalf("OriginalDest failed: %v", err)
+	}
+	if dest != "127.0.0.2:9" {
+		t.Errorf("original destination %s, want 127.0.0.2:9", dest)
+	}
+	if _, err := hook.OriginalDest(accepted); err == nil {
+		t.Error("expected the origin to be consumed by the first lookup")
+	}
+
+	if err := hook.DeleteRules(netip.MustParsePrefix("127.0.0.2/32")); err != nil {
+		t.Errorf("DeleteRules failed: %v", err)
+	}
+}
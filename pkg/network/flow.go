@@ -0,0 +1,139 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+const (
+	icmpEchoReply   = 0
+	icmpEchoRequest = 8
+)
+
+// Flow is the addressing of an IPv4 packet as seen by NAT. ICMP echo
+// messages carry their identifier in both ports; other protocols without
+// ports leave them zero.
+type Flow struct {
+	Protocol IPProtocol
+	Src      netip.Addr
+	Dst      netip.Addr
+	SrcPort  uint16
+	DstPort  uint16
+}
+
+func (f Flow) String() string {
+	return fmt.Sprintf("%d %s:%d -> %s:%d", f.Protocol, f.Src, f.SrcPort, f.Dst, f.DstPort)
+}
+
+// HasPorts reports whether the flow's ports can be rewritten.
+func (f Flow) HasPorts() bool {
+	return f.SrcPort != 0 || f.DstPort != 0
+}
+
+// ParseFlow reads the addressing of a raw IPv4 packet. Fragments are
+// rejected because only the first one carries the transport header.
+func ParseFlow(data []byte) (Flow, error) {
+	hl, err := ipv4HeaderLen(data)
+	if err != nil {
+		return Flow{}, err
+	}
+	if binary.BigEndian.Uint16(data[6:8])&0x3FFF != 0 {
+		return Flow{}, fmt.Errorf("fragmented packets are not supported")
+	}
+
+	f := Flow{
+		Protocol: IPProtocol(data[9]),
+		Src:      netip.AddrFrom4([4]byte(data[12:16])),
+		Dst:      netip.AddrFrom4([4]byte(data[16:20])),
+	}
+
+	l4 := data[hl:]
+	switch f.Protocol {
+	case ProtocolTCP, ProtocolUDP:
+		if len(l4) < 4 {
+			return Flow{}, fmt.Errorf("payload too small to extract ports")
+		}
+		f.SrcPort = binary.BigEndian.Uint16(l4[0:2])
+		f.DstPort = binary.BigEndian.Uint16(l4[2:4])
+	case ProtocolICMP:
+		if isICMPEcho(l4) {
+			f.SrcPort = binary.BigEndian.Uint16(l4[4:6])
+			f.DstPort = f.SrcPort
+		}
+	}
+
+	return f, nil
+}
+
+// SetSource rewrites the source address, and the source port when the flow
+// has ports, and fixes the IP and transport checksums in place.
+func SetSource(data []byte, addr netip.Addr, port uint16) error {
+	return rewrite(data, 12, 0, addr, port)
+}
+
+// SetDestination is SetSource for the destination.
+func SetDestination(data []byte, addr netip.Addr, port uint16) error {
+	return rewrite(data, 16, 2, addr, port)
+}
+
+func rewrite(data []byte, addrOff, portOff int, addr netip.Addr, port uint16) error {
+	if !addr.Is4() {
+		return fmt.Errorf("address %s is not IPv4", addr)
+	}
+	hl, err := ipv4HeaderLen(data)
+	if err != nil {
+		return err
+	}
+
+	a := addr.As4()
+	copy(data[addrOff:addrOff+4], a[:])
+
+	l4 := data[hl:]
+	switch IPProtocol(data[9]) {
+	case ProtocolTCP:
+		if len(l4) < 20 {
+			return fmt.Errorf("payload too small for TCP header: %d bytes", len(l4))
+		}
+		binary.BigEndian.PutUint16(l4[portOff:portOff+2], port)
+		binary.BigEndian.PutUint16(l4[16:18], CalculateTCPChecksum(data[12:16], data[16:20], l4))
+	case ProtocolUDP:
+		if len(l4) < 8 {
+			return fmt.Errorf("payload too small for UDP header: %d bytes", len(l4))
+		}
+		binary.BigEndian.PutUint16(l4[portOff:portOff+2], port)
+		// A zero checksum means the sender did not compute one.
+		if binary.BigEndian.Uint16(l4[6:8]) != 0 {
+			binary.BigEndian.PutUint16(l4[6:8], CalculateUDPChecksum(data[12:16], data[16:20], l4))
+		}
+	case ProtocolICMP:
+		if isICMPEcho(l4) {
+			binary.BigEndian.PutUint16(l4[4:6], port)
+			l4[2], l4[3] = 0, 0
+			binary.BigEndian.PutUint16(l4[2:4], CalculateChecksum(l4))
+		}
+	}
+
+	binary.BigEndian.PutUint16(data[10:12], CalculateIPChecksum(data[:hl]))
+	return nil
+}
+
+// ipv4HeaderLen validates the IPv4 header of a whole packet, as read from a
+// TUN device, and returns its length.
+func ipv4HeaderLen(data []byte) (int, error) {
+	if len(data) < 20 {
+		return 0, fmt.Errorf("packet too small for IP header: %d bytes", len(data))
+	}
+	if v := data[0] >> 4; v != 4 {
+		return 0, fmt.Errorf("unsupported IP version: %d", v)
+	}
+	hl := int(data[0]&0x0F) * 4
+	if hl < 20 || len(data) < hl {
+		return 0, fmt.Errorf("invalid IP header length: %d", hl)
+	}
+	return hl, nil
+}
+
+func isICMPEcho(l4 []byte) bool {
+	return len(l4) >= 8 && (l4[0] == icmpEchoRequest || l4[0] == icmpEchoReply)
+}
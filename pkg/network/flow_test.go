@@ -0,0 +1,90 @@
+package network
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+func buildUDPPacket(src, dst netip.AddrPort, payload []byte) []byte {
+	pkt := make([]byte, 28+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = byte(ProtocolUDP)
+	s, d := src.Addr().As4(), dst.Addr().As4()
+	copy(pkt[12:16], s[:])
+	copy(pkt[16:20], d[:])
+
+	udp := pkt[20:]
+	binary.BigEndian.PutUint16(udp[0:2], src.Port())
+	binary.BigEndian.PutUint16(udp[2:4], dst.Port())
+	binary.BigEndian.PutUint16(udp[4:6], uint16(len(udp)))
+	copy(udp[8:], payload)
+	binary.BigEndian.PutUint16(udp[6:8], CalculateUDPChecksum(pkt[12:16], pkt[16:20], udp))
+	binary.BigEndian.PutUint16(pkt[10:12], CalculateIPChecksum(pkt[:20]))
+	return pkt
+}
+
+func TestSetSource_RewritesFlowAndChecksums(t *testing.T) {
+	pkt := buildUDPPacket(
+		netip.MustParseAddrPort("198.18.0.1:40000"),
+		netip.MustParseAddrPort("10.0.0.5:53"),
+		[]byte("query"),
+	)
+
+	if err := SetSource(pkt, netip.MustParseAddr("10.254.0.2"), 20000); err != nil {
+		t.Fatalf("SetSource failed: %v", err)
+	}
+
+	flow, err := ParseFlow(pkt)
+	if err != nil {
+		t.Fatalf("ParseFlow failed: %v", err)
+	}
+	if flow.Src.String() != "10.254.0.2" || flow.SrcPort != 20000 {
+		t.Errorf("unexpected source %s:%d", flow.Src, flow.SrcPort)
+	}
+	if flow.Dst.String() != "10.0.0.5" || flow.DstPort != 53 {
+		t.Errorf("destination changed: %s:%d", flow.Dst, flow.DstPort)
+	}
+
+	if got := CalculateIPChecksum(pkt[:20]); got != binary.BigEndian.Uint16(pkt[10:12]) {
+		t.Errorf("IP checksum %#x, want %#x", binary.BigEndian.Uint16(pkt[10:12]), got)
+	}
+	if got := CalculateUDPChecksum(pkt[12:16], pkt[16:20], pkt[20:]); got != binary.BigEndian.Uint16(pkt[26:28]) {
+		t.Errorf("UDP checksum %#x, want %#x", binary.BigEndian.Uint16(pkt[26:28]), got)
+	}
+}
+
+func TestParseFlow_ICMPEchoAndFragments(t *testing.T) {
+	pkt := make([]byte, 28)
+	pkt[0] = 0x45
+	pkt[9] = byte(ProtocolICMP)
+	copy(pkt[12:16], []byte{198, 18, 0, 1})
+	copy(pkt[16:20], []byte{10, 0, 0, 5})
+	pkt[20] = icmpEchoRequest
+	binary.BigEndian.PutUint16(pkt[24:26], 0x1234)
+
+	flow, err := ParseFlow(pkt)
+	if err != nil {
+		t.Fatalf("ParseFlow failed: %v", err)
+	}
+	if flow.SrcPort != 0x1234 || flow.DstPort != 0x1234 {
+		t.Errorf("expected echo identifier in both ports, got %d/%d", flow.SrcPort, flow.DstPort)
+	}
+
+	if err := SetDestination(pkt, netip.MustParseAddr("198.18.0.9"), 0x4321); err != nil {
+		t.Fatalf("SetDestination failed: %v", err)
+	}
+	if id := binary.BigEndian.Uint16(pkt[24:26]); id != 0x4321 {
+		t.Errorf("expected rewritten identifier, got %#x", id)
+	}
+	if CalculateChecksum(pkt[20:]) != 0 {
+		t.Error("ICMP checksum does not verify")
+	}
+
+	binary.BigEndian.PutUint16(pkt[6:8], 0x2000) // more fragments
+	if _, err := ParseFlow(pkt); err == nil {
+		t.Error("expected fragments to be rejected")
+	}
+}
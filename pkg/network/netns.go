@@ -0,0 +1,141 @@
+//go:build linux
+
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Namespace is a named network namespace, managed like `ip netns` does so
+// it shows up in `ip netns list` and can be removed with `ip netns delete`.
+type Namespace struct {
+	name string
+	file *os.File
+}
+
+// CreateNamespace adds a network namespace with its loopback interface up.
+func CreateNamespace(name string) (*Namespace, error) {
+	if err := runIP("netns", "add", name); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filepath.Join("/run/netns", name))
+	if err != nil {
+		runIP("netns", "delete", name)
+		return nil, fmt.Errorf("failed to open network namespace %s: %w", name, err)
+	}
+
+	ns := &Namespace{name: name, file: file}
+	if err := ns.Do(func() error { return runIP("link", "set", "lo", "up") }); err != nil {
+		ns.Delete()
+		return nil, err
+	}
+	return ns, nil
+}
+
+// ListNamespaces returns the names of the named network namespaces.
+func ListNamespaces() ([]string, error) {
+	out, err := exec.Command("ip", "netns", "list").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ip netns list failed: %w, output: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	var names []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// Lines look like "name (id: 0)".
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			names = append(names, fields[0])
+		}
+	}
+	return names, nil
+}
+
+// DeleteNamespace removes a named network namespace. Interfaces inside it
+// are destroyed, and so is the host end of a veth pair.
+func DeleteNamespace(name string) error {
+	return runIP("netns", "delete", name)
+}
+
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+// Do runs fn on a thread switched into the namespace. Sockets fn opens and
+// processes it starts belong to the namespace; goroutines it starts do not.
+func (ns *Namespace) Do(fn func() error) error {
+	runtime.LockOSThread()
+
+	host, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to open current network namespace: %w", err)
+	}
+	defer host.Close()
+
+	if err := unix.Setns(int(ns.file.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter network namespace %s: %w", ns.name, err)
+	}
+
+	fnErr := fn()
+
+	if err := unix.Setns(int(host.Fd()), unix.CLONE_NEWNET); err != nil {
+		// The thread stays locked, so the runtime drops it with the
+		// goroutine instead of reusing it in the wrong namespace.
+		return errors.Join(fnErr, fmt.Errorf("failed to leave network namespace %s: %w", ns.name, err))
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
+
+// AddVeth connects the namespace to the host with a veth pair: hostName
+// with hostAddr on the host, eth0 with peerAddr inside the namespace, where
+// it carries the default routes.
+func (ns *Namespace) AddVeth(hostName string, hostAddr, peerAddr netip.Prefix) error {
+	if err := runIP("link", "add", hostName, "type", "veth", "peer", "name", "eth0", "netns", ns.name); err != nil {
+		return err
+	}
+	if err := runIP("addr", "add", hostAddr.String(), "dev", hostName); err != nil {
+		return err
+	}
+	if err := runIP("link", "set", hostName, "up"); err != nil {
+		return err
+	}
+
+	return ns.Do(func() error {
+		if err := runIP("addr", "add", peerAddr.String(), "dev", "eth0"); err != nil {
+			return err
+		}
+		if err := runIP("link", "set", "eth0", "up"); err != nil {
+			return err
+		}
+		if err := runIP("route", "add", "default", "via", hostAddr.Addr().String(), "dev", "eth0"); err != nil {
+			return err
+		}
+		// IPv6 needs no addresses: link-local ones are enough to route
+		// into the interception rules. Without IPv6 in the kernel there
+		// is nothing to route.
+		if err := runIP("-6", "route", "add", "default", "dev", "eth0"); err != nil && !strings.Contains(err.Error(), "not supported") {
+			return err
+		}
+		return nil
+	})
+}
+
+// Delete removes the namespace.
+func (ns *Namespace) Delete() error {
+	ns.file.Close()
+	return DeleteNamespace(ns.name)
+}
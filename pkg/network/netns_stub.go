@@ -0,0 +1,34 @@
+//go:build !linux
+
+package network
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+type Namespace struct{}
+
+func CreateNamespace(name string) (*Namespace, error) {
+	return nil, fmt.Errorf("network namespaces are not supported on this platform (Linux only)")
+}
+
+func ListNamespaces() ([]string, error) {
+	return nil, fmt.Errorf("network namespaces are not supported on this platform (Linux only)")
+}
+
+func DeleteNamespace(name string) error {
+	return fmt.Errorf("network namespaces are not supported on this platform (Linux only)")
+}
+
+func (ns *Namespace) Name() string { return "" }
+
+func (ns *Namespace) Do(fn func() error) error {
+	return fmt.Errorf("network namespaces are not supported on this platform (Linux only)")
+}
+
+func (ns *Namespace) AddVeth(hostName string, hostAddr, peerAddr netip.Prefix) error {
+	return fmt.Errorf("network namespaces are not supported on this platform (Linux only)")
+}
+
+func (ns *Namespace) Delete() error { return nil }
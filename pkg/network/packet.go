@@ -12,8 +12,12 @@ const (
 	ProtocolICMP IPProtocol = 1
 	ProtocolTCP  IPProtocol = 6
 	ProtocolUDP  IPProtocol = 17
+	// ProtocolICMPv6 is the next header value of ICMP for IPv6.
+	ProtocolICMPv6 IPProtocol = 58
 )
 
+const ipv6HeaderLen = 40
+
 type TCPFlags uint8
 
 const (
@@ -40,6 +44,10 @@ type IPPacket struct {
 	DstIP      net.IP
 	Options    []byte
 	Payload    []byte
+	// FlowLabel is only used by IPv6. For IPv6 packets TOS holds the traffic
+	// class, TTL the hop limit and Protocol the next header of the fixed
+	// header; extension headers are left at the front of the payload.
+	FlowLabel uint32
 }
 
 type TCPPacket struct {
@@ -63,7 +71,11 @@ func ParseIPPacket(data []byte) (*IPPacket, error) {
 
 	pkt := &IPPacket{}
 	pkt.Version = data[0] >> 4
-	if pkt.Version != 4 {
+	switch pkt.Version {
+	case 4:
+	case 6:
+		return parseIPv6Packet(data)
+	default:
 		return nil, fmt.Errorf("unsupported IP version: %d", pkt.Version)
 	}
 
@@ -102,6 +114,35 @@ func ParseIPPacket(data []byte) (*IPPacket, error) {
 	return pkt, nil
 }
 
+func parseIPv6Packet(data []byte) (*IPPacket, error) {
+	if len(data) < ipv6HeaderLen {
+		return nil, fmt.Errorf("packet too small for IPv6 header: %d bytes", len(data))
+	}
+
+	vtf := binary.BigEndian.Uint32(data[0:4])
+	payloadLen := int(binary.BigEndian.Uint16(data[4:6]))
+
+	pkt := &IPPacket{
+		Version:   6,
+		HeaderLen: ipv6HeaderLen,
+		TOS:       uint8(vtf >> 20),
+		FlowLabel: vtf & 0xFFFFF,
+		TotalLen:  uint16(ipv6HeaderLen + payloadLen),
+		Protocol:  IPProtocol(data[6]),
+		TTL:       data[7],
+		SrcIP:     net.IP(data[8:24]),
+		DstIP:     net.IP(data[24:40]),
+	}
+
+	if ipv6HeaderLen+payloadLen <= len(data) {
+		pkt.Payload = data[ipv6HeaderLen : ipv6HeaderLen+payloadLen]
+	} else {
+		pkt.Payload = data[ipv6HeaderLen:]
+	}
+
+	return pkt, nil
+}
+
 func ParseTCPPacket(payload []byte) (*TCPPacket, error) {
 	if len(payload) < 20 {
 		return nil, fmt.Errorf("payload too small for TCP header: %d bytes", len(payload))
@@ -134,6 +175,10 @@ func ParseTCPPacket(payload []byte) (*TCPPacket, error) {
 }
 
 func (p *IPPacket) Serialize() []byte {
+	if p.Version == 6 {
+		return p.serializeIPv6()
+	}
+
 	totalLen := int(p.HeaderLen) + len(p.Payload)
 	data := make([]byte, totalLen)
 
@@ -160,6 +205,21 @@ func (p *IPPacket) Serialize() []byte {
 	return data
 }
 
+func (p *IPPacket) serializeIPv6() []byte {
+	data := make([]byte, ipv6HeaderLen+len(p.Payload))
+
+	binary.BigEndian.PutUint32(data[0:4], 6<<28|uint32(p.TOS)<<20|p.FlowLabel&0xFFFFF)
+	binary.BigEndian.PutUint16(data[4:6], uint16(len(p.Payload)))
+	data[6] = uint8(p.Protocol)
+	data[7] = p.TTL
+
+	copy(data[8:24], p.SrcIP.To16())
+	copy(data[24:40], p.DstIP.To16())
+
+	copy(data[ipv6HeaderLen:], p.Payload)
+	return data
+}
+
 func (t *TCPPacket) Serialize() []byte {
 	totalLen := int(t.DataOffset) + len(t.Payload)
 	data := make([]byte, totalLen)
@@ -51,11 +51,47 @@ func TestParseIPPacket(t *testing.T) {
 			data:    []byte{0x45, 0x00, 0x00},
 			wantErr: true,
 		},
+		{
+			name: "valid IPv6 packet",
+			data: func() []byte {
+				pkt := make([]byte, 44)
+				binary.BigEndian.PutUint32(pkt[0:4], 6<<28|0x12<<20|0xabcde) // Version, traffic class, flow label
+				binary.BigEndian.PutUint16(pkt[4:6], 4)                      // Payload length
+				pkt[6] = uint8(ProtocolUDP)                                  // Next header
+				pkt[7] = 64                                                  // Hop limit
+				copy(pkt[8:24], net.ParseIP("fd00::1"))
+				copy(pkt[24:40], net.ParseIP("fd00::2"))
+				return pkt
+			}(),
+			wantErr: false,
+			validate: func(t *testing.T, p *IPPacket) {
+				if p.Version != 6 || p.HeaderLen != 40 {
+					t.Errorf("Version = %d, HeaderLen = %d, want 6 and 40", p.Version, p.HeaderLen)
+				}
+				if p.Protocol != ProtocolUDP || p.TTL != 64 {
+					t.Errorf("Protocol = %d, TTL = %d, want %d and 64", p.Protocol, p.TTL, ProtocolUDP)
+				}
+				if p.TOS != 0x12 || p.FlowLabel != 0xabcde {
+					t.Errorf("TOS = %#x, FlowLabel = %#x, want 0x12 and 0xabcde", p.TOS, p.FlowLabel)
+				}
+				if !p.SrcIP.Equal(net.ParseIP("fd00::1")) || !p.DstIP.Equal(net.ParseIP("fd00::2")) {
+					t.Errorf("addresses = %s -> %s, want fd00::1 -> fd00::2", p.SrcIP, p.DstIP)
+				}
+				if len(p.Payload) != 4 {
+					t.Errorf("Payload length = %d, want 4", len(p.Payload))
+				}
+			},
+		},
+		{
+			name:    "IPv6 packet too small",
+			data:    append([]byte{0x60}, make([]byte, 30)...),
+			wantErr: true,
+		},
 		{
 			name: "unsupported IP version",
 			data: func() []byte {
 				pkt := make([]byte, 20)
-				pkt[0] = 0x65 // Version 6 (IPv6)
+				pkt[0] = 0x55 // Version 5
 				return pkt
 			}(),
 			wantErr: true,
@@ -184,6 +220,40 @@ func TestIPPacketSerialize(t *testing.T) {
 	}
 }
 
+func TestIPPacketSerialize_IPv6(t *testing.T) {
+	pkt := &IPPacket{
+		Version:   6,
+		HeaderLen: 40,
+		TOS:       0x20,
+		FlowLabel: 0x12345,
+		TTL:       32,
+		Protocol:  ProtocolTCP,
+		SrcIP:     net.ParseIP("2001:db8::1"),
+		DstIP:     net.ParseIP("2001:db8::2"),
+		Payload:   []byte{1, 2, 3, 4, 5},
+	}
+
+	data := pkt.Serialize()
+	if len(data) != 45 {
+		t.Fatalf("serialized length = %d, want 45", len(data))
+	}
+
+	parsed, err := ParseIPPacket(data)
+	if err != nil {
+		t.Fatalf("Failed to parse serialized packet: %v", err)
+	}
+	if parsed.TOS != pkt.TOS || parsed.FlowLabel != pkt.FlowLabel || parsed.TTL != pkt.TTL {
+		t.Errorf("parsed TOS %#x, flow label %#x, TTL %d; want %#x, %#x, %d",
+			parsed.TOS, parsed.FlowLabel, parsed.TTL, pkt.TOS, pkt.FlowLabel, pkt.TTL)
+	}
+	if parsed.TotalLen != 45 || string(parsed.Payload) != string(pkt.Payload) {
+		t.Errorf("TotalLen = %d, payload = %v", parsed.TotalLen, parsed.Payload)
+	}
+	if !parsed.SrcIP.Equal(pkt.SrcIP) || !parsed.DstIP.Equal(pkt.DstIP) {
+		t.Errorf("addresses = %s -> %s, want %s -> %s", parsed.SrcIP, parsed.DstIP, pkt.SrcIP, pkt.DstIP)
+	}
+}
+
 func TestTCPPacketSerialize(t *testing.T) {
 	tcp := &TCPPacket{
 		SrcPort:    8080,
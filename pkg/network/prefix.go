@@ -0,0 +1,122 @@
+package network
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// IntersectPrefix returns the overlap of two prefixes. CIDR blocks either
+// nest or are disjoint, so the overlap is always the more specific one.
+func IntersectPrefix(a, b netip.Prefix) (netip.Prefix, bool) {
+	a, b = a.Masked(), b.Masked()
+	if !a.Overlaps(b) {
+		return netip.Prefix{}, false
+	}
+	if a.Bits() >= b.Bits() {
+		return a, true
+	}
+	return b, true
+}
+
+// IntersectPrefixes returns every overlap between prefixes and limits,
+// without duplicates and sorted by address and then length.
+func IntersectPrefixes(prefixes, limits []netip.Prefix) []netip.Prefix {
+	seen := make(map[netip.Prefix]bool)
+	var out []netip.Prefix
+
+	for _, p := range prefixes {
+		for _, l := range limits {
+			if inter, ok := IntersectPrefix(p, l); ok && !seen[inter] {
+				seen[inter] = true
+				out = append(out, inter)
+			}
+		}
+	}
+
+	SortPrefixes(out)
+	return out
+}
+
+func SortPrefixes(prefixes []netip.Prefix) {
+	sort.Slice(prefixes, func(i, j int) bool {
+		if c := prefixes[i].Addr().Compare(prefixes[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return prefixes[i].Bits() < prefixes[j].Bits()
+	})
+}
+
+// SubtractPrefix returns the smallest set of prefixes covering p but not
+// ex: p itself when they are disjoint, nothing when ex covers p.
+func SubtractPrefix(p, ex netip.Prefix) []netip.Prefix {
+	p, ex = p.Masked(), ex.Masked()
+	if !p.Overlaps(ex) {
+		return []netip.Prefix{p}
+	}
+	if ex.Bits() <= p.Bits() {
+		return nil
+	}
+
+	var out []netip.Prefix
+	for cur := p; cur.Bits() < ex.Bits(); {
+		lo, hi := splitPrefix(cur)
+		if lo.Overlaps(ex) {
+			out = append(out, hi)
+			cur = lo
+		} else {
+			out = append(out, lo)
+			cur = hi
+		}
+	}
+
+	SortPrefixes(out)
+	return out
+}
+
+// SubtractPrefixes removes every exclude from prefixes.
+func SubtractPrefixes(prefixes, excludes []netip.Prefix) []netip.Prefix {
+	out := append([]netip.Prefix(nil), prefixes...)
+	for _, ex := range excludes {
+		var next []netip.Prefix
+		for _, p := range out {
+			next = append(next, SubtractPrefix(p, ex)...)
+		}
+		out = next
+	}
+
+	SortPrefixes(out)
+	return out
+}
+
+func splitPrefix(p netip.Prefix) (netip.Prefix, netip.Prefix) {
+	bits := p.Bits() + 1
+	hi := p.Addr().AsSlice()
+	hi[(bits-1)/8] |= 0x80 >> ((bits - 1) % 8)
+
+	addr, _ := netip.AddrFromSlice(hi)
+	return netip.PrefixFrom(p.Addr(), bits), netip.PrefixFrom(addr, bits)
+}
+
+// MapPrefix translates addr from one prefix to another of the same length,
+// keeping its host bits, as iptables NETMAP does. Addresses outside from,
+// or of the other family, are returned unchanged and false.
+func MapPrefix(addr netip.Addr, from, to netip.Prefix) (netip.Addr, bool) {
+	if from.Bits() != to.Bits() || from.Addr().BitLen() != to.Addr().BitLen() || !from.Contains(addr) {
+		return addr, false
+	}
+
+	a, base := addr.AsSlice(), to.Masked().Addr().AsSlice()
+	for i := range a {
+		bits := from.Bits() - 8*i
+		switch {
+		case bits >= 8:
+			a[i] = base[i]
+		case bits > 0:
+			mask := byte(0xff << (8 - bits))
+			a[i] = base[i]&mask | a[i]&^mask
+		}
+	}
+
+	mapped, _ := netip.AddrFromSlice(a)
+	return mapped, true
+}
@@ -0,0 +1,101 @@
+package network
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestIntersectPrefix(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+		ok   bool
+	}{
+		{"10.0.0.0/8", "10.1.0.0/16", "10.1.0.0/16", true},
+		{"10.1.0.0/16", "10.0.0.0/8", "10.1.0.0/16", true},
+		{"10.0.0.0/8", "10.0.0.0/8", "10.0.0.0/8", true},
+		{"10.0.0.0/8", "192.168.0.0/16", "", false},
+		{"0.0.0.0/0", "192.168.1.0/24", "192.168.1.0/24", true},
+	}
+
+	for _, tt := range tests {
+		got, ok := IntersectPrefix(netip.MustParsePrefix(tt.a), netip.MustParsePrefix(tt.b))
+		if ok != tt.ok {
+			t.Errorf("IntersectPrefix(%s, %s) ok = %v, want %v", tt.a, tt.b, ok, tt.ok)
+			continue
+		}
+		if ok && got.String() != tt.want {
+			t.Errorf("IntersectPrefix(%s, %s) = %s, want %s", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestIntersectPrefixes(t *testing.T) {
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("192.168.1.0/24"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("172.16.0.0/12"),
+	}
+	limits := []netip.Prefix{
+		netip.MustParsePrefix("10.1.0.0/16"),
+		netip.MustParsePrefix("10.2.0.0/16"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+	}
+
+	got := IntersectPrefixes(prefixes, limits)
+	want := []netip.Prefix{
+		netip.MustParsePrefix("10.1.0.0/16"),
+		netip.MustParsePrefix("10.2.0.0/16"),
+		netip.MustParsePrefix("192.168.1.0/24"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("IntersectPrefixes() = %v, want %v", got, want)
+	}
+}
+
+func TestSubtractPrefix(t *testing.T) {
+	tests := []struct {
+		p, ex string
+		want  []string
+	}{
+		{"10.0.0.0/8", "192.168.0.0/16", []string{"10.0.0.0/8"}},
+		{"10.1.0.0/16", "10.0.0.0/8", nil},
+		{"10.0.0.0/24", "10.0.0.0/26", []string{"10.0.0.64/26", "10.0.0.128/25"}},
+		{"10.0.0.0/30", "10.0.0.2/32", []string{"10.0.0.0/31", "10.0.0.3/32"}},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, p := range SubtractPrefix(netip.MustParsePrefix(tt.p), netip.MustParsePrefix(tt.ex)) {
+			got = append(got, p.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SubtractPrefix(%s, %s) = %v, want %v", tt.p, tt.ex, got, tt.want)
+		}
+	}
+}
+
+func TestMapPrefix(t *testing.T) {
+	tests := []struct {
+		addr, from, to string
+		want           string
+		ok             bool
+	}{
+		{"100.64.1.5", "100.64.1.0/24", "192.168.1.0/24", "192.168.1.5", true},
+		{"100.64.1.200", "100.64.1.128/25", "10.0.0.0/25", "10.0.0.72", true},
+		{"100.64.3.7", "100.64.0.0/22", "10.20.4.0/22", "10.20.7.7", true},
+		{"192.168.1.5", "192.168.1.0/24", "100.64.1.0/24", "100.64.1.5", true},
+		{"fd00:1::42", "fd00:1::/64", "fd00:9::/64", "fd00:9::42", true},
+		{"100.64.2.5", "100.64.1.0/24", "192.168.1.0/24", "100.64.2.5", false},
+		{"100.64.1.5", "100.64.1.0/24", "192.168.0.0/16", "100.64.1.5", false},
+		{"100.64.1.5", "100.64.1.0/24", "fd00::/24", "100.64.1.5", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := MapPrefix(netip.MustParseAddr(tt.addr), netip.MustParsePrefix(tt.from), netip.MustParsePrefix(tt.to))
+		if ok != tt.ok || got.String() != tt.want {
+			t.Errorf("MapPrefix(%s, %s, %s) = %s, %v, want %s, %v", tt.addr, tt.from, tt.to, got, ok, tt.want, tt.ok)
+		}
+	}
+}
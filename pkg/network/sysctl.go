@@ -0,0 +1,28 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ReadSysctl returns a kernel parameter by its /proc/sys path, such as
+// "net/ipv4/ip_forward". Slashes rather than dots separate the components
+// so interface names like "eth0.100" need no escaping.
+func ReadSysctl(name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join("/proc/sys", name))
+	if err != nil {
+		return "", fmt.Errorf("failed to read sysctl %s: %w", name, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func WriteSysctl(name, value string) error {
+	if err := os.WriteFile(filepath.Join("/proc/sys", name), []byte(value+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to set sysctl %s=%s: %w", name, value, err)
+	}
+	return nil
+}
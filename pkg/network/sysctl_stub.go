@@ -0,0 +1,13 @@
+//go:build !linux
+
+package network
+
+import "fmt"
+
+func ReadSysctl(name string) (string, error) {
+	return "", fmt.Errorf("sysctl is not supported on this platform (Linux only)")
+}
+
+func WriteSysctl(name, value string) error {
+	return fmt.Errorf("sysctl is not supported on this platform (Linux only)")
+}
@@ -0,0 +1,141 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+const (
+	// Missing from the syscall package, see linux/in6.h.
+	IPV6_TRANSPARENT     = 75
+	IPV6_RECVORIGDSTADDR = 74
+	IPV6_ORIGDSTADDR     = IPV6_RECVORIGDSTADDR
+)
+
+// ListenTransparentUDP opens a UDP socket that accepts datagrams diverted by
+// a TPROXY rule and reports each one's original destination. The socket is
+// IPv6 only when addr has an IPv6 host, e.g. "[::]:9999", and IPv4 only
+// otherwise.
+func ListenTransparentUDP(addr string) (*net.UDPConn, error) {
+	network := "udp4"
+	opts := []sockopt{
+		{syscall.SOL_IP, syscall.IP_TRANSPARENT},
+		{syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR},
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && strings.Contains(host, ":") {
+		network = "udp6"
+		opts = []sockopt{
+			{syscall.SOL_IPV6, IPV6_TRANSPARENT},
+			{syscall.SOL_IPV6, IPV6_RECVORIGDSTADDR},
+		}
+	}
+	opts = append(opts, sockopt{syscall.SOL_SOCKET, syscall.SO_REUSEADDR})
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setSockopts(c, opts...)
+		},
+	}
+
+	pc, err := lc.ListenPacket(context.Background(), network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for transparent UDP on %s: %w", addr, err)
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// ReadFromUDPOrigDst reads one datagram from a socket opened with
+// ListenTransparentUDP, returning its source and original destination.
+func ReadFromUDPOrigDst(conn *net.UDPConn, buf []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	oob := make([]byte, 128)
+
+	n, oobn, _, src, err := conn.ReadMsgUDP(buf, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("failed to parse control message: %w", err)
+	}
+
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_ORIGDSTADDR:
+			if len(msg.Data) < syscall.SizeofSockaddrInet4 {
+				continue
+			}
+			// struct sockaddr_in: family, port (network order), address.
+			dst := &net.UDPAddr{
+				IP:   net.IPv4(msg.Data[4], msg.Data[5], msg.Data[6], msg.Data[7]),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}
+			return n, src, dst, nil
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == IPV6_ORIGDSTADDR:
+			if len(msg.Data) < syscall.SizeofSockaddrInet6 {
+				continue
+			}
+			// struct sockaddr_in6: family, port (network order), flow info,
+			// address, scope ID.
+			dst := &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), msg.Data[8:24]...)),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}
+			return n, src, dst, nil
+		}
+	}
+
+	return 0, nil, nil, fmt.Errorf("datagram from %s carries no original destination", src)
+}
+
+// DialTransparentUDP returns a socket bound to from, which need not be a
+// local address, and connected to to. Replies written to it appear to come
+// from the original destination.
+func DialTransparentUDP(from, to *net.UDPAddr) (*net.UDPConn, error) {
+	network, transparent := "udp4", sockopt{syscall.SOL_IP, syscall.IP_TRANSPARENT}
+	if from.IP.To4() == nil {
+		network, transparent = "udp6", sockopt{syscall.SOL_IPV6, IPV6_TRANSPARENT}
+	}
+
+	d := net.Dialer{
+		LocalAddr: from,
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setSockopts(c,
+				transparent,
+				sockopt{syscall.SOL_SOCKET, syscall.SO_REUSEADDR},
+			)
+		},
+	}
+
+	conn, err := d.Dial(network, to.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open transparent UDP socket %s -> %s: %w", from, to, err)
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+type sockopt struct {
+	level, name int
+}
+
+func setSockopts(c syscall.RawConn, opts ...sockopt) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		for _, o := range opts {
+			if sockErr = syscall.SetsockoptInt(int(fd), o.level, o.name, 1); sockErr != nil {
+				sockErr = fmt.Errorf("setsockopt %d/%d: %w", o.level, o.name, sockErr)
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
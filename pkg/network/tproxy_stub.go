@@ -0,0 +1,20 @@
+//go:build !linux
+
+package network
+
+import (
+	"fmt"
+	"net"
+)
+
+func ListenTransparentUDP(addr string) (*net.UDPConn, error) {
+	return nil, fmt.Errorf("transparent UDP is not supported on this platform (Linux only)")
+}
+
+func ReadFromUDPOrigDst(conn *net.UDPConn, buf []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	return 0, nil, nil, fmt.Errorf("transparent UDP is not supported on this platform (Linux only)")
+}
+
+func DialTransparentUDP(from, to *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, fmt.Errorf("transparent UDP is not supported on this platform (Linux only)")
+}
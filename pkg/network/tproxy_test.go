@@ -0,0 +1,77 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTransparentUDP_RoundTrip(t *testing.T) {
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		t.Run(host, func(t *testing.T) {
+			testTransparentUDPRoundTrip(t, net.ParseIP(host))
+		})
+	}
+}
+
+func testTransparentUDPRoundTrip(t *testing.T, ip net.IP) {
+	lis, err := ListenTransparentUDP(net.JoinHostPort(ip.String(), "0"))
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("IP_TRANSPARENT requires CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatalf("ListenTransparentUDP failed: %v", err)
+	}
+	defer lis.Close()
+
+	app, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatalf("failed to open app socket: %v", err)
+	}
+	defer app.Close()
+
+	lisAddr := lis.LocalAddr().(*net.UDPAddr)
+	if _, err := app.WriteToUDP([]byte("query"), lisAddr); err != nil {
+		t.Fatalf("failed to send datagram: %v", err)
+	}
+
+	lis.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, src, dst, err := ReadFromUDPOrigDst(lis, buf)
+	if err != nil {
+		t.Fatalf("ReadFromUDPOrigDst failed: %v", err)
+	}
+	if string(buf[:n]) != "query" {
+		t.Errorf("expected payload query, got %q", buf[:n])
+	}
+	// Without a TPROXY rule the original destination is the listener.
+	if dst.Port != lisAddr.Port || !dst.IP.Equal(lisAddr.IP) {
+		t.Errorf("expected original destination %s, got %s", lisAddr, dst)
+	}
+
+	reply, err := DialTransparentUDP(dst, src)
+	if err != nil {
+		t.Fatalf("DialTransparentUDP failed: %v", err)
+	}
+	defer reply.Close()
+
+	if _, err := reply.Write([]byte("answer")); err != nil {
+		t.Fatalf("failed to write reply: %v", err)
+	}
+
+	app.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := app.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if string(buf[:n]) != "answer" {
+		t.Errorf("expected reply answer, got %q", buf[:n])
+	}
+	if from.Port != lisAddr.Port {
+		t.Errorf("expected reply from %s, got %s", lisAddr, from)
+	}
+}
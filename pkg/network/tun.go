@@ -0,0 +1,105 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	tunSetIff = 0x400454ca
+	iffTun    = 0x0001
+	iffNoPI   = 0x1000
+)
+
+// TUN is a layer-3 tunnel device. Every Read returns one IP packet and
+// every Write injects one.
+type TUN struct {
+	file *os.File
+	name string
+}
+
+// OpenTUN creates the TUN interface name, or attaches to it if it already
+// exists. The interface disappears with its routes once closed.
+func OpenTUN(name string) (*TUN, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open /dev/net/tun: %w", err)
+	}
+
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:syscall.IFNAMSIZ-1], name)
+	ifr.flags = iffTun | iffNoPI
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetIff, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to create TUN device %s: %w", name, errno)
+	}
+
+	// Non-blocking mode puts the descriptor on the runtime poller, so Close
+	// unblocks a pending Read.
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to set TUN device non-blocking: %w", err)
+	}
+
+	return &TUN{
+		file: os.NewFile(uintptr(fd), "/dev/net/tun"),
+		name: strings.TrimRight(string(ifr.name[:]), "\x00"),
+	}, nil
+}
+
+func (t *TUN) Name() string {
+	return t.name
+}
+
+func (t *TUN) Read(buf []byte) (int, error) {
+	return t.file.Read(buf)
+}
+
+func (t *TUN) Write(pkt []byte) (int, error) {
+	return t.file.Write(pkt)
+}
+
+func (t *TUN) Close() error {
+	return t.file.Close()
+}
+
+// Configure assigns addr, sets the MTU and brings the interface up.
+func (t *TUN) Configure(addr netip.Prefix, mtu int) error {
+	if err := runIP("addr", "replace", addr.String(), "dev", t.name); err != nil {
+		return err
+	}
+	return runIP("link", "set", "dev", t.name, "mtu", strconv.Itoa(mtu), "up")
+}
+
+func (t *TUN) AddRoute(p netip.Prefix) error {
+	return runIP("route", "replace", p.String(), "dev", t.name)
+}
+
+func (t *TUN) DeleteRoute(p netip.Prefix) error {
+	err := runIP("route", "del", p.String(), "dev", t.name)
+	if err != nil && strings.Contains(err.Error(), "No such process") {
+		return nil
+	}
+	return err
+}
+
+func runIP(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s failed: %w, output: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+//go:build !linux
+
+package network
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+type TUN struct{}
+
+func OpenTUN(name string) (*TUN, error) {
+	return nil, fmt.Errorf("TUN devices are not supported on this platform (Linux only)")
+}
+
+func (t *TUN) Name() string { return "" }
+
+func (t *TUN) Read(buf []byte) (int, error) {
+	return 0, fmt.Errorf("TUN devices are not supported on this platform (Linux only)")
+}
+
+func (t *TUN) Write(pkt []byte) (int, error) {
+	return 0, fmt.Errorf("TUN devices are not supported on this platform (Linux only)")
+}
+
+func (t *TUN) Close() error { return nil }
+
+func (t *TUN) Configure(addr netip.Prefix, mtu int) error {
+	return fmt.Errorf("TUN devices are not supported on this platform (Linux only)")
+}
+
+func (t *TUN) AddRoute(p netip.Prefix) error {
+	return fmt.Errorf("TUN devices are not supported on this platform (Linux only)")
+}
+
+func (t *TUN) DeleteRoute(p netip.Prefix) error {
+	return fmt.Errorf("TUN devices are not supported on this platform (Linux only)")
+}
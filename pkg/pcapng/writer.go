@@ -0,0 +1,132 @@
+// Package pcapng writes capture files in the pcapng format
+// (https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html).
+package pcapng
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// LinkTypeRaw marks packets that start directly with an IPv4 or IPv6 header.
+const LinkTypeRaw uint16 = 101
+
+const (
+	blockTypeSHB uint32 = 0x0A0D0D0A
+	blockTypeIDB uint32 = 0x00000001
+	blockTypeEPB uint32 = 0x00000006
+
+	byteOrderMagic uint32 = 0x1A2B3C4D
+
+	optEndOfOpt uint16 = 0
+	optComment  uint16 = 1
+
+	defaultSnapLen uint32 = 262144
+)
+
+// Writer produces a single section with a single interface. Timestamps use
+// the default microsecond resolution.
+type Writer struct {
+	w   *bufio.Writer
+	mu  sync.Mutex
+	buf []byte
+}
+
+func NewWriter(w io.Writer, linkType uint16) (*Writer, error) {
+	pw := &Writer{w: bufio.NewWriter(w)}
+
+	if err := pw.writeSectionHeader(); err != nil {
+		return nil, err
+	}
+	if err := pw.writeInterfaceDescription(linkType); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+func (pw *Writer) writeSectionHeader() error {
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:4], byteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:6], 1)
+	binary.LittleEndian.PutUint16(body[6:8], 0)
+	// Section length is unknown while streaming.
+	binary.LittleEndian.PutUint64(body[8:16], 0xFFFFFFFFFFFFFFFF)
+
+	return pw.writeBlock(blockTypeSHB, body)
+}
+
+func (pw *Writer) writeInterfaceDescription(linkType uint16) error {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:2], linkType)
+	binary.LittleEndian.PutUint32(body[4:8], defaultSnapLen)
+
+	return pw.writeBlock(blockTypeIDB, body)
+}
+
+// WritePacket appends an enhanced packet block. A non-empty comment is
+// stored as opt_comment and shown by Wireshark next to the packet.
+func (pw *Writer) WritePacket(ts time.Time, data []byte, comment string) error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	micros := uint64(ts.UnixMicro())
+
+	body := pw.buf[:0]
+	body = binary.LittleEndian.AppendUint32(body, 0)
+	body = binary.LittleEndian.AppendUint32(body, uint32(micros>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(micros))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(data)))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(data)))
+	body = append(body, data...)
+	body = appendPadding(body)
+
+	if comment != "" {
+		body = binary.LittleEndian.AppendUint16(body, optComment)
+		body = binary.LittleEndian.AppendUint16(body, uint16(len(comment)))
+		body = append(body, comment...)
+		body = appendPadding(body)
+		body = binary.LittleEndian.AppendUint32(body, uint32(optEndOfOpt))
+	}
+
+	pw.buf = body
+	return pw.writeBlock(blockTypeEPB, body)
+}
+
+func (pw *Writer) Flush() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	return pw.w.Flush()
+}
+
+func (pw *Writer) writeBlock(blockType uint32, body []byte) error {
+	total := uint32(12 + len(body))
+
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], blockType)
+	binary.LittleEndian.PutUint32(hdr[4:8], total)
+
+	var trailer [4]byte
+	binary.LittleEndian.PutUint32(trailer[:], total)
+
+	if _, err := pw.w.Write(hdr[:]); err != nil {
+		return fmt.Errorf("failed to write pcapng block: %w", err)
+	}
+	if _, err := pw.w.Write(body); err != nil {
+		return fmt.Errorf("failed to write pcapng block: %w", err)
+	}
+	if _, err := pw.w.Write(trailer[:]); err != nil {
+		return fmt.Errorf("failed to write pcapng block: %w", err)
+	}
+	return nil
+}
+
+func appendPadding(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,89 @@
+package pcapng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+type block struct {
+	Type uint32
+	Body []byte
+}
+
+func readBlocks(t *testing.T, data []byte) []block {
+	t.Helper()
+
+	var blocks []block
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block: %d bytes left", len(data))
+		}
+		typ := binary.LittleEndian.Uint32(data[0:4])
+		total := binary.LittleEndian.Uint32(data[4:8])
+		if total%4 != 0 || int(total) > len(data) {
+			t.Fatalf("invalid block length %d", total)
+		}
+		if trailer := binary.LittleEndian.Uint32(data[total-4 : total]); trailer != total {
+			t.Fatalf("block trailer %d does not match header %d", trailer, total)
+		}
+		blocks = append(blocks, block{Type: typ, Body: data[8 : total-4]})
+		data = data[total:]
+	}
+	return blocks
+}
+
+func TestWriter_Blocks(t *testing.T) {
+	var buf bytes.Buffer
+
+	w, err := NewWriter(&buf, LinkTypeRaw)
+	if err != nil {
+		t.Fatalf("NewWriter failed: %v", err)
+	}
+
+	ts := time.Unix(1700000000, 123456000)
+	payload := []byte{0x45, 0x00, 0x00, 0x14, 0xAA}
+	if err := w.WritePacket(ts, payload, "conn-1"); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	if err := w.WritePacket(ts, payload, ""); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	blocks := readBlocks(t, buf.Bytes())
+	if len(blocks) != 4 {
+		t.Fatalf("expected 4 blocks, got %d", len(blocks))
+	}
+
+	if blocks[0].Type != blockTypeSHB || binary.LittleEndian.Uint32(blocks[0].Body[0:4]) != byteOrderMagic {
+		t.Error("expected section header block with byte-order magic first")
+	}
+	if blocks[1].Type != blockTypeIDB || binary.LittleEndian.Uint16(blocks[1].Body[0:2]) != LinkTypeRaw {
+		t.Error("expected interface description block with raw link type")
+	}
+
+	epb := blocks[2]
+	if epb.Type != blockTypeEPB {
+		t.Fatalf("expected enhanced packet block, got type %#x", epb.Type)
+	}
+	micros := uint64(binary.LittleEndian.Uint32(epb.Body[4:8]))<<32 | uint64(binary.LittleEndian.Uint32(epb.Body[8:12]))
+	if micros != uint64(ts.UnixMicro()) {
+		t.Errorf("timestamp = %d, want %d", micros, ts.UnixMicro())
+	}
+	if capLen := binary.LittleEndian.Uint32(epb.Body[12:16]); capLen != uint32(len(payload)) {
+		t.Errorf("captured length = %d, want %d", capLen, len(payload))
+	}
+	if !bytes.Equal(epb.Body[20:20+len(payload)], payload) {
+		t.Error("packet data mismatch")
+	}
+	if !bytes.Contains(epb.Body, []byte("conn-1")) {
+		t.Error("expected comment option in first packet")
+	}
+	if len(blocks[3].Body) != 20+8 {
+		t.Errorf("expected padded packet without options, got %d body bytes", len(blocks[3].Body))
+	}
+}
@@ -122,6 +122,61 @@ func (Direction) EnumDescriptor() ([]byte, []int) {
 	return file_proto_packet_proto_rawDescGZIP(), []int{1}
 }
 
+// Control turns a packet into a flow control signal for its connection;
+// such packets carry no data. The client sends all of them to the proxy,
+// the proxy only RESET, when it refuses a connection.
+type Control int32
+
+const (
+	Control_CONTROL_NONE   Control = 0
+	Control_CONTROL_PAUSE  Control = 1 // Stop reading from the target until resumed
+	Control_CONTROL_RESUME Control = 2
+	Control_CONTROL_RESET  Control = 3 // One end dropped or refused the connection; close it
+)
+
+// Enum value maps for Control.
+var (
+	Control_name = map[int32]string{
+		0: "CONTROL_NONE",
+		1: "CONTROL_PAUSE",
+		2: "CONTROL_RESUME",
+		3: "CONTROL_RESET",
+	}
+	Control_value = map[string]int32{
+		"CONTROL_NONE":   0,
+		"CONTROL_PAUSE":  1,
+		"CONTROL_RESUME": 2,
+		"CONTROL_RESET":  3,
+	}
+)
+
+func (x Control) Enum() *Control {
+	p := new(Control)
+	*p = x
+	return p
+}
+
+func (x Control) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Control) Descriptor() protoreflect.EnumDescriptor {
+	return file_proto_packet_proto_enumTypes[2].Descriptor()
+}
+
+func (Control) Type() protoreflect.EnumType {
+	return &file_proto_packet_proto_enumTypes[2]
+}
+
+func (x Control) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Control.Descriptor instead.
+func (Control) EnumDescriptor() ([]byte, []int) {
+	return file_proto_packet_proto_rawDescGZIP(), []int{2}
+}
+
 type MessageType int32
 
 const (
@@ -164,11 +219,11 @@ func (x MessageType) String() string {
 }
 
 func (MessageType) Descriptor() protoreflect.EnumDescriptor {
-	return file_proto_packet_proto_enumTypes[2].Descriptor()
+	return file_proto_packet_proto_enumTypes[3].Descriptor()
 }
 
 func (MessageType) Type() protoreflect.EnumType {
-	return &file_proto_packet_proto_enumTypes[2]
+	return &file_proto_packet_proto_enumTypes[3]
 }
 
 func (x MessageType) Number() protoreflect.EnumNumber {
@@ -177,15 +232,18 @@ func (x MessageType) Number() protoreflect.EnumNumber {
 
 // Deprecated: Use MessageType.Descriptor instead.
 func (MessageType) EnumDescriptor() ([]byte, []int) {
-	return file_proto_packet_proto_rawDescGZIP(), []int{2}
+	return file_proto_packet_proto_rawDescGZIP(), []int{3}
 }
 
 type ConnectionTuple struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	SrcIp         string                 `protobuf:"bytes,1,opt,name=src_ip,json=srcIp,proto3" json:"src_ip,omitempty"`
-	SrcPort       uint32                 `protobuf:"varint,2,opt,name=src_port,json=srcPort,proto3" json:"src_port,omitempty"`
-	DstIp         string                 `protobuf:"bytes,3,opt,name=dst_ip,json=dstIp,proto3" json:"dst_ip,omitempty"`
-	DstPort       uint32                 `protobuf:"varint,4,opt,name=dst_port,json=dstPort,proto3" json:"dst_port,omitempty"`
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	SrcIp   string                 `protobuf:"bytes,1,opt,name=src_ip,json=srcIp,proto3" json:"src_ip,omitempty"`
+	SrcPort uint32                 `protobuf:"varint,2,opt,name=src_port,json=srcPort,proto3" json:"src_port,omitempty"`
+	DstIp   string                 `protobuf:"bytes,3,opt,name=dst_ip,json=dstIp,proto3" json:"dst_ip,omitempty"`
+	DstPort uint32                 `protobuf:"varint,4,opt,name=dst_port,json=dstPort,proto3" json:"dst_port,omitempty"`
+	// dst_host names the destination when the client only has a hostname
+	// (SOCKS); dst_ip is then empty and the proxy resolves it.
+	DstHost       string `protobuf:"bytes,5,opt,name=dst_host,json=dstHost,proto3" json:"dst_host,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -248,14 +306,25 @@ func (x *ConnectionTuple) GetDstPort() uint32 {
 	return 0
 }
 
+func (x *ConnectionTuple) GetDstHost() string {
+	if x != nil {
+		return x.DstHost
+	}
+	return ""
+}
+
 type Packet struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	ConnectionId  string                 `protobuf:"bytes,1,opt,name=connection_id,json=connectionId,proto3" json:"connection_id,omitempty"`
-	Data          []byte                 `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
-	ConnTuple     *ConnectionTuple       `protobuf:"bytes,3,opt,name=conn_tuple,json=connTuple,proto3" json:"conn_tuple,omitempty"`
-	Protocol      Protocol               `protobuf:"varint,4,opt,name=protocol,proto3,enum=proto.Protocol" json:"protocol,omitempty"`
-	Direction     Direction              `protobuf:"varint,5,opt,name=direction,proto3,enum=proto.Direction" json:"direction,omitempty"`
-	Timestamp     int64                  `protobuf:"varint,6,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	ConnectionId string                 `protobuf:"bytes,1,opt,name=connection_id,json=connectionId,proto3" json:"connection_id,omitempty"`
+	Data         []byte                 `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	ConnTuple    *ConnectionTuple       `protobuf:"bytes,3,opt,name=conn_tuple,json=connTuple,proto3" json:"conn_tuple,omitempty"`
+	Protocol     Protocol               `protobuf:"varint,4,opt,name=protocol,proto3,enum=proto.Protocol" json:"protocol,omitempty"`
+	Direction    Direction              `protobuf:"varint,5,opt,name=direction,proto3,enum=proto.Direction" json:"direction,omitempty"`
+	Timestamp    int64                  `protobuf:"varint,6,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	// ip_packet marks data as a complete IPv4 packet (TUN mode) rather than
+	// stream or datagram payload.
+	IpPacket      bool    `protobuf:"varint,7,opt,name=ip_packet,json=ipPacket,proto3" json:"ip_packet,omitempty"`
+	Control       Control `protobuf:"varint,8,opt,name=control,proto3,enum=proto.Control" json:"control,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -332,6 +401,20 @@ func (x *Packet) GetTimestamp() int64 {
 	return 0
 }
 
+func (x *Packet) GetIpPacket() bool {
+	if x != nil {
+		return x.IpPacket
+	}
+	return false
+}
+
+func (x *Packet) GetControl() Control {
+	if x != nil {
+		return x.Control
+	}
+	return Control_CONTROL_NONE
+}
+
 type ClientRegister struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	ClientId      string                 `protobuf:"bytes,1,opt,name=client_id,json=clientId,proto3" json:"client_id,omitempty"`
@@ -377,9 +460,11 @@ func (x *ClientRegister) GetClientId() string {
 }
 
 type ProxyRegister struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	ProxyId       string                 `protobuf:"bytes,1,opt,name=proxy_id,json=proxyId,proto3" json:"proxy_id,omitempty"`
-	ManagedCidr   string                 `protobuf:"bytes,2,opt,name=managed_cidr,json=managedCidr,proto3" json:"managed_cidr,omitempty"`
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	ProxyId     string                 `protobuf:"bytes,1,opt,name=proxy_id,json=proxyId,proto3" json:"proxy_id,omitempty"`
+	ManagedCidr string                 `protobuf:"bytes,2,opt,name=managed_cidr,json=managedCidr,proto3" json:"managed_cidr,omitempty"`
+	// domains are the DNS suffixes whose hostnames this proxy resolves.
+	Domains       []string `protobuf:"bytes,3,rep,name=domains,proto3" json:"domains,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -428,6 +513,13 @@ func (x *ProxyRegister) GetManagedCidr() string {
 	return ""
 }
 
+func (x *ProxyRegister) GetDomains() []string {
+	if x != nil {
+		return x.Domains
+	}
+	return nil
+}
+
 type RegisterAck struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Success       bool                   `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`
@@ -532,6 +624,60 @@ func (x *Heartbeat) GetTimestamp() int64 {
 	return 0
 }
 
+// RouteTable lists the destination prefixes a client should intercept. The
+// server sends the full table on every change; version only increases.
+type RouteTable struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Version       uint64                 `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	Prefixes      []string               `protobuf:"bytes,2,rep,name=prefixes,proto3" json:"prefixes,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RouteTable) Reset() {
+	*x = RouteTable{}
+	mi := &file_proto_packet_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RouteTable) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RouteTable) ProtoMessage() {}
+
+func (x *RouteTable) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_packet_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RouteTable.ProtoReflect.Descriptor instead.
+func (*RouteTable) Descriptor() ([]byte, []int) {
+	return file_proto_packet_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *RouteTable) GetVersion() uint64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *RouteTable) GetPrefixes() []string {
+	if x != nil {
+		return x.Prefixes
+	}
+	return nil
+}
+
 type Envelope struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Type          MessageType            `protobuf:"varint,1,opt,name=type,proto3,enum=proto.MessageType" json:"type,omitempty"`
@@ -542,7 +688,7 @@ type Envelope struct {
 
 func (x *Envelope) Reset() {
 	*x = Envelope{}
-	mi := &file_proto_packet_proto_msgTypes[6]
+	mi := &file_proto_packet_proto_msgTypes[7]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -554,7 +700,7 @@ func (x *Envelope) String() string {
 func (*Envelope) ProtoMessage() {}
 
 func (x *Envelope) ProtoReflect() protoreflect.Message {
-	mi := &file_proto_packet_proto_msgTypes[6]
+	mi := &file_proto_packet_proto_msgTypes[7]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -567,7 +713,7 @@ func (x *Envelope) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Envelope.ProtoReflect.Descriptor instead.
 func (*Envelope) Descriptor() ([]byte, []int) {
-	return file_proto_packet_proto_rawDescGZIP(), []int{6}
+	return file_proto_packet_proto_rawDescGZIP(), []int{7}
 }
 
 func (x *Envelope) GetType() MessageType {
@@ -592,6 +738,7 @@ type ClientMessage struct {
 	//	*ClientMessage_Packet
 	//	*ClientMessage_Heartbeat
 	//	*ClientMessage_Ack
+	//	*ClientMessage_Routes
 	Message       isClientMessage_Message `protobuf_oneof:"message"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
@@ -599,7 +746,7 @@ type ClientMessage struct {
 
 func (x *ClientMessage) Reset() {
 	*x = ClientMessage{}
-	mi := &file_proto_packet_proto_msgTypes[7]
+	mi := &file_proto_packet_proto_msgTypes[8]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -611,7 +758,7 @@ func (x *ClientMessage) String() string {
 func (*ClientMessage) ProtoMessage() {}
 
 func (x *ClientMessage) ProtoReflect() protoreflect.Message {
-	mi := &file_proto_packet_proto_msgTypes[7]
+	mi := &file_proto_packet_proto_msgTypes[8]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -624,7 +771,7 @@ func (x *ClientMessage) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ClientMessage.ProtoReflect.Descriptor instead.
 func (*ClientMessage) Descriptor() ([]byte, []int) {
-	return file_proto_packet_proto_rawDescGZIP(), []int{7}
+	return file_proto_packet_proto_rawDescGZIP(), []int{8}
 }
 
 func (x *ClientMessage) GetMessage() isClientMessage_Message {
@@ -670,6 +817,15 @@ func (x *ClientMessage) GetAck() *RegisterAck {
 	return nil
 }
 
+func (x *ClientMessage) GetRoutes() *RouteTable {
+	if x != nil {
+		if x, ok := x.Message.(*ClientMessage_Routes); ok {
+			return x.Routes
+		}
+	}
+	return nil
+}
+
 type isClientMessage_Message interface {
 	isClientMessage_Message()
 }
@@ -690,6 +846,10 @@ type ClientMessage_Ack struct {
 	Ack *RegisterAck `protobuf:"bytes,4,opt,name=ack,proto3,oneof"`
 }
 
+type ClientMessage_Routes struct {
+	Routes *RouteTable `protobuf:"bytes,5,opt,name=routes,proto3,oneof"`
+}
+
 func (*ClientMessage_Register) isClientMessage_Message() {}
 
 func (*ClientMessage_Packet) isClientMessage_Message() {}
@@ -698,6 +858,8 @@ func (*ClientMessage_Heartbeat) isClientMessage_Message() {}
 
 func (*ClientMessage_Ack) isClientMessage_Message() {}
 
+func (*ClientMessage_Routes) isClientMessage_Message() {}
+
 type ProxyMessage struct {
 	state protoimpl.MessageState `protogen:"open.v1"`
 	// Types that are valid to be assigned to Message:
@@ -713,7 +875,7 @@ type ProxyMessage struct {
 
 func (x *ProxyMessage) Reset() {
 	*x = ProxyMessage{}
-	mi := &file_proto_packet_proto_msgTypes[8]
+	mi := &file_proto_packet_proto_msgTypes[9]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -725,7 +887,7 @@ func (x *ProxyMessage) String() string {
 func (*ProxyMessage) ProtoMessage() {}
 
 func (x *ProxyMessage) ProtoReflect() protoreflect.Message {
-	mi := &file_proto_packet_proto_msgTypes[8]
+	mi := &file_proto_packet_proto_msgTypes[9]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -738,7 +900,7 @@ func (x *ProxyMessage) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ProxyMessage.ProtoReflect.Descriptor instead.
 func (*ProxyMessage) Descriptor() ([]byte, []int) {
-	return file_proto_packet_proto_rawDescGZIP(), []int{8}
+	return file_proto_packet_proto_rawDescGZIP(), []int{9}
 }
 
 func (x *ProxyMessage) GetMessage() isProxyMessage_Message {
@@ -816,12 +978,13 @@ var File_proto_packet_proto protoreflect.FileDescriptor
 
 const file_proto_packet_proto_rawDesc = "" +
 	"\n" +
-	"\x12proto/packet.proto\x12\x05proto\"u\n" +
+	"\x12proto/packet.proto\x12\x05proto\"\x90\x01\n" +
 	"\x0fConnectionTuple\x12\x15\n" +
 	"\x06src_ip\x18\x01 \x01(\tR\x05srcIp\x12\x19\n" +
 	"\bsrc_port\x18\x02 \x01(\rR\asrcPort\x12\x15\n" +
 	"\x06dst_ip\x18\x03 \x01(\tR\x05dstIp\x12\x19\n" +
-	"\bdst_port\x18\x04 \x01(\rR\adstPort\"\xf3\x01\n" +
+	"\bdst_port\x18\x04 \x01(\rR\adstPort\x12\x19\n" +
+	"\bdst_host\x18\x05 \x01(\tR\adstHost\"\xba\x02\n" +
 	"\x06Packet\x12#\n" +
 	"\rconnection_id\x18\x01 \x01(\tR\fconnectionId\x12\x12\n" +
 	"\x04data\x18\x02 \x01(\fR\x04data\x125\n" +
@@ -829,26 +992,34 @@ const file_proto_packet_proto_rawDesc = "" +
 	"conn_tuple\x18\x03 \x01(\v2\x16.proto.ConnectionTupleR\tconnTuple\x12+\n" +
 	"\bprotocol\x18\x04 \x01(\x0e2\x0f.proto.ProtocolR\bprotocol\x12.\n" +
 	"\tdirection\x18\x05 \x01(\x0e2\x10.proto.DirectionR\tdirection\x12\x1c\n" +
-	"\ttimestamp\x18\x06 \x01(\x03R\ttimestamp\"-\n" +
+	"\ttimestamp\x18\x06 \x01(\x03R\ttimestamp\x12\x1b\n" +
+	"\tip_packet\x18\a \x01(\bR\bipPacket\x12(\n" +
+	"\acontrol\x18\b \x01(\x0e2\x0e.proto.ControlR\acontrol\"-\n" +
 	"\x0eClientRegister\x12\x1b\n" +
-	"\tclient_id\x18\x01 \x01(\tR\bclientId\"M\n" +
+	"\tclient_id\x18\x01 \x01(\tR\bclientId\"g\n" +
 	"\rProxyRegister\x12\x19\n" +
 	"\bproxy_id\x18\x01 \x01(\tR\aproxyId\x12!\n" +
-	"\fmanaged_cidr\x18\x02 \x01(\tR\vmanagedCidr\"A\n" +
+	"\fmanaged_cidr\x18\x02 \x01(\tR\vmanagedCidr\x12\x18\n" +
+	"\adomains\x18\x03 \x03(\tR\adomains\"A\n" +
 	"\vRegisterAck\x12\x18\n" +
 	"\asuccess\x18\x01 \x01(\bR\asuccess\x12\x18\n" +
 	"\amessage\x18\x02 \x01(\tR\amessage\"F\n" +
 	"\tHeartbeat\x12\x1b\n" +
 	"\tsender_id\x18\x01 \x01(\tR\bsenderId\x12\x1c\n" +
-	"\ttimestamp\x18\x02 \x01(\x03R\ttimestamp\"L\n" +
+	"\ttimestamp\x18\x02 \x01(\x03R\ttimestamp\"B\n" +
+	"\n" +
+	"RouteTable\x12\x18\n" +
+	"\aversion\x18\x01 \x01(\x04R\aversion\x12\x1a\n" +
+	"\bprefixes\x18\x02 \x03(\tR\bprefixes\"L\n" +
 	"\bEnvelope\x12&\n" +
 	"\x04type\x18\x01 \x01(\x0e2\x12.proto.MessageTypeR\x04type\x12\x18\n" +
-	"\apayload\x18\x02 \x01(\fR\apayload\"\xd2\x01\n" +
+	"\apayload\x18\x02 \x01(\fR\apayload\"\xff\x01\n" +
 	"\rClientMessage\x123\n" +
 	"\bregister\x18\x01 \x01(\v2\x15.proto.ClientRegisterH\x00R\bregister\x12'\n" +
 	"\x06packet\x18\x02 \x01(\v2\r.proto.PacketH\x00R\x06packet\x120\n" +
 	"\theartbeat\x18\x03 \x01(\v2\x10.proto.HeartbeatH\x00R\theartbeat\x12&\n" +
-	"\x03ack\x18\x04 \x01(\v2\x12.proto.RegisterAckH\x00R\x03ackB\t\n" +
+	"\x03ack\x18\x04 \x01(\v2\x12.proto.RegisterAckH\x00R\x03ack\x12+\n" +
+	"\x06routes\x18\x05 \x01(\v2\x11.proto.RouteTableH\x00R\x06routesB\t\n" +
 	"\amessage\"\xd0\x01\n" +
 	"\fProxyMessage\x122\n" +
 	"\bregister\x18\x01 \x01(\v2\x14.proto.ProxyRegisterH\x00R\bregister\x12'\n" +
@@ -864,7 +1035,12 @@ const file_proto_packet_proto_rawDesc = "" +
 	"\tDirection\x12\x19\n" +
 	"\x15DIRECTION_UNSPECIFIED\x10\x00\x12\x15\n" +
 	"\x11DIRECTION_FORWARD\x10\x01\x12\x15\n" +
-	"\x11DIRECTION_REVERSE\x10\x02*\x81\x01\n" +
+	"\x11DIRECTION_REVERSE\x10\x02*U\n" +
+	"\aControl\x12\x10\n" +
+	"\fCONTROL_NONE\x10\x00\x12\x11\n" +
+	"\rCONTROL_PAUSE\x10\x01\x12\x12\n" +
+	"\x0eCONTROL_RESUME\x10\x02\x12\x11\n" +
+	"\rCONTROL_RESET\x10\x03*\x81\x01\n" +
 	"\vMessageType\x12\x1c\n" +
 	"\x18MESSAGE_TYPE_UNSPECIFIED\x10\x00\x12\x13\n" +
 	"\x0fCLIENT_REGISTER\x10\x01\x12\x12\n" +
@@ -890,44 +1066,48 @@ func file_proto_packet_proto_rawDescGZIP() []byte {
 	return file_proto_packet_proto_rawDescData
 }
 
-var file_proto_packet_proto_enumTypes = make([]protoimpl.EnumInfo, 3)
-var file_proto_packet_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
+var file_proto_packet_proto_enumTypes = make([]protoimpl.EnumInfo, 4)
+var file_proto_packet_proto_msgTypes = make([]protoimpl.MessageInfo, 10)
 var file_proto_packet_proto_goTypes = []any{
 	(Protocol)(0),           // 0: proto.Protocol
 	(Direction)(0),          // 1: proto.Direction
-	(MessageType)(0),        // 2: proto.MessageType
-	(*ConnectionTuple)(nil), // 3: proto.ConnectionTuple
-	(*Packet)(nil),          // 4: proto.Packet
-	(*ClientRegister)(nil),  // 5: proto.ClientRegister
-	(*ProxyRegister)(nil),   // 6: proto.ProxyRegister
-	(*RegisterAck)(nil),     // 7: proto.RegisterAck
-	(*Heartbeat)(nil),       // 8: proto.Heartbeat
-	(*Envelope)(nil),        // 9: proto.Envelope
-	(*ClientMessage)(nil),   // 10: proto.ClientMessage
-	(*ProxyMessage)(nil),    // 11: proto.ProxyMessage
+	(Control)(0),            // 2: proto.Control
+	(MessageType)(0),        // 3: proto.MessageType
+	(*ConnectionTuple)(nil), // 4: proto.ConnectionTuple
+	(*Packet)(nil),          // 5: proto.Packet
+	(*ClientRegister)(nil),  // 6: proto.ClientRegister
+	(*ProxyRegister)(nil),   // 7: proto.ProxyRegister
+	(*RegisterAck)(nil),     // 8: proto.RegisterAck
+	(*Heartbeat)(nil),       // 9: proto.Heartbeat
+	(*RouteTable)(nil),      // 10: proto.RouteTable
+	(*Envelope)(nil),        // 11: proto.Envelope
+	(*ClientMessage)(nil),   // 12: proto.ClientMessage
+	(*ProxyMessage)(nil),    // 13: proto.ProxyMessage
 }
 var file_proto_packet_proto_depIdxs = []int32{
-	3,  // 0: proto.Packet.conn_tuple:type_name -> proto.ConnectionTuple
+	4,  // 0: proto.Packet.conn_tuple:type_name -> proto.ConnectionTuple
 	0,  // 1: proto.Packet.protocol:type_name -> proto.Protocol
 	1,  // 2: proto.Packet.direction:type_name -> proto.Direction
-	2,  // 3: proto.Envelope.type:type_name -> proto.MessageType
-	5,  // 4: proto.ClientMessage.register:type_name -> proto.ClientRegister
-	4,  // 5: proto.ClientMessage.packet:type_name -> proto.Packet
-	8,  // 6: proto.ClientMessage.heartbeat:type_name -> proto.Heartbeat
-	7,  // 7: proto.ClientMessage.ack:type_name -> proto.RegisterAck
-	6,  // 8: proto.ProxyMessage.register:type_name -> proto.ProxyRegister
-	4,  // 9: proto.ProxyMessage.packet:type_name -> proto.Packet
-	8,  // 10: proto.ProxyMessage.heartbeat:type_name -> proto.Heartbeat
-	7,  // 11: proto.ProxyMessage.ack:type_name -> proto.RegisterAck
-	10, // 12: proto.TunnelClient.Connect:input_type -> proto.ClientMessage
-	11, // 13: proto.TunnelProxy.Connect:input_type -> proto.ProxyMessage
-	10, // 14: proto.TunnelClient.Connect:output_type -> proto.ClientMessage
-	11, // 15: proto.TunnelProxy.Connect:output_type -> proto.ProxyMessage
-	14, // [14:16] is the sub-list for method output_type
-	12, // [12:14] is the sub-list for method input_type
-	12, // [12:12] is the sub-list for extension type_name
-	12, // [12:12] is the sub-list for extension extendee
-	0,  // [0:12] is the sub-list for field type_name
+	2,  // 3: proto.Packet.control:type_name -> proto.Control
+	3,  // 4: proto.Envelope.type:type_name -> proto.MessageType
+	6,  // 5: proto.ClientMessage.register:type_name -> proto.ClientRegister
+	5,  // 6: proto.ClientMessage.packet:type_name -> proto.Packet
+	9,  // 7: proto.ClientMessage.heartbeat:type_name -> proto.Heartbeat
+	8,  // 8: proto.ClientMessage.ack:type_name -> proto.RegisterAck
+	10, // 9: proto.ClientMessage.routes:type_name -> proto.RouteTable
+	7,  // 10: proto.ProxyMessage.register:type_name -> proto.ProxyRegister
+	5,  // 11: proto.ProxyMessage.packet:type_name -> proto.Packet
+	9,  // 12: proto.ProxyMessage.heartbeat:type_name -> proto.Heartbeat
+	8,  // 13: proto.ProxyMessage.ack:type_name -> proto.RegisterAck
+	12, // 14: proto.TunnelClient.Connect:input_type -> proto.ClientMessage
+	13, // 15: proto.TunnelProxy.Connect:input_type -> proto.ProxyMessage
+	12, // 16: proto.TunnelClient.Connect:output_type -> proto.ClientMessage
+	13, // 17: proto.TunnelProxy.Connect:output_type -> proto.ProxyMessage
+	16, // [16:18] is the sub-list for method output_type
+	14, // [14:16] is the sub-list for method input_type
+	14, // [14:14] is the sub-list for extension type_name
+	14, // [14:14] is the sub-list for extension extendee
+	0,  // [0:14] is the sub-list for field type_name
 }
 
 func init() { file_proto_packet_proto_init() }
@@ -935,13 +1115,14 @@ func file_proto_packet_proto_init() {
 	if File_proto_packet_proto != nil {
 		return
 	}
-	file_proto_packet_proto_msgTypes[7].OneofWrappers = []any{
+	file_proto_packet_proto_msgTypes[8].OneofWrappers = []any{
 		(*ClientMessage_Register)(nil),
 		(*ClientMessage_Packet)(nil),
 		(*ClientMessage_Heartbeat)(nil),
 		(*ClientMessage_Ack)(nil),
+		(*ClientMessage_Routes)(nil),
 	}
-	file_proto_packet_proto_msgTypes[8].OneofWrappers = []any{
+	file_proto_packet_proto_msgTypes[9].OneofWrappers = []any{
 		(*ProxyMessage_Register)(nil),
 		(*ProxyMessage_Packet)(nil),
 		(*ProxyMessage_Heartbeat)(nil),
@@ -952,8 +1133,8 @@ func file_proto_packet_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_packet_proto_rawDesc), len(file_proto_packet_proto_rawDesc)),
-			NumEnums:      3,
-			NumMessages:   9,
+			NumEnums:      4,
+			NumMessages:   10,
 			NumExtensions: 0,
 			NumServices:   2,
 		},